@@ -4,19 +4,15 @@ import (
 	"encoding/json"
 	"fmt"
 	"net/http"
-	"path"
-	"sync"
+	"os"
+
+	"dapp_server/contractresult"
 
 	"github.com/gin-gonic/gin"
 	"github.com/joho/godotenv"
 	wasmbridge "github.com/rubixchain/rubix-wasm/go-wasm-bridge"
 )
 
-var (
-	voteStore = make(map[string]string) // map[voter_id]color
-	storeLock = sync.Mutex{}
-)
-
 func main() {
 	_ = godotenv.Load()
 	r := gin.Default()
@@ -47,72 +43,57 @@ func handleVotingContract(c *gin.Context) {
 		return
 	}
 
-	method := contractInput.Method
-	payload := contractInput.Payload
-
-	switch method {
-	case "cast_and_tally":
-		voterID, ok1 := payload["voter_id"].(string)
-		color, ok2 := payload["color"].(string)
-		if !ok1 || !ok2 {
-			wrapError(c.JSON, "Missing or invalid voter_id or color")
-			return
-		}
-
-		storeLock.Lock()
-		voteStore[voterID] = color
-		tally := make(map[string]int)
-		for _, c := range voteStore {
-			tally[c]++
-		}
-
-		// Determine winner
-		winner := ""
-		maxVotes := -1
-		for color, count := range tally {
-			if count > maxVotes {
-				maxVotes = count
-				winner = color
-			}
-		}
-		storeLock.Unlock()
-
-		result := fmt.Sprintf("Vote recorded. Tally: %v. Current winner: %s", tally, winner)
-		wrapSuccess(c.JSON, result)
+	// The contract keeps its votes in the dapp_state_* host functions. Its
+	// writes are committed only when the execution succeeds.
+	executionLock.Lock()
+	defer executionLock.Unlock()
+	db, err := openState()
+	if err != nil {
+		wrapError(c.JSON, err.Error())
+		return
+	}
+	defer db.Close()
+	tx, err := db.Begin()
+	if err != nil {
+		wrapError(c.JSON, fmt.Sprintf("failed to begin state transaction: %v", err))
 		return
+	}
+	defer tx.Rollback()
 
-	default:
-		// Default fallback to wasm contract execution
-		hostFnRegistry := wasmbridge.NewHostFunctionRegistry()
-		wasmModule, err := wasmbridge.NewWasmModule(contractPath, hostFnRegistry, wasmbridge.WithRubixNodeAddress(nodeAddress))
-		if err != nil {
-			wrapError(c.JSON, fmt.Sprintf("failed to load wasm module: %v", err))
-			return
-		}
+	hostFnRegistry := wasmbridge.NewHostFunctionRegistry()
+	registerStateHostFunctions(hostFnRegistry, tx)
+	wasmModule, err := wasmbridge.NewWasmModule(contractPath, hostFnRegistry, wasmbridge.WithRubixNodeAddress(nodeAddress))
+	if err != nil {
+		wrapError(c.JSON, fmt.Sprintf("failed to load wasm module: %v", err))
+		return
+	}
 
-		input := map[string]interface{}{method: payload}
-		inputBytes, _ := json.Marshal(input)
-		result, err := wasmModule.CallFunction(string(inputBytes))
-		if err != nil {
-			wrapError(c.JSON, fmt.Sprintf("failed to call contract function: %v", err))
-			return
-		}
+	input := map[string]interface{}{contractInput.Method: contractInput.Payload}
+	inputBytes, _ := json.Marshal(input)
+	result, err := wasmModule.CallFunction(string(inputBytes))
+	if err != nil {
+		wrapError(c.JSON, fmt.Sprintf("failed to call contract function: %v", err))
+		return
+	}
 
-		msg, errMsg := extractContractOutput(result)
-		if errMsg != "" {
-			wrapError(c.JSON, fmt.Sprintf("contract execution failed: %v", errMsg))
-			return
-		}
-		wrapSuccess(c.JSON, msg)
+	msg, errMsg := extractContractOutput(result)
+	if errMsg != "" {
+		wrapError(c.JSON, fmt.Sprintf("contract execution failed: %v", errMsg))
+		return
+	}
+	if err := tx.Commit(); err != nil {
+		wrapError(c.JSON, fmt.Sprintf("failed to commit contract state: %v", err))
+		return
 	}
+	wrapSuccess(c.JSON, msg)
 }
 
-func extractContractOutput(result string) (string, string) {
-	var out struct {
-		Msg string `json:"msg"`
-	}
-	if err := json.Unmarshal([]byte(result), &out); err == nil && out.Msg != "" {
-		return out.Msg, ""
+// extractContractOutput returns the message of a successful contract call, or
+// the error code and message of a failed one
+func extractContractOutput(output string) (string, string) {
+	result := contractresult.Parse(output)
+	if !result.Succeeded() {
+		return "", fmt.Sprintf("%s: %s", result.Code, result.Message)
 	}
-	return "", result
+	return result.Message, ""
 }
@@ -0,0 +1,169 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"os"
+	"sync"
+
+	"github.com/bytecodealliance/wasmtime-go"
+	_ "github.com/mattn/go-sqlite3"
+	wasmbridge "github.com/rubixchain/rubix-wasm/go-wasm-bridge"
+)
+
+// executionLock runs one contract execution at a time, so that the state
+// read by an execution is not changed before it commits its own writes
+var executionLock sync.Mutex
+
+// stateDBPath is the SQLite database keeping the state of the contract
+func stateDBPath() string {
+	if path := os.Getenv("VOTING_STATE_DB"); path != "" {
+		return path
+	}
+	return "voting_state.db"
+}
+
+// openState opens the state database, creating its table when needed
+func openState() (*sql.DB, error) {
+	db, err := sql.Open("sqlite3", stateDBPath())
+	if err != nil {
+		return nil, fmt.Errorf("failed to open the state database: %w", err)
+	}
+	if _, err := db.Exec(`CREATE TABLE IF NOT EXISTS contract_state (key TEXT PRIMARY KEY, value TEXT NOT NULL);`); err != nil {
+		db.Close()
+		return nil, fmt.Errorf("failed to create the state table: %w", err)
+	}
+	return db, nil
+}
+
+// registerStateHostFunctions adds the dapp_state_* host functions of the dapp
+// server to registry, reading and writing the state within tx
+func registerStateHostFunctions(registry *wasmbridge.HostFunctionRegistry, tx *sql.Tx) {
+	registry.Register(&stateHostFunction{name: "dapp_state_get", tx: tx, handle: stateGet})
+	registry.Register(&stateHostFunction{name: "dapp_state_set", tx: tx, handle: stateSet})
+	registry.Register(&stateHostFunction{name: "dapp_state_delete", tx: tx, handle: stateDelete})
+	registry.Register(&stateHostFunction{name: "dapp_state_keys", tx: tx, handle: stateKeys})
+}
+
+type stateArgs struct {
+	Key    string          `json:"key"`
+	Value  json.RawMessage `json:"value"`
+	Prefix string          `json:"prefix"`
+}
+
+func stateGet(tx *sql.Tx, args stateArgs) (interface{}, error) {
+	var value string
+	err := tx.QueryRow(`SELECT value FROM contract_state WHERE key = ?;`, args.Key).Scan(&value)
+	if err == sql.ErrNoRows {
+		return map[string]interface{}{"found": false}, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return map[string]interface{}{"found": true, "value": json.RawMessage(value)}, nil
+}
+
+func stateSet(tx *sql.Tx, args stateArgs) (interface{}, error) {
+	if args.Key == "" || len(args.Value) == 0 {
+		return nil, fmt.Errorf("key and value are required")
+	}
+	_, err := tx.Exec(`INSERT INTO contract_state (key, value) VALUES (?, ?)
+		ON CONFLICT(key) DO UPDATE SET value = excluded.value;`, args.Key, string(args.Value))
+	return err == nil, err
+}
+
+func stateDelete(tx *sql.Tx, args stateArgs) (interface{}, error) {
+	_, err := tx.Exec(`DELETE FROM contract_state WHERE key = ?;`, args.Key)
+	return err == nil, err
+}
+
+func stateKeys(tx *sql.Tx, args stateArgs) (interface{}, error) {
+	rows, err := tx.Query(`SELECT key FROM contract_state WHERE substr(key, 1, length(?)) = ? ORDER BY key;`, args.Prefix, args.Prefix)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	keys := []string{}
+	for rows.Next() {
+		var key string
+		if err := rows.Scan(&key); err != nil {
+			return nil, err
+		}
+		keys = append(keys, key)
+	}
+	return keys, rows.Err()
+}
+
+// stateHostFunction is a dapp_state_* host function, imported from the
+// contract as
+//
+//	fn name(args_ptr: *const u8, args_len: usize, resp_ptr_ptr: *mut *const u8, resp_len_ptr: *mut usize) -> i32
+//
+// returning 0 with the JSON result, or 1 with {"error": "..."}.
+type stateHostFunction struct {
+	name   string
+	tx     *sql.Tx
+	handle func(tx *sql.Tx, args stateArgs) (interface{}, error)
+
+	allocFunc *wasmtime.Func
+	memory    *wasmtime.Memory
+}
+
+func (h *stateHostFunction) Name() string {
+	return h.name
+}
+
+func (h *stateHostFunction) FuncType() *wasmtime.FuncType {
+	i32 := wasmtime.NewValType(wasmtime.KindI32)
+	return wasmtime.NewFuncType([]*wasmtime.ValType{i32, i32, i32, i32}, []*wasmtime.ValType{i32})
+}
+
+func (h *stateHostFunction) Initialize(allocFunc, deallocFunc *wasmtime.Func, memory *wasmtime.Memory, nodeAddress string, quorumType int) {
+	h.allocFunc = allocFunc
+	h.memory = memory
+}
+
+func (h *stateHostFunction) Callback() wasmbridge.HostFunctionCallBack {
+	return h.callback
+}
+
+func (h *stateHostFunction) callback(caller *wasmtime.Caller, params []wasmtime.Val) ([]wasmtime.Val, *wasmtime.Trap) {
+	argsPtr, argsLen := params[0].I32(), params[1].I32()
+	respPtrPtr, respLenPtr := params[2].I32(), params[3].I32()
+
+	data := h.memory.UnsafeData(caller)
+	if argsPtr < 0 || argsLen < 0 || int(argsPtr)+int(argsLen) > len(data) {
+		return nil, wasmtime.NewTrap(fmt.Sprintf("%s: arguments out of bounds", h.name))
+	}
+
+	code := int32(0)
+	var result interface{}
+	var args stateArgs
+	err := json.Unmarshal(data[argsPtr:argsPtr+argsLen], &args)
+	if err == nil {
+		result, err = h.handle(h.tx, args)
+	}
+	if err != nil {
+		code = 1
+		result = map[string]string{"error": err.Error()}
+	}
+	resp, _ := json.Marshal(result)
+
+	allocated, err := h.allocFunc.Call(caller, int32(len(resp)))
+	if err != nil {
+		return nil, wasmtime.NewTrap(fmt.Sprintf("%s: failed to allocate response: %v", h.name, err))
+	}
+	respPtr := allocated.(int32)
+	// Fetch the memory again, alloc may have grown it
+	data = h.memory.UnsafeData(caller)
+	if respPtr < 0 || int(respPtr)+len(resp) > len(data) ||
+		respPtrPtr < 0 || int(respPtrPtr)+4 > len(data) || respLenPtr < 0 || int(respLenPtr)+4 > len(data) {
+		return nil, wasmtime.NewTrap(fmt.Sprintf("%s: response out of bounds", h.name))
+	}
+	copy(data[respPtr:], resp)
+	binary.LittleEndian.PutUint32(data[respPtrPtr:], uint32(respPtr))
+	binary.LittleEndian.PutUint32(data[respLenPtr:], uint32(len(resp)))
+	return []wasmtime.Val{wasmtime.ValI32(code)}, nil
+}
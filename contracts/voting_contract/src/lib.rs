@@ -1,5 +1,6 @@
 use rubixwasm_std::contract_fn;
 use serde::{Deserialize, Serialize};
+use serde_json::{json, Value};
 use std::collections::HashMap;
 
 #[derive(Serialize, Deserialize, Debug)]
@@ -22,21 +23,51 @@ impl ContractError {
 
 const ALLOWED_COLORS: [&str; 3] = ["Red", "Green", "Blue"];
 
-#[derive(Serialize, Deserialize, Clone, Debug)]
-pub struct Vote {
-    pub voter_id: String,
-    pub color: String,
+// Host functions provided by the dapp server, see
+// rubix_super_dapp/backend/dapp_server/dapp_host_functions.go
+extern "C" {
+    fn dapp_state_get(args_ptr: *const u8, args_len: usize, resp_ptr_ptr: *mut *const u8, resp_len_ptr: *mut usize) -> i32;
+    fn dapp_state_set(args_ptr: *const u8, args_len: usize, resp_ptr_ptr: *mut *const u8, resp_len_ptr: *mut usize) -> i32;
+    fn dapp_state_keys(args_ptr: *const u8, args_len: usize, resp_ptr_ptr: *mut *const u8, resp_len_ptr: *mut usize) -> i32;
 }
 
-static mut VOTES: Option<Vec<Vote>> = None;
+// Votes are kept in the contract state as votes/<voter_id> => color, so they
+// outlive the wasm instance of a single execution
+const VOTE_PREFIX: &str = "votes/";
+
+// Calls a dapp server host function with JSON arguments and decodes its JSON response
+fn call_dapp_host_function(
+    host_fn: unsafe extern "C" fn(*const u8, usize, *mut *const u8, *mut usize) -> i32,
+    args: Value,
+) -> Result<Value, ContractError> {
+    let args_bytes = serde_json::to_vec(&args)
+        .map_err(|e| ContractError::new(&format!("failed to encode host function args: {}", e)))?;
 
-fn get_votes() -> &'static mut Vec<Vote> {
-    unsafe {
-        if VOTES.is_none() {
-            VOTES = Some(Vec::new());
+    let mut resp_ptr: *const u8 = std::ptr::null();
+    let mut resp_len: usize = 0;
+    let code = unsafe { host_fn(args_bytes.as_ptr(), args_bytes.len(), &mut resp_ptr, &mut resp_len) };
+
+    let resp_bytes = unsafe { std::slice::from_raw_parts(resp_ptr, resp_len) }.to_vec();
+    let resp: Value = serde_json::from_slice(&resp_bytes)
+        .map_err(|e| ContractError::new(&format!("failed to decode host function response: {}", e)))?;
+
+    if code != 0 {
+        return Err(ContractError::new(&format!("host function failed: {}", resp["error"])));
+    }
+    Ok(resp)
+}
+
+// Counts the votes stored for every color
+fn tally_votes() -> Result<HashMap<String, usize>, ContractError> {
+    let keys = call_dapp_host_function(dapp_state_keys, json!({ "prefix": VOTE_PREFIX }))?;
+    let mut color_counts: HashMap<String, usize> = HashMap::new();
+    for key in keys.as_array().cloned().unwrap_or_default() {
+        let vote = call_dapp_host_function(dapp_state_get, json!({ "key": key }))?;
+        if let Some(color) = vote["value"].as_str() {
+            *color_counts.entry(color.to_string()).or_insert(0) += 1;
         }
-        VOTES.as_mut().unwrap()
     }
+    Ok(color_counts)
 }
 
 #[derive(Serialize, Deserialize, Debug)]
@@ -50,16 +81,13 @@ pub fn cast_and_tally(input: CastAndTally) -> Result<String, ContractError> {
     if !ALLOWED_COLORS.contains(&input.color.as_str()) {
         return Err(ContractError::new("Invalid color"));
     }
-    let votes = get_votes();
-    votes.push(Vote {
-        voter_id: input.voter_id.clone(),
-        color: input.color.clone(),
-    });
+    // A voter has a single vote, voting again changes it
+    call_dapp_host_function(
+        dapp_state_set,
+        json!({ "key": format!("{}{}", VOTE_PREFIX, input.voter_id), "value": input.color }),
+    )?;
 
-    let mut color_counts: HashMap<String, usize> = HashMap::new();
-    for vote in votes.iter() {
-        *color_counts.entry(vote.color.clone()).or_insert(0) += 1;
-    }
+    let color_counts = tally_votes()?;
 
     let winner = color_counts
         .iter()
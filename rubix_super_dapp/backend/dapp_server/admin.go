@@ -0,0 +1,226 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+)
+
+// maxWasmUploadSize caps the size of a wasm artifact uploaded through the
+// admin API
+const maxWasmUploadSize = 32 << 20
+
+// adminError is returned by a config update to answer with status
+type adminError struct {
+	status  int
+	message string
+}
+
+func (e *adminError) Error() string {
+	return e.message
+}
+
+// registerAdminRoutes mounts the admin API, which manages contracts_info at
+// runtime. It requires DAPP_ADMIN_TOKEN or an API key with the admin scope.
+func registerAdminRoutes(router *gin.Engine) {
+	admin := router.Group("/admin", requireScope(ScopeAdmin))
+	admin.GET("/contracts", listContractsHandler)
+	admin.PUT("/contracts/:contract", putContractHandler)
+	admin.POST("/contracts/:contract/disable", setContractDisabledHandler(true))
+	admin.POST("/contracts/:contract/enable", setContractDisabledHandler(false))
+	admin.DELETE("/contracts/:contract", deleteContractHandler)
+	admin.POST("/contracts/:contract/register-callback", registerCallbackHandler)
+	admin.GET("/callbacks/rejected", getCallbackRejectionsHandler)
+	admin.GET("/audit/verify", verifyAuditHandler)
+}
+
+// Handler function for GET /admin/contracts
+func listContractsHandler(c *gin.Context) {
+	config := GetConfig()
+	c.JSON(http.StatusOK, gin.H{"contracts_info": config.ContractsInfo})
+}
+
+// Handler function for PUT /admin/contracts/:contract
+//
+// The body is the contracts_info entry, which replaces the current one. It is
+// either sent as JSON, or as a multipart form with the entry in the contract
+// field and the wasm artifact in the wasm field, in which case contract_path
+// is set to the uploaded artifact.
+func putContractHandler(c *gin.Context) {
+	feature := c.Param("contract")
+	if !validContractName.MatchString(feature) {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "contract name may only contain letters, digits, - and _"})
+		return
+	}
+
+	var contractInfo ContractInfo
+	// wasmPath is the uploaded artifact to remove if the update is rejected
+	var wasmPath string
+	if strings.HasPrefix(c.ContentType(), "multipart/form-data") {
+		if err := json.Unmarshal([]byte(c.PostForm("contract")), &contractInfo); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "contract must be a JSON contracts_info entry"})
+			return
+		}
+		if _, err := c.FormFile("wasm"); err == nil {
+			path, hash, stored, err := saveUploadedWasm(c, feature)
+			if err != nil {
+				c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+				return
+			}
+			if stored {
+				wasmPath = path
+			}
+			if contractInfo.ArtifactHash != "" && !strings.EqualFold(contractInfo.ArtifactHash, hash) {
+				if wasmPath != "" {
+					os.Remove(wasmPath)
+				}
+				c.JSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("artifact_hash does not match the uploaded artifact, which has hash %s", hash)})
+				return
+			}
+			contractInfo.ContractPath = path
+			contractInfo.ArtifactHash = hash
+		}
+	} else if err := json.NewDecoder(c.Request.Body).Decode(&contractInfo); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "body must be a JSON contracts_info entry"})
+		return
+	}
+
+	created := false
+	err := updateConfigFile(func(config *Config) error {
+		_, exists := config.ContractsInfo[feature]
+		created = !exists
+		config.ContractsInfo[feature] = &contractInfo
+		return nil
+	})
+	if err != nil {
+		if wasmPath != "" {
+			os.Remove(wasmPath)
+		}
+		respondAdminError(c, err)
+		return
+	}
+
+	if created {
+		loggerFrom(c.Request.Context()).Info("Admin API: added contract", "contract", feature, "callback_url", contractInfo.CallBackUrl)
+		c.JSON(http.StatusCreated, gin.H{"message": "contract added", "contract": contractInfo})
+		return
+	}
+	loggerFrom(c.Request.Context()).Info("Admin API: updated contract", "contract", feature)
+	c.JSON(http.StatusOK, gin.H{"message": "contract updated", "contract": contractInfo})
+}
+
+// setContractDisabledHandler returns the handler which disables or enables a
+// contract, keeping its configuration
+func setContractDisabledHandler(disabled bool) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		feature := c.Param("contract")
+		err := updateConfigFile(func(config *Config) error {
+			contractInfo, ok := config.ContractsInfo[feature]
+			if !ok || contractInfo == nil {
+				return &adminError{status: http.StatusNotFound, message: fmt.Sprintf("unknown contract %s", feature)}
+			}
+			contractInfo.Disabled = disabled
+			return nil
+		})
+		if err != nil {
+			respondAdminError(c, err)
+			return
+		}
+
+		state := "enabled"
+		if disabled {
+			state = "disabled"
+		}
+		loggerFrom(c.Request.Context()).Info("Admin API: "+state+" contract", "contract", feature)
+		c.JSON(http.StatusOK, gin.H{"message": "contract " + state})
+	}
+}
+
+// Handler function for DELETE /admin/contracts/:contract
+//
+// Requests and state of the contract are kept in the database, and its wasm
+// artifacts are left on disk.
+func deleteContractHandler(c *gin.Context) {
+	feature := c.Param("contract")
+	err := updateConfigFile(func(config *Config) error {
+		if _, ok := config.ContractsInfo[feature]; !ok {
+			return &adminError{status: http.StatusNotFound, message: fmt.Sprintf("unknown contract %s", feature)}
+		}
+		delete(config.ContractsInfo, feature)
+		return nil
+	})
+	if err != nil {
+		respondAdminError(c, err)
+		return
+	}
+
+	loggerFrom(c.Request.Context()).Info("Admin API: removed contract", "contract", feature)
+	c.JSON(http.StatusOK, gin.H{"message": "contract removed"})
+}
+
+// saveUploadedWasm stores the wasm field of the form in the contracts
+// directory, named after the contract and the hash of the artifact, returning
+// the hex encoded sha256 of the artifact. stored is false when an identical
+// artifact was already there.
+func saveUploadedWasm(c *gin.Context, feature string) (path string, hash string, stored bool, err error) {
+	fileHeader, err := c.FormFile("wasm")
+	if err != nil {
+		return "", "", false, err
+	}
+	if fileHeader.Size > maxWasmUploadSize {
+		return "", "", false, fmt.Errorf("wasm artifact is larger than %d bytes", maxWasmUploadSize)
+	}
+	file, err := fileHeader.Open()
+	if err != nil {
+		return "", "", false, fmt.Errorf("failed to read wasm artifact: %w", err)
+	}
+	defer file.Close()
+
+	content, err := io.ReadAll(io.LimitReader(file, maxWasmUploadSize))
+	if err != nil {
+		return "", "", false, fmt.Errorf("failed to read wasm artifact: %w", err)
+	}
+	if len(content) < 4 || string(content[:4]) != "\x00asm" {
+		return "", "", false, fmt.Errorf("uploaded file is not a wasm module")
+	}
+
+	if err := os.MkdirAll(settings.ContractsDir, 0755); err != nil {
+		return "", "", false, fmt.Errorf("failed to create contracts directory: %w", err)
+	}
+	sum := sha256.Sum256(content)
+	hash = hex.EncodeToString(sum[:])
+	path = filepath.Join(settings.ContractsDir, fmt.Sprintf("%s-%s.wasm", feature, hash[:16]))
+	if _, err := os.Stat(path); err == nil {
+		return path, hash, false, nil
+	}
+	if err := os.WriteFile(path, content, 0644); err != nil {
+		return "", "", false, fmt.Errorf("failed to store wasm artifact: %w", err)
+	}
+	return path, hash, true, nil
+}
+
+// respondAdminError answers with the status of an adminError, 400 Bad
+// Request for an update rejected by config validation, or 500 when the
+// config file could not be read or written
+func respondAdminError(c *gin.Context, err error) {
+	var adminErr *adminError
+	switch {
+	case errors.As(err, &adminErr):
+		c.JSON(adminErr.status, gin.H{"error": adminErr.message})
+	case errors.Is(err, errInvalidConfig):
+		loggerFrom(c.Request.Context()).Warn("Admin API: rejected config change", "error", err)
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+	default:
+		loggerFrom(c.Request.Context()).Error("Admin API: failed to update config", "error", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+	}
+}
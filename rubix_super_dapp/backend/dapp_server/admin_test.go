@@ -0,0 +1,74 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+)
+
+func TestPutContractUpload(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	setupTestServer(t)
+	dir := t.TempDir()
+	settings.ConfigPath = filepath.Join(dir, "app.node.json")
+	settings.ContractsDir = filepath.Join(dir, "contracts")
+	if err := os.WriteFile(settings.ConfigPath, []byte(`{"non_quorum_node_address": "http://localhost:20005"}`), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	artifact := []byte("\x00asm\x01\x00\x00\x00")
+	sum := sha256.Sum256(artifact)
+	hash := hex.EncodeToString(sum[:])
+
+	tests := []struct {
+		name     string
+		contract string
+		status   int
+	}{
+		{"without artifact_hash", `{"contract_hash": "QmA", "callback_url": "/callback/a"}`, http.StatusCreated},
+		{"matching artifact_hash", `{"contract_hash": "QmA", "callback_url": "/callback/a", "artifact_hash": "` + hash + `"}`, http.StatusOK},
+		{"other artifact_hash", `{"contract_hash": "QmA", "callback_url": "/callback/a", "artifact_hash": "9f86d0"}`, http.StatusBadRequest},
+	}
+	for _, test := range tests {
+		var body bytes.Buffer
+		form := multipart.NewWriter(&body)
+		form.WriteField("contract", test.contract)
+		part, err := form.CreateFormFile("wasm", "a.wasm")
+		if err != nil {
+			t.Fatal(err)
+		}
+		part.Write(artifact)
+		form.Close()
+
+		w := httptest.NewRecorder()
+		c, _ := gin.CreateTestContext(w)
+		c.Request = httptest.NewRequest(http.MethodPut, "/admin/contracts/a", &body)
+		c.Request.Header.Set("Content-Type", form.FormDataContentType())
+		c.Params = gin.Params{{Key: "contract", Value: "a"}}
+		putContractHandler(c)
+
+		if w.Code != test.status {
+			t.Fatalf("%s: status = %d, want %d: %s", test.name, w.Code, test.status, w.Body)
+		}
+		contractInfo := GetConfig().ContractsInfo["a"]
+		if contractInfo == nil || contractInfo.ArtifactHash != hash {
+			t.Errorf("%s: contract = %+v, want artifact_hash %s", test.name, contractInfo, hash)
+			continue
+		}
+		version, err := contractInfo.versionForBlock(0)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := version.verifyArtifact(); err != nil {
+			t.Errorf("%s: uploaded artifact does not verify: %v", test.name, err)
+		}
+	}
+}
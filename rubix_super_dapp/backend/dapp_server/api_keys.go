@@ -0,0 +1,285 @@
+package main
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"flag"
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// Scopes an API key can be granted
+const (
+	ScopeReadStatus = "read-status" // request status and traces
+	ScopeExecute    = "execute"     // contract simulation
+	ScopeAdmin      = "admin"       // the admin API
+)
+
+var validScopes = []string{ScopeReadStatus, ScopeExecute, ScopeAdmin}
+
+// apiKeyPrefix marks the secrets generated for API keys
+const apiKeyPrefix = "dapp_"
+
+// apiKeyIdKey is the gin context key of the id of the authenticated API key
+const apiKeyIdKey = "api_key_id"
+
+// ApiKey is a token granting scoped access to the dapp server endpoints. Only
+// the hash of its secret is stored.
+type ApiKey struct {
+	Id        string     `json:"id"`
+	Name      string     `json:"name"`
+	Scopes    []string   `json:"scopes"`
+	CreatedAt time.Time  `json:"created_at"`
+	RevokedAt *time.Time `json:"revoked_at,omitempty"`
+}
+
+func (k ApiKey) hasScope(scope string) bool {
+	for _, granted := range k.Scopes {
+		if granted == scope {
+			return true
+		}
+	}
+	return false
+}
+
+// hashApiKey returns the stored form of an API key secret. The secrets are
+// random, so an unsalted hash is enough to keep them from being recovered.
+func hashApiKey(secret string) string {
+	hash := sha256.Sum256([]byte(secret))
+	return hex.EncodeToString(hash[:])
+}
+
+func splitScopes(scopes string) []string {
+	var split []string
+	for _, scope := range strings.Split(scopes, ",") {
+		if scope = strings.TrimSpace(scope); scope != "" {
+			split = append(split, scope)
+		}
+	}
+	return split
+}
+
+// createApiKey generates and stores a key with scopes, returning its secret,
+// which cannot be recovered afterwards
+func createApiKey(name string, scopes []string) (ApiKey, string, error) {
+	for _, scope := range scopes {
+		valid := false
+		for _, validScope := range validScopes {
+			valid = valid || scope == validScope
+		}
+		if !valid {
+			return ApiKey{}, "", fmt.Errorf("unknown scope %s, expected one of %s", scope, strings.Join(validScopes, ", "))
+		}
+	}
+	if len(scopes) == 0 {
+		return ApiKey{}, "", fmt.Errorf("at least one scope is required")
+	}
+
+	id := make([]byte, 6)
+	random := make([]byte, 32)
+	if _, err := rand.Read(id); err != nil {
+		return ApiKey{}, "", fmt.Errorf("failed to generate API key: %w", err)
+	}
+	if _, err := rand.Read(random); err != nil {
+		return ApiKey{}, "", fmt.Errorf("failed to generate API key: %w", err)
+	}
+	key := ApiKey{
+		Id:        hex.EncodeToString(id),
+		Name:      name,
+		Scopes:    scopes,
+		CreatedAt: time.Now(),
+	}
+	secret := apiKeyPrefix + hex.EncodeToString(random)
+	if err := insertApiKey(key, hashApiKey(secret)); err != nil {
+		return ApiKey{}, "", err
+	}
+	return key, secret, nil
+}
+
+// bearerToken returns the API key of the request, sent either as a bearer
+// token or in the X-API-Key header
+func bearerToken(c *gin.Context) string {
+	if token := c.GetHeader("X-API-Key"); token != "" {
+		return token
+	}
+	authorization := c.GetHeader("Authorization")
+	if strings.HasPrefix(authorization, "Bearer ") {
+		return strings.TrimPrefix(authorization, "Bearer ")
+	}
+	return ""
+}
+
+// requireApiKey reports whether requests without an API key are rejected,
+// which is the default unless require_api_key is set to false
+func (c Config) requireApiKey() bool {
+	return c.RequireApiKey == nil || *c.RequireApiKey
+}
+
+// requireScope returns the middleware which only lets requests through with
+// an API key granted scope. Requests without a key are only let through when
+// the config sets require_api_key to false, except for the admin scope which
+// always needs a key or DAPP_ADMIN_TOKEN.
+func requireScope(scope string) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		token := bearerToken(c)
+		if token == "" {
+			if scope != ScopeAdmin && !GetConfig().requireApiKey() {
+				c.Next()
+				return
+			}
+			c.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{"error": "an API key is required"})
+			return
+		}
+
+		if scope == ScopeAdmin && settings.AdminToken != "" &&
+			subtle.ConstantTimeCompare([]byte(token), []byte(settings.AdminToken)) == 1 {
+			c.Next()
+			return
+		}
+
+		key, ok, err := getApiKeyByHash(hashApiKey(token))
+		if err != nil {
+			loggerFrom(c.Request.Context()).Error("Error looking up API key", "error", err)
+			c.AbortWithStatusJSON(http.StatusInternalServerError, gin.H{"error": "failed to check API key"})
+			return
+		}
+		if !ok {
+			c.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{"error": "invalid API key"})
+			return
+		}
+		if !key.hasScope(scope) {
+			c.AbortWithStatusJSON(http.StatusForbidden, gin.H{"error": fmt.Sprintf("API key lacks the %s scope", scope)})
+			return
+		}
+		c.Set(apiKeyIdKey, key.Id)
+		c.Next()
+	}
+}
+
+// grantsScope reports whether the request carries a valid API key granted
+// scope, for endpoints which answer everyone but show more to such keys
+func grantsScope(c *gin.Context, scope string) bool {
+	token := bearerToken(c)
+	if token == "" {
+		return false
+	}
+	key, ok, err := getApiKeyByHash(hashApiKey(token))
+	if err != nil {
+		loggerFrom(c.Request.Context()).Error("Error looking up API key", "error", err)
+		return false
+	}
+	return ok && key.hasScope(scope)
+}
+
+// allowOrigin reports whether a browser on origin may call the server, no
+// origin is allowed when cors_allowed_origins is not set
+func allowOrigin(origin string) bool {
+	for _, allowed := range GetConfig().CorsAllowedOrigins {
+		if allowed == "*" || strings.EqualFold(allowed, origin) {
+			return true
+		}
+	}
+	return false
+}
+
+// apiKeyCommand manages API keys from the command line:
+//
+//	apikey create -name <name> -scopes read-status,execute
+//	apikey list
+//	apikey revoke <id>
+//
+// Each of them also accepts the flags of the server, e.g. -config or -db.
+func apiKeyCommand(args []string) error {
+	if len(args) == 0 {
+		return fmt.Errorf("usage: apikey create|list|revoke")
+	}
+
+	switch args[0] {
+	case "create":
+		flags := flag.NewFlagSet("apikey create", flag.ContinueOnError)
+		name := flags.String("name", "", "name identifying the holder of the key")
+		scopes := flags.String("scopes", ScopeReadStatus, "comma separated scopes: "+strings.Join(validScopes, ", "))
+		settingsFlags := addSettingsFlags(flags)
+		if err := flags.Parse(args[1:]); err != nil {
+			return err
+		}
+		if err := initServerCommand(settingsFlags); err != nil {
+			return err
+		}
+		key, secret, err := createApiKey(*name, splitScopes(*scopes))
+		if err != nil {
+			return err
+		}
+		fmt.Printf("Created API key %s with scopes %s\n", key.Id, strings.Join(key.Scopes, ","))
+		fmt.Printf("Key: %s\n", secret)
+		fmt.Println("Store it now, it cannot be shown again.")
+		return nil
+
+	case "list":
+		flags := flag.NewFlagSet("apikey list", flag.ContinueOnError)
+		settingsFlags := addSettingsFlags(flags)
+		if err := flags.Parse(args[1:]); err != nil {
+			return err
+		}
+		if err := initServerCommand(settingsFlags); err != nil {
+			return err
+		}
+		keys, err := listApiKeys()
+		if err != nil {
+			return err
+		}
+		w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+		fmt.Fprintln(w, "ID\tNAME\tSCOPES\tCREATED\tREVOKED")
+		for _, key := range keys {
+			revoked := ""
+			if key.RevokedAt != nil {
+				revoked = key.RevokedAt.Format(time.RFC3339)
+			}
+			fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\n", key.Id, key.Name, strings.Join(key.Scopes, ","), key.CreatedAt.Format(time.RFC3339), revoked)
+		}
+		return w.Flush()
+
+	case "revoke":
+		flags := flag.NewFlagSet("apikey revoke", flag.ContinueOnError)
+		settingsFlags := addSettingsFlags(flags)
+		if err := flags.Parse(args[1:]); err != nil {
+			return err
+		}
+		if flags.NArg() != 1 {
+			return fmt.Errorf("usage: apikey revoke [flags] <id>")
+		}
+		if err := initServerCommand(settingsFlags); err != nil {
+			return err
+		}
+		id := flags.Arg(0)
+		revoked, err := revokeApiKey(id)
+		if err != nil {
+			return err
+		}
+		if !revoked {
+			return fmt.Errorf("no active API key with id %s", id)
+		}
+		fmt.Printf("Revoked API key %s\n", id)
+		return nil
+	}
+	return fmt.Errorf("unknown apikey command %s, expected create, list or revoke", args[0])
+}
+
+// initServerCommand resolves the settings of the server, e.g. from -config or
+// -db, and opens its database, for commands which work on the database of a
+// server
+func initServerCommand(f *settingsFlags) error {
+	if err := initSettings(f); err != nil {
+		return fmt.Errorf("failed to load config: %w", err)
+	}
+	initDB()
+	return nil
+}
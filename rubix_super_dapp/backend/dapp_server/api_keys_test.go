@@ -0,0 +1,99 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+)
+
+func TestCreateApiKey(t *testing.T) {
+	setupTestServer(t)
+	tests := []struct {
+		name   string
+		scopes []string
+		valid  bool
+	}{
+		{"single scope", []string{ScopeReadStatus}, true},
+		{"every scope", []string{ScopeReadStatus, ScopeExecute, ScopeAdmin}, true},
+		{"no scope", nil, false},
+		{"unknown scope", []string{ScopeExecute, "write"}, false},
+	}
+	for _, test := range tests {
+		_, secret, err := createApiKey(test.name, test.scopes)
+		if (err == nil) != test.valid {
+			t.Errorf("%s: createApiKey() = %v, want valid %v", test.name, err, test.valid)
+		}
+		if err == nil && len(secret) <= len(apiKeyPrefix) {
+			t.Errorf("%s: secret %q is too short", test.name, secret)
+		}
+	}
+}
+
+func TestRequireScope(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	setupTestServer(t)
+	saved := settings
+	t.Cleanup(func() { settings = saved })
+	settings.AdminToken = "admin-token"
+
+	readKey, readSecret, err := createApiKey("reader", []string{ScopeReadStatus})
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, revokedSecret, err := createApiKey("revoked", []string{ScopeReadStatus, ScopeExecute})
+	if err != nil {
+		t.Fatal(err)
+	}
+	revoked, _, err := getApiKeyByHash(hashApiKey(revokedSecret))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := revokeApiKey(revoked.Id); err != nil {
+		t.Fatal(err)
+	}
+
+	optional := false
+	tests := []struct {
+		name    string
+		config  Config
+		scope   string
+		headers map[string]string
+		status  int
+	}{
+		{"bearer token", Config{}, ScopeReadStatus, map[string]string{"Authorization": "Bearer " + readSecret}, http.StatusOK},
+		{"X-API-Key header", Config{}, ScopeReadStatus, map[string]string{"X-API-Key": readSecret}, http.StatusOK},
+		{"missing scope", Config{}, ScopeExecute, map[string]string{"X-API-Key": readSecret}, http.StatusForbidden},
+		{"unknown key", Config{}, ScopeReadStatus, map[string]string{"X-API-Key": "dapp_unknown"}, http.StatusUnauthorized},
+		{"revoked key", Config{}, ScopeExecute, map[string]string{"X-API-Key": revokedSecret}, http.StatusUnauthorized},
+		{"no key", Config{}, ScopeReadStatus, nil, http.StatusUnauthorized},
+		{"no key with require_api_key false", Config{RequireApiKey: &optional}, ScopeReadStatus, nil, http.StatusOK},
+		{"admin without key with require_api_key false", Config{RequireApiKey: &optional}, ScopeAdmin, nil, http.StatusUnauthorized},
+		{"admin token", Config{}, ScopeAdmin, map[string]string{"Authorization": "Bearer admin-token"}, http.StatusOK},
+		{"admin token for another scope", Config{}, ScopeReadStatus, map[string]string{"Authorization": "Bearer admin-token"}, http.StatusUnauthorized},
+	}
+	for _, test := range tests {
+		config := test.config
+		currentConfig.Store(&config)
+		var keyId string
+		router := gin.New()
+		router.GET("/", requireScope(test.scope), func(c *gin.Context) {
+			keyId = c.GetString(apiKeyIdKey)
+			c.Status(http.StatusOK)
+		})
+		req := httptest.NewRequest(http.MethodGet, "/", nil)
+		for key, value := range test.headers {
+			req.Header.Set(key, value)
+		}
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, req)
+
+		if w.Code != test.status {
+			t.Errorf("%s: status = %d, want %d", test.name, w.Code, test.status)
+		}
+		if test.headers["X-API-Key"] == readSecret && w.Code == http.StatusOK && keyId != readKey.Id {
+			t.Errorf("%s: request authenticated as key %q, want %s", test.name, keyId, readKey.Id)
+		}
+	}
+}
@@ -0,0 +1,701 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// Events recorded in the audit log
+const (
+	AuditRequestCreated   = "request_created"
+	AuditRequestCompleted = "request_completed"
+	AuditRequestFailed    = "request_failed"
+	AuditRequestInvalid   = "request_invalid"
+	AuditRequestRejected  = "request_rejected"
+	AuditStatusUpdated    = "status_updated"
+	AuditExecutionStarted = "execution_started"
+	AuditInterrupted      = "request_interrupted"
+	AuditBlockRecorded    = "block_recorded"
+	// AuditCallerRecorded was recorded, instead of AuditBlockRecorded, by
+	// older versions of the server
+	AuditCallerRecorded = "caller_recorded"
+	// AuditRequestImported records a request stored before the audit log
+	// was created, with the whole row as data
+	AuditRequestImported = "request_imported"
+)
+
+// genesisHash is the previous hash of the first audit entry
+var genesisHash = hex.EncodeToString(make([]byte, sha256.Size))
+
+// defaultAnchorPasswordEnv holds the password of the DID anchoring the audit
+// log when audit_anchor does not name another variable
+const defaultAnchorPasswordEnv = "DAPP_ANCHOR_PASSWORD"
+
+// auditLock serializes appends, so that every entry links to the one
+// written before it
+var auditLock sync.Mutex
+
+// AuditEntry is an entry of the audit log. Hash covers every other field,
+// including the hash of the previous entry.
+type AuditEntry struct {
+	Seq       int64           `json:"seq"`
+	CreatedAt string          `json:"created_at"`
+	RequestId string          `json:"request_id"`
+	Event     string          `json:"event"`
+	Data      json.RawMessage `json:"data"`
+	PrevHash  string          `json:"prev_hash"`
+	Hash      string          `json:"hash"`
+}
+
+func (e *AuditEntry) computeHash() string {
+	hash := sha256.Sum256([]byte(fmt.Sprintf("%d|%s|%s|%s|%s|%s", e.Seq, e.CreatedAt, e.RequestId, e.Event, e.Data, e.PrevHash)))
+	return hex.EncodeToString(hash[:])
+}
+
+// AuditVerification is the result of checking the audit log
+type AuditVerification struct {
+	Valid    bool   `json:"valid"`
+	Entries  int64  `json:"entries"`
+	HeadSeq  int64  `json:"head_seq"`
+	HeadHash string `json:"head_hash"`
+	// BadSeq is the first entry which does not verify, or the last entry of
+	// a request which does not match the requests table
+	BadSeq    int64  `json:"bad_seq,omitempty"`
+	RequestId string `json:"request_id,omitempty"`
+	Problem   string `json:"problem,omitempty"`
+	// AnchoredSeq is the last entry covered by an anchor read back from the
+	// chain. The entries after it are only protected by the hash chain,
+	// which whoever can write the database can rebuild.
+	AnchoredSeq       int64 `json:"anchored_seq"`
+	UnanchoredEntries int64 `json:"unanchored_entries"`
+}
+
+// auditedRequest is the part of a requests row which is recorded in the
+// audit log
+type auditedRequest struct {
+	Status             int    `json:"status"`
+	Outcome            string `json:"outcome,omitempty"`
+	FailureReason      string `json:"failure_reason,omitempty"`
+	FailureDetail      string `json:"failure_detail,omitempty"`
+	ValidationErrors   string `json:"validation_errors,omitempty"`
+	CallerDid          string `json:"caller_did,omitempty"`
+	ExecutionStartedAt string `json:"execution_started_at,omitempty"`
+	BlockNo            int64  `json:"block_no,omitempty"`
+}
+
+// apply updates the request the way the transition recorded by entry
+// updated its row
+func (r *auditedRequest) apply(entry AuditEntry) error {
+	if entry.Event == AuditRequestImported {
+		*r = auditedRequest{}
+		return json.Unmarshal(entry.Data, r)
+	}
+	var data struct {
+		Status        int             `json:"status"`
+		Outcome       string          `json:"outcome"`
+		FailureReason string          `json:"failure_reason"`
+		FailureDetail string          `json:"failure_detail"`
+		FieldErrors   json.RawMessage `json:"field_errors"`
+		StartedAt     string          `json:"started_at"`
+		CallerDid     string          `json:"caller_did"`
+		BlockNo       int64           `json:"block_no"`
+	}
+	if err := json.Unmarshal(entry.Data, &data); err != nil {
+		return err
+	}
+
+	switch entry.Event {
+	case AuditRequestCreated:
+		*r = auditedRequest{Status: data.Status}
+		return nil
+	case AuditCallerRecorded:
+		r.CallerDid = data.CallerDid
+		return nil
+	case AuditBlockRecorded:
+		r.BlockNo, r.CallerDid = data.BlockNo, data.CallerDid
+		return nil
+	case AuditExecutionStarted:
+		r.ExecutionStartedAt = data.StartedAt
+	}
+
+	r.Status = data.Status
+	r.Outcome, r.FailureReason, r.FailureDetail, r.ValidationErrors = "", "", "", ""
+	switch entry.Event {
+	case AuditRequestCompleted:
+		r.Outcome = data.Outcome
+	case AuditRequestFailed:
+		r.Outcome, r.FailureReason, r.FailureDetail = data.Outcome, data.FailureReason, data.FailureDetail
+	case AuditRequestRejected, AuditInterrupted:
+		r.FailureReason, r.FailureDetail = data.FailureReason, data.FailureDetail
+	case AuditRequestInvalid:
+		var fieldErrors []FieldError
+		if err := json.Unmarshal(data.FieldErrors, &fieldErrors); err != nil {
+			return err
+		}
+		r.FailureReason, r.ValidationErrors = data.FailureReason, string(data.FieldErrors)
+		r.FailureDetail = firstNonEmpty(data.FailureDetail, fmt.Sprintf("%d field(s) failed validation", len(fieldErrors)))
+	}
+	return nil
+}
+
+// queryer is implemented by *sql.DB and *sql.Tx
+type queryer interface {
+	Query(query string, args ...interface{}) (*sql.Rows, error)
+}
+
+// storedRequests reads the audited columns of every request
+func storedRequests(q queryer) (map[string]auditedRequest, error) {
+	rows, err := q.Query(`SELECT request_id, status, outcome, failure_reason, failure_detail, validation_errors, caller_did, execution_started_at, block_no FROM requests;`)
+	if err != nil {
+		return nil, fmt.Errorf("failed to execute query: %w", err)
+	}
+	defer rows.Close()
+
+	requests := make(map[string]auditedRequest)
+	for rows.Next() {
+		var requestID string
+		var request auditedRequest
+		var outcome, failureReason, failureDetail, validationErrors, callerDid, executionStartedAt sql.NullString
+		var blockNo sql.NullInt64
+		if err := rows.Scan(&requestID, &request.Status, &outcome, &failureReason, &failureDetail, &validationErrors, &callerDid, &executionStartedAt, &blockNo); err != nil {
+			return nil, fmt.Errorf("failed to scan request: %w", err)
+		}
+		request.Outcome = outcome.String
+		request.FailureReason = failureReason.String
+		request.FailureDetail = failureDetail.String
+		request.ValidationErrors = validationErrors.String
+		request.CallerDid = callerDid.String
+		request.ExecutionStartedAt = executionStartedAt.String
+		request.BlockNo = blockNo.Int64
+		requests[requestID] = request
+	}
+	return requests, rows.Err()
+}
+
+// importUnauditedRequests records the requests of a database created before
+// the audit log, so that their rows are verified from then on
+func importUnauditedRequests(db *sql.DB) error {
+	auditLock.Lock()
+	defer auditLock.Unlock()
+
+	tx, err := db.Begin()
+	if err != nil {
+		return fmt.Errorf("failed to begin transaction: %w", err)
+	}
+	defer tx.Rollback()
+
+	requests, err := storedRequests(tx)
+	if err != nil {
+		return err
+	}
+	requestIDs := make([]string, 0, len(requests))
+	for requestID := range requests {
+		requestIDs = append(requestIDs, requestID)
+	}
+	sort.Strings(requestIDs)
+	for _, requestID := range requestIDs {
+		if err := appendAudit(tx, requestID, AuditRequestImported, requests[requestID]); err != nil {
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+// AuditAnchorConfig enables periodic anchoring of the head of the audit log
+// on chain, by executing the contract ContractHash with the head as input.
+// The contract is not served by the dapp server.
+type AuditAnchorConfig struct {
+	ContractHash    string `json:"contract_hash"`
+	ExecutorDid     string `json:"executor_did,omitempty"` // user_did when empty
+	IntervalMinutes int    `json:"interval_minutes"`
+	QuorumType      int    `json:"quorum_type,omitempty"`
+	// PasswordEnv is the environment variable holding the password of the
+	// executor DID, DAPP_ANCHOR_PASSWORD when empty
+	PasswordEnv string `json:"password_env,omitempty"`
+}
+
+// auditedUpdate runs update and appends event to the audit log in the same
+// transaction, so that no state transition is stored without its entry
+func auditedUpdate(ctx context.Context, requestID string, event string, data interface{}, update func(tx *sql.Tx) error) error {
+	defer startDBOperation(ctx, event)()
+	auditLock.Lock()
+	defer auditLock.Unlock()
+
+	db, err := sql.Open("sqlite3", settings.DBPath)
+	if err != nil {
+		return fmt.Errorf("failed to open the database: %w", err)
+	}
+	defer db.Close()
+
+	tx, err := db.Begin()
+	if err != nil {
+		return fmt.Errorf("failed to begin transaction: %w", err)
+	}
+	defer tx.Rollback()
+
+	if err := update(tx); err != nil {
+		return err
+	}
+	if err := appendAudit(tx, requestID, event, data); err != nil {
+		return err
+	}
+	if err := tx.Commit(); err != nil {
+		return fmt.Errorf("failed to commit transaction: %w", err)
+	}
+	return nil
+}
+
+// appendAudit appends an entry linked to the current head of the audit log.
+// The caller must hold auditLock.
+func appendAudit(tx *sql.Tx, requestID string, event string, data interface{}) error {
+	dataJSON, err := json.Marshal(data)
+	if err != nil {
+		return fmt.Errorf("failed to encode audit data: %w", err)
+	}
+
+	entry := AuditEntry{
+		Seq:       1,
+		CreatedAt: time.Now().UTC().Format(time.RFC3339Nano),
+		RequestId: requestID,
+		Event:     event,
+		Data:      dataJSON,
+		PrevHash:  genesisHash,
+	}
+	err = tx.QueryRow(`SELECT seq, hash FROM audit_log ORDER BY seq DESC LIMIT 1;`).Scan(&entry.Seq, &entry.PrevHash)
+	if err != nil && err != sql.ErrNoRows {
+		return fmt.Errorf("failed to read audit head: %w", err)
+	}
+	if err == nil {
+		entry.Seq++
+	}
+	entry.Hash = entry.computeHash()
+
+	insertQuery := `INSERT INTO audit_log (seq, created_at, request_id, event, data, prev_hash, hash) VALUES (?, ?, ?, ?, ?, ?, ?);`
+	if _, err := tx.Exec(insertQuery, entry.Seq, entry.CreatedAt, entry.RequestId, entry.Event, string(entry.Data), entry.PrevHash, entry.Hash); err != nil {
+		return fmt.Errorf("failed to append audit entry: %w", err)
+	}
+	return nil
+}
+
+// verifyAuditLog walks the audit log, checking that sequence numbers have no
+// gaps, that every entry links to the previous one and that no entry was
+// modified. The anchored heads are checked to still be part of the log, which
+// detects entries removed from its end. Finally the log is replayed and
+// compared with the requests table, which detects rows changed without going
+// through the log.
+func verifyAuditLog() (AuditVerification, error) {
+	result := AuditVerification{Valid: true, HeadHash: genesisHash}
+
+	db, err := sql.Open("sqlite3", settings.DBPath)
+	if err != nil {
+		return result, fmt.Errorf("failed to open the database: %w", err)
+	}
+	defer db.Close()
+
+	// Read the log and the requests in one transaction, so that they are
+	// consistent with each other
+	tx, err := db.Begin()
+	if err != nil {
+		return result, fmt.Errorf("failed to begin transaction: %w", err)
+	}
+	defer tx.Rollback()
+
+	rows, err := tx.Query(`SELECT seq, created_at, request_id, event, data, prev_hash, hash FROM audit_log ORDER BY seq;`)
+	if err != nil {
+		return result, fmt.Errorf("failed to execute query: %w", err)
+	}
+	defer rows.Close()
+
+	hashes := make(map[int64]string)
+	replayed := make(map[string]*auditedRequest)
+	lastSeq := make(map[string]int64)
+	for rows.Next() {
+		var entry AuditEntry
+		var data string
+		if err := rows.Scan(&entry.Seq, &entry.CreatedAt, &entry.RequestId, &entry.Event, &data, &entry.PrevHash, &entry.Hash); err != nil {
+			return result, fmt.Errorf("failed to scan audit entry: %w", err)
+		}
+		entry.Data = json.RawMessage(data)
+
+		var problem string
+		switch {
+		case entry.Seq != result.HeadSeq+1:
+			problem = fmt.Sprintf("entries %d to %d are missing", result.HeadSeq+1, entry.Seq-1)
+		case entry.PrevHash != result.HeadHash:
+			problem = "previous hash does not match the entry before it"
+		case entry.computeHash() != entry.Hash:
+			problem = "entry was modified"
+		}
+		if problem != "" {
+			result.Valid = false
+			result.BadSeq = entry.Seq
+			result.Problem = problem
+			return result, nil
+		}
+
+		result.Entries++
+		result.HeadSeq = entry.Seq
+		result.HeadHash = entry.Hash
+		hashes[entry.Seq] = entry.Hash
+
+		request, ok := replayed[entry.RequestId]
+		if !ok {
+			request = &auditedRequest{}
+			replayed[entry.RequestId] = request
+		}
+		if err := request.apply(entry); err != nil {
+			result.Valid = false
+			result.BadSeq = entry.Seq
+			result.RequestId = entry.RequestId
+			result.Problem = fmt.Sprintf("entry cannot be replayed: %v", err)
+			return result, nil
+		}
+		lastSeq[entry.RequestId] = entry.Seq
+	}
+	if err := rows.Err(); err != nil {
+		return result, err
+	}
+	rows.Close()
+
+	stored, err := storedRequests(tx)
+	if err != nil {
+		return result, err
+	}
+	if requestID, problem := compareRequests(replayed, stored); problem != "" {
+		result.Valid = false
+		result.BadSeq = lastSeq[requestID]
+		result.RequestId = requestID
+		result.Problem = problem
+		return result, nil
+	}
+
+	anchors, err := auditAnchors(db)
+	if err != nil {
+		return result, err
+	}
+	for _, anchor := range anchors {
+		if hashes[anchor.Seq] != anchor.Hash {
+			result.Valid = false
+			result.BadSeq = anchor.Seq
+			result.Problem = fmt.Sprintf("entry %d no longer matches the head anchored on chain", anchor.Seq)
+			return result, nil
+		}
+		if anchor.onChain && anchor.Seq > result.AnchoredSeq {
+			result.AnchoredSeq = anchor.Seq
+		}
+	}
+	result.UnanchoredEntries = result.HeadSeq - result.AnchoredSeq
+	return result, nil
+}
+
+// compareRequests compares the requests replayed from the audit log with the
+// stored ones, returning the first request which differs and how
+func compareRequests(replayed map[string]*auditedRequest, stored map[string]auditedRequest) (string, string) {
+	requestIDs := make([]string, 0, len(replayed)+len(stored))
+	for requestID := range replayed {
+		requestIDs = append(requestIDs, requestID)
+	}
+	for requestID := range stored {
+		if _, ok := replayed[requestID]; !ok {
+			requestIDs = append(requestIDs, requestID)
+		}
+	}
+	sort.Strings(requestIDs)
+
+	for _, requestID := range requestIDs {
+		want, logged := replayed[requestID]
+		got, ok := stored[requestID]
+		switch {
+		case !logged:
+			return requestID, fmt.Sprintf("request %s is not in the audit log", requestID)
+		case !ok:
+			return requestID, fmt.Sprintf("request %s was removed from the requests table", requestID)
+		case got != *want:
+			return requestID, fmt.Sprintf("request %s does not match the audit log: %s", requestID, requestDifference(*want, got))
+		}
+	}
+	return "", ""
+}
+
+// requestDifference names the columns of got which differ from want
+func requestDifference(want auditedRequest, got auditedRequest) string {
+	var columns []string
+	if got.Status != want.Status {
+		columns = append(columns, fmt.Sprintf("status is %d, the log has %d", got.Status, want.Status))
+	}
+	for _, column := range []struct {
+		name      string
+		got, want string
+	}{
+		{"outcome", got.Outcome, want.Outcome},
+		{"failure_reason", got.FailureReason, want.FailureReason},
+		{"failure_detail", got.FailureDetail, want.FailureDetail},
+		{"validation_errors", got.ValidationErrors, want.ValidationErrors},
+		{"caller_did", got.CallerDid, want.CallerDid},
+		{"execution_started_at", got.ExecutionStartedAt, want.ExecutionStartedAt},
+	} {
+		if column.got != column.want {
+			columns = append(columns, column.name+" differs")
+		}
+	}
+	if got.BlockNo != want.BlockNo {
+		columns = append(columns, "block_no differs")
+	}
+	return strings.Join(columns, ", ")
+}
+
+// auditAnchor is a head of the audit log which was anchored on chain
+type auditAnchor struct {
+	Seq  int64  `json:"seq"`
+	Hash string `json:"hash"`
+	// onChain is set for the anchors read back from the chain, rather than
+	// from audit_anchors
+	onChain bool
+}
+
+// auditAnchors returns the anchors recorded in the database and, when
+// anchoring is configured, the latest anchor read back from the chain, which
+// cannot be edited along with the database
+func auditAnchors(db *sql.DB) ([]auditAnchor, error) {
+	rows, err := db.Query(`SELECT seq, hash FROM audit_anchors ORDER BY seq;`)
+	if err != nil {
+		return nil, fmt.Errorf("failed to execute query: %w", err)
+	}
+	defer rows.Close()
+
+	var anchors []auditAnchor
+	for rows.Next() {
+		var anchor auditAnchor
+		if err := rows.Scan(&anchor.Seq, &anchor.Hash); err != nil {
+			return nil, fmt.Errorf("failed to scan audit anchor: %w", err)
+		}
+		anchors = append(anchors, anchor)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	config := GetConfig()
+	if config.AuditAnchor == nil {
+		return anchors, nil
+	}
+	tokenData := GetSmartContractData(context.Background(), config.AuditAnchor.ContractHash, config.NodeAddress)
+	if tokenData == nil {
+		return nil, fmt.Errorf("failed to fetch the anchors from the chain")
+	}
+	var reply SmartContractDataReply
+	if err := json.Unmarshal(tokenData, &reply); err != nil {
+		return nil, fmt.Errorf("failed to decode the anchors from the chain: %w", err)
+	}
+	for _, block := range reply.SCTDataReply {
+		var input struct {
+			Anchor *auditAnchor `json:"anchor_audit_head"`
+		}
+		if err := json.Unmarshal([]byte(block.SmartContractData), &input); err == nil && input.Anchor != nil {
+			input.Anchor.onChain = true
+			anchors = append(anchors, *input.Anchor)
+		}
+	}
+	return anchors, nil
+}
+
+// Handler function for GET /admin/audit/verify
+func verifyAuditHandler(c *gin.Context) {
+	result, err := verifyAuditLog()
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, result)
+}
+
+// verifyAuditCommand checks the audit log of a server from the command line,
+// exiting with an error when it does not verify
+func verifyAuditCommand(args []string) error {
+	flags := flag.NewFlagSet("verify-audit", flag.ContinueOnError)
+	settingsFlags := addSettingsFlags(flags)
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+	if err := initServerCommand(settingsFlags); err != nil {
+		return err
+	}
+
+	result, err := verifyAuditLog()
+	if err != nil {
+		return err
+	}
+	if !result.Valid && result.BadSeq == 0 {
+		return fmt.Errorf("audit log is invalid: %s", result.Problem)
+	}
+	if !result.Valid {
+		return fmt.Errorf("audit log is invalid at entry %d: %s", result.BadSeq, result.Problem)
+	}
+	fmt.Printf("Audit log verified: %d entries, head %d %s\n", result.Entries, result.HeadSeq, result.HeadHash)
+	if result.UnanchoredEntries > 0 && result.AnchoredSeq == 0 {
+		fmt.Println("Warning: no anchor read from the chain covers the log, a rewritten log would verify too")
+	} else if result.UnanchoredEntries > 0 {
+		fmt.Printf("Warning: entries %d to %d are not covered by an anchor read from the chain, a rewrite of them would verify too\n", result.AnchoredSeq+1, result.HeadSeq)
+	}
+	return nil
+}
+
+// anchorAuditLog periodically anchors the head of the audit log on chain,
+// when audit_anchor is configured, until ctx is cancelled
+func anchorAuditLog(ctx context.Context) {
+	for {
+		interval := time.Hour
+		if anchor := GetConfig().AuditAnchor; anchor != nil && anchor.IntervalMinutes > 0 {
+			interval = time.Duration(anchor.IntervalMinutes) * time.Minute
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(interval):
+		}
+
+		config := GetConfig()
+		if config.AuditAnchor == nil {
+			continue
+		}
+		if err := anchorAuditHead(config); err != nil {
+			slog.Error("Failed to anchor audit log", "error", err)
+		}
+	}
+}
+
+// anchorAuditHead executes the anchor contract with the current head of the
+// audit log, unless it was already anchored
+func anchorAuditHead(config Config) error {
+	anchor := config.AuditAnchor
+	db, err := sql.Open("sqlite3", settings.DBPath)
+	if err != nil {
+		return fmt.Errorf("failed to open the database: %w", err)
+	}
+	defer db.Close()
+
+	var seq int64
+	var hash string
+	err = db.QueryRow(`SELECT seq, hash FROM audit_log ORDER BY seq DESC LIMIT 1;`).Scan(&seq, &hash)
+	if err == sql.ErrNoRows {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("failed to read audit head: %w", err)
+	}
+	var anchored int
+	if err := db.QueryRow(`SELECT COUNT(*) FROM audit_anchors WHERE seq = ?;`, seq).Scan(&anchored); err != nil {
+		return fmt.Errorf("failed to read audit anchors: %w", err)
+	}
+	if anchored > 0 {
+		return nil
+	}
+
+	input, err := json.Marshal(map[string]interface{}{
+		"anchor_audit_head": map[string]interface{}{"seq": seq, "hash": hash},
+	})
+	if err != nil {
+		return err
+	}
+	quorumType := anchor.QuorumType
+	if quorumType == 0 {
+		quorumType = defaultQuorumType
+	}
+	executeRequest := map[string]interface{}{
+		"comment":            fmt.Sprintf("Audit log head %d", seq),
+		"executorAddr":       firstNonEmpty(anchor.ExecutorDid, config.UserDid),
+		"quorumType":         quorumType,
+		"smartContractData":  string(input),
+		"smartContractToken": anchor.ContractHash,
+	}
+	var executeReply struct {
+		BasicResponse
+		Result struct {
+			Id string `json:"id"`
+		} `json:"result"`
+	}
+	if err := postNodeJSON(config.NodeAddress+"/api/execute-smart-contract", executeRequest, &executeReply); err != nil {
+		return err
+	}
+	if !executeReply.Status {
+		return fmt.Errorf("node rejected anchor execution: %s", executeReply.Message)
+	}
+
+	signatureRequest := map[string]interface{}{
+		"id":       executeReply.Result.Id,
+		"mode":     0,
+		"password": os.Getenv(firstNonEmpty(anchor.PasswordEnv, defaultAnchorPasswordEnv)),
+	}
+	var signatureReply BasicResponse
+	if err := postNodeJSON(config.NodeAddress+"/api/signature-response", signatureRequest, &signatureReply); err != nil {
+		return err
+	}
+	if !signatureReply.Status {
+		return fmt.Errorf("node rejected anchor signature: %s", signatureReply.Message)
+	}
+
+	insertQuery := `INSERT INTO audit_anchors (seq, hash, node_request_id) VALUES (?, ?, ?);`
+	if _, err := db.Exec(insertQuery, seq, hash, executeReply.Result.Id); err != nil {
+		return fmt.Errorf("failed to record audit anchor: %w", err)
+	}
+	slog.Info("Anchored audit log head on chain", "seq", seq, "hash", hash)
+	return nil
+}
+
+func postNodeJSON(url string, body interface{}, reply interface{}) error {
+	bodyJSON, err := json.Marshal(body)
+	if err != nil {
+		return err
+	}
+	resp, err := nodeHTTPClient().Post(url, "application/json; charset=UTF-8", bytes.NewBuffer(bodyJSON))
+	if err != nil {
+		return fmt.Errorf("failed to reach node: %w", err)
+	}
+	defer resp.Body.Close()
+	content, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return fmt.Errorf("failed to read node response: %w", err)
+	}
+	if err := json.Unmarshal(content, reply); err != nil {
+		return fmt.Errorf("unexpected node response %s: %s", resp.Status, string(content))
+	}
+	return nil
+}
+
+// getAuditEntries lists the audit entries of a request in the order they
+// were written
+func getAuditEntries(db *sql.DB, requestID string) ([]AuditEntry, error) {
+	rows, err := db.Query(`SELECT seq, created_at, request_id, event, data, prev_hash, hash FROM audit_log WHERE request_id = ? ORDER BY seq;`, requestID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to execute query: %w", err)
+	}
+	defer rows.Close()
+
+	var entries []AuditEntry
+	for rows.Next() {
+		var entry AuditEntry
+		var data string
+		if err := rows.Scan(&entry.Seq, &entry.CreatedAt, &entry.RequestId, &entry.Event, &data, &entry.PrevHash, &entry.Hash); err != nil {
+			return nil, fmt.Errorf("failed to scan audit entry: %w", err)
+		}
+		entry.Data = json.RawMessage(data)
+		entries = append(entries, entry)
+	}
+	return entries, rows.Err()
+}
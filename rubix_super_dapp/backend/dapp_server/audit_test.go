@@ -0,0 +1,120 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"strings"
+	"testing"
+)
+
+// auditTestLog records a few requests going through the audit log
+func auditTestLog(t *testing.T) {
+	t.Helper()
+	setupTestServer(t)
+	ctx := context.Background()
+	for _, requestId := range []string{"nft-QmA-mint", "nft-QmB-mint"} {
+		if err := insertRequest(ctx, requestId, Pending); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := markRequestFailed(ctx, "nft-QmA-mint", "trap", "trap", "unreachable"); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// execAudit runs statements against the database, as someone editing it by
+// hand would
+func execAudit(t *testing.T, statements ...string) {
+	t.Helper()
+	db, err := sql.Open("sqlite3", settings.DBPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	for _, statement := range statements {
+		if _, err := db.Exec(statement); err != nil {
+			t.Fatalf("%s: %v", statement, err)
+		}
+	}
+}
+
+// rehashAudit rebuilds the hash chain from the entries as they are stored
+func rehashAudit(t *testing.T) {
+	t.Helper()
+	db, err := sql.Open("sqlite3", settings.DBPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	rows, err := db.Query(`SELECT seq, created_at, request_id, event, data FROM audit_log ORDER BY seq;`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var entries []AuditEntry
+	for rows.Next() {
+		var entry AuditEntry
+		var data string
+		if err := rows.Scan(&entry.Seq, &entry.CreatedAt, &entry.RequestId, &entry.Event, &data); err != nil {
+			t.Fatal(err)
+		}
+		entry.Data = json.RawMessage(data)
+		entries = append(entries, entry)
+	}
+	rows.Close()
+
+	prevHash := genesisHash
+	for _, entry := range entries {
+		entry.PrevHash = prevHash
+		entry.Hash = entry.computeHash()
+		if _, err := db.Exec(`UPDATE audit_log SET prev_hash = ?, hash = ? WHERE seq = ?;`, entry.PrevHash, entry.Hash, entry.Seq); err != nil {
+			t.Fatal(err)
+		}
+		prevHash = entry.Hash
+	}
+}
+
+func TestVerifyAuditLog(t *testing.T) {
+	tests := []struct {
+		name    string
+		tamper  func(t *testing.T)
+		valid   bool
+		badSeq  int64
+		problem string
+	}{
+		{"untouched", func(t *testing.T) {}, true, 0, ""},
+		{"entry modified", func(t *testing.T) {
+			execAudit(t, `UPDATE audit_log SET data = '{}' WHERE seq = 2;`)
+		}, false, 2, "entry was modified"},
+		{"entry removed", func(t *testing.T) {
+			execAudit(t, `DELETE FROM audit_log WHERE seq = 2;`)
+		}, false, 3, "entries 2 to 2 are missing"},
+		{"request changed", func(t *testing.T) {
+			execAudit(t, `UPDATE requests SET status = 1 WHERE request_id = 'nft-QmA-mint';`)
+		}, false, 0, "request nft-QmA-mint does not match the audit log: status is 1"},
+		{"request added", func(t *testing.T) {
+			execAudit(t, `INSERT INTO requests (request_id, status) SELECT 'nft-QmC-mint', status FROM requests LIMIT 1;`)
+		}, false, 0, "request nft-QmC-mint is not in the audit log"},
+		{"anchor no longer matches", func(t *testing.T) {
+			execAudit(t, `INSERT INTO audit_anchors (seq, hash) VALUES (1, 'deadbeef');`)
+		}, false, 1, "no longer matches the head anchored on chain"},
+		{"chain rebuilt", func(t *testing.T) {
+			execAudit(t, `UPDATE audit_log SET data = '{}' WHERE seq = 2;`)
+			rehashAudit(t)
+		}, true, 0, ""},
+	}
+	for _, test := range tests {
+		auditTestLog(t)
+		test.tamper(t)
+		result, err := verifyAuditLog()
+		if err != nil {
+			t.Fatalf("%s: %v", test.name, err)
+		}
+		if result.Valid != test.valid || (test.badSeq != 0 && result.BadSeq != test.badSeq) || !strings.Contains(result.Problem, test.problem) {
+			t.Errorf("%s: verification = %+v, want valid %v at %d with %q", test.name, result, test.valid, test.badSeq, test.problem)
+		}
+		if result.Valid && (result.AnchoredSeq != 0 || result.UnanchoredEntries != result.HeadSeq) {
+			t.Errorf("%s: %d of %d entries are anchored without an anchor on chain", test.name, result.HeadSeq-result.UnanchoredEntries, result.HeadSeq)
+		}
+	}
+}
@@ -0,0 +1,175 @@
+package main
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"crypto/subtle"
+	"crypto/x509"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+)
+
+// Headers checked by callback authentication
+const (
+	callbackSecretHeader    = "X-Callback-Secret"
+	callbackSignatureHeader = "X-Callback-Signature"
+)
+
+// callbackContractKey is the gin context key of the contract an
+// authenticated callback is for
+const callbackContractKey = "callback_contract"
+
+// callbackSecretParam is the query parameter carrying the shared secret, for
+// nodes which can only be given a callback url
+const callbackSecretParam = "secret"
+
+// maxCallbackBodySize caps the body read to verify a signature
+const maxCallbackBodySize = 1 << 20
+
+// CallbackAuth is the authentication required from the callbacks of a
+// contract. Every check which is configured must pass.
+type CallbackAuth struct {
+	// Secret must be sent in the X-Callback-Secret header or the secret
+	// query parameter of the callback url
+	Secret string `json:"secret,omitempty"`
+	// HMACSecret is the key of the hex encoded HMAC-SHA256 of the body, sent
+	// in the X-Callback-Signature header with an optional "sha256=" prefix
+	HMACSecret string `json:"hmac_secret,omitempty"`
+	// AllowedIPs are the addresses or CIDR ranges callbacks may come from
+	AllowedIPs []string `json:"allowed_ips,omitempty"`
+	// RequireClientCert requires a client certificate verified against
+	// tls.client_ca_file, whose common name or DNS names include one of
+	// ClientCertNames when it is set
+	RequireClientCert bool     `json:"require_client_cert,omitempty"`
+	ClientCertNames   []string `json:"client_cert_names,omitempty"`
+}
+
+// validate checks that the allowed IPs can be parsed
+func (a *CallbackAuth) validate() error {
+	for _, allowed := range a.AllowedIPs {
+		if _, _, err := net.ParseCIDR(allowed); err == nil {
+			continue
+		}
+		if net.ParseIP(allowed) == nil {
+			return fmt.Errorf("allowed_ips: %s is not an IP address or CIDR range", allowed)
+		}
+	}
+	return nil
+}
+
+// allowsIP reports whether the callback may come from ip
+func (a *CallbackAuth) allowsIP(ip net.IP) bool {
+	if len(a.AllowedIPs) == 0 {
+		return true
+	}
+	if ip == nil {
+		return false
+	}
+	for _, allowed := range a.AllowedIPs {
+		if _, network, err := net.ParseCIDR(allowed); err == nil {
+			if network.Contains(ip) {
+				return true
+			}
+		} else if allowedIP := net.ParseIP(allowed); allowedIP != nil && allowedIP.Equal(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// allowsClientCert reports whether the verified certificate cert names one of
+// the allowed clients
+func (a *CallbackAuth) allowsClientCert(cert *x509.Certificate) bool {
+	if len(a.ClientCertNames) == 0 {
+		return true
+	}
+	names := append([]string{cert.Subject.CommonName}, cert.DNSNames...)
+	for _, name := range names {
+		if containsString(a.ClientCertNames, name) {
+			return true
+		}
+	}
+	return false
+}
+
+// authenticate checks the callback against every configured check, returning
+// the reason it is rejected. The body is read to verify the signature and
+// left in place for the handler.
+func (a *CallbackAuth) authenticate(c *gin.Context) (string, bool) {
+	if !a.allowsIP(net.ParseIP(c.RemoteIP())) {
+		return "ip_not_allowed", false
+	}
+
+	if a.RequireClientCert {
+		if c.Request.TLS == nil || len(c.Request.TLS.VerifiedChains) == 0 {
+			return "missing_client_cert", false
+		}
+		if !a.allowsClientCert(c.Request.TLS.VerifiedChains[0][0]) {
+			return "client_cert_not_allowed", false
+		}
+	}
+
+	if a.Secret != "" {
+		secret := c.GetHeader(callbackSecretHeader)
+		if secret == "" {
+			secret = c.Query(callbackSecretParam)
+		}
+		if subtle.ConstantTimeCompare([]byte(secret), []byte(a.Secret)) != 1 {
+			return "invalid_secret", false
+		}
+	}
+
+	if a.HMACSecret != "" {
+		body, err := io.ReadAll(io.LimitReader(c.Request.Body, maxCallbackBodySize))
+		if err != nil {
+			return "unreadable_body", false
+		}
+		c.Request.Body = io.NopCloser(bytes.NewReader(body))
+
+		signature, err := hex.DecodeString(strings.TrimPrefix(c.GetHeader(callbackSignatureHeader), "sha256="))
+		if err != nil || len(signature) == 0 {
+			return "missing_signature", false
+		}
+		mac := hmac.New(sha256.New, []byte(a.HMACSecret))
+		mac.Write(body)
+		if !hmac.Equal(signature, mac.Sum(nil)) {
+			return "invalid_signature", false
+		}
+	}
+	return "", true
+}
+
+// rejectCallback logs, counts and answers a callback which failed
+// authentication
+func rejectCallback(c *gin.Context, feature string, reason string) {
+	callbacksRejected.inc(feature, reason)
+
+	loggerFrom(c.Request.Context()).Warn("Rejected callback", "contract", feature, "client_ip", c.RemoteIP(), "reason", reason)
+	c.JSON(http.StatusUnauthorized, gin.H{"error": "callback authentication failed"})
+}
+
+// callbackRejectionCounts returns the rejected callbacks by contract and
+// reason, as counted by the dapp_callbacks_rejected_total metric
+func callbackRejectionCounts() map[string]map[string]int64 {
+	counts := make(map[string]map[string]int64)
+	callbacksRejected.each(func(labelValues []string, value float64) {
+		feature, reason := labelValues[0], labelValues[1]
+		if counts[feature] == nil {
+			counts[feature] = make(map[string]int64)
+		}
+		counts[feature][reason] = int64(value)
+	})
+	return counts
+}
+
+// Handler function for GET /admin/callbacks/rejected
+func getCallbackRejectionsHandler(c *gin.Context) {
+	c.JSON(http.StatusOK, gin.H{"rejected_callbacks": callbackRejectionCounts()})
+}
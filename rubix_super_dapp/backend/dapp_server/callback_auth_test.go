@@ -0,0 +1,82 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+)
+
+func TestCallbackAuthValidate(t *testing.T) {
+	tests := []struct {
+		name       string
+		allowedIPs []string
+		valid      bool
+	}{
+		{"addresses", []string{"10.0.0.5", "::1"}, true},
+		{"CIDR ranges", []string{"10.0.0.0/8", "fd00::/8"}, true},
+		{"host name", []string{"localhost"}, false},
+		{"invalid range", []string{"10.0.0.0/33"}, false},
+	}
+	for _, test := range tests {
+		auth := &CallbackAuth{AllowedIPs: test.allowedIPs}
+		if err := auth.validate(); (err == nil) != test.valid {
+			t.Errorf("%s: validate() = %v, want valid %v", test.name, err, test.valid)
+		}
+	}
+}
+
+func TestCallbackAuthenticate(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	const body = `{"smart_contract_hash": "QmContract"}`
+	mac := hmac.New(sha256.New, []byte("hmac-key"))
+	mac.Write([]byte(body))
+	signature := hex.EncodeToString(mac.Sum(nil))
+
+	allowlist := &CallbackAuth{AllowedIPs: []string{"10.0.0.0/8", "192.168.1.7"}}
+	secret := &CallbackAuth{Secret: "shared"}
+	signed := &CallbackAuth{HMACSecret: "hmac-key"}
+	tests := []struct {
+		name       string
+		auth       *CallbackAuth
+		remoteAddr string
+		target     string
+		headers    map[string]string
+		reason     string
+	}{
+		{"address in range", allowlist, "10.1.2.3:4000", "/api/nft", nil, ""},
+		{"allowed address", allowlist, "192.168.1.7:4000", "/api/nft", nil, ""},
+		{"address not allowed", allowlist, "192.168.1.8:4000", "/api/nft", nil, "ip_not_allowed"},
+		{"secret header", secret, "10.1.2.3:4000", "/api/nft", map[string]string{callbackSecretHeader: "shared"}, ""},
+		{"secret parameter", secret, "10.1.2.3:4000", "/api/nft?secret=shared", nil, ""},
+		{"wrong secret", secret, "10.1.2.3:4000", "/api/nft", map[string]string{callbackSecretHeader: "guess"}, "invalid_secret"},
+		{"missing secret", secret, "10.1.2.3:4000", "/api/nft", nil, "invalid_secret"},
+		{"signature", signed, "10.1.2.3:4000", "/api/nft", map[string]string{callbackSignatureHeader: signature}, ""},
+		{"prefixed signature", signed, "10.1.2.3:4000", "/api/nft", map[string]string{callbackSignatureHeader: "sha256=" + signature}, ""},
+		{"signature of another body", signed, "10.1.2.3:4000", "/api/nft", map[string]string{callbackSignatureHeader: strings.Repeat("ab", 32)}, "invalid_signature"},
+		{"missing signature", signed, "10.1.2.3:4000", "/api/nft", nil, "missing_signature"},
+		{"missing client certificate", &CallbackAuth{RequireClientCert: true}, "10.1.2.3:4000", "/api/nft", nil, "missing_client_cert"},
+	}
+	for _, test := range tests {
+		c, _ := gin.CreateTestContext(httptest.NewRecorder())
+		c.Request = httptest.NewRequest(http.MethodPost, test.target, strings.NewReader(body))
+		c.Request.RemoteAddr = test.remoteAddr
+		for key, value := range test.headers {
+			c.Request.Header.Set(key, value)
+		}
+
+		reason, ok := test.auth.authenticate(c)
+		if reason != test.reason || ok != (test.reason == "") {
+			t.Errorf("%s: authenticate() = %q, %v, want %q", test.name, reason, ok, test.reason)
+		}
+		if rest, err := io.ReadAll(c.Request.Body); err != nil || string(rest) != body {
+			t.Errorf("%s: body left for the handler = %q, %v, want %q", test.name, rest, err, body)
+		}
+	}
+}
@@ -0,0 +1,573 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/csv"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"dapp_server/contractresult"
+)
+
+const cliUsage = `Usage: dapp_server [command] [flags]
+
+Commands:
+  serve                         serve the API (the default)
+  migrate                       create or migrate the database
+  config validate               check the config file
+  config migrate                rewrite a legacy config in the contracts_info layout
+  requests list                 list requests
+  requests show <id>            show a request and its audit entries
+  requeue <id>                  execute a failed request again
+  replay-block <contract> <n>   execute block n of a contract
+  register-callbacks            register the callback urls with the nodes
+  export                        export a table as JSON lines or CSV
+  verify-audit                  verify the audit log
+  apikey create|list|revoke     manage API keys
+
+Every command accepts the flags of the server, e.g. -config or -db. Run
+"dapp_server <command> -h" for the flags of a command.
+`
+
+// runCommand runs a command of the dapp server binary
+func runCommand(command string, args []string) error {
+	switch command {
+	case "serve":
+		return serveCommand(args)
+	case "migrate":
+		return migrateCommand(args)
+	case "config":
+		if len(args) > 0 && args[0] == "validate" {
+			return validateConfigCommand(args[1:])
+		}
+		if len(args) > 0 && args[0] == "migrate" {
+			return migrateConfigCommand(args[1:])
+		}
+		return fmt.Errorf("usage: config validate|migrate")
+	case "requests":
+		return requestsCommand(args)
+	case "requeue":
+		return requeueCommand(args)
+	case "replay-block":
+		return replayBlockCommand(args)
+	case "register-callbacks":
+		return registerCallbacksCommand(args)
+	case "export":
+		return exportCommand(args)
+	case "verify-audit":
+		return verifyAuditCommand(args)
+	case "apikey":
+		return apiKeyCommand(args)
+	case "help":
+		fmt.Print(cliUsage)
+		return nil
+	}
+	fmt.Fprint(os.Stderr, cliUsage)
+	return fmt.Errorf("unknown command %s", command)
+}
+
+// migrateCommand creates the tables of the database, and adds the columns
+// missing from databases created by older versions of the server
+func migrateCommand(args []string) error {
+	flags := flag.NewFlagSet("migrate", flag.ContinueOnError)
+	settingsFlags := addSettingsFlags(flags)
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+	if err := initServerCommand(settingsFlags); err != nil {
+		return err
+	}
+	fmt.Printf("Database %s is up to date\n", settings.DBPath)
+	return nil
+}
+
+// validateConfigCommand loads the config as the server would, without
+// starting it
+func validateConfigCommand(args []string) error {
+	flags := flag.NewFlagSet("config validate", flag.ContinueOnError)
+	settingsFlags := addSettingsFlags(flags)
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+	if err := initSettings(settingsFlags); err != nil {
+		return err
+	}
+	config := GetConfig()
+	enabled := 0
+	for _, contractInfo := range config.ContractsInfo {
+		if !contractInfo.Disabled {
+			enabled++
+		}
+	}
+	fmt.Printf("%s is valid: %d contracts, %d enabled\n", settings.ConfigPath, len(config.ContractsInfo), enabled)
+	return nil
+}
+
+// statusNames are the names of the request statuses on the command line
+var statusNames = map[int]string{
+	Pending: "pending",
+	Success: "success",
+	Failed:  "failed",
+}
+
+func statusName(status int) string {
+	if name, ok := statusNames[status]; ok {
+		return name
+	}
+	return strconv.Itoa(status)
+}
+
+func parseStatus(name string) (int, error) {
+	for status, statusName := range statusNames {
+		if strings.EqualFold(name, statusName) {
+			return status, nil
+		}
+	}
+	if status, err := strconv.Atoi(name); err == nil {
+		return status, nil
+	}
+	return 0, fmt.Errorf("unknown status %s, expected pending, success or failed", name)
+}
+
+// requestsCommand lists and shows requests:
+//
+//	requests list [-status failed] [-contract nft] [-caller <did>] [-limit 50]
+//	requests show <id>
+func requestsCommand(args []string) error {
+	if len(args) == 0 {
+		return fmt.Errorf("usage: requests list|show")
+	}
+
+	switch args[0] {
+	case "list":
+		flags := flag.NewFlagSet("requests list", flag.ContinueOnError)
+		status := flags.String("status", "", "only requests with this status: pending, success or failed")
+		contract := flags.String("contract", "", "only requests of this contract")
+		caller := flags.String("caller", "", "only requests submitted by this DID")
+		limit := flags.Int("limit", 50, "maximum number of requests listed, 0 for all")
+		settingsFlags := addSettingsFlags(flags)
+		if err := flags.Parse(args[1:]); err != nil {
+			return err
+		}
+		var statusFilter *int
+		if *status != "" {
+			parsed, err := parseStatus(*status)
+			if err != nil {
+				return err
+			}
+			statusFilter = &parsed
+		}
+		if err := initServerCommand(settingsFlags); err != nil {
+			return err
+		}
+		config := GetConfig()
+		if *contract != "" {
+			if _, ok := config.ContractsInfo[*contract]; !ok {
+				return fmt.Errorf("unknown contract %s", *contract)
+			}
+		}
+
+		requests, err := listRequestDetails(statusFilter, *caller)
+		if err != nil {
+			return err
+		}
+		w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+		fmt.Fprintln(w, "REQUEST ID\tCONTRACT\tSTATUS\tOUTCOME\tREASON\tCALLER")
+		listed := 0
+		for _, request := range requests {
+			if *limit > 0 && listed == *limit {
+				break
+			}
+			feature := ""
+			if parsed, err := parseRequestId(config, request.RequestId); err == nil {
+				feature = parsed.feature
+			}
+			if *contract != "" && feature != *contract {
+				continue
+			}
+			fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\t%s\n", request.RequestId, feature, statusName(request.Status), request.Outcome, request.FailureReason, request.CallerDid)
+			listed++
+		}
+		return w.Flush()
+
+	case "show":
+		flags := flag.NewFlagSet("requests show", flag.ContinueOnError)
+		settingsFlags := addSettingsFlags(flags)
+		if err := flags.Parse(args[1:]); err != nil {
+			return err
+		}
+		if flags.NArg() != 1 {
+			return fmt.Errorf("usage: requests show [flags] <id>")
+		}
+		if err := initServerCommand(settingsFlags); err != nil {
+			return err
+		}
+		request, found, err := getRequestDetail(flags.Arg(0))
+		if err != nil {
+			return err
+		}
+		if !found {
+			return fmt.Errorf("no request with id %s", flags.Arg(0))
+		}
+		encoder := json.NewEncoder(os.Stdout)
+		encoder.SetIndent("", "  ")
+		return encoder.Encode(request)
+	}
+	return fmt.Errorf("unknown requests command %s, expected list or show", args[0])
+}
+
+// parsedRequestId is a request id split into the contract, the smart
+// contract hash and the function suffix it was made of
+type parsedRequestId struct {
+	feature      string
+	contractHash string
+	suffix       string
+}
+
+// parseRequestId finds the contract whose callbacks create requestId. When
+// the id matches several contracts, e.g. because one of them has no request
+// id prefix, the one with the longest prefix is preferred.
+func parseRequestId(config Config, requestId string) (parsedRequestId, error) {
+	var candidates []parsedRequestId
+	prefixes := make(map[string]int)
+	for feature, contractInfo := range config.ContractsInfo {
+		if contractInfo == nil {
+			continue
+		}
+		prefix := contractInfo.requestIdPrefix(feature)
+		if !strings.HasPrefix(requestId, prefix) {
+			continue
+		}
+		rest := strings.TrimPrefix(requestId, prefix)
+		functions := contractInfo.Functions
+		if len(functions) == 0 {
+			functions = dappFunctions[feature]
+		}
+		suffixes := make(map[string]bool)
+		for _, suffix := range functions {
+			suffixes[suffix] = true
+		}
+		for suffix := range suffixes {
+			if len(rest) > len(suffix)+1 && strings.HasSuffix(rest, "-"+suffix) {
+				candidates = append(candidates, parsedRequestId{feature, strings.TrimSuffix(rest, "-"+suffix), suffix})
+				prefixes[feature] = len(prefix)
+			}
+		}
+	}
+	if len(candidates) == 0 {
+		return parsedRequestId{}, fmt.Errorf("request id %s does not match any configured contract", requestId)
+	}
+	sort.Slice(candidates, func(i, j int) bool {
+		if prefixes[candidates[i].feature] != prefixes[candidates[j].feature] {
+			return prefixes[candidates[i].feature] > prefixes[candidates[j].feature]
+		}
+		return candidates[i].feature < candidates[j].feature
+	})
+	if len(candidates) > 1 && prefixes[candidates[0].feature] == prefixes[candidates[1].feature] {
+		return parsedRequestId{}, fmt.Errorf("request id %s matches both %s and %s", requestId, candidates[0].feature, candidates[1].feature)
+	}
+	return candidates[0], nil
+}
+
+// initExecutionCommand prepares a command which executes contracts the way
+// the server does, refusing to while a server is serving from the database
+func initExecutionCommand(f *settingsFlags) error {
+	if err := initServerCommand(f); err != nil {
+		return err
+	}
+	holder, active, err := activeServer(time.Now())
+	if err != nil {
+		return err
+	}
+	if active {
+		return fmt.Errorf("a dapp server (%s) is serving from %s, stop it before executing contracts from the command line", holder, settings.DBPath)
+	}
+	registerDefaultHostFunctions()
+	return nil
+}
+
+// requeueCommand executes a request again from the block it was last
+// executed for. Requests which succeeded, or are still pending, need -force.
+//
+//	requeue [-force] <id>
+func requeueCommand(args []string) error {
+	flags := flag.NewFlagSet("requeue", flag.ContinueOnError)
+	force := flags.Bool("force", false, "requeue requests which succeeded or are still pending")
+	settingsFlags := addSettingsFlags(flags)
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+	if flags.NArg() != 1 {
+		return fmt.Errorf("usage: requeue [flags] <id>")
+	}
+	if err := initExecutionCommand(settingsFlags); err != nil {
+		return err
+	}
+	requestId := flags.Arg(0)
+
+	status, found, err := getRequestStatus(requestId)
+	if err != nil {
+		return err
+	}
+	if !found {
+		return fmt.Errorf("no request with id %s", requestId)
+	}
+	if status == Success && !*force {
+		return fmt.Errorf("request %s already succeeded, use -force to execute it again", requestId)
+	}
+	if status == Pending && !*force {
+		return fmt.Errorf("request %s is pending and may be executing on a running server, use -force to execute it anyway", requestId)
+	}
+
+	parsed, err := parseRequestId(GetConfig(), requestId)
+	if err != nil {
+		return err
+	}
+	block, recorded, err := getRequestBlock(requestId)
+	if err != nil {
+		return err
+	}
+	if !recorded {
+		return fmt.Errorf("the block of request %s was not recorded, run replay-block with the block to execute", requestId)
+	}
+
+	ctx := withLogAttrs(context.Background(), "command", "requeue")
+	fmt.Printf("Requeueing %s from block %d\n", requestId, block)
+	return reportExecution(executeContract(ctx, parsed.feature, parsed.contractHash, executionOptions{Block: &block}))
+}
+
+// replayBlockCommand executes a block of the smart contract of a contract,
+// as if its callback had been received when it was the latest block
+//
+//	replay-block [-contract-hash <hash>] [-force] <contract> <block>
+func replayBlockCommand(args []string) error {
+	flags := flag.NewFlagSet("replay-block", flag.ContinueOnError)
+	contractHash := flags.String("contract-hash", "", "smart contract to replay, the contract_hash of the contract by default")
+	force := flags.Bool("force", false, "execute the block even if its request already succeeded")
+	settingsFlags := addSettingsFlags(flags)
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+	if flags.NArg() != 2 {
+		return fmt.Errorf("usage: replay-block [flags] <contract> <block>")
+	}
+	blockNo, err := strconv.ParseUint(flags.Arg(1), 10, 64)
+	if err != nil {
+		return fmt.Errorf("invalid block number %s", flags.Arg(1))
+	}
+	if err := initExecutionCommand(settingsFlags); err != nil {
+		return err
+	}
+
+	feature := flags.Arg(0)
+	contractInfo, ok := GetConfig().ContractsInfo[feature]
+	if !ok || contractInfo == nil {
+		return fmt.Errorf("unknown contract %s", feature)
+	}
+	hash := firstNonEmpty(*contractHash, contractInfo.ContractHash)
+	if hash == "" {
+		return fmt.Errorf("contract %s has no contract_hash, use -contract-hash", feature)
+	}
+
+	ctx := withLogAttrs(context.Background(), "command", "replay-block")
+	return reportExecution(executeContract(ctx, feature, hash, executionOptions{Block: &blockNo, SkipSucceeded: !*force}))
+}
+
+// reportExecution prints the response of an execution, failing when the
+// contract was not executed successfully
+func reportExecution(result executionResult) error {
+	if result.Err != nil {
+		return result.Err
+	}
+	body, err := json.MarshalIndent(result.Body, "", "  ")
+	if err != nil {
+		return err
+	}
+	if result.RequestId != "" {
+		fmt.Printf("Request %s: ", result.RequestId)
+	}
+	fmt.Printf("%d %s\n%s\n", result.Status, http.StatusText(result.Status), body)
+	if result.Status != http.StatusOK {
+		return fmt.Errorf("the contract was not executed")
+	}
+	if data, ok := result.Body["data"].(contractresult.Result); ok && !data.Succeeded() {
+		return fmt.Errorf("the contract execution failed")
+	}
+	return nil
+}
+
+// registerCallbacksCommand registers the callback urls of the enabled
+// contracts with their nodes
+//
+//	register-callbacks [-contract nft]
+func registerCallbacksCommand(args []string) error {
+	flags := flag.NewFlagSet("register-callbacks", flag.ContinueOnError)
+	contract := flags.String("contract", "", "only register the callback of this contract")
+	settingsFlags := addSettingsFlags(flags)
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+	if err := initServerCommand(settingsFlags); err != nil {
+		return err
+	}
+
+	config := GetConfig()
+	var features []string
+	if *contract != "" {
+		features = append(features, *contract)
+	} else {
+		for feature, contractInfo := range config.ContractsInfo {
+			if contractInfo != nil && !contractInfo.Disabled {
+				features = append(features, feature)
+			}
+		}
+		sort.Strings(features)
+	}
+
+	failed := 0
+	for _, feature := range features {
+		registration, err := registerCallback(config, feature)
+		if err != nil {
+			fmt.Printf("%s: %v\n", feature, err)
+			failed++
+			continue
+		}
+		fmt.Printf("%s: registered %s for %s\n", feature, registration.CallbackURL, registration.ContractHash)
+	}
+	if failed > 0 {
+		return fmt.Errorf("%d of %d callbacks could not be registered", failed, len(features))
+	}
+	return nil
+}
+
+// exportTables are the tables which can be exported. API keys and sessions
+// are left out, since their hashes are only of use to an attacker.
+var exportTables = []string{"requests", "audit_log", "audit_anchors", "contract_events", "contract_state", "request_traces", "callback_registrations", "quota_usage", "quota_charges"}
+
+// exportCommand writes the rows of a table as JSON lines or CSV
+//
+//	export -table requests [-format jsonl|csv] [-o <file>]
+func exportCommand(args []string) error {
+	flags := flag.NewFlagSet("export", flag.ContinueOnError)
+	table := flags.String("table", "requests", "table to export: "+strings.Join(exportTables, ", "))
+	format := flags.String("format", "jsonl", "output format: jsonl or csv")
+	output := flags.String("o", "", "file to write, standard output by default")
+	settingsFlags := addSettingsFlags(flags)
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+	known := false
+	for _, exportTable := range exportTables {
+		known = known || *table == exportTable
+	}
+	if !known {
+		return fmt.Errorf("unknown table %s, expected one of %s", *table, strings.Join(exportTables, ", "))
+	}
+	if *format != "jsonl" && *format != "csv" {
+		return fmt.Errorf("unknown format %s, expected jsonl or csv", *format)
+	}
+	if err := initServerCommand(settingsFlags); err != nil {
+		return err
+	}
+
+	w := io.Writer(os.Stdout)
+	if *output != "" {
+		file, err := os.Create(*output)
+		if err != nil {
+			return fmt.Errorf("failed to create %s: %w", *output, err)
+		}
+		defer file.Close()
+		w = file
+	}
+	count, err := exportTable(w, *table, *format)
+	if err != nil {
+		return err
+	}
+	if *output != "" {
+		fmt.Printf("Exported %d rows of %s to %s\n", count, *table, *output)
+	}
+	return nil
+}
+
+// exportTable writes every row of table to w in format, returning the number
+// of rows written
+func exportTable(w io.Writer, table string, format string) (int, error) {
+	db, err := sql.Open("sqlite3", settings.DBPath)
+	if err != nil {
+		return 0, fmt.Errorf("failed to open the database: %w", err)
+	}
+	defer db.Close()
+
+	// table is one of exportTables
+	rows, err := db.Query(`SELECT * FROM ` + table + ` ORDER BY rowid;`)
+	if err != nil {
+		return 0, fmt.Errorf("failed to execute query: %w", err)
+	}
+	defer rows.Close()
+	columns, err := rows.Columns()
+	if err != nil {
+		return 0, err
+	}
+
+	csvWriter := csv.NewWriter(w)
+	encoder := json.NewEncoder(w)
+	if format == "csv" {
+		if err := csvWriter.Write(columns); err != nil {
+			return 0, err
+		}
+	}
+	count := 0
+	values := make([]interface{}, len(columns))
+	pointers := make([]interface{}, len(columns))
+	for i := range values {
+		pointers[i] = &values[i]
+	}
+	for rows.Next() {
+		if err := rows.Scan(pointers...); err != nil {
+			return count, fmt.Errorf("failed to scan row: %w", err)
+		}
+		if format == "csv" {
+			record := make([]string, len(columns))
+			for i, value := range values {
+				switch value := value.(type) {
+				case nil:
+				case []byte:
+					record[i] = string(value)
+				default:
+					record[i] = fmt.Sprint(value)
+				}
+			}
+			if err := csvWriter.Write(record); err != nil {
+				return count, err
+			}
+		} else {
+			row := make(map[string]interface{}, len(columns))
+			for i, column := range columns {
+				if value, ok := values[i].([]byte); ok {
+					row[column] = string(value)
+				} else {
+					row[column] = values[i]
+				}
+			}
+			if err := encoder.Encode(row); err != nil {
+				return count, err
+			}
+		}
+		count++
+	}
+	if err := rows.Err(); err != nil {
+		return count, err
+	}
+	csvWriter.Flush()
+	return count, csvWriter.Error()
+}
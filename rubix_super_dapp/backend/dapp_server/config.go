@@ -2,24 +2,460 @@ package main
 
 import (
 	"encoding/json"
-	"log"
+	"errors"
+	"flag"
+	"fmt"
+	"log/slog"
+	"net/http"
 	"os"
+	"os/signal"
+	"path/filepath"
+	"reflect"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
 )
 
+// Defaults of the settings which are not required in app.node.json
+const (
+	defaultConfigPath = "../../app.node.json"
+	defaultPort       = 8080
+	defaultDBPath     = "./requests.db"
+	// defaultContractsDir holds the wasm artifacts uploaded through the
+	// admin API
+	defaultContractsDir = "./contracts"
+)
+
+// validContractName matches the keys allowed in contracts_info
+var validContractName = regexp.MustCompile(`^[A-Za-z0-9_-]+$`)
+
+// configPollInterval is how often the config file is checked for changes
+const configPollInterval = 2 * time.Second
+
+// ServerSettings are the options of the dapp server process. They are
+// resolved once at startup, from flags, then environment variables, then
+// app.node.json.
+type ServerSettings struct {
+	ConfigPath   string
+	Port         int
+	DBPath       string
+	NodeAddress  string
+	ContractsDir string
+	// AdminToken enables the admin API, it is only read from the
+	// environment so that it does not show up in the process list
+	AdminToken string
+}
+
+var settings = ServerSettings{
+	ConfigPath:   defaultConfigPath,
+	Port:         defaultPort,
+	DBPath:       defaultDBPath,
+	ContractsDir: defaultContractsDir,
+}
+
+var (
+	currentConfig atomic.Pointer[Config]
+	configModTime time.Time
+	reloadLock    = sync.Mutex{}
+)
+
+// GetConfig returns the current configuration. Handlers should call it once
+// and keep using the returned value, so that a reload does not change the
+// configuration of a request which is already in flight.
 func GetConfig() Config {
-	// Open the JSON file
-	file, err := os.Open("../../app.node.json")
+	return *currentConfig.Load()
+}
+
+// settingsFlags are the command line flags of the server settings
+type settingsFlags struct {
+	configPath   *string
+	port         *int
+	dbPath       *string
+	nodeAddress  *string
+	contractsDir *string
+}
+
+// addSettingsFlags defines the flags of the server settings on flags, so that
+// subcommands working on the server can accept them as well
+func addSettingsFlags(flags *flag.FlagSet) *settingsFlags {
+	return &settingsFlags{
+		configPath:   flags.String("config", "", "path of app.node.json (env DAPP_CONFIG)"),
+		port:         flags.Int("port", 0, "port to listen on (env DAPP_PORT)"),
+		dbPath:       flags.String("db", "", "path of the SQLite database (env DAPP_DB_PATH)"),
+		nodeAddress:  flags.String("node-address", "", "address of the non quorum Rubix node (env DAPP_NODE_ADDRESS)"),
+		contractsDir: flags.String("contracts-dir", "", "directory of the wasm artifacts uploaded through the admin API (env DAPP_CONTRACTS_DIR)"),
+	}
+}
+
+// initConfig resolves the server settings and loads the configuration. It
+// must be called before the server starts.
+func initConfig(args []string) error {
+	flags := flag.NewFlagSet("dapp_server", flag.ContinueOnError)
+	settingsFlags := addSettingsFlags(flags)
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+	return initSettings(settingsFlags)
+}
+
+// initSettings resolves the server settings from the parsed flags and loads
+// the configuration
+func initSettings(f *settingsFlags) error {
+	settings.ConfigPath = firstNonEmpty(*f.configPath, os.Getenv("DAPP_CONFIG"), defaultConfigPath)
+	settings.DBPath = firstNonEmpty(*f.dbPath, os.Getenv("DAPP_DB_PATH"))
+	settings.NodeAddress = firstNonEmpty(*f.nodeAddress, os.Getenv("DAPP_NODE_ADDRESS"))
+	settings.ContractsDir = firstNonEmpty(*f.contractsDir, os.Getenv("DAPP_CONTRACTS_DIR"), defaultContractsDir)
+	settings.AdminToken = os.Getenv("DAPP_ADMIN_TOKEN")
+	settings.Port = *f.port
+	if settings.Port == 0 {
+		if envPort := os.Getenv("DAPP_PORT"); envPort != "" {
+			p, err := strconv.Atoi(envPort)
+			if err != nil {
+				return fmt.Errorf("invalid DAPP_PORT %q: %w", envPort, err)
+			}
+			settings.Port = p
+		}
+	}
+
+	config, modTime, err := loadConfig(settings.ConfigPath)
+	if err != nil {
+		return err
+	}
+
+	// Settings not given as a flag or environment variable fall back to
+	// the config file, and then to the defaults
+	if settings.Port == 0 {
+		settings.Port = config.Port
+	}
+	if settings.Port == 0 {
+		settings.Port = defaultPort
+	}
+	if settings.DBPath == "" {
+		settings.DBPath = firstNonEmpty(config.DBPath, defaultDBPath)
+	}
+
+	currentConfig.Store(config)
+	configModTime = modTime
+	configureLogging(config.Logging)
+	return nil
+}
+
+// loadConfig reads, applies the overrides to and validates the config file
+func loadConfig(path string) (*Config, time.Time, error) {
+	info, err := os.Stat(path)
+	if err != nil {
+		return nil, time.Time{}, fmt.Errorf("failed to open config file: %w", err)
+	}
+	content, err := os.ReadFile(path)
+	if err != nil {
+		return nil, time.Time{}, fmt.Errorf("failed to open config file: %w", err)
+	}
+
+	config, err := decodeConfig(content, path)
 	if err != nil {
-		log.Fatalf("Failed to open file: %v", err)
+		return nil, time.Time{}, err
+	}
+	applyOverrides(config)
+	if err := validateConfig(config); err != nil {
+		return nil, time.Time{}, fmt.Errorf("invalid config %s: %w", path, err)
+	}
+	return config, info.ModTime(), nil
+}
+
+// decodeConfig decodes the content of the config file at path, mapping the
+// nft_dapp layout onto contracts_info
+func decodeConfig(content []byte, path string) (*Config, error) {
+	if isLegacyConfig(content) {
+		config, err := convertLegacyConfig(content)
+		if err != nil {
+			return nil, fmt.Errorf("failed to decode config file: %w", err)
+		}
+		slog.Warn("Config uses the legacy nft_dapp layout, run `config migrate` to convert it", "path", path)
+		return config, nil
 	}
-	defer file.Close()
 
-	// Decode the JSON file into the Config struct
 	var config Config
-	decoder := json.NewDecoder(file)
-	if err := decoder.Decode(&config); err != nil {
-		log.Fatalf("Failed to decode JSON: %v", err)
+	if err := json.Unmarshal(content, &config); err != nil {
+		return nil, fmt.Errorf("failed to decode config file: %w", err)
+	}
+	return &config, nil
+}
+
+// applyOverrides applies the settings given as flags or environment
+// variables which take precedence over the config file
+func applyOverrides(config *Config) {
+	if settings.NodeAddress != "" {
+		config.NodeAddress = settings.NodeAddress
+	}
+}
+
+// errInvalidConfig is returned by updateConfigFile when the updated config
+// does not pass validation
+var errInvalidConfig = errors.New("invalid config")
+
+// updateConfigFile applies update to the contents of the config file, and
+// writes and loads the result if it is valid
+func updateConfigFile(update func(config *Config) error) error {
+	reloadLock.Lock()
+	defer reloadLock.Unlock()
+
+	content, err := os.ReadFile(settings.ConfigPath)
+	if err != nil {
+		return fmt.Errorf("failed to open config file: %w", err)
+	}
+	if isLegacyConfig(content) {
+		return &adminError{status: http.StatusConflict, message: "the config file uses the legacy nft_dapp layout, run `config migrate` before changing it"}
+	}
+	fileConfig, err := decodeConfig(content, settings.ConfigPath)
+	if err != nil {
+		return err
+	}
+	if fileConfig.ContractsInfo == nil {
+		fileConfig.ContractsInfo = make(map[string]*ContractInfo)
+	}
+	if err := update(fileConfig); err != nil {
+		return err
+	}
+
+	// Validate what will be served, but write the file without the overrides
+	served := *fileConfig
+	applyOverrides(&served)
+	if err := validateConfig(&served); err != nil {
+		return fmt.Errorf("%w: %v", errInvalidConfig, err)
 	}
 
-	return config
+	updated, err := json.MarshalIndent(fileConfig, "", "    ")
+	if err != nil {
+		return fmt.Errorf("failed to encode config: %w", err)
+	}
+	if err := writeConfigFile(settings.ConfigPath, append(updated, '\n'), 0644); err != nil {
+		return fmt.Errorf("failed to write config file: %w", err)
+	}
+	if info, err := os.Stat(settings.ConfigPath); err == nil {
+		configModTime = info.ModTime()
+	}
+
+	currentConfig.Store(&served)
+	configureLogging(served.Logging)
+	return nil
+}
+
+// writeConfigFile replaces the file at path with content through a temporary
+// file, so that a failed write never leaves a truncated config behind
+func writeConfigFile(path string, content []byte, mode os.FileMode) error {
+	tmp, err := os.CreateTemp(filepath.Dir(path), filepath.Base(path)+".*.tmp")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(content); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	if err := os.Chmod(tmp.Name(), mode); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), path)
+}
+
+// validateConfig checks that the configuration can be served
+func validateConfig(config *Config) error {
+	var problems []string
+	if config.NodeAddress == "" {
+		problems = append(problems, "non_quorum_node_address is required")
+	}
+
+	if config.TLS != nil {
+		if err := config.TLS.validate(); err != nil {
+			problems = append(problems, fmt.Sprintf("tls: %v", err))
+		}
+	}
+	if config.NodeTLS != nil {
+		if err := config.NodeTLS.validate(); err != nil {
+			problems = append(problems, fmt.Sprintf("node_tls: %v", err))
+		}
+	}
+	if config.AuditAnchor != nil && config.AuditAnchor.ContractHash == "" {
+		problems = append(problems, "audit_anchor.contract_hash is required")
+	}
+	if config.AuditAnchor != nil && config.AuditAnchor.IntervalMinutes < 0 {
+		problems = append(problems, "audit_anchor.interval_minutes must not be negative")
+	}
+	if config.ShutdownTimeoutSeconds < 0 {
+		problems = append(problems, "shutdown_timeout_seconds must not be negative")
+	}
+	if config.Tracing != nil {
+		if err := config.Tracing.validate(); err != nil {
+			problems = append(problems, fmt.Sprintf("tracing: %v", err))
+		}
+	}
+	if config.Logging != nil {
+		if err := config.Logging.validate(); err != nil {
+			problems = append(problems, fmt.Sprintf("logging: %v", err))
+		}
+	}
+	if config.PolicyPath != "" {
+		if _, err := loadPolicy(config.PolicyPath); err != nil {
+			problems = append(problems, fmt.Sprintf("policy_path: %v", err))
+		}
+	}
+	if config.DidAuth != nil {
+		if err := config.DidAuth.validate(); err != nil {
+			problems = append(problems, fmt.Sprintf("did_auth: %v", err))
+		}
+	}
+
+	if config.RateLimits != nil {
+		for name, limit := range map[string]*RateLimit{"per_ip": config.RateLimits.PerIP, "per_api_key": config.RateLimits.PerApiKey, "per_did": config.RateLimits.PerDid, "per_callback": config.RateLimits.PerCallback} {
+			if limit == nil {
+				continue
+			}
+			if err := limit.validate(); err != nil {
+				problems = append(problems, fmt.Sprintf("rate_limits.%s: %v", name, err))
+			}
+		}
+	}
+
+	callbackUrls := make(map[string]string)
+	for feature, contractInfo := range config.ContractsInfo {
+		if contractInfo == nil {
+			problems = append(problems, fmt.Sprintf("contracts_info.%s is empty", feature))
+			continue
+		}
+
+		if !validContractName.MatchString(feature) {
+			problems = append(problems, fmt.Sprintf("contracts_info.%s: name may only contain letters, digits, - and _", feature))
+		}
+		if contractInfo.CallBackUrl == "" || !strings.HasPrefix(contractInfo.CallBackUrl, "/") {
+			problems = append(problems, fmt.Sprintf("contracts_info.%s.callback_url must be a path starting with /", feature))
+		} else if isReservedPath(contractInfo.CallBackUrl) {
+			problems = append(problems, fmt.Sprintf("contracts_info.%s.callback_url %s is used by the dapp server", feature, contractInfo.CallBackUrl))
+		} else if other, ok := callbackUrls[contractInfo.CallBackUrl]; ok {
+			problems = append(problems, fmt.Sprintf("contracts_info.%s.callback_url %s is also used by %s", feature, contractInfo.CallBackUrl, other))
+		} else {
+			callbackUrls[contractInfo.CallBackUrl] = feature
+		}
+
+		if len(contractInfo.Versions) == 0 {
+			if _, err := os.Stat(contractInfo.ContractPath); err != nil {
+				problems = append(problems, fmt.Sprintf("contracts_info.%s.contract_path: %v", feature, err))
+			}
+		}
+		for _, version := range contractInfo.Versions {
+			if _, err := os.Stat(version.ContractPath); err != nil {
+				problems = append(problems, fmt.Sprintf("contracts_info.%s version %s: %v", feature, version.Version, err))
+			}
+		}
+		if contractInfo.CallbackAuth != nil {
+			if err := contractInfo.CallbackAuth.validate(); err != nil {
+				problems = append(problems, fmt.Sprintf("contracts_info.%s.callback_auth.%v", feature, err))
+			}
+		}
+		for funcName, quota := range contractInfo.Quotas {
+			if quota == nil {
+				continue
+			}
+			if err := quota.validate(); err != nil {
+				problems = append(problems, fmt.Sprintf("contracts_info.%s.quotas.%s: %v", feature, funcName, err))
+			}
+		}
+		if _, err := functionSchemas(contractInfo); err != nil {
+			problems = append(problems, fmt.Sprintf("contracts_info.%s: %v", feature, err))
+		}
+	}
+
+	if len(problems) > 0 {
+		return errors.New(strings.Join(problems, "; "))
+	}
+	return nil
+}
+
+// reservedPaths are the routes of the dapp server itself, which callback
+// urls may not shadow
+var reservedPaths = []string{"/request-status", "/simulate/", "/requests/", "/admin/", "/auth/", "/me/", "/policy/", "/metrics", "/healthz", "/readyz"}
+
+func isReservedPath(path string) bool {
+	for _, reserved := range reservedPaths {
+		if path == strings.TrimSuffix(reserved, "/") || strings.HasPrefix(path, reserved) {
+			return true
+		}
+	}
+	return false
+}
+
+// reloadConfig loads the config file again, keeping the current
+// configuration if the new one is invalid
+func reloadConfig() {
+	reloadLock.Lock()
+	defer reloadLock.Unlock()
+
+	config, modTime, err := loadConfig(settings.ConfigPath)
+	if err != nil {
+		slog.Error("Config reload failed, keeping the current config", "error", err)
+		return
+	}
+	configModTime = modTime
+
+	previous := currentConfig.Load()
+	if config.DBPath != previous.DBPath || config.Port != previous.Port {
+		slog.Warn("Changes to port and db_path take effect after a restart")
+	}
+	if (config.TLS == nil) != (previous.TLS == nil) || (config.TLS != nil && *config.TLS != *previous.TLS) {
+		slog.Warn("Changes to tls take effect after a restart")
+	}
+	if !reflect.DeepEqual(config.Tracing, previous.Tracing) {
+		slog.Warn("Changes to tracing take effect after a restart")
+	}
+
+	currentConfig.Store(config)
+	configureLogging(config.Logging)
+	slog.Info("Config reloaded", "path", settings.ConfigPath)
+}
+
+// watchConfig reloads the configuration on SIGHUP or when the config file
+// changes
+func watchConfig() {
+	hangup := make(chan os.Signal, 1)
+	signal.Notify(hangup, syscall.SIGHUP)
+
+	ticker := time.NewTicker(configPollInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-hangup:
+			reloadConfig()
+		case <-ticker.C:
+			info, err := os.Stat(settings.ConfigPath)
+			if err != nil {
+				continue
+			}
+			reloadLock.Lock()
+			changed := !info.ModTime().Equal(configModTime)
+			reloadLock.Unlock()
+			if changed {
+				reloadConfig()
+			}
+		}
+	}
+}
+
+func firstNonEmpty(values ...string) string {
+	for _, value := range values {
+		if value != "" {
+			return value
+		}
+	}
+	return ""
 }
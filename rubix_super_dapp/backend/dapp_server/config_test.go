@@ -0,0 +1,104 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// writeTestConfig writes content as the config file of a temporary
+// directory, in which contract.wasm exists, and returns its path
+func writeTestConfig(t *testing.T, content string) string {
+	t.Helper()
+	dir := t.TempDir()
+	if err := os.WriteFile(filepath.Join(dir, "contract.wasm"), []byte("\x00asm\x01\x00\x00\x00"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	path := filepath.Join(dir, "app.node.json")
+	content = strings.ReplaceAll(content, "{dir}", dir)
+	if err := os.WriteFile(path, []byte(content), 0644); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestInitConfig(t *testing.T) {
+	saved := settings
+	t.Cleanup(func() {
+		settings = saved
+		currentConfig.Store(&Config{})
+		configureLogging(nil)
+	})
+	path := writeTestConfig(t, `{"non_quorum_node_address": "http://file:20005", "port": 8081, "db_path": "file.db"}`)
+
+	tests := []struct {
+		name        string
+		args        []string
+		env         map[string]string
+		port        int
+		dbPath      string
+		nodeAddress string
+	}{
+		{"config file", []string{"-config", path}, nil, 8081, "file.db", "http://file:20005"},
+		{"config from the environment", nil, map[string]string{"DAPP_CONFIG": path}, 8081, "file.db", "http://file:20005"},
+		{"environment", []string{"-config", path}, map[string]string{"DAPP_PORT": "8082", "DAPP_DB_PATH": "env.db", "DAPP_NODE_ADDRESS": "http://env:20005"}, 8082, "env.db", "http://env:20005"},
+		{"flags", []string{"-config", path, "-port", "8083", "-db", "flag.db", "-node-address", "http://flag:20005"}, map[string]string{"DAPP_PORT": "8082", "DAPP_DB_PATH": "env.db", "DAPP_NODE_ADDRESS": "http://env:20005"}, 8083, "flag.db", "http://flag:20005"},
+	}
+	for _, test := range tests {
+		for _, name := range []string{"DAPP_CONFIG", "DAPP_PORT", "DAPP_DB_PATH", "DAPP_NODE_ADDRESS"} {
+			t.Setenv(name, test.env[name])
+		}
+		if err := initConfig(test.args); err != nil {
+			t.Fatalf("%s: %v", test.name, err)
+		}
+		config := GetConfig()
+		if settings.Port != test.port || settings.DBPath != test.dbPath || config.NodeAddress != test.nodeAddress {
+			t.Errorf("%s: port %d, db %s, node %s, want %d, %s, %s", test.name, settings.Port, settings.DBPath, config.NodeAddress, test.port, test.dbPath, test.nodeAddress)
+		}
+	}
+}
+
+func TestLoadConfig(t *testing.T) {
+	saved := settings
+	t.Cleanup(func() { settings = saved })
+	settings.NodeAddress = ""
+
+	tests := []struct {
+		name    string
+		content string
+		problem string
+	}{
+		{"valid", `{"non_quorum_node_address": "http://localhost:20005", "contracts_info": {"nft": {"contract_path": "{dir}/contract.wasm", "callback_url": "/api/nft"}}}`, ""},
+		{"not JSON", `{"non_quorum_node_address": `, "failed to decode"},
+		{"without node address", `{}`, "non_quorum_node_address is required"},
+		{"missing artifact", `{"non_quorum_node_address": "http://localhost:20005", "contracts_info": {"nft": {"contract_path": "{dir}/missing.wasm", "callback_url": "/api/nft"}}}`, "contracts_info.nft.contract_path"},
+		{"invalid contract name", `{"non_quorum_node_address": "http://localhost:20005", "contracts_info": {"my nft": {"contract_path": "{dir}/contract.wasm", "callback_url": "/api/nft"}}}`, "name may only contain"},
+		{"reserved callback url", `{"non_quorum_node_address": "http://localhost:20005", "contracts_info": {"nft": {"contract_path": "{dir}/contract.wasm", "callback_url": "/admin/nft"}}}`, "is used by the dapp server"},
+		{"relative callback url", `{"non_quorum_node_address": "http://localhost:20005", "contracts_info": {"nft": {"contract_path": "{dir}/contract.wasm", "callback_url": "api/nft"}}}`, "must be a path starting with /"},
+		{"negative shutdown timeout", `{"non_quorum_node_address": "http://localhost:20005", "shutdown_timeout_seconds": -1}`, "shutdown_timeout_seconds must not be negative"},
+	}
+	for _, test := range tests {
+		_, _, err := loadConfig(writeTestConfig(t, test.content))
+		switch {
+		case test.problem == "" && err != nil:
+			t.Errorf("%s: loadConfig() = %v, want success", test.name, err)
+		case test.problem != "" && (err == nil || !strings.Contains(err.Error(), test.problem)):
+			t.Errorf("%s: loadConfig() = %v, want an error containing %q", test.name, err, test.problem)
+		}
+	}
+}
+
+func TestLoadConfigOverride(t *testing.T) {
+	saved := settings
+	t.Cleanup(func() { settings = saved })
+	settings.NodeAddress = "http://override:20005"
+
+	config, _, err := loadConfig(writeTestConfig(t, `{}`))
+	if err != nil {
+		t.Fatalf("loadConfig() = %v, want the node address override to make the config valid", err)
+	}
+	if config.NodeAddress != settings.NodeAddress {
+		t.Errorf("node address = %s, want %s", config.NodeAddress, settings.NodeAddress)
+	}
+}
@@ -0,0 +1,146 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// contractState is the key-value state of a contract as seen by a single
+// execution. Reads go to the database, while writes are buffered until the
+// execution has finished and are then committed together with the request
+// status, so a failed execution leaves the stored state untouched. Executions
+// which commit their state hold lockContractState while they run.
+type contractState struct {
+	contractHash string
+
+	mu     sync.Mutex
+	writes map[string]json.RawMessage // a nil value marks a deleted key
+}
+
+// stateLocks serializes the executions of each contract, so that one
+// execution's reads cannot be overwritten by the commit of another one
+var stateLocks = struct {
+	sync.Mutex
+	locks map[string]*sync.Mutex
+}{locks: make(map[string]*sync.Mutex)}
+
+// lockContractState waits until no other execution of the contract holds its
+// state, and holds it until the returned function is called
+func lockContractState(contractHash string) func() {
+	stateLocks.Lock()
+	lock, ok := stateLocks.locks[contractHash]
+	if !ok {
+		lock = &sync.Mutex{}
+		stateLocks.locks[contractHash] = lock
+	}
+	stateLocks.Unlock()
+
+	lock.Lock()
+	return lock.Unlock
+}
+
+func newContractState(contractHash string) *contractState {
+	return &contractState{
+		contractHash: contractHash,
+		writes:       make(map[string]json.RawMessage),
+	}
+}
+
+func (s *contractState) get(key string) (json.RawMessage, bool, error) {
+	s.mu.Lock()
+	value, written := s.writes[key]
+	s.mu.Unlock()
+	if written {
+		return value, value != nil, nil
+	}
+
+	value, found, err := getContractStateValue(s.contractHash, key)
+	if err != nil {
+		return nil, false, err
+	}
+	return value, found, nil
+}
+
+func (s *contractState) set(key string, value json.RawMessage) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.writes[key] = value
+}
+
+func (s *contractState) delete(key string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.writes[key] = nil
+}
+
+// keys returns the sorted keys starting with prefix, including the ones
+// written by this execution
+func (s *contractState) keys(prefix string) ([]string, error) {
+	stored, err := getContractStateKeys(s.contractHash, prefix)
+	if err != nil {
+		return nil, err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	keySet := make(map[string]bool, len(stored))
+	for _, key := range stored {
+		keySet[key] = true
+	}
+	for key, value := range s.writes {
+		if !strings.HasPrefix(key, prefix) {
+			continue
+		}
+		keySet[key] = value != nil
+	}
+
+	keys := make([]string, 0, len(keySet))
+	for key, present := range keySet {
+		if present {
+			keys = append(keys, key)
+		}
+	}
+	sort.Strings(keys)
+	return keys, nil
+}
+
+// pendingWrites returns the writes buffered so far, with deleted keys mapped
+// to null
+func (s *contractState) pendingWrites() map[string]json.RawMessage {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	writes := make(map[string]json.RawMessage, len(s.writes))
+	for key, value := range s.writes {
+		if value == nil {
+			value = json.RawMessage("null")
+		}
+		writes[key] = value
+	}
+	return writes
+}
+
+// commit applies the buffered writes within tx
+func (s *contractState) commit(tx *sql.Tx) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for key, value := range s.writes {
+		var err error
+		if value == nil {
+			_, err = tx.Exec(`DELETE FROM contract_state WHERE contract_hash = ? AND key = ?;`, s.contractHash, key)
+		} else {
+			_, err = tx.Exec(`INSERT INTO contract_state (contract_hash, key, value) VALUES (?, ?, ?)
+				ON CONFLICT(contract_hash, key) DO UPDATE SET value = excluded.value;`, s.contractHash, key, string(value))
+		}
+		if err != nil {
+			return fmt.Errorf("failed to write state key %s: %w", key, err)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,57 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"sync"
+	"testing"
+
+	"dapp_server/contractresult"
+)
+
+func TestConcurrentExecutionsDoNotLoseWrites(t *testing.T) {
+	setupTestServer(t)
+	ctx := context.Background()
+	const contractHash = "QmVoting"
+	const executions = 8
+
+	var wg sync.WaitGroup
+	errs := make(chan error, executions)
+	for i := 0; i < executions; i++ {
+		requestId := fmt.Sprintf("voting-%s-vote-%d", contractHash, i)
+		if err := insertRequest(ctx, requestId, Pending); err != nil {
+			t.Fatal(err)
+		}
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			defer lockContractState(contractHash)()
+			state := newContractState(contractHash)
+			value, _, err := state.get("votes")
+			if err != nil {
+				errs <- err
+				return
+			}
+			var count int
+			if value != nil {
+				count, _ = strconv.Atoi(string(value))
+			}
+			state.set("votes", json.RawMessage(strconv.Itoa(count+1)))
+			errs <- completeRequest(ctx, requestId, state, contractresult.Parse("success"))
+		}()
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	value, found, err := newContractState(contractHash).get("votes")
+	if err != nil || !found || string(value) != strconv.Itoa(executions) {
+		t.Errorf("votes = %s (found %v, %v), want %d", value, found, err, executions)
+	}
+}
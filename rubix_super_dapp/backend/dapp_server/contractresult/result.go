@@ -0,0 +1,131 @@
+// Package contractresult interprets the output of a wasm contract call.
+//
+// Contracts report their result in several shapes: the literal "success",
+// a node BasicResponse passed through from a Rubix API call, a {"msg": ...}
+// response, or a WasmError. Parse maps all of them to a single Result with a
+// machine readable error code.
+package contractresult
+
+import (
+	"encoding/json"
+	"strings"
+)
+
+// Outcome is the kind of result a contract call ended with
+type Outcome string
+
+const (
+	// Success means the contract and any node calls it made succeeded
+	Success Outcome = "success"
+	// ContractRejected means the contract refused the input, e.g. a name
+	// missing from its whitelist
+	ContractRejected Outcome = "contract_rejected"
+	// NodeError means a Rubix node call made by the contract failed
+	NodeError Outcome = "node_error"
+	// Trap means the execution itself failed, the contract trapped, could
+	// not be called or produced output which could not be understood
+	Trap Outcome = "trap"
+)
+
+// Error codes of a Result
+const (
+	CodeOK               = "ok"
+	CodeContractRejected = "contract_rejected"
+	CodeNodeRejected     = "node_rejected"
+	CodeTrap             = "trap"
+	CodeEmptyOutput      = "empty_output"
+	CodeInvalidOutput    = "invalid_output"
+)
+
+// Result is the interpreted output of a contract call
+type Result struct {
+	Outcome Outcome     `json:"outcome"`
+	Code    string      `json:"error_code"`
+	Message string      `json:"message"`
+	Data    interface{} `json:"result,omitempty"`
+	// Raw is the output as returned by the contract
+	Raw string `json:"-"`
+}
+
+// Succeeded reports whether the call ended with Success
+func (r Result) Succeeded() bool {
+	return r.Outcome == Success
+}
+
+// envelope holds every field used by the known result shapes
+type envelope struct {
+	Status  *bool           `json:"status"`
+	Message string          `json:"message"`
+	Result  interface{}     `json:"result"`
+	Msg     *string         `json:"msg"`
+	Error   json.RawMessage `json:"error"`
+	Err     json.RawMessage `json:"err"`
+}
+
+// Parse interprets the output of a contract call which returned without error
+func Parse(output string) Result {
+	trimmed := strings.TrimSpace(output)
+	switch {
+	case trimmed == "":
+		return Result{Outcome: Trap, Code: CodeEmptyOutput, Message: "contract returned no output", Raw: output}
+	case strings.EqualFold(trimmed, "success"):
+		return Result{Outcome: Success, Code: CodeOK, Message: "Contract executed successfully", Raw: output}
+	}
+
+	var env envelope
+	if err := json.Unmarshal([]byte(trimmed), &env); err != nil {
+		return Result{Outcome: Trap, Code: CodeInvalidOutput, Message: "unrecognised contract output: " + trimmed, Raw: output}
+	}
+
+	switch {
+	// WasmError, returned by the contract itself
+	case len(env.Error) > 0 && string(env.Error) != "null":
+		return Result{Outcome: ContractRejected, Code: CodeContractRejected, Message: errorMessage(env.Error), Raw: output}
+	case len(env.Err) > 0 && string(env.Err) != "null":
+		return Result{Outcome: ContractRejected, Code: CodeContractRejected, Message: errorMessage(env.Err), Raw: output}
+
+	// BasicResponse of a Rubix node API call
+	case env.Status != nil:
+		if *env.Status {
+			return Result{Outcome: Success, Code: CodeOK, Message: env.Message, Data: env.Result, Raw: output}
+		}
+		return Result{Outcome: NodeError, Code: CodeNodeRejected, Message: env.Message, Data: env.Result, Raw: output}
+
+	// {"msg": ...} response
+	case env.Msg != nil:
+		return Result{Outcome: Success, Code: CodeOK, Message: *env.Msg, Raw: output}
+	}
+
+	return Result{Outcome: Trap, Code: CodeInvalidOutput, Message: "unrecognised contract output: " + trimmed, Raw: output}
+}
+
+// FromError builds the Result of a contract call which failed to run, with
+// code identifying the failure
+func FromError(err error, code string) Result {
+	if code == "" {
+		code = CodeTrap
+	}
+	return Result{Outcome: Trap, Code: code, Message: err.Error()}
+}
+
+// errorMessage extracts a readable message from a WasmError, which is either
+// a plain string or an object with a message field
+func errorMessage(raw json.RawMessage) string {
+	var message string
+	if err := json.Unmarshal(raw, &message); err == nil {
+		return message
+	}
+	var obj struct {
+		Msg     string `json:"msg"`
+		Message string `json:"message"`
+	}
+	if err := json.Unmarshal(raw, &obj); err == nil {
+		if obj.Msg != "" {
+			return obj.Msg
+		}
+		if obj.Message != "" {
+			return obj.Message
+		}
+	}
+	return string(raw)
+}
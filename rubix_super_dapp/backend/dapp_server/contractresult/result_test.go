@@ -0,0 +1,71 @@
+package contractresult
+
+import (
+	"errors"
+	"reflect"
+	"testing"
+)
+
+func TestParse(t *testing.T) {
+	tests := []struct {
+		name    string
+		output  string
+		outcome Outcome
+		code    string
+		message string
+		data    interface{}
+	}{
+		{"literal success", "success", Success, CodeOK, "Contract executed successfully", nil},
+		{"literal success with case and spaces", "  Success\n", Success, CodeOK, "Contract executed successfully", nil},
+		{"empty output", "  ", Trap, CodeEmptyOutput, "contract returned no output", nil},
+		{"non-JSON output", "panicked at src/lib.rs", Trap, CodeInvalidOutput, "unrecognised contract output: panicked at src/lib.rs", nil},
+		{"unknown JSON object", `{"value": 1}`, Trap, CodeInvalidOutput, `unrecognised contract output: {"value": 1}`, nil},
+		{"error string", `{"error": "name not whitelisted"}`, ContractRejected, CodeContractRejected, "name not whitelisted", nil},
+		{"error object with msg", `{"error": {"msg": "already voted"}}`, ContractRejected, CodeContractRejected, "already voted", nil},
+		{"error object with message", `{"error": {"message": "bad input"}}`, ContractRejected, CodeContractRejected, "bad input", nil},
+		{"error of another shape", `{"error": 42}`, ContractRejected, CodeContractRejected, "42", nil},
+		{"err string", `{"err": "invalid color"}`, ContractRejected, CodeContractRejected, "invalid color", nil},
+		{"err object", `{"err": {"msg": "invalid color"}}`, ContractRejected, CodeContractRejected, "invalid color", nil},
+		{"null error is ignored", `{"error": null, "msg": "ok"}`, Success, CodeOK, "ok", nil},
+		{"status true", `{"status": true, "message": "NFT minted", "result": "id"}`, Success, CodeOK, "NFT minted", "id"},
+		{"status false", `{"status": false, "message": "insufficient balance"}`, NodeError, CodeNodeRejected, "insufficient balance", nil},
+		{"msg", `{"msg": "Vote recorded"}`, Success, CodeOK, "Vote recorded", nil},
+	}
+	for _, test := range tests {
+		result := Parse(test.output)
+		if result.Outcome != test.outcome || result.Code != test.code || result.Message != test.message {
+			t.Errorf("%s: Parse(%q) = %s/%s/%q, want %s/%s/%q", test.name, test.output,
+				result.Outcome, result.Code, result.Message, test.outcome, test.code, test.message)
+		}
+		if !reflect.DeepEqual(result.Data, test.data) {
+			t.Errorf("%s: Parse(%q).Data = %v, want %v", test.name, test.output, result.Data, test.data)
+		}
+		if result.Raw != test.output {
+			t.Errorf("%s: Parse(%q).Raw = %q, want the output", test.name, test.output, result.Raw)
+		}
+		if result.Succeeded() != (test.outcome == Success) {
+			t.Errorf("%s: Parse(%q).Succeeded() = %v", test.name, test.output, result.Succeeded())
+		}
+	}
+}
+
+func TestFromError(t *testing.T) {
+	tests := []struct {
+		name string
+		code string
+		want string
+	}{
+		{"default code", "", CodeTrap},
+		{"explicit code", "limit_exceeded", "limit_exceeded"},
+	}
+	for _, test := range tests {
+		result := FromError(errors.New("wasm trap: unreachable"), test.code)
+		if result.Outcome != Trap || result.Code != test.want || result.Message != "wasm trap: unreachable" {
+			t.Errorf("%s: FromError = %s/%s/%q, want trap/%s/%q", test.name,
+				result.Outcome, result.Code, result.Message, test.want, "wasm trap: unreachable")
+		}
+		if result.Succeeded() {
+			t.Errorf("%s: FromError result succeeded", test.name)
+		}
+	}
+}
@@ -0,0 +1,175 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+)
+
+type GetConfigArgs struct {
+	Key string `json:"key"`
+}
+
+type GetRequestStatusArgs struct {
+	RequestId string `json:"request_id"`
+}
+
+type RequestStatusResult struct {
+	Found  bool `json:"found"`
+	Status int  `json:"status"`
+}
+
+type EmitEventArgs struct {
+	Name string      `json:"name"`
+	Data interface{} `json:"data"`
+}
+
+type LogArgs struct {
+	Stream  string `json:"stream"`
+	Message string `json:"message"`
+}
+
+type StateKeyArgs struct {
+	Key string `json:"key"`
+}
+
+type StateGetResult struct {
+	Found bool            `json:"found"`
+	Value json.RawMessage `json:"value,omitempty"`
+}
+
+type StateSetArgs struct {
+	Key   string          `json:"key"`
+	Value json.RawMessage `json:"value"`
+}
+
+type StateKeysArgs struct {
+	Prefix string `json:"prefix"`
+}
+
+// registerDefaultHostFunctions exposes the capabilities of the dapp server
+// which every contract can import
+func registerDefaultHostFunctions() {
+	RegisterHostFunction(allContracts, "dapp_get_config", dappGetConfig)
+	RegisterHostFunction(allContracts, "dapp_get_request_status", dappGetRequestStatus)
+	RegisterHostFunction(allContracts, "dapp_emit_event", dappEmitEvent)
+	RegisterHostFunction(allContracts, "dapp_log", dappLog)
+
+	RegisterHostFunction(allContracts, "dapp_state_get", dappStateGet)
+	RegisterHostFunction(allContracts, "dapp_state_set", dappStateSet)
+	RegisterHostFunction(allContracts, "dapp_state_delete", dappStateDelete)
+	RegisterHostFunction(allContracts, "dapp_state_keys", dappStateKeys)
+}
+
+// dappGetConfig returns a value from the configuration of the calling contract
+func dappGetConfig(ctx *HostCallContext, args GetConfigArgs) (string, error) {
+	switch args.Key {
+	case "user_did":
+		return ctx.Config.UserDid, nil
+	case "non_quorum_node_address":
+		if ctx.Contract != nil {
+			return ctx.Contract.nodeAddress(ctx.Config), nil
+		}
+		return ctx.Config.NodeAddress, nil
+	case "contract_hash":
+		return ctx.ContractHash, nil
+	case "request_id":
+		return ctx.RequestId, nil
+	default:
+		return "", fmt.Errorf("unknown config key %q", args.Key)
+	}
+}
+
+// dappGetRequestStatus looks up a request of the calling contract in the
+// local request index. The requests of other contracts are not visible.
+func dappGetRequestStatus(ctx *HostCallContext, args GetRequestStatusArgs) (RequestStatusResult, error) {
+	if ctx.Contract == nil {
+		return RequestStatusResult{}, fmt.Errorf("request status is not available")
+	}
+	if !strings.HasPrefix(args.RequestId, ctx.Contract.requestId(ctx.Feature, ctx.ContractHash, "")) {
+		return RequestStatusResult{}, fmt.Errorf("request %s does not belong to this contract", args.RequestId)
+	}
+	status, found, err := getRequestStatus(args.RequestId)
+	if err != nil {
+		return RequestStatusResult{}, err
+	}
+	return RequestStatusResult{Found: found, Status: status}, nil
+}
+
+// dappEmitEvent records an event raised by the contract against the current
+// request
+func dappEmitEvent(ctx *HostCallContext, args EmitEventArgs) (bool, error) {
+	if args.Name == "" {
+		return false, fmt.Errorf("event name is required")
+	}
+	if ctx.Simulation != nil {
+		args, _ := json.Marshal(args)
+		ctx.Simulation.record("dapp_emit_event", args)
+		return true, nil
+	}
+	if err := insertContractEvent(ctx, args.Name, args.Data); err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+// dappLog writes a line to the stdout or stderr stream of the execution
+// trace, as wasm contracts have no console of their own
+func dappLog(ctx *HostCallContext, args LogArgs) (bool, error) {
+	stream := args.Stream
+	if stream == "" {
+		stream = "stdout"
+	}
+	if stream != "stdout" && stream != "stderr" {
+		return false, fmt.Errorf("unknown stream %q", args.Stream)
+	}
+	if ctx.Trace != nil {
+		ctx.Trace.log(stream, args.Message)
+	}
+	return true, nil
+}
+
+// dappStateGet reads a key from the state of the calling contract
+func dappStateGet(ctx *HostCallContext, args StateKeyArgs) (StateGetResult, error) {
+	if ctx.State == nil {
+		return StateGetResult{}, fmt.Errorf("contract state is not available")
+	}
+	value, found, err := ctx.State.get(args.Key)
+	if err != nil {
+		return StateGetResult{}, err
+	}
+	return StateGetResult{Found: found, Value: value}, nil
+}
+
+// dappStateSet stores a JSON value under a key in the state of the calling
+// contract. It is persisted only if the execution succeeds.
+func dappStateSet(ctx *HostCallContext, args StateSetArgs) (bool, error) {
+	if ctx.State == nil {
+		return false, fmt.Errorf("contract state is not available")
+	}
+	if args.Key == "" {
+		return false, fmt.Errorf("key is required")
+	}
+	if len(args.Value) == 0 {
+		return false, fmt.Errorf("value is required")
+	}
+	ctx.State.set(args.Key, args.Value)
+	return true, nil
+}
+
+// dappStateDelete removes a key from the state of the calling contract
+func dappStateDelete(ctx *HostCallContext, args StateKeyArgs) (bool, error) {
+	if ctx.State == nil {
+		return false, fmt.Errorf("contract state is not available")
+	}
+	ctx.State.delete(args.Key)
+	return true, nil
+}
+
+// dappStateKeys lists the keys of the calling contract's state with a prefix
+func dappStateKeys(ctx *HostCallContext, args StateKeysArgs) ([]string, error) {
+	if ctx.State == nil {
+		return nil, fmt.Errorf("contract state is not available")
+	}
+	return ctx.State.keys(args.Prefix)
+}
@@ -1,16 +1,25 @@
 package main
 
 import (
+	"context"
 	"database/sql"
+	"encoding/json"
 	"fmt"
 	"log"
+	"log/slog"
+	"strings"
+	"time"
+
+	"dapp_server/contractresult"
+
+	"github.com/gin-gonic/gin"
 
 	_ "github.com/mattn/go-sqlite3"
 )
 
 func initDB() {
 	// Open a SQLite database connection
-	db, err := sql.Open("sqlite3", "./requests.db")
+	db, err := sql.Open("sqlite3", settings.DBPath)
 	if err != nil {
 		log.Fatalf("Failed to open the database: %v", err)
 	}
@@ -27,43 +36,457 @@ func initDB() {
 		log.Fatalf("Failed to create table: %v", err)
 	}
 
-	fmt.Println("Table 'requests' created successfully!")
+	// Columns added after the initial schema, databases created by older
+	// versions of the server are migrated in place
+	if err := ensureColumn(db, "requests", "failure_reason", "TEXT"); err != nil {
+		log.Fatalf("Failed to migrate table: %v", err)
+	}
+	if err := ensureColumn(db, "requests", "failure_detail", "TEXT"); err != nil {
+		log.Fatalf("Failed to migrate table: %v", err)
+	}
+	if err := ensureColumn(db, "requests", "validation_errors", "TEXT"); err != nil {
+		log.Fatalf("Failed to migrate table: %v", err)
+	}
+	if err := ensureColumn(db, "requests", "outcome", "TEXT"); err != nil {
+		log.Fatalf("Failed to migrate table: %v", err)
+	}
+	if err := ensureColumn(db, "requests", "caller_did", "TEXT"); err != nil {
+		log.Fatalf("Failed to migrate table: %v", err)
+	}
+	if err := ensureColumn(db, "requests", "execution_started_at", "TEXT"); err != nil {
+		log.Fatalf("Failed to migrate table: %v", err)
+	}
+	if err := ensureColumn(db, "requests", "block_no", "INTEGER"); err != nil {
+		log.Fatalf("Failed to migrate table: %v", err)
+	}
+
+	slog.Debug("Database initialized", "path", settings.DBPath)
+
+	createEventsTableQuery := `
+	CREATE TABLE IF NOT EXISTS contract_events (
+		id INTEGER PRIMARY KEY AUTOINCREMENT,
+		feature TEXT,
+		contract_hash TEXT,
+		request_id TEXT,
+		name TEXT,
+		data TEXT,
+		created_at DATETIME DEFAULT CURRENT_TIMESTAMP
+	);`
+	_, err = db.Exec(createEventsTableQuery)
+	if err != nil {
+		log.Fatalf("Failed to create table: %v", err)
+	}
+
+	createTracesTableQuery := `
+	CREATE TABLE IF NOT EXISTS request_traces (
+		request_id TEXT PRIMARY KEY,
+		trace TEXT,
+		updated_at DATETIME DEFAULT CURRENT_TIMESTAMP
+	);`
+	_, err = db.Exec(createTracesTableQuery)
+	if err != nil {
+		log.Fatalf("Failed to create table: %v", err)
+	}
+
+	createStateTableQuery := `
+	CREATE TABLE IF NOT EXISTS contract_state (
+		contract_hash TEXT,
+		key TEXT,
+		value TEXT,
+		PRIMARY KEY (contract_hash, key)
+	);`
+	_, err = db.Exec(createStateTableQuery)
+	if err != nil {
+		log.Fatalf("Failed to create table: %v", err)
+	}
+
+	createApiKeysTableQuery := `
+	CREATE TABLE IF NOT EXISTS api_keys (
+		id TEXT PRIMARY KEY,
+		name TEXT,
+		key_hash TEXT UNIQUE,
+		scopes TEXT,
+		created_at DATETIME DEFAULT CURRENT_TIMESTAMP,
+		revoked_at DATETIME
+	);`
+	_, err = db.Exec(createApiKeysTableQuery)
+	if err != nil {
+		log.Fatalf("Failed to create table: %v", err)
+	}
+
+	createSessionsTableQuery := `
+	CREATE TABLE IF NOT EXISTS sessions (
+		token_hash TEXT PRIMARY KEY,
+		did TEXT,
+		created_at DATETIME DEFAULT CURRENT_TIMESTAMP,
+		expires_at DATETIME
+	);`
+	_, err = db.Exec(createSessionsTableQuery)
+	if err != nil {
+		log.Fatalf("Failed to create table: %v", err)
+	}
+
+	// Requests of databases created before the audit log are recorded in it
+	// once, when it is created
+	var auditTables int
+	if err := db.QueryRow(`SELECT COUNT(1) FROM sqlite_master WHERE type = 'table' AND name = 'audit_log';`).Scan(&auditTables); err != nil {
+		log.Fatalf("Failed to read tables: %v", err)
+	}
+
+	createAuditTableQuery := `
+	CREATE TABLE IF NOT EXISTS audit_log (
+		seq INTEGER PRIMARY KEY,
+		created_at TEXT,
+		request_id TEXT,
+		event TEXT,
+		data TEXT,
+		prev_hash TEXT,
+		hash TEXT
+	);`
+	_, err = db.Exec(createAuditTableQuery)
+	if err != nil {
+		log.Fatalf("Failed to create table: %v", err)
+	}
+
+	if auditTables == 0 {
+		if err := importUnauditedRequests(db); err != nil {
+			log.Fatalf("Failed to record requests in the audit log: %v", err)
+		}
+	}
+
+	createAnchorsTableQuery := `
+	CREATE TABLE IF NOT EXISTS audit_anchors (
+		seq INTEGER PRIMARY KEY,
+		hash TEXT,
+		node_request_id TEXT,
+		anchored_at DATETIME DEFAULT CURRENT_TIMESTAMP
+	);`
+	_, err = db.Exec(createAnchorsTableQuery)
+	if err != nil {
+		log.Fatalf("Failed to create table: %v", err)
+	}
+
+	createCallbackRegistrationsTableQuery := `
+	CREATE TABLE IF NOT EXISTS callback_registrations (
+		feature TEXT PRIMARY KEY,
+		contract_hash TEXT,
+		callback_url TEXT,
+		registered_at DATETIME DEFAULT CURRENT_TIMESTAMP
+	);`
+	_, err = db.Exec(createCallbackRegistrationsTableQuery)
+	if err != nil {
+		log.Fatalf("Failed to create table: %v", err)
+	}
+
+	createQuotaTableQuery := `
+	CREATE TABLE IF NOT EXISTS quota_usage (
+		feature TEXT,
+		function TEXT,
+		did TEXT,
+		window_start INTEGER,
+		count INTEGER,
+		PRIMARY KEY (feature, function, did, window_start)
+	);`
+	_, err = db.Exec(createQuotaTableQuery)
+	if err != nil {
+		log.Fatalf("Failed to create table: %v", err)
+	}
+
+	// The blocks counted in quota_usage, so that executing a block again
+	// does not count it twice. They are kept after their window has passed,
+	// as a block can be replayed at any time.
+	createQuotaChargesTableQuery := `
+	CREATE TABLE IF NOT EXISTS quota_charges (
+		feature TEXT,
+		contract_hash TEXT,
+		block_no INTEGER,
+		function TEXT,
+		did TEXT,
+		window_start INTEGER,
+		PRIMARY KEY (feature, contract_hash, block_no)
+	);`
+	_, err = db.Exec(createQuotaChargesTableQuery)
+	if err != nil {
+		log.Fatalf("Failed to create table: %v", err)
+	}
+
+	// The server serving from the database, so that commands executing
+	// contracts do not run alongside it
+	createHeartbeatTableQuery := `
+	CREATE TABLE IF NOT EXISTS server_heartbeat (
+		id INTEGER PRIMARY KEY CHECK (id = 1),
+		holder TEXT,
+		beat_at INTEGER
+	);`
+	_, err = db.Exec(createHeartbeatTableQuery)
+	if err != nil {
+		log.Fatalf("Failed to create table: %v", err)
+	}
 }
 
-// insertRequest inserts a new request into the database
-func insertRequest(requestID string, status int) error {
-	db, err := sql.Open("sqlite3", "./requests.db")
+// ensureColumn adds a column to a table if it is not already present
+func ensureColumn(db *sql.DB, table string, column string, definition string) error {
+	rows, err := db.Query(fmt.Sprintf("PRAGMA table_info(%s);", table))
 	if err != nil {
-		log.Fatalf("Failed to open the database: %v", err)
+		return fmt.Errorf("failed to read table info: %w", err)
 	}
-	defer db.Close()
-	insertQuery := `INSERT INTO requests (request_id, status) VALUES (?, ?);`
-	_, err1 := db.Exec(insertQuery, requestID, status)
-	if err1 != nil {
-		return fmt.Errorf("failed to insert record: %w", err)
+	defer rows.Close()
+
+	for rows.Next() {
+		var (
+			cid       int
+			name      string
+			colType   string
+			notNull   int
+			dfltValue sql.NullString
+			pk        int
+		)
+		if err := rows.Scan(&cid, &name, &colType, &notNull, &dfltValue, &pk); err != nil {
+			return fmt.Errorf("failed to scan table info: %w", err)
+		}
+		if name == column {
+			return nil
+		}
+	}
+	if err := rows.Err(); err != nil {
+		return fmt.Errorf("failed to read table info: %w", err)
+	}
+
+	alterQuery := fmt.Sprintf("ALTER TABLE %s ADD COLUMN %s %s;", table, column, definition)
+	if _, err := db.Exec(alterQuery); err != nil {
+		return fmt.Errorf("failed to add column %s: %w", column, err)
+	}
+	return nil
+}
+
+// insertRequest inserts a new request into the database
+func insertRequest(ctx context.Context, requestID string, status int) error {
+	err := auditedUpdate(ctx, requestID, AuditRequestCreated, gin.H{"status": status}, func(tx *sql.Tx) error {
+		insertQuery := `INSERT INTO requests (request_id, status) VALUES (?, ?);`
+		if _, err := tx.Exec(insertQuery, requestID, status); err != nil {
+			return fmt.Errorf("failed to insert record: %w", err)
+		}
+		return nil
+	})
+	if err != nil {
+		return err
 	}
-	fmt.Printf("Inserted request_id: %s with status: %d\n", requestID, status)
+	loggerFrom(ctx).Info("Inserted request", "request_id", requestID, "status", status)
 	return nil
 }
 
 // updateRequestStatus updates the status of an existing request in the database
-func updateRequestStatus(requestID string, newStatus int) error {
-	db, err := sql.Open("sqlite3", "./requests.db")
+func updateRequestStatus(ctx context.Context, requestID string, newStatus int) error {
+	err := auditedUpdate(ctx, requestID, AuditStatusUpdated, gin.H{"status": newStatus}, func(tx *sql.Tx) error {
+		updateQuery := `UPDATE requests SET status = ?, outcome = NULL, failure_reason = NULL, failure_detail = NULL, validation_errors = NULL WHERE request_id = ?;`
+		if _, err := tx.Exec(updateQuery, newStatus, requestID); err != nil {
+			return fmt.Errorf("failed to update record: %w", err)
+		}
+		return nil
+	})
 	if err != nil {
-		log.Fatalf("Failed to open the database: %v", err)
+		return err
+	}
+	loggerFrom(ctx).Info("Updated request status", "request_id", requestID, "status", newStatus)
+	return nil
+}
+
+// completeRequest sets the final status of a successful execution and
+// commits the contract state it wrote, in a single transaction. It returns
+// errNotPending, without committing the state, when the request was already
+// finished, e.g. marked interrupted by a shutdown.
+func completeRequest(ctx context.Context, requestID string, state *contractState, result contractresult.Result) error {
+	auditData := gin.H{"status": Success, "outcome": result.Outcome, "message": result.Message, "result": result.Data}
+	if state != nil {
+		auditData["state_writes"] = state.pendingWrites()
+	}
+	err := auditedUpdate(ctx, requestID, AuditRequestCompleted, auditData, func(tx *sql.Tx) error {
+		if state != nil {
+			if err := state.commit(tx); err != nil {
+				return err
+			}
+		}
+		updateQuery := `UPDATE requests SET status = ?, outcome = ?, failure_reason = NULL, failure_detail = NULL, validation_errors = NULL WHERE request_id = ? AND status = ?;`
+		updated, err := tx.Exec(updateQuery, Success, string(contractresult.Success), requestID, Pending)
+		if err != nil {
+			return fmt.Errorf("failed to update record: %w", err)
+		}
+		if count, err := updated.RowsAffected(); err == nil && count == 0 {
+			return errNotPending
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	loggerFrom(ctx).Info("Updated request status", "request_id", requestID, "status", Success)
+	return nil
+}
+
+// markRequestFailed sets a request to Failed and records the outcome of the
+// execution and why it failed
+func markRequestFailed(ctx context.Context, requestID string, outcome string, reason string, detail string) error {
+	return updateRequestFailed(ctx, requestID, outcome, reason, detail, false)
+}
+
+// markExecutionFailed fails a request whose contract was executed, returning
+// errNotPending when it was already finished, e.g. marked interrupted by a
+// shutdown while the contract was still running
+func markExecutionFailed(ctx context.Context, requestID string, outcome string, reason string, detail string) error {
+	return updateRequestFailed(ctx, requestID, outcome, reason, detail, true)
+}
+
+func updateRequestFailed(ctx context.Context, requestID string, outcome string, reason string, detail string, pendingOnly bool) error {
+	auditData := gin.H{"status": Failed, "outcome": outcome, "failure_reason": reason, "failure_detail": detail}
+	err := auditedUpdate(ctx, requestID, AuditRequestFailed, auditData, func(tx *sql.Tx) error {
+		updateQuery := `UPDATE requests SET status = ?, outcome = ?, failure_reason = ?, failure_detail = ?, validation_errors = NULL WHERE request_id = ?`
+		args := []interface{}{Failed, outcome, reason, detail, requestID}
+		if pendingOnly {
+			updateQuery += ` AND status = ?`
+			args = append(args, Pending)
+		}
+		result, err := tx.Exec(updateQuery+";", args...)
+		if err != nil {
+			return fmt.Errorf("failed to update record: %w", err)
+		}
+		if updated, err := result.RowsAffected(); err == nil && updated == 0 && pendingOnly {
+			return errNotPending
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	loggerFrom(ctx).Info("Request failed", "request_id", requestID, "reason", reason)
+	return nil
+}
+
+// markRequestInvalid fails a request whose input did not match the schema of
+// the called function, storing the field errors
+func markRequestInvalid(ctx context.Context, requestID string, fieldErrors []FieldError) error {
+	fieldErrorsJSON, err := json.Marshal(fieldErrors)
+	if err != nil {
+		return fmt.Errorf("failed to encode field errors: %w", err)
+	}
+	detail := fmt.Sprintf("%d field(s) failed validation", len(fieldErrors))
+	auditData := gin.H{"status": Failed, "failure_reason": ReasonInvalidInput, "failure_detail": detail, "field_errors": fieldErrors}
+	err = auditedUpdate(ctx, requestID, AuditRequestInvalid, auditData, func(tx *sql.Tx) error {
+		updateQuery := `UPDATE requests SET status = ?, outcome = NULL, failure_reason = ?, failure_detail = ?, validation_errors = ? WHERE request_id = ?;`
+		if _, err := tx.Exec(updateQuery, Failed, ReasonInvalidInput, detail, string(fieldErrorsJSON), requestID); err != nil {
+			return fmt.Errorf("failed to update record: %w", err)
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	loggerFrom(ctx).Info("Request failed", "request_id", requestID, "reason", ReasonInvalidInput)
+	return nil
+}
+
+// markRequestRejected marks a request as failed without executing it
+func markRequestRejected(ctx context.Context, requestID string, reason string, detail string) error {
+	auditData := gin.H{"status": Failed, "failure_reason": reason, "failure_detail": detail}
+	err := auditedUpdate(ctx, requestID, AuditRequestRejected, auditData, func(tx *sql.Tx) error {
+		updateQuery := `UPDATE requests SET status = ?, outcome = NULL, failure_reason = ?, failure_detail = ?, validation_errors = NULL WHERE request_id = ?;`
+		if _, err := tx.Exec(updateQuery, Failed, reason, detail, requestID); err != nil {
+			return fmt.Errorf("failed to update record: %w", err)
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	loggerFrom(ctx).Info("Request failed", "request_id", requestID, "reason", reason)
+	return nil
+}
+
+// countRequestsWithStatus counts the stored requests with status
+func countRequestsWithStatus(status int) (int, error) {
+	db, err := sql.Open("sqlite3", settings.DBPath)
+	if err != nil {
+		return 0, fmt.Errorf("failed to open the database: %w", err)
 	}
 	defer db.Close()
-	updateQuery := `UPDATE requests SET status = ? WHERE request_id = ?;`
-	_, err1 := db.Exec(updateQuery, newStatus, requestID)
-	if err1 != nil {
-		return fmt.Errorf("failed to update record: %w", err)
+
+	var count int
+	if err := db.QueryRow(`SELECT COUNT(1) FROM requests WHERE status = ?;`, status).Scan(&count); err != nil {
+		return 0, fmt.Errorf("failed to execute query: %w", err)
 	}
-	fmt.Printf("Updated request_id: %s to new status: %d\n", requestID, newStatus)
+	return count, nil
+}
+
+// markExecutionStarted sets a request back to Pending as its contract is
+// about to be executed, so that an interrupted execution can be told apart
+// from a request which never reached the contract
+func markExecutionStarted(ctx context.Context, requestID string) error {
+	startedAt := time.Now().UTC().Format(time.RFC3339Nano)
+	return auditedUpdate(ctx, requestID, AuditExecutionStarted, gin.H{"status": Pending, "started_at": startedAt}, func(tx *sql.Tx) error {
+		updateQuery := `UPDATE requests SET status = ?, outcome = NULL, failure_reason = NULL, failure_detail = NULL, validation_errors = NULL, execution_started_at = ? WHERE request_id = ?;`
+		if _, err := tx.Exec(updateQuery, Pending, startedAt, requestID); err != nil {
+			return fmt.Errorf("failed to update record: %w", err)
+		}
+		return nil
+	})
+}
+
+// markRequestInterrupted fails a pending request whose execution was stopped
+// by a shutdown, returning errNotPending when it had already finished
+func markRequestInterrupted(ctx context.Context, requestID string, detail string) error {
+	auditData := gin.H{"status": Failed, "failure_reason": ReasonInterrupted, "failure_detail": detail}
+	err := auditedUpdate(ctx, requestID, AuditInterrupted, auditData, func(tx *sql.Tx) error {
+		updateQuery := `UPDATE requests SET status = ?, outcome = NULL, failure_reason = ?, failure_detail = ?, validation_errors = NULL WHERE request_id = ? AND status = ?;`
+		result, err := tx.Exec(updateQuery, Failed, ReasonInterrupted, detail, requestID, Pending)
+		if err != nil {
+			return fmt.Errorf("failed to update record: %w", err)
+		}
+		if updated, err := result.RowsAffected(); err == nil && updated == 0 {
+			return errNotPending
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	loggerFrom(ctx).Info("Request failed", "request_id", requestID, "reason", ReasonInterrupted)
 	return nil
 }
 
-func checkStringInRequests(searchString string) (bool, error) {
-	db, err := sql.Open("sqlite3", "./requests.db")
+// pendingRequest is a request left pending, and whether its contract had
+// started executing
+type pendingRequest struct {
+	requestId        string
+	executionStarted bool
+}
+
+// getPendingRequests lists the requests with the pending status
+func getPendingRequests() ([]pendingRequest, error) {
+	db, err := sql.Open("sqlite3", settings.DBPath)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open the database: %w", err)
+	}
+	defer db.Close()
+
+	rows, err := db.Query(`SELECT request_id, execution_started_at IS NOT NULL FROM requests WHERE status = ?;`, Pending)
+	if err != nil {
+		return nil, fmt.Errorf("failed to execute query: %w", err)
+	}
+	defer rows.Close()
+
+	var requests []pendingRequest
+	for rows.Next() {
+		var request pendingRequest
+		if err := rows.Scan(&request.requestId, &request.executionStarted); err != nil {
+			return nil, fmt.Errorf("failed to scan row: %w", err)
+		}
+		requests = append(requests, request)
+	}
+	return requests, rows.Err()
+}
+
+func checkStringInRequests(ctx context.Context, searchString string) (bool, error) {
+	defer startDBOperation(ctx, "check_request")()
+	db, err := sql.Open("sqlite3", settings.DBPath)
 	if err != nil {
 		log.Fatalf("Failed to open the database: %v", err)
 	}
@@ -78,3 +501,571 @@ func checkStringInRequests(searchString string) (bool, error) {
 
 	return count > 0, nil
 }
+
+// getRequestStatus returns the status of a request and whether it exists
+func getRequestStatus(requestID string) (int, bool, error) {
+	db, err := sql.Open("sqlite3", settings.DBPath)
+	if err != nil {
+		return 0, false, fmt.Errorf("failed to open the database: %w", err)
+	}
+	defer db.Close()
+
+	var status int
+	err = db.QueryRow(`SELECT status FROM requests WHERE request_id = ?;`, requestID).Scan(&status)
+	if err == sql.ErrNoRows {
+		return 0, false, nil
+	}
+	if err != nil {
+		return 0, false, fmt.Errorf("failed to execute query: %w", err)
+	}
+	return status, true, nil
+}
+
+// insertContractEvent stores an event emitted by a contract during execution
+func insertContractEvent(ctx *HostCallContext, name string, data interface{}) error {
+	defer startDBOperation(ctx.Context, "insert_event")()
+	db, err := sql.Open("sqlite3", settings.DBPath)
+	if err != nil {
+		return fmt.Errorf("failed to open the database: %w", err)
+	}
+	defer db.Close()
+
+	dataJSON, err := json.Marshal(data)
+	if err != nil {
+		return fmt.Errorf("failed to encode event data: %w", err)
+	}
+	insertQuery := `INSERT INTO contract_events (feature, contract_hash, request_id, name, data) VALUES (?, ?, ?, ?, ?);`
+	_, err = db.Exec(insertQuery, ctx.Feature, ctx.ContractHash, ctx.RequestId, name, string(dataJSON))
+	if err != nil {
+		return fmt.Errorf("failed to insert event: %w", err)
+	}
+	ctx.logger().Info("Contract event emitted", "event", name)
+	return nil
+}
+
+// getContractStateValue reads a single key from the committed state of a contract
+func getContractStateValue(contractHash string, key string) (json.RawMessage, bool, error) {
+	db, err := sql.Open("sqlite3", settings.DBPath)
+	if err != nil {
+		return nil, false, fmt.Errorf("failed to open the database: %w", err)
+	}
+	defer db.Close()
+
+	var value string
+	err = db.QueryRow(`SELECT value FROM contract_state WHERE contract_hash = ? AND key = ?;`, contractHash, key).Scan(&value)
+	if err == sql.ErrNoRows {
+		return nil, false, nil
+	}
+	if err != nil {
+		return nil, false, fmt.Errorf("failed to execute query: %w", err)
+	}
+	return json.RawMessage(value), true, nil
+}
+
+// getContractStateKeys lists the committed keys of a contract starting with prefix
+func getContractStateKeys(contractHash string, prefix string) ([]string, error) {
+	db, err := sql.Open("sqlite3", settings.DBPath)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open the database: %w", err)
+	}
+	defer db.Close()
+
+	query := `SELECT key FROM contract_state WHERE contract_hash = ? AND substr(key, 1, ?) = ? ORDER BY key;`
+	rows, err := db.Query(query, contractHash, len(prefix), prefix)
+	if err != nil {
+		return nil, fmt.Errorf("failed to execute query: %w", err)
+	}
+	defer rows.Close()
+
+	var keys []string
+	for rows.Next() {
+		var key string
+		if err := rows.Scan(&key); err != nil {
+			return nil, fmt.Errorf("failed to scan key: %w", err)
+		}
+		keys = append(keys, key)
+	}
+	return keys, rows.Err()
+}
+
+// upsertRequestTrace stores the execution trace of a request, replacing the
+// trace of any previous execution
+func upsertRequestTrace(ctx context.Context, requestID string, trace string) error {
+	defer startDBOperation(ctx, "save_trace")()
+	db, err := sql.Open("sqlite3", settings.DBPath)
+	if err != nil {
+		return fmt.Errorf("failed to open the database: %w", err)
+	}
+	defer db.Close()
+
+	upsertQuery := `INSERT INTO request_traces (request_id, trace, updated_at) VALUES (?, ?, CURRENT_TIMESTAMP)
+		ON CONFLICT(request_id) DO UPDATE SET trace = excluded.trace, updated_at = excluded.updated_at;`
+	if _, err := db.Exec(upsertQuery, requestID, trace); err != nil {
+		return fmt.Errorf("failed to store trace: %w", err)
+	}
+	return nil
+}
+
+// getRequestTrace returns the stored execution trace of a request
+func getRequestTrace(requestID string) (string, bool, error) {
+	db, err := sql.Open("sqlite3", settings.DBPath)
+	if err != nil {
+		return "", false, fmt.Errorf("failed to open the database: %w", err)
+	}
+	defer db.Close()
+
+	var trace string
+	err = db.QueryRow(`SELECT trace FROM request_traces WHERE request_id = ?;`, requestID).Scan(&trace)
+	if err == sql.ErrNoRows {
+		return "", false, nil
+	}
+	if err != nil {
+		return "", false, fmt.Errorf("failed to execute query: %w", err)
+	}
+	return trace, true, nil
+}
+
+// insertApiKey stores a new API key by the hash of its secret
+func insertApiKey(key ApiKey, keyHash string) error {
+	db, err := sql.Open("sqlite3", settings.DBPath)
+	if err != nil {
+		return fmt.Errorf("failed to open the database: %w", err)
+	}
+	defer db.Close()
+
+	insertQuery := `INSERT INTO api_keys (id, name, key_hash, scopes) VALUES (?, ?, ?, ?);`
+	if _, err := db.Exec(insertQuery, key.Id, key.Name, keyHash, strings.Join(key.Scopes, ",")); err != nil {
+		return fmt.Errorf("failed to insert API key: %w", err)
+	}
+	return nil
+}
+
+// getApiKeyByHash returns the API key whose secret has keyHash, and whether
+// it exists and is not revoked
+func getApiKeyByHash(keyHash string) (ApiKey, bool, error) {
+	db, err := sql.Open("sqlite3", settings.DBPath)
+	if err != nil {
+		return ApiKey{}, false, fmt.Errorf("failed to open the database: %w", err)
+	}
+	defer db.Close()
+
+	var key ApiKey
+	var scopes string
+	query := `SELECT id, name, scopes, created_at FROM api_keys WHERE key_hash = ? AND revoked_at IS NULL;`
+	err = db.QueryRow(query, keyHash).Scan(&key.Id, &key.Name, &scopes, &key.CreatedAt)
+	if err == sql.ErrNoRows {
+		return ApiKey{}, false, nil
+	}
+	if err != nil {
+		return ApiKey{}, false, fmt.Errorf("failed to execute query: %w", err)
+	}
+	key.Scopes = splitScopes(scopes)
+	return key, true, nil
+}
+
+// listApiKeys returns every API key, including revoked ones
+func listApiKeys() ([]ApiKey, error) {
+	db, err := sql.Open("sqlite3", settings.DBPath)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open the database: %w", err)
+	}
+	defer db.Close()
+
+	rows, err := db.Query(`SELECT id, name, scopes, created_at, revoked_at FROM api_keys ORDER BY created_at;`)
+	if err != nil {
+		return nil, fmt.Errorf("failed to execute query: %w", err)
+	}
+	defer rows.Close()
+
+	var keys []ApiKey
+	for rows.Next() {
+		var key ApiKey
+		var scopes string
+		var revokedAt sql.NullTime
+		if err := rows.Scan(&key.Id, &key.Name, &scopes, &key.CreatedAt, &revokedAt); err != nil {
+			return nil, fmt.Errorf("failed to scan API key: %w", err)
+		}
+		key.Scopes = splitScopes(scopes)
+		if revokedAt.Valid {
+			key.RevokedAt = &revokedAt.Time
+		}
+		keys = append(keys, key)
+	}
+	return keys, rows.Err()
+}
+
+// revokeApiKey revokes the API key with id, reporting whether it existed and
+// was not already revoked
+func revokeApiKey(id string) (bool, error) {
+	db, err := sql.Open("sqlite3", settings.DBPath)
+	if err != nil {
+		return false, fmt.Errorf("failed to open the database: %w", err)
+	}
+	defer db.Close()
+
+	result, err := db.Exec(`UPDATE api_keys SET revoked_at = CURRENT_TIMESTAMP WHERE id = ? AND revoked_at IS NULL;`, id)
+	if err != nil {
+		return false, fmt.Errorf("failed to revoke API key: %w", err)
+	}
+	affected, err := result.RowsAffected()
+	if err != nil {
+		return false, fmt.Errorf("failed to revoke API key: %w", err)
+	}
+	return affected > 0, nil
+}
+
+// recordServerHeartbeat records that holder is serving from the database
+func recordServerHeartbeat(holder string, now time.Time) error {
+	db, err := sql.Open("sqlite3", settings.DBPath)
+	if err != nil {
+		return fmt.Errorf("failed to open the database: %w", err)
+	}
+	defer db.Close()
+
+	_, err = db.Exec(`INSERT INTO server_heartbeat (id, holder, beat_at) VALUES (1, ?, ?)
+		ON CONFLICT(id) DO UPDATE SET holder = excluded.holder, beat_at = excluded.beat_at;`, holder, now.Unix())
+	if err != nil {
+		return fmt.Errorf("failed to record heartbeat: %w", err)
+	}
+	return nil
+}
+
+// clearServerHeartbeat removes the heartbeat of holder as it stops serving
+func clearServerHeartbeat(holder string) error {
+	db, err := sql.Open("sqlite3", settings.DBPath)
+	if err != nil {
+		return fmt.Errorf("failed to open the database: %w", err)
+	}
+	defer db.Close()
+
+	if _, err := db.Exec(`DELETE FROM server_heartbeat WHERE holder = ?;`, holder); err != nil {
+		return fmt.Errorf("failed to clear heartbeat: %w", err)
+	}
+	return nil
+}
+
+// activeServer returns the server whose heartbeat is more recent than
+// serverHeartbeatTTL, if any
+func activeServer(now time.Time) (string, bool, error) {
+	db, err := sql.Open("sqlite3", settings.DBPath)
+	if err != nil {
+		return "", false, fmt.Errorf("failed to open the database: %w", err)
+	}
+	defer db.Close()
+
+	var holder string
+	var beatAt int64
+	err = db.QueryRow(`SELECT holder, beat_at FROM server_heartbeat WHERE id = 1;`).Scan(&holder, &beatAt)
+	if err == sql.ErrNoRows {
+		return "", false, nil
+	}
+	if err != nil {
+		return "", false, fmt.Errorf("failed to read heartbeat: %w", err)
+	}
+	return holder, now.Sub(time.Unix(beatAt, 0)) < serverHeartbeatTTL, nil
+}
+
+// recordRequestBlock records the block a request is executed for, and the
+// DID which submitted it
+func recordRequestBlock(ctx context.Context, requestID string, blockNo uint64, callerDid string) error {
+	return auditedUpdate(ctx, requestID, AuditBlockRecorded, gin.H{"block_no": blockNo, "caller_did": callerDid}, func(tx *sql.Tx) error {
+		if _, err := tx.Exec(`UPDATE requests SET block_no = ?, caller_did = ? WHERE request_id = ?;`, blockNo, callerDid, requestID); err != nil {
+			return fmt.Errorf("failed to update record: %w", err)
+		}
+		return nil
+	})
+}
+
+// getRequestBlock returns the block a request was last executed for, and
+// whether it is known. Requests of older versions of the server do not
+// record it.
+func getRequestBlock(requestID string) (uint64, bool, error) {
+	db, err := sql.Open("sqlite3", settings.DBPath)
+	if err != nil {
+		return 0, false, fmt.Errorf("failed to open the database: %w", err)
+	}
+	defer db.Close()
+
+	var blockNo sql.NullInt64
+	err = db.QueryRow(`SELECT block_no FROM requests WHERE request_id = ?;`, requestID).Scan(&blockNo)
+	if err == sql.ErrNoRows {
+		return 0, false, nil
+	}
+	if err != nil {
+		return 0, false, fmt.Errorf("failed to execute query: %w", err)
+	}
+	return uint64(blockNo.Int64), blockNo.Valid, nil
+}
+
+// getRequestsByCaller lists the requests submitted by did, newest first
+func getRequestsByCaller(did string) ([]RequestSummary, error) {
+	db, err := sql.Open("sqlite3", settings.DBPath)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open the database: %w", err)
+	}
+	defer db.Close()
+
+	query := `SELECT request_id, status, outcome, failure_reason FROM requests WHERE caller_did = ? ORDER BY rowid DESC;`
+	rows, err := db.Query(query, did)
+	if err != nil {
+		return nil, fmt.Errorf("failed to execute query: %w", err)
+	}
+	defer rows.Close()
+
+	requests := []RequestSummary{}
+	for rows.Next() {
+		var request RequestSummary
+		var outcome, failureReason sql.NullString
+		if err := rows.Scan(&request.RequestId, &request.Status, &outcome, &failureReason); err != nil {
+			return nil, fmt.Errorf("failed to scan request: %w", err)
+		}
+		request.Outcome = outcome.String
+		request.FailureReason = failureReason.String
+		requests = append(requests, request)
+	}
+	return requests, rows.Err()
+}
+
+// insertSession stores a login session of did by the hash of its token
+func insertSession(tokenHash string, did string, expiresAt time.Time) error {
+	db, err := sql.Open("sqlite3", settings.DBPath)
+	if err != nil {
+		return fmt.Errorf("failed to open the database: %w", err)
+	}
+	defer db.Close()
+
+	// Times are stored in UTC so that they compare as text
+	if _, err := db.Exec(`DELETE FROM sessions WHERE expires_at < ?;`, time.Now().UTC()); err != nil {
+		return fmt.Errorf("failed to delete expired sessions: %w", err)
+	}
+	if _, err := db.Exec(`INSERT INTO sessions (token_hash, did, expires_at) VALUES (?, ?, ?);`, tokenHash, did, expiresAt.UTC()); err != nil {
+		return fmt.Errorf("failed to insert session: %w", err)
+	}
+	return nil
+}
+
+// getSessionDid returns the DID of the session with tokenHash, and whether it
+// exists and has not expired
+func getSessionDid(tokenHash string) (string, bool, error) {
+	db, err := sql.Open("sqlite3", settings.DBPath)
+	if err != nil {
+		return "", false, fmt.Errorf("failed to open the database: %w", err)
+	}
+	defer db.Close()
+
+	var did string
+	err = db.QueryRow(`SELECT did FROM sessions WHERE token_hash = ? AND expires_at > ?;`, tokenHash, time.Now().UTC()).Scan(&did)
+	if err == sql.ErrNoRows {
+		return "", false, nil
+	}
+	if err != nil {
+		return "", false, fmt.Errorf("failed to execute query: %w", err)
+	}
+	return did, true, nil
+}
+
+// deleteSession ends the session with tokenHash
+func deleteSession(tokenHash string) error {
+	db, err := sql.Open("sqlite3", settings.DBPath)
+	if err != nil {
+		return fmt.Errorf("failed to open the database: %w", err)
+	}
+	defer db.Close()
+
+	if _, err := db.Exec(`DELETE FROM sessions WHERE token_hash = ?;`, tokenHash); err != nil {
+		return fmt.Errorf("failed to delete session: %w", err)
+	}
+	return nil
+}
+
+// consumeQuota counts the execution of block blockNo of contractHash, which
+// calls function, against the quota window of did. It reports whether the
+// quota allows the execution. A block already counted, in this window or an
+// earlier one, is allowed without being counted again.
+func consumeQuota(ctx context.Context, feature string, contractHash string, blockNo uint64, function string, did string, windowStart time.Time, limit int) (bool, error) {
+	defer startDBOperation(ctx, "consume_quota")()
+	db, err := sql.Open("sqlite3", settings.DBPath)
+	if err != nil {
+		return false, fmt.Errorf("failed to open the database: %w", err)
+	}
+	defer db.Close()
+
+	tx, err := db.Begin()
+	if err != nil {
+		return false, fmt.Errorf("failed to begin transaction: %w", err)
+	}
+	defer tx.Rollback()
+
+	if _, err := tx.Exec(`DELETE FROM quota_usage WHERE feature = ? AND function = ? AND did = ? AND window_start < ?;`,
+		feature, function, did, windowStart.Unix()); err != nil {
+		return false, fmt.Errorf("failed to delete old quota windows: %w", err)
+	}
+
+	var charged int
+	err = tx.QueryRow(`SELECT COUNT(*) FROM quota_charges WHERE feature = ? AND contract_hash = ? AND block_no = ?;`,
+		feature, contractHash, blockNo).Scan(&charged)
+	if err != nil {
+		return false, fmt.Errorf("failed to look up quota usage: %w", err)
+	}
+	if charged > 0 {
+		return true, nil
+	}
+
+	result, err := tx.Exec(`INSERT INTO quota_usage (feature, function, did, window_start, count) VALUES (?, ?, ?, ?, 1)
+		ON CONFLICT(feature, function, did, window_start) DO UPDATE SET count = count + 1 WHERE count < ?;`,
+		feature, function, did, windowStart.Unix(), limit)
+	if err != nil {
+		return false, fmt.Errorf("failed to count quota usage: %w", err)
+	}
+	affected, err := result.RowsAffected()
+	if err != nil {
+		return false, fmt.Errorf("failed to count quota usage: %w", err)
+	}
+	if affected == 0 {
+		return false, nil
+	}
+	if _, err := tx.Exec(`INSERT INTO quota_charges (feature, contract_hash, block_no, function, did, window_start) VALUES (?, ?, ?, ?, ?, ?);`,
+		feature, contractHash, blockNo, function, did, windowStart.Unix()); err != nil {
+		return false, fmt.Errorf("failed to count quota usage: %w", err)
+	}
+	if err := tx.Commit(); err != nil {
+		return false, fmt.Errorf("failed to commit quota usage: %w", err)
+	}
+	return true, nil
+}
+
+// upsertCallbackRegistration records the callback url registered for a
+// contract, replacing the previous registration
+func upsertCallbackRegistration(registration *CallbackRegistration) error {
+	db, err := sql.Open("sqlite3", settings.DBPath)
+	if err != nil {
+		return fmt.Errorf("failed to open the database: %w", err)
+	}
+	defer db.Close()
+
+	upsertQuery := `INSERT INTO callback_registrations (feature, contract_hash, callback_url, registered_at) VALUES (?, ?, ?, ?)
+	ON CONFLICT(feature) DO UPDATE SET contract_hash = excluded.contract_hash, callback_url = excluded.callback_url, registered_at = excluded.registered_at;`
+	if _, err := db.Exec(upsertQuery, registration.Feature, registration.ContractHash, registration.CallbackURL, registration.RegisteredAt); err != nil {
+		return fmt.Errorf("failed to record callback registration: %w", err)
+	}
+	return nil
+}
+
+// getCallbackRegistration returns the callback url registered for feature
+func getCallbackRegistration(feature string) (*CallbackRegistration, bool, error) {
+	db, err := sql.Open("sqlite3", settings.DBPath)
+	if err != nil {
+		return nil, false, fmt.Errorf("failed to open the database: %w", err)
+	}
+	defer db.Close()
+
+	registration := CallbackRegistration{Feature: feature}
+	query := `SELECT contract_hash, callback_url, registered_at FROM callback_registrations WHERE feature = ?;`
+	err = db.QueryRow(query, feature).Scan(&registration.ContractHash, &registration.CallbackURL, &registration.RegisteredAt)
+	if err == sql.ErrNoRows {
+		return nil, false, nil
+	}
+	if err != nil {
+		return nil, false, fmt.Errorf("failed to execute query: %w", err)
+	}
+	return &registration, true, nil
+}
+
+// RequestDetail is a request with everything recorded against it, as shown
+// to operators
+type RequestDetail struct {
+	RequestId          string          `json:"request_id"`
+	Status             int             `json:"status"`
+	Outcome            string          `json:"outcome,omitempty"`
+	FailureReason      string          `json:"failure_reason,omitempty"`
+	FailureDetail      string          `json:"failure_detail,omitempty"`
+	ValidationErrors   json.RawMessage `json:"validation_errors,omitempty"`
+	CallerDid          string          `json:"caller_did,omitempty"`
+	ExecutionStartedAt string          `json:"execution_started_at,omitempty"`
+	BlockNo            *uint64         `json:"block_no,omitempty"`
+	Audit              []AuditEntry    `json:"audit,omitempty"`
+}
+
+const requestDetailColumns = `request_id, status, outcome, failure_reason, failure_detail, validation_errors, caller_did, execution_started_at, block_no`
+
+func scanRequestDetail(row interface{ Scan(...interface{}) error }) (RequestDetail, error) {
+	var request RequestDetail
+	var outcome, failureReason, failureDetail, validationErrors, callerDid, executionStartedAt sql.NullString
+	var blockNo sql.NullInt64
+	err := row.Scan(&request.RequestId, &request.Status, &outcome, &failureReason, &failureDetail, &validationErrors, &callerDid, &executionStartedAt, &blockNo)
+	if err != nil {
+		return request, err
+	}
+	request.Outcome = outcome.String
+	request.FailureReason = failureReason.String
+	request.FailureDetail = failureDetail.String
+	if validationErrors.String != "" && json.Valid([]byte(validationErrors.String)) {
+		request.ValidationErrors = json.RawMessage(validationErrors.String)
+	}
+	request.CallerDid = callerDid.String
+	request.ExecutionStartedAt = executionStartedAt.String
+	if blockNo.Valid {
+		block := uint64(blockNo.Int64)
+		request.BlockNo = &block
+	}
+	return request, nil
+}
+
+// listRequestDetails lists the requests, newest first, with status when it
+// is not nil and submitted by callerDid when it is not empty
+func listRequestDetails(status *int, callerDid string) ([]RequestDetail, error) {
+	db, err := sql.Open("sqlite3", settings.DBPath)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open the database: %w", err)
+	}
+	defer db.Close()
+
+	query := `SELECT ` + requestDetailColumns + ` FROM requests WHERE 1 = 1`
+	var args []interface{}
+	if status != nil {
+		query += ` AND status = ?`
+		args = append(args, *status)
+	}
+	if callerDid != "" {
+		query += ` AND caller_did = ?`
+		args = append(args, callerDid)
+	}
+	rows, err := db.Query(query+` ORDER BY rowid DESC;`, args...)
+	if err != nil {
+		return nil, fmt.Errorf("failed to execute query: %w", err)
+	}
+	defer rows.Close()
+
+	requests := []RequestDetail{}
+	for rows.Next() {
+		request, err := scanRequestDetail(rows)
+		if err != nil {
+			return nil, fmt.Errorf("failed to scan request: %w", err)
+		}
+		requests = append(requests, request)
+	}
+	return requests, rows.Err()
+}
+
+// getRequestDetail returns a request along with its audit entries, and
+// whether it exists
+func getRequestDetail(requestID string) (*RequestDetail, bool, error) {
+	db, err := sql.Open("sqlite3", settings.DBPath)
+	if err != nil {
+		return nil, false, fmt.Errorf("failed to open the database: %w", err)
+	}
+	defer db.Close()
+
+	request, err := scanRequestDetail(db.QueryRow(`SELECT `+requestDetailColumns+` FROM requests WHERE request_id = ?;`, requestID))
+	if err == sql.ErrNoRows {
+		return nil, false, nil
+	}
+	if err != nil {
+		return nil, false, fmt.Errorf("failed to execute query: %w", err)
+	}
+	request.Audit, err = getAuditEntries(db, requestID)
+	if err != nil {
+		return nil, false, err
+	}
+	return &request, true, nil
+}
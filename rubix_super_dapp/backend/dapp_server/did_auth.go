@@ -0,0 +1,469 @@
+package main
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// challengeTTL is how long a login challenge can be answered
+const challengeTTL = 5 * time.Minute
+
+// maxChallenges bounds the unanswered login challenges kept in memory
+const maxChallenges = 10000
+
+// challengeSweepInterval is how often expired challenges are removed
+const challengeSweepInterval = time.Minute
+
+// challengeRateLimit limits the challenges requested by a client address,
+// whether or not rate_limits are configured
+var challengeRateLimit = &RateLimit{RatePerMinute: 10, Burst: 5}
+
+// defaultSessionTTL is the lifetime of a session when did_auth does not set
+// session_ttl_minutes
+const defaultSessionTTL = 24 * time.Hour
+
+// sessionDidKey is the gin context key of the DID of the session
+const sessionDidKey = "session_did"
+
+// The signatures of login challenges are verified locally, as the non quorum
+// node has no endpoint to verify a signature with. The verifiers differ in
+// where the public key of a DID comes from.
+const (
+	// VerifierKeys only accepts the DIDs of public_keys
+	VerifierKeys = "keys"
+	// VerifierDocument fetches the public key of a DID from the DID
+	// document at key_url, usually through the IPFS gateway of the node
+	VerifierDocument = "document"
+)
+
+// maxPublicKeySize bounds the public key fetched from a DID document
+const maxPublicKeySize = 64 << 10
+
+// DidAuthConfig configures DID login
+type DidAuthConfig struct {
+	// Verifier checks the signatures of login challenges, "keys" verifies
+	// them against PublicKeys and "document" against the key at KeyURL
+	Verifier string `json:"verifier"`
+	// PublicKeys maps DIDs to their PEM encoded Ed25519 or ECDSA public
+	// key, given inline or as the path of a PEM file. They take precedence
+	// over the DID documents.
+	PublicKeys map[string]string `json:"public_keys,omitempty"`
+	// KeyURL is the URL of the PEM encoded public key of a DID, in which
+	// {did} is replaced by the DID
+	KeyURL            string `json:"key_url,omitempty"`
+	SessionTTLMinutes int    `json:"session_ttl_minutes,omitempty"`
+}
+
+func (a *DidAuthConfig) sessionTTL() time.Duration {
+	if a == nil || a.SessionTTLMinutes <= 0 {
+		return defaultSessionTTL
+	}
+	return time.Duration(a.SessionTTLMinutes) * time.Minute
+}
+
+// validate checks the verifier and the public keys
+func (a *DidAuthConfig) validate() error {
+	switch a.Verifier {
+	case VerifierKeys:
+		if a.KeyURL != "" {
+			return fmt.Errorf("key_url is only used by the %s verifier", VerifierDocument)
+		}
+	case VerifierDocument:
+		if !strings.Contains(a.KeyURL, "{did}") {
+			return errors.New("key_url must contain {did}")
+		}
+		if parsed, err := url.Parse(a.KeyURL); err != nil || (parsed.Scheme != "http" && parsed.Scheme != "https") {
+			return errors.New("key_url must be an http or https URL")
+		}
+	default:
+		return fmt.Errorf("verifier must be %s or %s, the node cannot verify signatures", VerifierKeys, VerifierDocument)
+	}
+	for did := range a.PublicKeys {
+		if _, err := a.publicKey(context.Background(), did); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// publicKey returns the public key of did, registered in PublicKeys or, with
+// the document verifier, fetched from its DID document
+func (a *DidAuthConfig) publicKey(ctx context.Context, did string) (interface{}, error) {
+	value, ok := a.PublicKeys[did]
+	if !ok {
+		if a.Verifier != VerifierDocument {
+			return nil, fmt.Errorf("no public key registered for %s", did)
+		}
+		encoded, err := a.fetchPublicKey(ctx, did)
+		if err != nil {
+			return nil, err
+		}
+		return parsePublicKey(did, encoded)
+	}
+	encoded := []byte(value)
+	if !strings.HasPrefix(strings.TrimSpace(value), "-----BEGIN") {
+		content, err := os.ReadFile(value)
+		if err != nil {
+			return nil, fmt.Errorf("public key of %s: %w", did, err)
+		}
+		encoded = content
+	}
+	return parsePublicKey(did, encoded)
+}
+
+// fetchPublicKey downloads the PEM encoded public key of did from key_url,
+// with the client used for the node
+func (a *DidAuthConfig) fetchPublicKey(ctx context.Context, did string) ([]byte, error) {
+	keyURL := strings.ReplaceAll(a.KeyURL, "{did}", url.PathEscape(did))
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, keyURL, nil)
+	if err != nil {
+		return nil, fmt.Errorf("public key of %s: %w", did, err)
+	}
+	resp, err := nodeHTTPClient().Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("failed to fetch the public key of %s: %w", did, err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("failed to fetch the public key of %s: %s", did, resp.Status)
+	}
+	encoded, err := io.ReadAll(io.LimitReader(resp.Body, maxPublicKeySize))
+	if err != nil {
+		return nil, fmt.Errorf("failed to fetch the public key of %s: %w", did, err)
+	}
+	return encoded, nil
+}
+
+// parsePublicKey parses the PEM encoded public key of did
+func parsePublicKey(did string, encoded []byte) (interface{}, error) {
+	block, _ := pem.Decode(encoded)
+	if block == nil {
+		return nil, fmt.Errorf("public key of %s is not PEM encoded", did)
+	}
+	key, err := x509.ParsePKIXPublicKey(block.Bytes)
+	if err != nil {
+		return nil, fmt.Errorf("public key of %s: %w", did, err)
+	}
+	return key, nil
+}
+
+// verify checks that signature is the signature of message by did
+func (a *DidAuthConfig) verify(ctx context.Context, did string, message string, signature []byte) error {
+	key, err := a.publicKey(ctx, did)
+	if err != nil {
+		return err
+	}
+	switch key := key.(type) {
+	case ed25519.PublicKey:
+		if ed25519.Verify(key, []byte(message), signature) {
+			return nil
+		}
+	case *ecdsa.PublicKey:
+		digest := sha256.Sum256([]byte(message))
+		if ecdsa.VerifyASN1(key, digest[:], signature) {
+			return nil
+		}
+	default:
+		return fmt.Errorf("unsupported public key type %T", key)
+	}
+	return errors.New("invalid signature")
+}
+
+// loginChallenge is a nonce issued to a DID, which it signs to log in
+type loginChallenge struct {
+	did       string
+	expiresAt time.Time
+}
+
+// challenges holds the unanswered login challenges by nonce. They only need
+// to survive until the client signs them, so they are kept in memory.
+var challenges = struct {
+	sync.Mutex
+	byNonce map[string]loginChallenge
+}{byNonce: make(map[string]loginChallenge)}
+
+// challengeMessage is the text the client signs with its DID key
+func challengeMessage(did string, nonce string) string {
+	return fmt.Sprintf("Sign in to the Rubix dapp server\nDID: %s\nNonce: %s", did, nonce)
+}
+
+// addChallenge stores a challenge, failing when too many are unanswered
+func addChallenge(nonce string, challenge loginChallenge) bool {
+	challenges.Lock()
+	defer challenges.Unlock()
+	if len(challenges.byNonce) >= maxChallenges {
+		removeExpiredChallenges(time.Now())
+		if len(challenges.byNonce) >= maxChallenges {
+			return false
+		}
+	}
+	challenges.byNonce[nonce] = challenge
+	return true
+}
+
+// takeChallenge removes and returns the challenge of nonce, if it is still
+// valid
+func takeChallenge(nonce string) (loginChallenge, bool) {
+	challenges.Lock()
+	defer challenges.Unlock()
+	challenge, ok := challenges.byNonce[nonce]
+	delete(challenges.byNonce, nonce)
+	if !ok || time.Now().After(challenge.expiresAt) {
+		return loginChallenge{}, false
+	}
+	return challenge, true
+}
+
+// removeExpiredChallenges drops the challenges expired at now. The caller
+// holds the lock of challenges.
+func removeExpiredChallenges(now time.Time) {
+	for nonce, challenge := range challenges.byNonce {
+		if now.After(challenge.expiresAt) {
+			delete(challenges.byNonce, nonce)
+		}
+	}
+}
+
+// sweepChallenges periodically removes the expired challenges until ctx is
+// done
+func sweepChallenges(ctx context.Context) {
+	ticker := time.NewTicker(challengeSweepInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case now := <-ticker.C:
+			challenges.Lock()
+			removeExpiredChallenges(now)
+			challenges.Unlock()
+		}
+	}
+}
+
+func randomHex(size int) (string, error) {
+	random := make([]byte, size)
+	if _, err := rand.Read(random); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(random), nil
+}
+
+// decodeSignature accepts hex or base64 encoded signatures
+func decodeSignature(signature string) ([]byte, error) {
+	if decoded, err := hex.DecodeString(signature); err == nil {
+		return decoded, nil
+	}
+	return base64.StdEncoding.DecodeString(signature)
+}
+
+// registerDidAuthRoutes mounts the login flow and the endpoints of the
+// logged in DID
+func registerDidAuthRoutes(router *gin.Engine) {
+	router.POST("/auth/challenge", rateLimitChallenges, createChallengeHandler)
+	router.POST("/auth/login", loginHandler)
+	router.POST("/auth/logout", requireSession, logoutHandler)
+	router.GET("/me/requests", requireSession, rateLimitByClient, getMyRequestsHandler)
+	router.GET("/me/nfts", requireSession, rateLimitByClient, getMyNftsHandler)
+}
+
+// requireDidAuth answers with 404 when DID login is not configured
+func requireDidAuth(c *gin.Context) (*DidAuthConfig, Config, bool) {
+	config := GetConfig()
+	if config.DidAuth == nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "DID login is not enabled"})
+		return nil, config, false
+	}
+	return config.DidAuth, config, true
+}
+
+// rateLimitChallenges limits the login challenges requested by every client
+// address
+func rateLimitChallenges(c *gin.Context) {
+	if ok, wait := limiter.allow("challenge:"+c.RemoteIP(), challengeRateLimit, time.Now()); !ok {
+		respondRateLimited(c, "too many login challenges from this address", wait)
+		return
+	}
+	c.Next()
+}
+
+// Handler function for POST /auth/challenge
+func createChallengeHandler(c *gin.Context) {
+	if _, _, ok := requireDidAuth(c); !ok {
+		return
+	}
+	var req struct {
+		Did string `json:"did"`
+	}
+	if err := c.ShouldBindJSON(&req); err != nil || req.Did == "" {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "did is required"})
+		return
+	}
+
+	nonce, err := randomHex(16)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to create challenge"})
+		return
+	}
+	expiresAt := time.Now().Add(challengeTTL)
+	if !addChallenge(nonce, loginChallenge{did: req.Did, expiresAt: expiresAt}) {
+		c.JSON(http.StatusServiceUnavailable, gin.H{"error": "too many pending login challenges, try again later"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"nonce":      nonce,
+		"message":    challengeMessage(req.Did, nonce),
+		"expires_at": expiresAt,
+	})
+}
+
+// Handler function for POST /auth/login
+//
+// The body is {"did", "nonce", "signature"}, with the signature of the
+// challenge message hex or base64 encoded.
+func loginHandler(c *gin.Context) {
+	didAuth, _, ok := requireDidAuth(c)
+	if !ok {
+		return
+	}
+	var req struct {
+		Did       string `json:"did"`
+		Nonce     string `json:"nonce"`
+		Signature string `json:"signature"`
+	}
+	if err := c.ShouldBindJSON(&req); err != nil || req.Did == "" || req.Nonce == "" || req.Signature == "" {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "did, nonce and signature are required"})
+		return
+	}
+
+	challenge, ok := takeChallenge(req.Nonce)
+	if !ok || challenge.did != req.Did {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "unknown or expired challenge"})
+		return
+	}
+	signature, err := decodeSignature(req.Signature)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "signature must be hex or base64 encoded"})
+		return
+	}
+	if err := didAuth.verify(c.Request.Context(), req.Did, challengeMessage(req.Did, req.Nonce), signature); err != nil {
+		loggerFrom(c.Request.Context()).Warn("Login rejected", "did", req.Did, "error", err)
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "signature verification failed"})
+		return
+	}
+
+	token, err := randomHex(32)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to create session"})
+		return
+	}
+	token = "dapp_session_" + token
+	expiresAt := time.Now().Add(didAuth.sessionTTL())
+	if err := insertSession(hashApiKey(token), req.Did, expiresAt); err != nil {
+		loggerFrom(c.Request.Context()).Error("Error creating session", "did", req.Did, "error", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to create session"})
+		return
+	}
+	loggerFrom(c.Request.Context()).Info("DID logged in", "did", req.Did)
+	c.JSON(http.StatusOK, gin.H{"token": token, "did": req.Did, "expires_at": expiresAt})
+}
+
+// requireSession only lets requests through with a valid session token as
+// bearer token, and stores its DID in the context
+func requireSession(c *gin.Context) {
+	token := bearerToken(c)
+	if token == "" {
+		c.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{"error": "a session token is required"})
+		return
+	}
+	did, ok, err := getSessionDid(hashApiKey(token))
+	if err != nil {
+		loggerFrom(c.Request.Context()).Error("Error looking up session", "error", err)
+		c.AbortWithStatusJSON(http.StatusInternalServerError, gin.H{"error": "failed to check session"})
+		return
+	}
+	if !ok {
+		c.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{"error": "invalid or expired session"})
+		return
+	}
+	c.Set(sessionDidKey, did)
+	c.Next()
+}
+
+// Handler function for POST /auth/logout
+func logoutHandler(c *gin.Context) {
+	if err := deleteSession(hashApiKey(bearerToken(c))); err != nil {
+		loggerFrom(c.Request.Context()).Error("Error deleting session", "error", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to log out"})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"message": "logged out"})
+}
+
+// Handler function for GET /me/requests
+func getMyRequestsHandler(c *gin.Context) {
+	requests, err := getRequestsByCaller(c.GetString(sessionDidKey))
+	if err != nil {
+		loggerFrom(c.Request.Context()).Error("Error listing requests", "did", c.GetString(sessionDidKey), "error", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to list requests"})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"requests": requests})
+}
+
+// Handler function for GET /me/nfts
+//
+// The NFTs are listed by the non quorum node and filtered by owner.
+func getMyNftsHandler(c *gin.Context) {
+	did := c.GetString(sessionDidKey)
+	config := GetConfig()
+	req, err := http.NewRequestWithContext(c.Request.Context(), http.MethodGet, config.NodeAddress+"/api/list-nfts", nil)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "invalid node address"})
+		return
+	}
+	resp, err := nodeHTTPClient().Do(req)
+	if err != nil {
+		loggerFrom(c.Request.Context()).Error("Error listing NFTs", "did", did, "error", err)
+		c.JSON(http.StatusBadGateway, gin.H{"error": "failed to reach node"})
+		return
+	}
+	defer resp.Body.Close()
+
+	var reply struct {
+		BasicResponse
+		Nfts []map[string]interface{} `json:"nfts"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&reply); err != nil {
+		c.JSON(http.StatusBadGateway, gin.H{"error": "unexpected node response"})
+		return
+	}
+
+	nfts := []map[string]interface{}{}
+	for _, nft := range reply.Nfts {
+		if owner, _ := nft["owner_did"].(string); owner == did {
+			nfts = append(nfts, nft)
+		}
+	}
+	c.JSON(http.StatusOK, gin.H{"did": did, "nfts": nfts})
+}
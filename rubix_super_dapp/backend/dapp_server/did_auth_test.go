@@ -0,0 +1,97 @@
+package main
+
+import (
+	"context"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/x509"
+	"encoding/pem"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+// testDidKey returns a new Ed25519 key and its PEM encoded public key
+func testDidKey(t *testing.T) (ed25519.PrivateKey, string) {
+	t.Helper()
+	public, private, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	der, err := x509.MarshalPKIXPublicKey(public)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return private, string(pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: der}))
+}
+
+func TestDidAuthValidate(t *testing.T) {
+	_, publicPEM := testDidKey(t)
+	tests := []struct {
+		name   string
+		config DidAuthConfig
+		valid  bool
+	}{
+		{"keys", DidAuthConfig{Verifier: VerifierKeys, PublicKeys: map[string]string{"did-a": publicPEM}}, true},
+		{"keys with key_url", DidAuthConfig{Verifier: VerifierKeys, KeyURL: "http://localhost:8080/ipfs/{did}/pubKey.pem"}, false},
+		{"invalid public key", DidAuthConfig{Verifier: VerifierKeys, PublicKeys: map[string]string{"did-a": "-----BEGIN PUBLIC KEY-----\n-----END PUBLIC KEY-----\n"}}, false},
+		{"document", DidAuthConfig{Verifier: VerifierDocument, KeyURL: "http://localhost:8080/ipfs/{did}/pubKey.pem"}, true},
+		{"document without {did}", DidAuthConfig{Verifier: VerifierDocument, KeyURL: "http://localhost:8080/ipfs/pubKey.pem"}, false},
+		{"document without scheme", DidAuthConfig{Verifier: VerifierDocument, KeyURL: "localhost:8080/ipfs/{did}/pubKey.pem"}, false},
+		{"node verifier", DidAuthConfig{Verifier: "node"}, false},
+	}
+	for _, test := range tests {
+		if err := test.config.validate(); (err == nil) != test.valid {
+			t.Errorf("%s: validate() = %v, want valid %v", test.name, err, test.valid)
+		}
+	}
+}
+
+func TestDidAuthVerify(t *testing.T) {
+	currentConfig.Store(&Config{})
+	registered, registeredPEM := testDidKey(t)
+	published, publishedPEM := testDidKey(t)
+	other, _ := testDidKey(t)
+
+	documents := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/ipfs/did-published/pubKey.pem" {
+			http.NotFound(w, r)
+			return
+		}
+		w.Write([]byte(publishedPEM))
+	}))
+	defer documents.Close()
+
+	keys := &DidAuthConfig{Verifier: VerifierKeys, PublicKeys: map[string]string{"did-registered": registeredPEM}}
+	document := &DidAuthConfig{
+		Verifier:   VerifierDocument,
+		PublicKeys: map[string]string{"did-registered": registeredPEM},
+		KeyURL:     documents.URL + "/ipfs/{did}/pubKey.pem",
+	}
+	tests := []struct {
+		name   string
+		config *DidAuthConfig
+		did    string
+		key    ed25519.PrivateKey
+		err    string
+	}{
+		{"registered key", keys, "did-registered", registered, ""},
+		{"wrong key", keys, "did-registered", other, "invalid signature"},
+		{"unregistered DID", keys, "did-published", published, "no public key registered"},
+		{"document of a registered DID", document, "did-registered", registered, ""},
+		{"published key", document, "did-published", published, ""},
+		{"wrong key for the document", document, "did-published", other, "invalid signature"},
+		{"DID without document", document, "did-missing", other, "404 Not Found"},
+	}
+	for _, test := range tests {
+		message := challengeMessage(test.did, "nonce")
+		err := test.config.verify(context.Background(), test.did, message, ed25519.Sign(test.key, []byte(message)))
+		switch {
+		case test.err == "" && err != nil:
+			t.Errorf("%s: verify() = %v, want success", test.name, err)
+		case test.err != "" && (err == nil || !strings.Contains(err.Error(), test.err)):
+			t.Errorf("%s: verify() = %v, want an error containing %q", test.name, err, test.err)
+		}
+	}
+}
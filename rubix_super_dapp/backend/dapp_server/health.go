@@ -0,0 +1,277 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// Status of a readiness check
+const (
+	CheckOk   = "ok"
+	CheckWarn = "warn" // reported, but the server is still ready
+	CheckFail = "fail"
+)
+
+// nodeCheckTimeout bounds the call made to check that a node is reachable
+const nodeCheckTimeout = 5 * time.Second
+
+// HealthCheck is the result of checking one dependency of the server
+type HealthCheck struct {
+	Name       string  `json:"name"`
+	Status     string  `json:"status"`
+	Message    string  `json:"message,omitempty"`
+	DurationMs float64 `json:"duration_ms"`
+}
+
+// Handler function for GET /healthz
+//
+// The server is alive as long as it answers, dependencies are only checked
+// by /readyz.
+func healthzHandler(c *gin.Context) {
+	c.JSON(http.StatusOK, gin.H{"status": "ok"})
+}
+
+// Handler function for GET /readyz
+//
+// Every dependency is checked. The server is ready, and 200 is returned, when
+// none of the checks failed. The checks name nodes, callback urls and
+// artifacts, so they are only listed for an API key with the read-status
+// scope.
+func readyzHandler(c *gin.Context) {
+	checks := runReadinessChecks(c.Request.Context(), GetConfig())
+	status, ready := http.StatusOK, "ready"
+	for _, check := range checks {
+		if check.Status == CheckFail {
+			status, ready = http.StatusServiceUnavailable, "not_ready"
+			break
+		}
+	}
+	if !grantsScope(c, ScopeReadStatus) {
+		c.JSON(status, gin.H{"status": ready})
+		return
+	}
+	c.JSON(status, gin.H{"status": ready, "checks": checks})
+}
+
+// runReadinessChecks checks the database, every node the contracts run
+// against, the wasm artifacts and the callback registration of every enabled
+// contract
+func runReadinessChecks(ctx context.Context, config Config) []HealthCheck {
+	checks := map[string]func() (string, string){
+		"database": checkDatabase,
+	}
+	nodes := map[string]bool{config.NodeAddress: true}
+	for feature, contractInfo := range config.ContractsInfo {
+		if contractInfo == nil || contractInfo.Disabled {
+			continue
+		}
+		nodes[contractInfo.nodeAddress(config)] = true
+		checks["artifact:"+feature] = func() (string, string) {
+			return checkArtifacts(contractInfo)
+		}
+		checks["callback:"+feature] = func() (string, string) {
+			return checkCallbackRegistration(config, feature, contractInfo)
+		}
+	}
+	for address := range nodes {
+		checks["node:"+address] = func() (string, string) {
+			return checkNode(ctx, address)
+		}
+	}
+
+	var mu sync.Mutex
+	var wg sync.WaitGroup
+	results := make([]HealthCheck, 0, len(checks))
+	for name, check := range checks {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			start := time.Now()
+			status, message := check()
+			mu.Lock()
+			defer mu.Unlock()
+			results = append(results, HealthCheck{
+				Name:       name,
+				Status:     status,
+				Message:    message,
+				DurationMs: float64(time.Since(start).Microseconds()) / 1000,
+			})
+		}()
+	}
+	wg.Wait()
+	sort.Slice(results, func(i, j int) bool { return results[i].Name < results[j].Name })
+	return results
+}
+
+func checkDatabase() (string, string) {
+	db, err := sql.Open("sqlite3", settings.DBPath)
+	if err != nil {
+		return CheckFail, fmt.Sprintf("failed to open the database: %v", err)
+	}
+	defer db.Close()
+	var count int
+	if err := db.QueryRow(`SELECT COUNT(1) FROM requests;`).Scan(&count); err != nil {
+		return CheckFail, fmt.Sprintf("failed to query the database: %v", err)
+	}
+	return CheckOk, ""
+}
+
+// checkNode calls an inexpensive API of the node
+func checkNode(ctx context.Context, address string) (string, string) {
+	ctx, cancel := context.WithTimeout(ctx, nodeCheckTimeout)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, address+"/api/getalldid", nil)
+	if err != nil {
+		return CheckFail, err.Error()
+	}
+	resp, err := nodeHTTPClient().Do(req)
+	if err != nil {
+		return CheckFail, fmt.Sprintf("node unreachable: %v", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode >= http.StatusInternalServerError {
+		return CheckFail, fmt.Sprintf("node returned %s", resp.Status)
+	}
+	return CheckOk, ""
+}
+
+// artifactCheck is the result of verifying an artifact, valid as long as the
+// file keeps its size and modification time
+type artifactCheck struct {
+	size    int64
+	modTime time.Time
+	err     error
+}
+
+// artifactChecks caches the artifact verifications of the readiness checks
+// by path and expected hash, so that probes do not hash every artifact
+var artifactChecks sync.Map
+
+// checkArtifacts checks that every wasm artifact of the contract exists and
+// matches its artifact_hash
+func checkArtifacts(contractInfo *ContractInfo) (string, string) {
+	versions := contractInfo.Versions
+	if len(versions) == 0 {
+		versions = []*ContractVersion{{ContractPath: contractInfo.ContractPath, ArtifactHash: contractInfo.ArtifactHash}}
+	}
+	for _, version := range versions {
+		info, err := os.Stat(version.ContractPath)
+		if err != nil {
+			return CheckFail, fmt.Sprintf("wasm artifact missing: %v", err)
+		}
+		key := version.ContractPath + "|" + version.ArtifactHash
+		cached, ok := artifactChecks.Load(key)
+		check, _ := cached.(artifactCheck)
+		if !ok || check.size != info.Size() || !check.modTime.Equal(info.ModTime()) {
+			check = artifactCheck{size: info.Size(), modTime: info.ModTime(), err: version.verifyArtifact()}
+			artifactChecks.Store(key, check)
+		}
+		if check.err != nil {
+			return CheckFail, check.err.Error()
+		}
+	}
+	return CheckOk, ""
+}
+
+// checkCallbackRegistration compares the callback registration recorded for
+// the contract with its current configuration. Callbacks registered without
+// the dapp server, e.g. by the deployment scripts, are not known to it, so
+// a missing registration is only a warning.
+func checkCallbackRegistration(config Config, feature string, contractInfo *ContractInfo) (string, string) {
+	registration, found, err := getCallbackRegistration(feature)
+	if err != nil {
+		return CheckFail, err.Error()
+	}
+	if !found {
+		return CheckWarn, "no callback registration recorded"
+	}
+	callbackURL := publicCallbackURL(config, contractInfo)
+	if registration.ContractHash != contractInfo.ContractHash || registration.CallbackURL != callbackURL {
+		return CheckWarn, fmt.Sprintf("registered %s for %s, configured %s for %s", registration.CallbackURL, registration.ContractHash, callbackURL, contractInfo.ContractHash)
+	}
+	return CheckOk, fmt.Sprintf("registered at %s", registration.RegisteredAt)
+}
+
+// CallbackRegistration is a callback url registered with the node by the
+// dapp server
+type CallbackRegistration struct {
+	Feature      string `json:"feature"`
+	ContractHash string `json:"contract_hash"`
+	CallbackURL  string `json:"callback_url"`
+	RegisteredAt string `json:"registered_at"`
+}
+
+// publicCallbackURL is the url the node calls for the callbacks of the
+// contract
+func publicCallbackURL(config Config, contractInfo *ContractInfo) string {
+	base := config.PublicURL
+	if base == "" {
+		scheme := "http"
+		if config.TLS != nil {
+			scheme = "https"
+		}
+		base = fmt.Sprintf("%s://localhost:%d", scheme, settings.Port)
+	}
+	return strings.TrimRight(base, "/") + contractInfo.CallBackUrl
+}
+
+// registerCallback registers the callback url of the contract of feature
+// with the node it runs against, and records the registration
+func registerCallback(config Config, feature string) (*CallbackRegistration, error) {
+	contractInfo, ok := config.ContractsInfo[feature]
+	if !ok || contractInfo == nil {
+		return nil, fmt.Errorf("unknown contract %s", feature)
+	}
+	if contractInfo.ContractHash == "" {
+		return nil, fmt.Errorf("contract %s has no contract_hash", feature)
+	}
+
+	registration := &CallbackRegistration{
+		Feature:      feature,
+		ContractHash: contractInfo.ContractHash,
+		CallbackURL:  publicCallbackURL(config, contractInfo),
+		RegisteredAt: time.Now().UTC().Format(time.DateTime),
+	}
+	body := map[string]string{
+		"SmartContractToken": registration.ContractHash,
+		"CallBackURL":        registration.CallbackURL,
+	}
+	var reply BasicResponse
+	if err := postNodeJSON(contractInfo.nodeAddress(config)+"/api/register-callback-url", body, &reply); err != nil {
+		return nil, err
+	}
+	if !reply.Status {
+		return nil, fmt.Errorf("node rejected the callback url: %s", reply.Message)
+	}
+	if err := upsertCallbackRegistration(registration); err != nil {
+		return nil, err
+	}
+	slog.Info("Registered callback url", "contract", feature, "contract_hash", registration.ContractHash, "callback_url", registration.CallbackURL)
+	return registration, nil
+}
+
+// Handler function for POST /admin/contracts/:contract/register-callback
+func registerCallbackHandler(c *gin.Context) {
+	feature := c.Param("contract")
+	config := GetConfig()
+	if contractInfo, ok := config.ContractsInfo[feature]; !ok || contractInfo == nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": fmt.Sprintf("unknown contract %s", feature)})
+		return
+	}
+	registration, err := registerCallback(config, feature)
+	if err != nil {
+		c.JSON(http.StatusBadGateway, gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, registration)
+}
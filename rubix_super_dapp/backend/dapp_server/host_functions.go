@@ -0,0 +1,212 @@
+package main
+
+import (
+	"context"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"sort"
+	"sync"
+
+	"github.com/bytecodealliance/wasmtime-go"
+	wasmbridge "github.com/rubixchain/rubix-wasm/go-wasm-bridge"
+)
+
+// allContracts registers a host function for every contract in contracts_info
+const allContracts = "*"
+
+// Return codes of a dapp host function, as seen by the contract
+const (
+	hostCallOk    = 0
+	hostCallError = 1
+)
+
+// HostCallContext describes the execution a host function is being called from
+type HostCallContext struct {
+	// Context carries the logger of the request
+	Context      context.Context
+	Feature      string
+	Contract     *ContractInfo
+	ContractHash string
+	RequestId    string
+	Config       Config
+	State        *contractState
+	Trace        *ExecutionTrace
+	// Simulation is set when the execution is a dry run
+	Simulation *simulationRecorder
+}
+
+// logger returns the logger of the execution
+func (c *HostCallContext) logger() *slog.Logger {
+	return loggerFrom(c.Context)
+}
+
+// HostFunctionHandler receives the raw JSON arguments passed by the contract
+// and returns a value which is JSON encoded back to it
+type HostFunctionHandler func(ctx *HostCallContext, args json.RawMessage) (interface{}, error)
+
+var (
+	hostFunctions     = make(map[string]map[string]HostFunctionHandler) // map[feature]map[name]handler
+	hostFunctionsLock = sync.RWMutex{}
+)
+
+// RegisterHostFunction makes fn callable from the contracts of feature under
+// name. The contract passes its arguments as a JSON document which is decoded
+// into T, and the returned R is JSON encoded as the response.
+func RegisterHostFunction[T any, R any](feature string, name string, fn func(ctx *HostCallContext, args T) (R, error)) {
+	handler := func(ctx *HostCallContext, rawArgs json.RawMessage) (interface{}, error) {
+		var args T
+		if len(rawArgs) > 0 {
+			if err := json.Unmarshal(rawArgs, &args); err != nil {
+				return nil, fmt.Errorf("invalid arguments for %s: %w", name, err)
+			}
+		}
+		return fn(ctx, args)
+	}
+
+	hostFunctionsLock.Lock()
+	defer hostFunctionsLock.Unlock()
+	if hostFunctions[feature] == nil {
+		hostFunctions[feature] = make(map[string]HostFunctionHandler)
+	}
+	hostFunctions[feature][name] = handler
+}
+
+// hostFunctionNames lists the host functions available to the contracts of
+// feature, including the ones registered for every contract
+func hostFunctionNames(feature string) []string {
+	hostFunctionsLock.RLock()
+	defer hostFunctionsLock.RUnlock()
+
+	var names []string
+	for name := range hostFunctions[allContracts] {
+		if _, overridden := hostFunctions[feature][name]; !overridden {
+			names = append(names, name)
+		}
+	}
+	for name := range hostFunctions[feature] {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+func lookupHostFunction(feature string, name string) (HostFunctionHandler, bool) {
+	hostFunctionsLock.RLock()
+	defer hostFunctionsLock.RUnlock()
+
+	if handler, ok := hostFunctions[feature][name]; ok {
+		return handler, true
+	}
+	handler, ok := hostFunctions[allContracts][name]
+	return handler, ok
+}
+
+// newHostFunctionRegistry returns the bridge registry for a single execution,
+// with the built-in Rubix API calls plus the dapp host functions the contract
+// is allowed to use
+func newHostFunctionRegistry(ctx *HostCallContext) *wasmbridge.HostFunctionRegistry {
+	registry := wasmbridge.NewHostFunctionRegistry()
+	for _, name := range hostFunctionNames(ctx.Feature) {
+		if ctx.Contract != nil && !ctx.Contract.allowsHostFunction(name) {
+			continue
+		}
+		handler, _ := lookupHostFunction(ctx.Feature, name)
+		registry.Register(&dappHostFunction{name: name, handler: handler, ctx: ctx})
+	}
+	return registry
+}
+
+// dappHostFunction adapts a HostFunctionHandler to the bridge. From the
+// contract it is imported as
+//
+//	fn name(args_ptr: *const u8, args_len: usize, resp_ptr_ptr: *mut *const u8, resp_len_ptr: *mut usize) -> i32
+//
+// On success the JSON encoded result is written to the response and 0 is
+// returned, otherwise the response holds {"error": "..."} and 1 is returned.
+type dappHostFunction struct {
+	name    string
+	handler HostFunctionHandler
+	ctx     *HostCallContext
+
+	allocFunc *wasmtime.Func
+	memory    *wasmtime.Memory
+}
+
+func (h *dappHostFunction) Name() string {
+	return h.name
+}
+
+func (h *dappHostFunction) FuncType() *wasmtime.FuncType {
+	i32 := wasmtime.NewValType(wasmtime.KindI32)
+	return wasmtime.NewFuncType(
+		[]*wasmtime.ValType{i32, i32, i32, i32},
+		[]*wasmtime.ValType{i32},
+	)
+}
+
+func (h *dappHostFunction) Initialize(allocFunc, deallocFunc *wasmtime.Func, memory *wasmtime.Memory, nodeAddress string, quorumType int) {
+	h.allocFunc = allocFunc
+	h.memory = memory
+}
+
+func (h *dappHostFunction) Callback() wasmbridge.HostFunctionCallBack {
+	return h.callback
+}
+
+func (h *dappHostFunction) callback(caller *wasmtime.Caller, args []wasmtime.Val) ([]wasmtime.Val, *wasmtime.Trap) {
+	argsPtr, argsLen := args[0].I32(), args[1].I32()
+	respPtrPtr, respLenPtr := args[2].I32(), args[3].I32()
+
+	data := h.memory.UnsafeData(caller)
+	if argsPtr < 0 || argsLen < 0 || int(argsPtr)+int(argsLen) > len(data) {
+		return nil, wasmtime.NewTrap(fmt.Sprintf("%s: arguments out of bounds", h.name))
+	}
+	rawArgs := make([]byte, argsLen)
+	copy(rawArgs, data[argsPtr:argsPtr+argsLen])
+
+	code := int32(hostCallOk)
+	result, err := h.handler(h.ctx, rawArgs)
+	if err != nil {
+		h.ctx.logger().Warn("Host function failed", "host_function", h.name, "error", err)
+		code = hostCallError
+		result = map[string]string{"error": err.Error()}
+	}
+	resp, err := json.Marshal(result)
+	if err != nil {
+		code = hostCallError
+		resp, _ = json.Marshal(map[string]string{"error": err.Error()})
+	}
+
+	if err := h.writeResponse(caller, resp, respPtrPtr, respLenPtr); err != nil {
+		return nil, wasmtime.NewTrap(fmt.Sprintf("%s: %v", h.name, err))
+	}
+	return []wasmtime.Val{wasmtime.ValI32(code)}, nil
+}
+
+// writeResponse copies resp into memory allocated by the contract and stores
+// its location at respPtrPtr and respLenPtr
+func (h *dappHostFunction) writeResponse(caller *wasmtime.Caller, resp []byte, respPtrPtr int32, respLenPtr int32) error {
+	allocated, err := h.allocFunc.Call(caller, int32(len(resp)))
+	if err != nil {
+		return fmt.Errorf("failed to allocate response: %w", err)
+	}
+	respPtr, ok := allocated.(int32)
+	if !ok {
+		return fmt.Errorf("unexpected alloc result %v", allocated)
+	}
+
+	// Fetch the memory again, alloc may have grown it
+	data := h.memory.UnsafeData(caller)
+	if respPtr < 0 || int(respPtr)+len(resp) > len(data) {
+		return fmt.Errorf("response out of bounds")
+	}
+	if respPtrPtr < 0 || int(respPtrPtr)+4 > len(data) || respLenPtr < 0 || int(respLenPtr)+4 > len(data) {
+		return fmt.Errorf("response pointers out of bounds")
+	}
+	copy(data[respPtr:], resp)
+	binary.LittleEndian.PutUint32(data[respPtrPtr:], uint32(respPtr))
+	binary.LittleEndian.PutUint32(data[respLenPtr:], uint32(len(resp)))
+	return nil
+}
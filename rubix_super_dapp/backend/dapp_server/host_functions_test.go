@@ -0,0 +1,248 @@
+package main
+
+import (
+	"context"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/bytecodealliance/wasmtime-go"
+	wasmbridge "github.com/rubixchain/rubix-wasm/go-wasm-bridge"
+)
+
+// hostCallerWat is a contract which forwards call to the imported host
+// function, using the calling convention of the Rubix host functions
+const hostCallerWat = `
+(module
+  (import "env" "%s" (func $host (param i32 i32 i32 i32) (result i32)))
+  (memory (export "memory") 1)
+  (global $heap (mut i32) (i32.const 1024))
+  (func (export "alloc") (param $size i32) (result i32)
+    (local $ptr i32)
+    (local.set $ptr (global.get $heap))
+    (global.set $heap (i32.add (global.get $heap) (local.get $size)))
+    (local.get $ptr))
+  (func (export "call") (param i32 i32 i32 i32) (result i32)
+    (call $host (local.get 0) (local.get 1) (local.get 2) (local.get 3))))
+`
+
+// Where the test contract keeps the arguments and the response location
+const (
+	testArgsPtr    = 16
+	testRespPtrPtr = 8
+	testRespLenPtr = 12
+)
+
+// setupTestServer points the server at a fresh database and an empty config
+func setupTestServer(t *testing.T) {
+	t.Helper()
+	settings.DBPath = filepath.Join(t.TempDir(), "requests.db")
+	currentConfig.Store(&Config{})
+	initDB()
+}
+
+// callHostFunction calls hostFn from a wasm contract with args, returning
+// the return code and the response written by the host function
+func callHostFunction(t *testing.T, hostFn wasmbridge.HostFunction, args string) (int32, string, error) {
+	t.Helper()
+	engine := wasmtime.NewEngine()
+	store := wasmtime.NewStore(engine)
+	code, err := wasmtime.Wat2Wasm(strings.Replace(hostCallerWat, "%s", hostFn.Name(), 1))
+	if err != nil {
+		t.Fatalf("failed to compile test contract: %v", err)
+	}
+	module, err := wasmtime.NewModule(engine, code)
+	if err != nil {
+		t.Fatalf("failed to load test contract: %v", err)
+	}
+	linker := wasmtime.NewLinker(engine)
+	if err := linker.FuncNew("env", hostFn.Name(), hostFn.FuncType(), hostFn.Callback()); err != nil {
+		t.Fatalf("failed to define %s: %v", hostFn.Name(), err)
+	}
+	instance, err := linker.Instantiate(store, module)
+	if err != nil {
+		t.Fatalf("failed to instantiate test contract: %v", err)
+	}
+	memory := instance.GetExport(store, "memory").Memory()
+	hostFn.Initialize(instance.GetFunc(store, "alloc"), nil, memory, "", 0)
+
+	copy(memory.UnsafeData(store)[testArgsPtr:], args)
+	result, err := instance.GetFunc(store, "call").Call(store, testArgsPtr, len(args), testRespPtrPtr, testRespLenPtr)
+	if err != nil {
+		return 0, "", err
+	}
+	data := memory.UnsafeData(store)
+	respPtr := binary.LittleEndian.Uint32(data[testRespPtrPtr:])
+	respLen := binary.LittleEndian.Uint32(data[testRespLenPtr:])
+	return result.(int32), string(data[respPtr : respPtr+respLen]), nil
+}
+
+// registeredHostFunction returns the host function name of the registry built
+// for an execution of feature
+func registeredHostFunction(t *testing.T, feature string, contract *ContractInfo, name string) wasmbridge.HostFunction {
+	t.Helper()
+	registry := newHostFunctionRegistry(&HostCallContext{Context: context.Background(), Feature: feature, Contract: contract})
+	for _, hostFn := range registry.GetHostFunctions() {
+		if hostFn.Name() == name {
+			return hostFn
+		}
+	}
+	t.Fatalf("%s is not available to %s", name, feature)
+	return nil
+}
+
+func hasHostFunction(feature string, contract *ContractInfo, name string) bool {
+	registry := newHostFunctionRegistry(&HostCallContext{Context: context.Background(), Feature: feature, Contract: contract})
+	for _, hostFn := range registry.GetHostFunctions() {
+		if hostFn.Name() == name {
+			return true
+		}
+	}
+	return false
+}
+
+type sumArgs struct {
+	Values []int  `json:"values"`
+	Label  string `json:"label"`
+}
+
+type sumResult struct {
+	Label string `json:"label"`
+	Sum   int    `json:"sum"`
+}
+
+func TestRegisterHostFunctionRoundTrip(t *testing.T) {
+	RegisterHostFunction("roundtrip", "test_sum", func(ctx *HostCallContext, args sumArgs) (sumResult, error) {
+		result := sumResult{Label: args.Label}
+		for _, value := range args.Values {
+			result.Sum += value
+		}
+		return result, nil
+	})
+
+	hostFn := registeredHostFunction(t, "roundtrip", &ContractInfo{}, "test_sum")
+	code, resp, err := callHostFunction(t, hostFn, `{"values": [1, 2, 39], "label": "answer"}`)
+	if err != nil {
+		t.Fatalf("call trapped: %v", err)
+	}
+	if code != hostCallOk {
+		t.Fatalf("return code = %d, want %d, response %s", code, hostCallOk, resp)
+	}
+	var result sumResult
+	if err := json.Unmarshal([]byte(resp), &result); err != nil {
+		t.Fatalf("response %q is not JSON: %v", resp, err)
+	}
+	if result != (sumResult{Label: "answer", Sum: 42}) {
+		t.Errorf("result = %+v, want {answer 42}", result)
+	}
+}
+
+func TestRegisterHostFunctionScoping(t *testing.T) {
+	RegisterHostFunction(allContracts, "test_scoped", func(ctx *HostCallContext, args struct{}) (string, error) {
+		return "shared", nil
+	})
+	RegisterHostFunction("scope_a", "test_scoped", func(ctx *HostCallContext, args struct{}) (string, error) {
+		return "scope_a", nil
+	})
+	RegisterHostFunction("scope_a", "test_scope_a_only", func(ctx *HostCallContext, args struct{}) (string, error) {
+		return "scope_a only", nil
+	})
+
+	names := hostFunctionNames("scope_a")
+	count := 0
+	for _, name := range names {
+		if name == "test_scoped" {
+			count++
+		}
+	}
+	if count != 1 {
+		t.Errorf("test_scoped listed %d times for scope_a, want once", count)
+	}
+
+	tests := []struct {
+		feature string
+		want    string
+	}{
+		{"scope_a", `"scope_a"`},
+		{"scope_b", `"shared"`},
+	}
+	for _, test := range tests {
+		_, resp, err := callHostFunction(t, registeredHostFunction(t, test.feature, &ContractInfo{}, "test_scoped"), `{}`)
+		if err != nil {
+			t.Fatalf("%s: call trapped: %v", test.feature, err)
+		}
+		if resp != test.want {
+			t.Errorf("%s: test_scoped returned %s, want %s", test.feature, resp, test.want)
+		}
+	}
+
+	if hasHostFunction("scope_b", &ContractInfo{}, "test_scope_a_only") {
+		t.Error("test_scope_a_only is available to scope_b")
+	}
+	restricted := &ContractInfo{HostFunctions: []string{"test_scope_a_only"}}
+	if hasHostFunction("scope_a", restricted, "test_scoped") {
+		t.Error("test_scoped is available to a contract whose host_functions leave it out")
+	}
+	if !hasHostFunction("scope_a", restricted, "test_scope_a_only") {
+		t.Error("test_scope_a_only is not available to a contract whose host_functions list it")
+	}
+}
+
+func TestRegisterHostFunctionErrors(t *testing.T) {
+	RegisterHostFunction("errors", "test_fail", func(ctx *HostCallContext, args sumArgs) (bool, error) {
+		return false, errors.New("nothing to sum")
+	})
+	hostFn := registeredHostFunction(t, "errors", &ContractInfo{}, "test_fail")
+
+	tests := []struct {
+		name string
+		args string
+		want string
+	}{
+		{"handler error", `{"values": []}`, "nothing to sum"},
+		{"invalid arguments", `{"values": "one"}`, "invalid arguments for test_fail"},
+		{"malformed JSON", `{`, "invalid arguments for test_fail"},
+	}
+	for _, test := range tests {
+		code, resp, err := callHostFunction(t, hostFn, test.args)
+		if err != nil {
+			t.Fatalf("%s: call trapped: %v", test.name, err)
+		}
+		if code != hostCallError {
+			t.Errorf("%s: return code = %d, want %d", test.name, code, hostCallError)
+		}
+		var result map[string]string
+		if err := json.Unmarshal([]byte(resp), &result); err != nil || !strings.Contains(result["error"], test.want) {
+			t.Errorf("%s: response = %s, want an error containing %q", test.name, resp, test.want)
+		}
+	}
+}
+
+func TestDappGetRequestStatusOwnRequestsOnly(t *testing.T) {
+	setupTestServer(t)
+	ctx := context.Background()
+	if err := insertRequest(ctx, "nft-QmOwn-mint", Success); err != nil {
+		t.Fatal(err)
+	}
+	if err := insertRequest(ctx, "ft-QmOther-mint", Pending); err != nil {
+		t.Fatal(err)
+	}
+
+	hostCtx := &HostCallContext{Context: ctx, Feature: "nft", Contract: &ContractInfo{}, ContractHash: "QmOwn"}
+	result, err := dappGetRequestStatus(hostCtx, GetRequestStatusArgs{RequestId: "nft-QmOwn-mint"})
+	if err != nil {
+		t.Fatalf("own request: %v", err)
+	}
+	if !result.Found || result.Status != Success {
+		t.Errorf("own request = %+v, want found with status %d", result, Success)
+	}
+
+	for _, requestId := range []string{"ft-QmOther-mint", "nft-QmOther-mint", "nft-QmOwnX-mint"} {
+		if _, err := dappGetRequestStatus(hostCtx, GetRequestStatusArgs{RequestId: requestId}); err == nil {
+			t.Errorf("%s was visible to nft-QmOwn", requestId)
+		}
+	}
+}
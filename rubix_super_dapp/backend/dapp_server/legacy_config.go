@@ -0,0 +1,105 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"os"
+)
+
+// legacyFeature is the contracts_info key the contract of a legacy config
+// is mapped to
+const legacyFeature = "nft"
+
+// LegacyConfig is the flat app.node.json layout used by nft_dapp, which
+// configures a single NFT contract
+type LegacyConfig struct {
+	UserDid         string `json:"user_did"`
+	NodeAddress     string `json:"non_quorum_node_address"`
+	NftContractHash string `json:"nft_contract_hash"`
+	NftContractPath string `json:"nft_contract_path"`
+	DappServerApi   string `json:"dapp_server_api"`
+}
+
+// isLegacyConfig reports whether content uses the nft_dapp layout, i.e. it
+// has the flat NFT contract fields and no contracts_info
+func isLegacyConfig(content []byte) bool {
+	var fields map[string]json.RawMessage
+	if err := json.Unmarshal(content, &fields); err != nil {
+		return false
+	}
+	if _, ok := fields["contracts_info"]; ok {
+		return false
+	}
+	_, hasHash := fields["nft_contract_hash"]
+	_, hasPath := fields["nft_contract_path"]
+	return hasHash || hasPath
+}
+
+// convertLegacyConfig maps a legacy config onto contracts_info. Request ids
+// of nft_dapp have no feature prefix, which is kept so that its frontend can
+// still look them up.
+func convertLegacyConfig(content []byte) (*Config, error) {
+	var legacy LegacyConfig
+	if err := json.Unmarshal(content, &legacy); err != nil {
+		return nil, err
+	}
+
+	noPrefix := ""
+	return &Config{
+		UserDid:     legacy.UserDid,
+		NodeAddress: legacy.NodeAddress,
+		ContractsInfo: map[string]*ContractInfo{
+			legacyFeature: {
+				ContractHash:    legacy.NftContractHash,
+				ContractPath:    legacy.NftContractPath,
+				CallBackUrl:     legacy.DappServerApi,
+				RequestIdPrefix: &noPrefix,
+			},
+		},
+	}, nil
+}
+
+// migrateConfigCommand rewrites a legacy config file in the contracts_info
+// layout, keeping a copy of the original next to it
+func migrateConfigCommand(args []string) error {
+	flags := flag.NewFlagSet("config migrate", flag.ContinueOnError)
+	configPath := flags.String("config", "", "path of app.node.json (env DAPP_CONFIG)")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+	path := firstNonEmpty(*configPath, os.Getenv("DAPP_CONFIG"), defaultConfigPath)
+
+	content, err := os.ReadFile(path)
+	if err != nil {
+		return fmt.Errorf("failed to open config file: %w", err)
+	}
+	if !isLegacyConfig(content) {
+		fmt.Printf("%s already uses contracts_info, nothing to migrate\n", path)
+		return nil
+	}
+
+	config, err := convertLegacyConfig(content)
+	if err != nil {
+		return fmt.Errorf("failed to decode config file: %w", err)
+	}
+	migrated, err := json.MarshalIndent(config, "", "    ")
+	if err != nil {
+		return fmt.Errorf("failed to encode config: %w", err)
+	}
+
+	info, err := os.Stat(path)
+	if err != nil {
+		return err
+	}
+	backupPath := path + ".bak"
+	if err := os.WriteFile(backupPath, content, info.Mode()); err != nil {
+		return fmt.Errorf("failed to back up config file: %w", err)
+	}
+	if err := writeConfigFile(path, append(migrated, '\n'), info.Mode()); err != nil {
+		return fmt.Errorf("failed to write config file: %w", err)
+	}
+
+	fmt.Printf("Migrated %s to contracts_info, the original is kept at %s\n", path, backupPath)
+	return nil
+}
@@ -0,0 +1,101 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"os"
+	"testing"
+)
+
+const legacyConfigContent = `{
+	"user_did": "bafybmiuser",
+	"non_quorum_node_address": "http://localhost:20005",
+	"nft_contract_hash": "QmLegacy",
+	"nft_contract_path": "{dir}/contract.wasm",
+	"dapp_server_api": "/api/v1/nft"
+}`
+
+func TestIsLegacyConfig(t *testing.T) {
+	tests := []struct {
+		name    string
+		content string
+		legacy  bool
+	}{
+		{"nft_dapp layout", legacyConfigContent, true},
+		{"only the contract path", `{"nft_contract_path": "nft_contract.wasm"}`, true},
+		{"contracts_info", `{"contracts_info": {}}`, false},
+		{"both layouts", `{"nft_contract_hash": "QmLegacy", "contracts_info": {}}`, false},
+		{"no contracts", `{"non_quorum_node_address": "http://localhost:20005"}`, false},
+		{"not JSON", `nft_contract_hash`, false},
+	}
+	for _, test := range tests {
+		if legacy := isLegacyConfig([]byte(test.content)); legacy != test.legacy {
+			t.Errorf("%s: isLegacyConfig() = %v, want %v", test.name, legacy, test.legacy)
+		}
+	}
+}
+
+func TestLoadLegacyConfig(t *testing.T) {
+	saved := settings
+	t.Cleanup(func() { settings = saved })
+	settings.NodeAddress = ""
+
+	config, _, err := loadConfig(writeTestConfig(t, legacyConfigContent))
+	if err != nil {
+		t.Fatal(err)
+	}
+	contractInfo := config.ContractsInfo[legacyFeature]
+	if config.UserDid != "bafybmiuser" || contractInfo == nil || contractInfo.ContractHash != "QmLegacy" || contractInfo.CallBackUrl != "/api/v1/nft" {
+		t.Fatalf("legacy config loaded as %+v, %+v", config, contractInfo)
+	}
+	if contractInfo.RequestIdPrefix == nil || *contractInfo.RequestIdPrefix != "" {
+		t.Errorf("request ids of the legacy contract have a prefix %v, want none", contractInfo.RequestIdPrefix)
+	}
+}
+
+func TestMigrateConfigCommand(t *testing.T) {
+	saved := settings
+	t.Cleanup(func() { settings = saved })
+	path := writeTestConfig(t, legacyConfigContent)
+	legacy, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	settings.ConfigPath = path
+	settings.NodeAddress = ""
+
+	// The admin API refuses to rewrite a legacy config in the new layout
+	err = updateConfigFile(func(config *Config) error { return nil })
+	var adminErr *adminError
+	if !errors.As(err, &adminErr) || adminErr.status != http.StatusConflict {
+		t.Errorf("updateConfigFile() of a legacy config = %v, want a conflict", err)
+	}
+
+	for _, run := range []string{"migrate", "migrate again"} {
+		if err := migrateConfigCommand([]string{"-config", path}); err != nil {
+			t.Fatalf("%s: %v", run, err)
+		}
+		content, err := os.ReadFile(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if isLegacyConfig(content) {
+			t.Fatalf("%s: config still uses the legacy layout", run)
+		}
+		var migrated Config
+		if err := json.Unmarshal(content, &migrated); err != nil {
+			t.Fatalf("%s: %v", run, err)
+		}
+		if contractInfo := migrated.ContractsInfo[legacyFeature]; contractInfo == nil || contractInfo.ContractHash != "QmLegacy" {
+			t.Errorf("%s: migrated contracts_info = %v", run, migrated.ContractsInfo)
+		}
+		backup, err := os.ReadFile(path + ".bak")
+		if err != nil || string(backup) != string(legacy) {
+			t.Errorf("%s: backup = %q, %v, want the legacy config", run, backup, err)
+		}
+	}
+	if _, _, err := loadConfig(path); err != nil {
+		t.Errorf("loadConfig() of the migrated config = %v", err)
+	}
+}
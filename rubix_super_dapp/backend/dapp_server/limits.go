@@ -0,0 +1,415 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+	"time"
+)
+
+// wasmPageSize is the size of a single WebAssembly linear memory page
+const wasmPageSize = 64 * 1024
+
+// maxWasmPages is the largest memory a 32-bit wasm module can declare
+const maxWasmPages = 65536
+
+// ResourceLimits bounds a single contract execution. A zero value disables
+// the corresponding limit.
+type ResourceLimits struct {
+	TimeoutMs      int64  `json:"timeout_ms"`
+	MaxFuel        uint64 `json:"max_fuel"`
+	MaxMemoryPages uint32 `json:"max_memory_pages"`
+}
+
+// LimitExceededError is returned when a contract execution is stopped
+// because it went over one of its ResourceLimits
+type LimitExceededError struct {
+	Limit  string
+	Detail string
+
+	// running is set when the contract is still executing after a timeout,
+	// and is closed once its call returns
+	running <-chan struct{}
+}
+
+func (e *LimitExceededError) Error() string {
+	return fmt.Sprintf("%s limit exceeded: %s", e.Limit, e.Detail)
+}
+
+func (l *ResourceLimits) timeout() time.Duration {
+	if l == nil || l.TimeoutMs <= 0 {
+		return 0
+	}
+	return time.Duration(l.TimeoutMs) * time.Millisecond
+}
+
+// checkModuleLimits inspects the memory declared by the wasm artifact before
+// it is instantiated, rejecting a module which needs more initial memory
+// than the limit. Growth past the limit is stopped by capMemory.
+func checkModuleLimits(wasmPath string, limits *ResourceLimits) error {
+	if limits == nil || limits.MaxMemoryPages == 0 {
+		return nil
+	}
+
+	code, err := os.ReadFile(wasmPath)
+	if err != nil {
+		return fmt.Errorf("failed to read wasm artifact: %w", err)
+	}
+	memories, err := declaredMemories(code)
+	if err != nil {
+		return fmt.Errorf("failed to parse wasm artifact: %w", err)
+	}
+
+	for _, mem := range memories {
+		if mem.min > uint64(limits.MaxMemoryPages) {
+			return &LimitExceededError{
+				Limit:  "memory",
+				Detail: fmt.Sprintf("module requests %d initial pages, limit is %d", mem.min, limits.MaxMemoryPages),
+			}
+		}
+	}
+	return nil
+}
+
+// capMemory rewrites the memory section of a wasm binary so that every
+// memory declares a maximum of at most maxPages, which wasmtime enforces on
+// every memory.grow. Modules without a declared maximum get maxPages.
+func capMemory(code []byte, maxPages uint32) ([]byte, error) {
+	section, err := wasmSection(code, memorySectionId)
+	if err != nil || section == nil {
+		return code, err
+	}
+	count, n, err := readULEB128(section)
+	if err != nil {
+		return nil, err
+	}
+	rest := section[n:]
+
+	capped := appendULEB128(nil, count)
+	for i := uint64(0); i < count; i++ {
+		if len(rest) > 0 && rest[0]&^0x01 != 0 {
+			return nil, fmt.Errorf("unsupported memory flags %#x", rest[0])
+		}
+		var mem memoryLimits
+		if mem, rest, err = readLimits(rest); err != nil {
+			return nil, err
+		}
+		if mem.min > uint64(maxPages) {
+			return nil, &LimitExceededError{
+				Limit:  "memory",
+				Detail: fmt.Sprintf("module requests %d initial pages, limit is %d", mem.min, maxPages),
+			}
+		}
+		max := uint64(maxPages)
+		if max > maxWasmPages {
+			max = maxWasmPages
+		}
+		if mem.hasMax && mem.max < max {
+			max = mem.max
+		}
+		capped = append(capped, 0x01)
+		capped = appendULEB128(capped, mem.min)
+		capped = appendULEB128(capped, max)
+	}
+	return replaceWasmSection(code, memorySectionId, capped)
+}
+
+type memoryLimits struct {
+	min    uint64
+	max    uint64
+	hasMax bool
+}
+
+var errTruncatedWasm = errors.New("unexpected end of wasm binary")
+
+// Ids of the wasm binary sections which are inspected
+const (
+	typeSectionId   = 1
+	importSectionId = 2
+	memorySectionId = 5
+)
+
+// wasmSection returns the contents of the section id of a wasm binary, or
+// nil when it has none
+func wasmSection(code []byte, id byte) ([]byte, error) {
+	_, start, end, err := wasmSectionBounds(code, id)
+	if err != nil || start < 0 {
+		return nil, err
+	}
+	return code[start:end], nil
+}
+
+// replaceWasmSection returns a copy of a wasm binary with the contents of its
+// section id replaced by content
+func replaceWasmSection(code []byte, id byte, content []byte) ([]byte, error) {
+	header, _, end, err := wasmSectionBounds(code, id)
+	if err != nil {
+		return nil, err
+	}
+	if header < 0 {
+		return nil, fmt.Errorf("wasm binary has no section %d", id)
+	}
+	replaced := append([]byte{}, code[:header]...)
+	replaced = append(replaced, id)
+	replaced = appendULEB128(replaced, uint64(len(content)))
+	replaced = append(replaced, content...)
+	return append(replaced, code[end:]...), nil
+}
+
+// wasmSectionBounds returns the offsets of the header, the contents and the
+// end of the section id of a wasm binary, or -1 offsets when it has none
+func wasmSectionBounds(code []byte, id byte) (header int, start int, end int, err error) {
+	if len(code) < 8 || !bytes.Equal(code[:4], []byte("\x00asm")) {
+		return -1, -1, -1, errors.New("not a wasm binary")
+	}
+
+	pos := 8
+	for pos < len(code) {
+		sectionHeader := pos
+		sectionId := code[pos]
+		pos++
+		size, n, err := readULEB128(code[pos:])
+		if err != nil {
+			return -1, -1, -1, err
+		}
+		pos += n
+		if uint64(len(code)-pos) < size {
+			return -1, -1, -1, errTruncatedWasm
+		}
+		if sectionId == id {
+			return sectionHeader, pos, pos + int(size), nil
+		}
+		pos += int(size)
+	}
+	return -1, -1, -1, nil
+}
+
+// declaredMemories returns the limits of every memory defined in the memory
+// section of a wasm binary
+func declaredMemories(code []byte) ([]memoryLimits, error) {
+	section, err := wasmSection(code, memorySectionId)
+	if err != nil || section == nil {
+		return nil, err
+	}
+	count, n, err := readULEB128(section)
+	if err != nil {
+		return nil, err
+	}
+	section = section[n:]
+
+	memories := make([]memoryLimits, 0, count)
+	for i := uint64(0); i < count; i++ {
+		var mem memoryLimits
+		if mem, section, err = readLimits(section); err != nil {
+			return nil, err
+		}
+		memories = append(memories, mem)
+	}
+	return memories, nil
+}
+
+func readLimits(buf []byte) (memoryLimits, []byte, error) {
+	var mem memoryLimits
+	if len(buf) == 0 {
+		return mem, nil, errTruncatedWasm
+	}
+	flags := buf[0]
+	buf = buf[1:]
+	var n int
+	var err error
+	if mem.min, n, err = readULEB128(buf); err != nil {
+		return mem, nil, err
+	}
+	buf = buf[n:]
+	if flags&0x01 != 0 {
+		if mem.max, n, err = readULEB128(buf); err != nil {
+			return mem, nil, err
+		}
+		buf = buf[n:]
+		mem.hasMax = true
+	}
+	return mem, buf, nil
+}
+
+// wasmFuncType is the signature of a wasm function, as the value type codes
+// of its parameters and results
+type wasmFuncType struct {
+	params  []byte
+	results []byte
+}
+
+// Value type codes of wasm
+const (
+	wasmI32 = 0x7f
+	wasmI64 = 0x7e
+	wasmF32 = 0x7d
+	wasmF64 = 0x7c
+)
+
+func (t wasmFuncType) equal(other wasmFuncType) bool {
+	return bytes.Equal(t.params, other.params) && bytes.Equal(t.results, other.results)
+}
+
+func (t wasmFuncType) String() string {
+	names := map[byte]string{wasmI32: "i32", wasmI64: "i64", wasmF32: "f32", wasmF64: "f64"}
+	join := func(types []byte) string {
+		var parts []string
+		for _, valType := range types {
+			parts = append(parts, names[valType])
+		}
+		return "(" + strings.Join(parts, ", ") + ")"
+	}
+	return join(t.params) + " -> " + join(t.results)
+}
+
+// wasmImport is an import of a wasm module. funcType is only set for
+// function imports.
+type wasmImport struct {
+	module   string
+	name     string
+	isFunc   bool
+	funcType wasmFuncType
+}
+
+// declaredImports returns the imports of a wasm binary
+func declaredImports(code []byte) ([]wasmImport, error) {
+	types, err := declaredTypes(code)
+	if err != nil {
+		return nil, err
+	}
+	section, err := wasmSection(code, importSectionId)
+	if err != nil || section == nil {
+		return nil, err
+	}
+	count, n, err := readULEB128(section)
+	if err != nil {
+		return nil, err
+	}
+	section = section[n:]
+
+	imports := make([]wasmImport, 0, count)
+	for i := uint64(0); i < count; i++ {
+		var imp wasmImport
+		if imp.module, section, err = readName(section); err != nil {
+			return nil, err
+		}
+		if imp.name, section, err = readName(section); err != nil {
+			return nil, err
+		}
+		if len(section) == 0 {
+			return nil, errTruncatedWasm
+		}
+		kind := section[0]
+		section = section[1:]
+		switch kind {
+		case 0x00: // function
+			typeIndex, n, err := readULEB128(section)
+			if err != nil {
+				return nil, err
+			}
+			section = section[n:]
+			if typeIndex >= uint64(len(types)) {
+				return nil, fmt.Errorf("import %s.%s has unknown type %d", imp.module, imp.name, typeIndex)
+			}
+			imp.isFunc = true
+			imp.funcType = types[typeIndex]
+		case 0x01: // table
+			if len(section) == 0 {
+				return nil, errTruncatedWasm
+			}
+			if _, section, err = readLimits(section[1:]); err != nil {
+				return nil, err
+			}
+		case 0x02: // memory
+			if _, section, err = readLimits(section); err != nil {
+				return nil, err
+			}
+		case 0x03: // global
+			if len(section) < 2 {
+				return nil, errTruncatedWasm
+			}
+			section = section[2:]
+		default:
+			return nil, fmt.Errorf("import %s.%s has unknown kind %d", imp.module, imp.name, kind)
+		}
+		imports = append(imports, imp)
+	}
+	return imports, nil
+}
+
+// declaredTypes returns the function signatures of the type section of a
+// wasm binary
+func declaredTypes(code []byte) ([]wasmFuncType, error) {
+	section, err := wasmSection(code, typeSectionId)
+	if err != nil || section == nil {
+		return nil, err
+	}
+	count, n, err := readULEB128(section)
+	if err != nil {
+		return nil, err
+	}
+	section = section[n:]
+
+	types := make([]wasmFuncType, 0, count)
+	for i := uint64(0); i < count; i++ {
+		if len(section) == 0 || section[0] != 0x60 {
+			return nil, errors.New("malformed type section")
+		}
+		var funcType wasmFuncType
+		if funcType.params, section, err = readBytes(section[1:]); err != nil {
+			return nil, err
+		}
+		if funcType.results, section, err = readBytes(section); err != nil {
+			return nil, err
+		}
+		types = append(types, funcType)
+	}
+	return types, nil
+}
+
+// readBytes reads a length prefixed vector of bytes
+func readBytes(buf []byte) ([]byte, []byte, error) {
+	length, n, err := readULEB128(buf)
+	if err != nil {
+		return nil, nil, err
+	}
+	buf = buf[n:]
+	if uint64(len(buf)) < length {
+		return nil, nil, errTruncatedWasm
+	}
+	return buf[:length], buf[length:], nil
+}
+
+func readName(buf []byte) (string, []byte, error) {
+	name, rest, err := readBytes(buf)
+	return string(name), rest, err
+}
+
+func readULEB128(buf []byte) (uint64, int, error) {
+	var result uint64
+	var shift uint
+	for i, b := range buf {
+		if shift >= 64 {
+			return 0, 0, errors.New("malformed LEB128 integer")
+		}
+		result |= uint64(b&0x7f) << shift
+		if b&0x80 == 0 {
+			return result, i + 1, nil
+		}
+		shift += 7
+	}
+	return 0, 0, errTruncatedWasm
+}
+
+func appendULEB128(buf []byte, value uint64) []byte {
+	for {
+		b := byte(value & 0x7f)
+		value >>= 7
+		if value == 0 {
+			return append(buf, b)
+		}
+		buf = append(buf, b|0x80)
+	}
+}
@@ -0,0 +1,93 @@
+package main
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/bytecodealliance/wasmtime-go"
+)
+
+func TestCapMemory(t *testing.T) {
+	tests := []struct {
+		name    string
+		wat     string
+		limit   uint32
+		wantMax uint64
+		wantErr bool
+	}{
+		{"no declared maximum", `(module (memory 1))`, 4, 4, false},
+		{"smaller maximum is kept", `(module (memory 1 2))`, 4, 2, false},
+		{"larger maximum is lowered", `(module (memory 1 100))`, 4, 4, false},
+		{"initial memory over the limit", `(module (memory 8))`, 4, 0, true},
+	}
+	for _, test := range tests {
+		code, err := wasmtime.Wat2Wasm(test.wat)
+		if err != nil {
+			t.Fatalf("%s: %v", test.name, err)
+		}
+		capped, err := capMemory(code, test.limit)
+		if test.wantErr {
+			var limitErr *LimitExceededError
+			if !errors.As(err, &limitErr) || limitErr.Limit != "memory" {
+				t.Errorf("%s: capMemory error = %v, want a memory limit error", test.name, err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Fatalf("%s: capMemory failed: %v", test.name, err)
+		}
+		memories, err := declaredMemories(capped)
+		if err != nil || len(memories) != 1 {
+			t.Fatalf("%s: declaredMemories = %v, %v", test.name, memories, err)
+		}
+		if !memories[0].hasMax || memories[0].max != test.wantMax || memories[0].min != 1 {
+			t.Errorf("%s: capped memory = %+v, want min 1 and max %d", test.name, memories[0], test.wantMax)
+		}
+		if _, err := wasmtime.NewModule(wasmtime.NewEngine(), capped); err != nil {
+			t.Errorf("%s: capped module does not compile: %v", test.name, err)
+		}
+	}
+}
+
+func TestCapMemoryKeepsOtherSections(t *testing.T) {
+	code, err := wasmtime.Wat2Wasm(`(module (memory 1) (func (export "answer") (result i32) i32.const 42))`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	capped, err := capMemory(code, 70000)
+	if err != nil {
+		t.Fatalf("capMemory failed: %v", err)
+	}
+	engine := wasmtime.NewEngine()
+	store := wasmtime.NewStore(engine)
+	module, err := wasmtime.NewModule(engine, capped)
+	if err != nil {
+		t.Fatalf("capped module does not compile: %v", err)
+	}
+	instance, err := wasmtime.NewInstance(store, module, nil)
+	if err != nil {
+		t.Fatalf("capped module does not instantiate: %v", err)
+	}
+	if answer, err := instance.GetFunc(store, "answer").Call(store); err != nil || answer.(int32) != 42 {
+		t.Errorf("answer() = %v, %v, want 42", answer, err)
+	}
+}
+
+func TestCheckModuleLimitsShippedArtifacts(t *testing.T) {
+	// The shipped artifacts start with 17 pages and declare no maximum
+	tests := []struct {
+		limit   uint32
+		wantErr bool
+	}{
+		{0, false},
+		{17, false},
+		{256, false},
+		{16, true},
+	}
+	for _, test := range tests {
+		err := checkModuleLimits(nftArtifact, &ResourceLimits{MaxMemoryPages: test.limit})
+		if (err != nil) != test.wantErr {
+			t.Errorf("limit %d: checkModuleLimits = %v, want error %v", test.limit, err, test.wantErr)
+		}
+	}
+}
@@ -0,0 +1,192 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"os"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// redactedValue replaces the value of a redacted field
+const redactedValue = "[REDACTED]"
+
+// httpRequestIdHeader carries the correlation id of an HTTP request. It is
+// taken from the client when given and returned in the response.
+const httpRequestIdHeader = "X-Request-Id"
+
+// defaultRedactFields are always redacted, on top of logging.redact_fields
+var defaultRedactFields = []string{"password", "pin", "secret", "hmac_secret", "private_key", "priv_key", "token", "api_key"}
+
+// LoggingConfig configures the logs of the dapp server
+type LoggingConfig struct {
+	Level  string `json:"level,omitempty"`  // debug, info (default), warn or error
+	Format string `json:"format,omitempty"` // text (default) or json
+	// RedactFields are the names of payload fields and log attributes whose
+	// values are never logged, such as did or owner
+	RedactFields []string `json:"redact_fields,omitempty"`
+}
+
+func (l *LoggingConfig) validate() error {
+	if _, err := parseLogLevel(l.Level); err != nil {
+		return err
+	}
+	if l.Format != "" && l.Format != "text" && l.Format != "json" {
+		return fmt.Errorf("format must be text or json")
+	}
+	return nil
+}
+
+func parseLogLevel(level string) (slog.Level, error) {
+	switch strings.ToLower(level) {
+	case "", "info":
+		return slog.LevelInfo, nil
+	case "debug":
+		return slog.LevelDebug, nil
+	case "warn":
+		return slog.LevelWarn, nil
+	case "error":
+		return slog.LevelError, nil
+	}
+	return 0, fmt.Errorf("level must be debug, info, warn or error")
+}
+
+// redactFields holds the lower cased names of the redacted fields
+var redactFields atomic.Pointer[map[string]bool]
+
+// configureLogging installs the default logger for the logging settings of
+// the config. Lines written through the log package go through it too.
+func configureLogging(config *LoggingConfig) {
+	if config == nil {
+		config = &LoggingConfig{}
+	}
+	level, err := parseLogLevel(config.Level)
+	if err != nil {
+		level = slog.LevelInfo
+	}
+
+	fields := make(map[string]bool)
+	for _, field := range append(defaultRedactFields, config.RedactFields...) {
+		fields[strings.ToLower(field)] = true
+	}
+	redactFields.Store(&fields)
+
+	options := &slog.HandlerOptions{Level: level, ReplaceAttr: redactAttr}
+	var handler slog.Handler
+	if config.Format == "json" {
+		handler = slog.NewJSONHandler(os.Stdout, options)
+	} else {
+		handler = slog.NewTextHandler(os.Stdout, options)
+	}
+	slog.SetDefault(slog.New(handler))
+}
+
+func isRedacted(field string) bool {
+	fields := redactFields.Load()
+	return fields != nil && (*fields)[strings.ToLower(field)]
+}
+
+// redactAttr hides the value of attributes named after a redacted field
+func redactAttr(groups []string, attr slog.Attr) slog.Attr {
+	if attr.Value.Kind() != slog.KindGroup && isRedacted(attr.Key) {
+		return slog.String(attr.Key, redactedValue)
+	}
+	return attr
+}
+
+// redactPayload returns payload, a JSON document when it can be decoded, with
+// the values of the redacted fields replaced at any depth. JSON encoded
+// strings within it, such as smart contract data, are redacted as well.
+func redactPayload(payload string) string {
+	var value interface{}
+	if err := json.Unmarshal([]byte(payload), &value); err != nil {
+		return payload
+	}
+	redacted, err := json.Marshal(redactValue(value))
+	if err != nil {
+		return payload
+	}
+	return string(redacted)
+}
+
+func redactValue(value interface{}) interface{} {
+	switch v := value.(type) {
+	case map[string]interface{}:
+		for key, field := range v {
+			if isRedacted(key) {
+				v[key] = redactedValue
+			} else {
+				v[key] = redactValue(field)
+			}
+		}
+	case []interface{}:
+		for i, item := range v {
+			v[i] = redactValue(item)
+		}
+	case string:
+		trimmed := strings.TrimSpace(v)
+		if strings.HasPrefix(trimmed, "{") || strings.HasPrefix(trimmed, "[") {
+			return redactPayload(v)
+		}
+	}
+	return value
+}
+
+// payloadAttr logs a request or response body with its redacted fields hidden
+func payloadAttr(key string, payload string) slog.Attr {
+	return slog.String(key, redactPayload(payload))
+}
+
+type loggerKey struct{}
+
+// withLogAttrs returns a context whose logger tags every line with args, on
+// top of the tags already carried by ctx
+func withLogAttrs(ctx context.Context, args ...any) context.Context {
+	return context.WithValue(ctx, loggerKey{}, loggerFrom(ctx).With(args...))
+}
+
+// loggerFrom returns the logger carried by ctx, or the default logger
+func loggerFrom(ctx context.Context) *slog.Logger {
+	if ctx != nil {
+		if logger, ok := ctx.Value(loggerKey{}).(*slog.Logger); ok {
+			return logger
+		}
+	}
+	return slog.Default()
+}
+
+// logRequests tags the context of every HTTP request with a correlation id
+// and logs the request once it is served
+func logRequests(c *gin.Context) {
+	requestId := c.GetHeader(httpRequestIdHeader)
+	if requestId == "" || len(requestId) > 64 {
+		id := make([]byte, 8)
+		rand.Read(id)
+		requestId = hex.EncodeToString(id)
+	}
+	c.Header(httpRequestIdHeader, requestId)
+	ctx := withLogAttrs(c.Request.Context(), "http_request_id", requestId)
+	c.Request = c.Request.WithContext(ctx)
+
+	start := time.Now()
+	c.Next()
+
+	level := slog.LevelInfo
+	if c.Writer.Status() >= 500 {
+		level = slog.LevelError
+	}
+	loggerFrom(ctx).Log(ctx, level, "HTTP request served",
+		"method", c.Request.Method,
+		"path", c.Request.URL.Path,
+		"status", c.Writer.Status(),
+		"duration_ms", float64(time.Since(start).Microseconds())/1000,
+		"client_ip", c.RemoteIP(),
+	)
+}
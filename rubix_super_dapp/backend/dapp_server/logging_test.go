@@ -0,0 +1,69 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"log/slog"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestRedactPayload(t *testing.T) {
+	configureLogging(&LoggingConfig{RedactFields: []string{"did", "Owner"}})
+	defer configureLogging(nil)
+
+	tests := []struct {
+		name    string
+		payload string
+		want    string
+	}{
+		{"default field", `{"password": "hunter2", "amount": 5}`, `{"amount": 5, "password": "[REDACTED]"}`},
+		{"configured field", `{"did": "bafybmi", "status": true}`, `{"did": "[REDACTED]", "status": true}`},
+		{"case of the field", `{"OWNER": "bafybmi", "DID": "bafybmi"}`, `{"DID": "[REDACTED]", "OWNER": "[REDACTED]"}`},
+		{"nested object", `{"result": {"owner": "bafybmi", "nft": "QmNft"}}`, `{"result": {"nft": "QmNft", "owner": "[REDACTED]"}}`},
+		{"array", `[{"token": "abc"}, {"id": 1}]`, `[{"token": "[REDACTED]"}, {"id": 1}]`},
+		{"object value", `{"secret": {"key": "abc"}}`, `{"secret": "[REDACTED]"}`},
+		{"JSON encoded string", `{"data": "{\"private_key\": \"abc\", \"name\": \"x\"}"}`, `{"data": "{\"name\":\"x\",\"private_key\":\"[REDACTED]\"}"}`},
+		{"not JSON", `did=bafybmi`, ``},
+	}
+	for _, test := range tests {
+		got := redactPayload(test.payload)
+		if test.want == "" {
+			if got != test.payload {
+				t.Errorf("%s: redactPayload(%s) = %s, want it unchanged", test.name, test.payload, got)
+			}
+			continue
+		}
+		var gotValue, wantValue interface{}
+		if err := json.Unmarshal([]byte(got), &gotValue); err != nil {
+			t.Fatalf("%s: redactPayload(%s) = %s, not JSON: %v", test.name, test.payload, got, err)
+		}
+		if err := json.Unmarshal([]byte(test.want), &wantValue); err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(gotValue, wantValue) {
+			t.Errorf("%s: redactPayload(%s) = %s, want %s", test.name, test.payload, got, test.want)
+		}
+	}
+}
+
+func TestRedactAttr(t *testing.T) {
+	configureLogging(&LoggingConfig{RedactFields: []string{"did"}})
+	defer configureLogging(nil)
+
+	var out bytes.Buffer
+	logger := slog.New(slog.NewTextHandler(&out, &slog.HandlerOptions{ReplaceAttr: redactAttr}))
+	logger.Info("test", "did", "bafybmi", "api_key", "dapp_abc", "contract", "nft",
+		slog.Group("session", "token", "dapp_session_abc"))
+
+	line := out.String()
+	for _, secret := range []string{"bafybmi", "dapp_abc", "dapp_session_abc"} {
+		if strings.Contains(line, secret) {
+			t.Errorf("log line %q contains %s", line, secret)
+		}
+	}
+	if !strings.Contains(line, "contract=nft") {
+		t.Errorf("log line %q is missing contract=nft", line)
+	}
+}
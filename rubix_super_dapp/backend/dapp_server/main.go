@@ -1,6 +1,74 @@
 package main
 
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"os/signal"
+	"strings"
+	"syscall"
+	"time"
+)
+
 func main() {
+	args := os.Args[1:]
+	command := "serve"
+	if len(args) > 0 && !strings.HasPrefix(args[0], "-") {
+		command, args = args[0], args[1:]
+	}
+	if err := runCommand(command, args); err != nil {
+		if errors.Is(err, flag.ErrHelp) {
+			os.Exit(2)
+		}
+		fmt.Fprintf(os.Stderr, "%s: %v\n", command, err)
+		os.Exit(1)
+	}
+}
+
+// serveCommand serves the API until the server is interrupted. It runs when
+// the binary is started without a command.
+func serveCommand(args []string) error {
+	if err := initConfig(args); err != nil {
+		return fmt.Errorf("failed to load config: %w", err)
+	}
+	go watchConfig()
+
+	shutdownTracing, err := initTracing(GetConfig().Tracing)
+	if err != nil {
+		return fmt.Errorf("failed to initialize tracing: %w", err)
+	}
+	defer shutdownTracing(context.Background())
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
 	initDB()
-	bootupServer()
+	if holder, active, err := activeServer(time.Now()); err != nil {
+		return err
+	} else if active {
+		return fmt.Errorf("another dapp server (%s) is serving from %s", holder, settings.DBPath)
+	}
+	stopHeartbeat, err := startServerHeartbeat()
+	if err != nil {
+		return err
+	}
+	defer stopHeartbeat()
+	if err := reconcileInterruptedRequests(); err != nil {
+		return fmt.Errorf("failed to reconcile interrupted requests: %w", err)
+	}
+	registerDefaultHostFunctions()
+	backgroundJobs.Add(1)
+	go func() {
+		defer backgroundJobs.Done()
+		anchorAuditLog(ctx)
+	}()
+	backgroundJobs.Add(1)
+	go func() {
+		defer backgroundJobs.Done()
+		sweepChallenges(ctx)
+	}()
+	bootupServer(ctx)
+	return nil
 }
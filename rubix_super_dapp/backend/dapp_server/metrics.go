@@ -0,0 +1,220 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// Kinds of metrics, as named in the Prometheus text format
+const (
+	metricCounter   = "counter"
+	metricGauge     = "gauge"
+	metricHistogram = "histogram"
+)
+
+// durationBuckets are the upper bounds, in seconds, of the duration histograms
+var durationBuckets = []float64{0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10, 30}
+
+// metricVec is a metric partitioned by the values of its labels
+type metricVec struct {
+	name    string
+	help    string
+	kind    string
+	labels  []string
+	buckets []float64
+
+	mu     sync.Mutex
+	series map[string]*metricSeries
+}
+
+type metricSeries struct {
+	labelValues []string
+	value       float64  // counters and gauges
+	counts      []uint64 // histograms, per bucket
+	sum         float64
+	count       uint64
+}
+
+// metrics lists every metric in the order they are exposed
+var metrics []*metricVec
+
+func newMetric(kind string, name string, help string, labels ...string) *metricVec {
+	m := &metricVec{name: name, help: help, kind: kind, labels: labels, series: make(map[string]*metricSeries)}
+	if kind == metricHistogram {
+		m.buckets = durationBuckets
+	}
+	metrics = append(metrics, m)
+	return m
+}
+
+var (
+	callbacksReceived = newMetric(metricCounter, "dapp_callbacks_received_total",
+		"Callbacks received from the node, by contract", "contract")
+	callbacksRejected = newMetric(metricCounter, "dapp_callbacks_rejected_total",
+		"Callbacks which failed authentication, by contract and reason", "contract", "reason")
+	executionsTotal = newMetric(metricCounter, "dapp_executions_total",
+		"Contract executions, by contract, function and outcome", "contract", "function", "outcome")
+	requestsRejected = newMetric(metricCounter, "dapp_requests_rejected_total",
+		"Requests failed before execution, by contract, function and reason", "contract", "function", "reason")
+	executionsInFlight = newMetric(metricGauge, "dapp_executions_in_flight",
+		"Callbacks being processed, by contract", "contract")
+	requestsPending = newMetric(metricGauge, "dapp_requests_pending",
+		"Requests stored with the pending status")
+	nodeRequestDuration = newMetric(metricHistogram, "dapp_node_request_duration_seconds",
+		"Latency of the calls to the Rubix node, by API path", "path")
+	nodeRequestErrors = newMetric(metricCounter, "dapp_node_request_errors_total",
+		"Calls to the Rubix node which failed or returned a server error, by API path", "path")
+	wasmCompileDuration = newMetric(metricHistogram, "dapp_wasm_compile_duration_seconds",
+		"Time to load and compile the wasm artifact of a contract", "contract")
+	wasmExecuteDuration = newMetric(metricHistogram, "dapp_wasm_execute_duration_seconds",
+		"Time to execute a contract function", "contract", "function")
+	dbOperationDuration = newMetric(metricHistogram, "dapp_db_operation_duration_seconds",
+		"Latency of the database operations, by operation", "operation")
+)
+
+func (m *metricVec) seriesFor(labelValues []string) *metricSeries {
+	key := strings.Join(labelValues, "\xff")
+	s, ok := m.series[key]
+	if !ok {
+		s = &metricSeries{labelValues: append([]string(nil), labelValues...)}
+		if m.kind == metricHistogram {
+			s.counts = make([]uint64, len(m.buckets))
+		}
+		m.series[key] = s
+	}
+	return s
+}
+
+// add adds delta to a counter or gauge
+func (m *metricVec) add(delta float64, labelValues ...string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.seriesFor(labelValues).value += delta
+}
+
+// inc adds one to a counter or gauge
+func (m *metricVec) inc(labelValues ...string) {
+	m.add(1, labelValues...)
+}
+
+// set sets the value of a gauge
+func (m *metricVec) set(value float64, labelValues ...string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.seriesFor(labelValues).value = value
+}
+
+// observe records a value in a histogram
+func (m *metricVec) observe(value float64, labelValues ...string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	s := m.seriesFor(labelValues)
+	for i, bound := range m.buckets {
+		if value <= bound {
+			s.counts[i]++
+		}
+	}
+	s.sum += value
+	s.count++
+}
+
+// observeSince records the time elapsed since start in a histogram
+func (m *metricVec) observeSince(start time.Time, labelValues ...string) {
+	m.observe(time.Since(start).Seconds(), labelValues...)
+}
+
+// each calls fn with the label values and the value of every series of a
+// counter or gauge
+func (m *metricVec) each(fn func(labelValues []string, value float64)) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for _, s := range m.series {
+		fn(s.labelValues, s.value)
+	}
+}
+
+// write exposes the metric in the Prometheus text format
+func (m *metricVec) write(w io.Writer) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n", m.name, m.help, m.name, m.kind)
+	keys := make([]string, 0, len(m.series))
+	for key := range m.series {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		s := m.series[key]
+		if m.kind != metricHistogram {
+			fmt.Fprintf(w, "%s%s %s\n", m.name, formatLabels(m.labels, s.labelValues, "", ""), formatValue(s.value))
+			continue
+		}
+		for i, bound := range m.buckets {
+			fmt.Fprintf(w, "%s_bucket%s %d\n", m.name, formatLabels(m.labels, s.labelValues, "le", formatValue(bound)), s.counts[i])
+		}
+		fmt.Fprintf(w, "%s_bucket%s %d\n", m.name, formatLabels(m.labels, s.labelValues, "le", "+Inf"), s.count)
+		fmt.Fprintf(w, "%s_sum%s %s\n", m.name, formatLabels(m.labels, s.labelValues, "", ""), formatValue(s.sum))
+		fmt.Fprintf(w, "%s_count%s %d\n", m.name, formatLabels(m.labels, s.labelValues, "", ""), s.count)
+	}
+}
+
+var labelEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+func formatLabels(names []string, values []string, extraName string, extraValue string) string {
+	var pairs []string
+	for i, name := range names {
+		pairs = append(pairs, fmt.Sprintf(`%s="%s"`, name, labelEscaper.Replace(values[i])))
+	}
+	if extraName != "" {
+		pairs = append(pairs, fmt.Sprintf(`%s="%s"`, extraName, extraValue))
+	}
+	if len(pairs) == 0 {
+		return ""
+	}
+	return "{" + strings.Join(pairs, ",") + "}"
+}
+
+func formatValue(value float64) string {
+	return strconv.FormatFloat(value, 'g', -1, 64)
+}
+
+// metricsTransport records the latency and errors of the calls made to the
+// Rubix node
+type metricsTransport struct {
+	base http.RoundTripper
+}
+
+func (t *metricsTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	start := time.Now()
+	resp, err := t.base.RoundTrip(req)
+	nodeRequestDuration.observeSince(start, req.URL.Path)
+	if err != nil || resp.StatusCode >= http.StatusInternalServerError {
+		nodeRequestErrors.inc(req.URL.Path)
+	}
+	return resp, err
+}
+
+// Handler function for GET /metrics
+func metricsHandler(c *gin.Context) {
+	if pending, err := countRequestsWithStatus(Pending); err != nil {
+		slog.Error("Failed to count pending requests", "error", err)
+	} else {
+		requestsPending.set(float64(pending))
+	}
+
+	c.Header("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	c.Status(http.StatusOK)
+	for _, m := range metrics {
+		m.write(c.Writer)
+	}
+}
@@ -6,6 +6,21 @@ const (
 	Failed  = 2
 )
 
+// Failure reasons recorded against a request when it fails before or
+// around the contract call. Failures reported by the contract itself use
+// the error codes of the contractresult package.
+const (
+	ReasonModuleLoadFailed = "module_load_failed"
+	ReasonLimitExceeded    = "limit_exceeded"
+	ReasonInvalidInput     = "invalid_input"
+	ReasonSchemaError      = "schema_error"
+	ReasonQuotaExceeded    = "quota_exceeded"
+	ReasonQuotaError       = "quota_error"
+	ReasonPolicyDenied     = "policy_denied"
+	ReasonPolicyError      = "policy_error"
+	ReasonInterrupted      = "interrupted"
+)
+
 type ContractInputRequest struct {
 	Port              string `json:"port"`
 	SmartContractHash string `json:"smart_contract_hash"` //port should also be added here, so that the api can understand which node.
@@ -14,13 +29,148 @@ type ContractInputRequest struct {
 type ContractInfo struct {
 	ContractHash string `json:"contract_hash"`
 	ContractPath string `json:"contract_path"`
+	// ArtifactHash is the hex encoded sha256 of the artifact at
+	// contract_path, checked before it is loaded when set
+	ArtifactHash string `json:"artifact_hash,omitempty"`
 	CallBackUrl  string `json:"callback_url"`
+	// Execution options, all optional
+	//
+	// QuorumType is the quorum used for the transactions the contract
+	// submits, NodeAddress overrides non_quorum_node_address for this
+	// contract and HostFunctions restricts the dapp host functions it may
+	// import. A contract without Limits runs unbounded.
+	QuorumType    int             `json:"quorum_type,omitempty"`
+	NodeAddress   string          `json:"node_address,omitempty"`
+	Limits        *ResourceLimits `json:"limits,omitempty"`
+	HostFunctions []string        `json:"host_functions,omitempty"`
+	// Versions of the contract by activation block, contract_path is used
+	// for every block when it is empty
+	Versions []*ContractVersion `json:"versions,omitempty"`
+	// RequestIdPrefix is prepended to the request ids of the contract,
+	// "<feature>-" when not set
+	RequestIdPrefix *string `json:"request_id_prefix,omitempty"`
+	// Input schemas keyed by function name, either inline or from the
+	// schema file the contract was generated with
+	Schemas    map[string]*JSONSchema `json:"schemas,omitempty"`
+	SchemaPath string                 `json:"schema_path,omitempty"`
+	// Functions the callback may execute, mapped to the suffix of their
+	// request ids. The built-in sample functions of the feature are used
+	// when it is empty.
+	Functions map[string]string `json:"functions,omitempty"`
+	// Disabled contracts keep their configuration but are not served
+	Disabled bool `json:"disabled,omitempty"`
+	// Quotas caps the executions of a function per caller DID, keyed by
+	// function name
+	Quotas map[string]*Quota `json:"quotas,omitempty"`
+	// CallbackAuth authenticates the callbacks of the contract, which are
+	// accepted from anyone when it is not set
+	CallbackAuth *CallbackAuth `json:"callback_auth,omitempty"`
+}
+
+// defaultQuorumType is used for contracts which do not set quorum_type
+const defaultQuorumType = 2
+
+func (c *ContractInfo) quorumType() int {
+	if c.QuorumType == 0 {
+		return defaultQuorumType
+	}
+	return c.QuorumType
+}
+
+// nodeAddress returns the Rubix node the contract is executed against
+func (c *ContractInfo) nodeAddress(config Config) string {
+	if c.NodeAddress != "" {
+		return c.NodeAddress
+	}
+	return config.NodeAddress
+}
+
+// allowsHostFunction reports whether the contract may import the dapp host
+// function name
+func (c *ContractInfo) allowsHostFunction(name string) bool {
+	if len(c.HostFunctions) == 0 {
+		return true
+	}
+	for _, allowed := range c.HostFunctions {
+		if allowed == name {
+			return true
+		}
+	}
+	return false
+}
+
+// functionSuffix returns the request id suffix of funcName, and whether the
+// contract of feature may execute it
+func (c *ContractInfo) functionSuffix(feature string, funcName string) (string, bool) {
+	functions := c.Functions
+	if len(functions) == 0 {
+		functions = dappFunctions[feature]
+	}
+	suffix, ok := functions[funcName]
+	return suffix, ok
+}
+
+// requestId returns the id of the request executing function suffix of the
+// smart contract contractHash
+func (c *ContractInfo) requestId(feature string, contractHash string, suffix string) string {
+	return c.requestIdPrefix(feature) + contractHash + "-" + suffix
+}
+
+// requestIdPrefix returns the prefix of the request ids of the contract of
+// feature
+func (c *ContractInfo) requestIdPrefix(feature string) string {
+	if c.RequestIdPrefix != nil {
+		return *c.RequestIdPrefix
+	}
+	return feature + "-"
+}
+
+// RequestSummary is a request as listed for its caller
+type RequestSummary struct {
+	RequestId     string `json:"request_id"`
+	Status        int    `json:"status"`
+	Outcome       string `json:"outcome,omitempty"`
+	FailureReason string `json:"failure_reason,omitempty"`
 }
 
 type Config struct {
 	UserDid       string                   `json:"user_did"`
 	NodeAddress   string                   `json:"non_quorum_node_address"`
 	ContractsInfo map[string]*ContractInfo `json:"contracts_info"`
+	// Optional, overridden by the -port and -db flags or the DAPP_PORT and
+	// DAPP_DB_PATH environment variables
+	Port   int    `json:"port,omitempty"`
+	DBPath string `json:"db_path,omitempty"`
+	// PublicURL is the base url the node reaches the dapp server at, used
+	// to register callback urls. http://localhost:<port> when empty.
+	PublicURL string `json:"public_url,omitempty"`
+	// ShutdownTimeoutSeconds bounds how long in-flight executions are
+	// waited for on shutdown, 30 seconds when not set
+	ShutdownTimeoutSeconds int `json:"shutdown_timeout_seconds,omitempty"`
+	// RequireApiKey rejects requests to the status and simulation endpoints
+	// which do not carry an API key, true when not set
+	RequireApiKey *bool `json:"require_api_key,omitempty"`
+	// CorsAllowedOrigins are the browser origins allowed to call the server,
+	// none when empty
+	CorsAllowedOrigins []string `json:"cors_allowed_origins,omitempty"`
+	// RateLimits of the clients of the server, not limited when empty
+	RateLimits *RateLimits `json:"rate_limits,omitempty"`
+	// TLS of the listener, plain HTTP when not set. Enabling or disabling
+	// it takes a restart, rotated certificates are picked up on their own.
+	TLS *ServerTLS `json:"tls,omitempty"`
+	// NodeTLS configures the calls made to the Rubix node
+	NodeTLS *NodeTLS `json:"node_tls,omitempty"`
+	// PolicyPath is the policy file deciding who may execute which
+	// function, every execution is allowed when empty
+	PolicyPath string `json:"policy_path,omitempty"`
+	// Logging configures the level, format and redaction of the logs
+	Logging *LoggingConfig `json:"logging,omitempty"`
+	// Tracing configures the OpenTelemetry exporter, see tracing.go
+	Tracing *TracingConfig `json:"tracing,omitempty"`
+	// AuditAnchor enables anchoring the audit log on chain
+	AuditAnchor *AuditAnchorConfig `json:"audit_anchor,omitempty"`
+	// DidAuth enables login with a DID, see did_auth.go
+	DidAuth *DidAuthConfig `json:"did_auth,omitempty"`
 }
 
 type SmartContractDataReply struct {
@@ -38,4 +188,6 @@ type SCTDataReply struct {
 	BlockNo           uint64
 	BlockId           string
 	SmartContractData string
+	// ExecutorDID is the DID which signed the execution of the block
+	ExecutorDID string
 }
@@ -0,0 +1,125 @@
+package main
+
+import (
+	"context"
+	"io"
+	"log/slog"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+)
+
+// The built-in host functions of go-wasm-bridge call the node with a client
+// of their own. Each execution gives them the address of a route of the node
+// proxy instead, which forwards their calls with nodeHTTPClient, so that they
+// get the node_tls settings, the node metrics and the trace of the execution.
+
+// hopHeaders are not forwarded by the node proxy
+var hopHeaders = []string{"Connection", "Keep-Alive", "Proxy-Authenticate", "Proxy-Authorization", "Proxy-Connection", "Te", "Trailer", "Transfer-Encoding", "Upgrade"}
+
+// nodeRoute is the node an execution calls through the proxy
+type nodeRoute struct {
+	ctx         context.Context
+	nodeAddress string
+}
+
+// nodeProxy listens on the loopback interface for the node calls of the
+// executions. A route is only known to the execution it was created for.
+var nodeProxy = struct {
+	sync.RWMutex
+	once    sync.Once
+	address string
+	routes  map[string]nodeRoute
+}{routes: make(map[string]nodeRoute)}
+
+// startNodeProxy starts the listener of the node proxy, returning its
+// address, or "" when it could not be started
+func startNodeProxy() string {
+	nodeProxy.once.Do(func() {
+		listener, err := net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			slog.Error("Failed to start the node proxy, host functions will call the node directly", "error", err)
+			return
+		}
+		nodeProxy.address = "http://" + listener.Addr().String()
+		go func() {
+			if err := http.Serve(listener, http.HandlerFunc(serveNodeProxy)); err != nil {
+				slog.Error("Node proxy stopped", "error", err)
+			}
+		}()
+	})
+	return nodeProxy.address
+}
+
+// proxyNodeCalls returns the address the host functions of an execution
+// call nodeAddress with, and a function removing it once the execution is
+// over. The calls are traced and logged within ctx.
+func proxyNodeCalls(ctx context.Context, nodeAddress string) (string, func()) {
+	address := startNodeProxy()
+	if address == "" {
+		return nodeAddress, func() {}
+	}
+	token, err := randomHex(16)
+	if err != nil {
+		loggerFrom(ctx).Error("Failed to create a node proxy route, host functions will call the node directly", "error", err)
+		return nodeAddress, func() {}
+	}
+
+	nodeProxy.Lock()
+	nodeProxy.routes[token] = nodeRoute{ctx: context.WithoutCancel(ctx), nodeAddress: strings.TrimSuffix(nodeAddress, "/")}
+	nodeProxy.Unlock()
+	var once sync.Once
+	return address + "/exec/" + token, func() {
+		once.Do(func() {
+			nodeProxy.Lock()
+			delete(nodeProxy.routes, token)
+			nodeProxy.Unlock()
+		})
+	}
+}
+
+// serveNodeProxy forwards /exec/<token>/<path> to <path> of the node of the
+// route
+func serveNodeProxy(w http.ResponseWriter, r *http.Request) {
+	rest, routed := strings.CutPrefix(r.URL.Path, "/exec/")
+	token, path, _ := strings.Cut(rest, "/")
+	nodeProxy.RLock()
+	route, ok := nodeProxy.routes[token]
+	nodeProxy.RUnlock()
+	if !routed || !ok {
+		http.Error(w, "unknown execution", http.StatusNotFound)
+		return
+	}
+
+	target := route.nodeAddress + "/" + path
+	if r.URL.RawQuery != "" {
+		target += "?" + r.URL.RawQuery
+	}
+	req, err := http.NewRequestWithContext(route.ctx, r.Method, target, r.Body)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	req.Header = r.Header.Clone()
+	for _, header := range hopHeaders {
+		req.Header.Del(header)
+	}
+	req.ContentLength = r.ContentLength
+
+	resp, err := nodeHTTPClient().Do(req)
+	if err != nil {
+		loggerFrom(route.ctx).Warn("Host function failed to reach the node", "path", "/"+path, "error", err)
+		http.Error(w, "failed to reach node", http.StatusBadGateway)
+		return
+	}
+	defer resp.Body.Close()
+	for key, values := range resp.Header {
+		w.Header()[key] = values
+	}
+	for _, header := range hopHeaders {
+		w.Header().Del(header)
+	}
+	w.WriteHeader(resp.StatusCode)
+	io.Copy(w, resp.Body)
+}
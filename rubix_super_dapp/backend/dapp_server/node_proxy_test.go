@@ -0,0 +1,77 @@
+package main
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestNodeProxy(t *testing.T) {
+	currentConfig.Store(&Config{})
+	node := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		w.Header().Set("Content-Type", "application/json")
+		w.Header().Set("X-Node", "yes")
+		w.WriteHeader(http.StatusAccepted)
+		w.Write([]byte(r.Method + " " + r.URL.RequestURI() + " " + r.Header.Get("Content-Type") + " " + string(body)))
+	}))
+	defer node.Close()
+
+	address, release := proxyNodeCalls(context.Background(), node.URL+"/")
+	if address == node.URL+"/" {
+		t.Fatal("the node proxy did not start")
+	}
+	otherAddress, releaseOther := proxyNodeCalls(context.Background(), node.URL)
+	defer releaseOther()
+	if otherAddress == address {
+		t.Fatal("two executions got the same route")
+	}
+	proxy := startNodeProxy()
+
+	tests := []struct {
+		name   string
+		method string
+		url    string
+		body   string
+		status int
+		want   string
+	}{
+		{"post", http.MethodPost, address + "/api/nft/transfer", `{"nft": "QmNft"}`, http.StatusAccepted, `POST /api/nft/transfer application/json {"nft": "QmNft"}`},
+		{"get with query", http.MethodGet, address + "/api/get-ft-info-by-did?did=bafybmi", "", http.StatusAccepted, "GET /api/get-ft-info-by-did?did=bafybmi application/json "},
+		{"unknown route", http.MethodGet, proxy + "/exec/unknown/api/list-nfts", "", http.StatusNotFound, ""},
+		{"not a route", http.MethodGet, proxy + "/api/list-nfts", "", http.StatusNotFound, ""},
+	}
+	for _, test := range tests {
+		req, err := http.NewRequest(test.method, test.url, strings.NewReader(test.body))
+		if err != nil {
+			t.Fatal(err)
+		}
+		req.Header.Set("Content-Type", "application/json")
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatalf("%s: %v", test.name, err)
+		}
+		body, _ := io.ReadAll(resp.Body)
+		resp.Body.Close()
+		if resp.StatusCode != test.status {
+			t.Errorf("%s: status = %d, want %d", test.name, resp.StatusCode, test.status)
+			continue
+		}
+		if test.want != "" && (string(body) != test.want || resp.Header.Get("X-Node") != "yes") {
+			t.Errorf("%s: node received %q, want %q", test.name, body, test.want)
+		}
+	}
+
+	release()
+	resp, err := http.Get(address + "/api/list-nfts")
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusNotFound {
+		t.Errorf("status after release = %d, want %d", resp.StatusCode, http.StatusNotFound)
+	}
+}
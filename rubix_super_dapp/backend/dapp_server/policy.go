@@ -0,0 +1,453 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// Effects of a policy rule
+const (
+	PolicyAllow = "allow"
+	PolicyDeny  = "deny"
+)
+
+// Policy is the declarative authorization of contract executions, read from
+// the file at policy_path. Rules are evaluated in order and the first rule
+// whose conditions all hold decides; Default applies when none does.
+type Policy struct {
+	Default string        `json:"default,omitempty"` // allow when empty
+	Rules   []*PolicyRule `json:"rules"`
+}
+
+// PolicyRule allows or denies the executions matching all of its conditions.
+// Conditions which are left out always hold.
+type PolicyRule struct {
+	Name      string               `json:"name"`
+	Effect    string               `json:"effect"`
+	Reason    string               `json:"reason,omitempty"`
+	Contracts []string             `json:"contracts,omitempty"`
+	Functions []string             `json:"functions,omitempty"`
+	Callers   []string             `json:"callers,omitempty"`
+	Input     []*PolicyInputCheck  `json:"input,omitempty"`
+	Time      *PolicyTimeWindow    `json:"time,omitempty"`
+	Holdings  []*PolicyHoldingRule `json:"holdings,omitempty"`
+}
+
+// PolicyInputCheck compares an input field, given as a dotted path, with
+// Value. Op is one of eq, ne, gt, gte, lt, lte, in or exists. Values are
+// compared with their JSON type, so "1" does not equal 1.
+type PolicyInputCheck struct {
+	Field string      `json:"field"`
+	Op    string      `json:"op"`
+	Value interface{} `json:"value,omitempty"`
+}
+
+// PolicyTimeWindow holds between After and Before ("15:04"), on Days
+// ("mon".."sun"), in Timezone (UTC when empty). A window whose After is
+// later than its Before spans midnight, and belongs to the day it starts on.
+type PolicyTimeWindow struct {
+	After    string   `json:"after,omitempty"`
+	Before   string   `json:"before,omitempty"`
+	Days     []string `json:"days,omitempty"`
+	Timezone string   `json:"timezone,omitempty"`
+}
+
+// PolicyHoldingRule holds when the caller owns at least Min tokens of Token,
+// "ft" (of FtName, any FT when empty) or "nft"
+type PolicyHoldingRule struct {
+	Token  string  `json:"token"`
+	FtName string  `json:"ft_name,omitempty"`
+	Min    float64 `json:"min"`
+}
+
+// PolicyRequest is the execution a policy is evaluated for
+type PolicyRequest struct {
+	Contract  string      `json:"contract"`
+	Function  string      `json:"function"`
+	CallerDid string      `json:"caller_did"`
+	Input     interface{} `json:"input"`
+}
+
+// PolicyDecision is the result of evaluating a policy
+type PolicyDecision struct {
+	Allowed bool   `json:"allowed"`
+	Rule    string `json:"rule,omitempty"`
+	Reason  string `json:"reason"`
+}
+
+// policyDays are the days of a PolicyTimeWindow, in the order of
+// time.Weekday
+var policyDays = []string{"sun", "mon", "tue", "wed", "thu", "fri", "sat"}
+
+// loadPolicy reads and checks the policy file at path
+func loadPolicy(path string) (*Policy, error) {
+	content, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open policy file: %w", err)
+	}
+	var policy Policy
+	if err := json.Unmarshal(content, &policy); err != nil {
+		return nil, fmt.Errorf("failed to decode policy file: %w", err)
+	}
+	if err := policy.validate(); err != nil {
+		return nil, err
+	}
+	return &policy, nil
+}
+
+func (p *Policy) validate() error {
+	if p.Default != "" && p.Default != PolicyAllow && p.Default != PolicyDeny {
+		return fmt.Errorf("default must be %s or %s", PolicyAllow, PolicyDeny)
+	}
+	for i, rule := range p.Rules {
+		if rule == nil {
+			return fmt.Errorf("rules[%d] is empty", i)
+		}
+		if rule.Effect != PolicyAllow && rule.Effect != PolicyDeny {
+			return fmt.Errorf("rules[%d]: effect must be %s or %s", i, PolicyAllow, PolicyDeny)
+		}
+		for _, check := range rule.Input {
+			if err := check.validate(); err != nil {
+				return fmt.Errorf("rules[%d]: %w", i, err)
+			}
+		}
+		if rule.Time != nil {
+			if _, err := rule.Time.location(); err != nil {
+				return fmt.Errorf("rules[%d]: %w", i, err)
+			}
+			for _, clock := range []string{rule.Time.After, rule.Time.Before} {
+				if _, err := time.Parse("15:04", clock); clock != "" && err != nil {
+					return fmt.Errorf("rules[%d]: time %s must be formatted as 15:04", i, clock)
+				}
+			}
+			if rule.Time.After != "" && rule.Time.After == rule.Time.Before {
+				return fmt.Errorf("rules[%d]: time after and before must differ", i)
+			}
+			for _, day := range rule.Time.Days {
+				if !containsString(policyDays, day) {
+					return fmt.Errorf("rules[%d]: unknown day %s", i, day)
+				}
+			}
+		}
+		for _, holding := range rule.Holdings {
+			if holding.Token != "ft" && holding.Token != "nft" {
+				return fmt.Errorf("rules[%d]: holdings token must be ft or nft", i)
+			}
+		}
+	}
+	return nil
+}
+
+// evaluate decides whether the execution of req is allowed
+func (p *Policy) evaluate(ctx context.Context, req PolicyRequest, nodeAddress string, now time.Time) (PolicyDecision, error) {
+	for i, rule := range p.Rules {
+		matched, err := rule.matches(ctx, req, nodeAddress, now)
+		if err != nil {
+			return PolicyDecision{}, fmt.Errorf("rule %s: %w", rule.label(i), err)
+		}
+		if !matched {
+			continue
+		}
+		reason := rule.Reason
+		if reason == "" {
+			reason = fmt.Sprintf("%s by rule %s", rule.Effect, rule.label(i))
+		}
+		return PolicyDecision{Allowed: rule.Effect == PolicyAllow, Rule: rule.label(i), Reason: reason}, nil
+	}
+	if p.Default == PolicyDeny {
+		return PolicyDecision{Allowed: false, Reason: "no policy rule allows this execution"}, nil
+	}
+	return PolicyDecision{Allowed: true, Reason: "no policy rule matched"}, nil
+}
+
+func (r *PolicyRule) label(index int) string {
+	if r.Name != "" {
+		return r.Name
+	}
+	return fmt.Sprintf("#%d", index)
+}
+
+// matches reports whether every condition of the rule holds for req. Token
+// holdings are checked last, as they need calls to the node.
+func (r *PolicyRule) matches(ctx context.Context, req PolicyRequest, nodeAddress string, now time.Time) (bool, error) {
+	if len(r.Contracts) > 0 && !containsString(r.Contracts, req.Contract) {
+		return false, nil
+	}
+	if len(r.Functions) > 0 && !containsString(r.Functions, req.Function) {
+		return false, nil
+	}
+	if len(r.Callers) > 0 && !containsString(r.Callers, req.CallerDid) {
+		return false, nil
+	}
+	for _, check := range r.Input {
+		if !check.holds(req.Input) {
+			return false, nil
+		}
+	}
+	if r.Time != nil && !r.Time.contains(now) {
+		return false, nil
+	}
+	for _, holding := range r.Holdings {
+		held, err := holding.holds(ctx, req.CallerDid, nodeAddress)
+		if err != nil || !held {
+			return false, err
+		}
+	}
+	return true, nil
+}
+
+// validate checks that the op of the check is known and its value has the
+// type the op compares with
+func (c *PolicyInputCheck) validate() error {
+	if c.Field == "" {
+		return fmt.Errorf("input check without a field")
+	}
+	switch c.Op {
+	case "exists":
+		if c.Value != nil {
+			return fmt.Errorf("input %s: exists takes no value", c.Field)
+		}
+	case "eq", "ne":
+		if !isScalar(c.Value) {
+			return fmt.Errorf("input %s: %s value must be a string, number, boolean or null", c.Field, c.Op)
+		}
+	case "gt", "gte", "lt", "lte":
+		if _, ok := c.Value.(float64); !ok {
+			return fmt.Errorf("input %s: %s value must be a number", c.Field, c.Op)
+		}
+	case "in":
+		options, ok := c.Value.([]interface{})
+		if !ok {
+			return fmt.Errorf("input %s: in value must be a list", c.Field)
+		}
+		for _, option := range options {
+			if !isScalar(option) {
+				return fmt.Errorf("input %s: in values must be strings, numbers, booleans or null", c.Field)
+			}
+		}
+	default:
+		return fmt.Errorf("unknown input op %s", c.Op)
+	}
+	return nil
+}
+
+func (c *PolicyInputCheck) holds(input interface{}) bool {
+	value, found := lookupField(input, c.Field)
+	switch c.Op {
+	case "exists":
+		return found
+	case "eq":
+		return found && valuesEqual(value, c.Value)
+	case "ne":
+		return !found || !valuesEqual(value, c.Value)
+	case "in":
+		options, ok := c.Value.([]interface{})
+		if !found || !ok {
+			return false
+		}
+		for _, option := range options {
+			if valuesEqual(value, option) {
+				return true
+			}
+		}
+		return false
+	}
+
+	actual, ok := value.(float64)
+	expected, expectedOk := c.Value.(float64)
+	if !found || !ok || !expectedOk {
+		return false
+	}
+	switch c.Op {
+	case "gt":
+		return actual > expected
+	case "gte":
+		return actual >= expected
+	case "lt":
+		return actual < expected
+	case "lte":
+		return actual <= expected
+	}
+	return false
+}
+
+func (w *PolicyTimeWindow) location() (*time.Location, error) {
+	if w.Timezone == "" {
+		return time.UTC, nil
+	}
+	return time.LoadLocation(w.Timezone)
+}
+
+func (w *PolicyTimeWindow) contains(now time.Time) bool {
+	location, err := w.location()
+	if err != nil {
+		return false
+	}
+	local := now.In(location)
+	clock := local.Format("15:04")
+	day := local.Weekday()
+	if w.After != "" && w.Before != "" && w.After > w.Before {
+		// Overnight, the part after midnight belongs to the previous day
+		switch {
+		case clock >= w.After:
+		case clock < w.Before:
+			day = (day + 6) % 7
+		default:
+			return false
+		}
+	} else {
+		if w.After != "" && clock < w.After {
+			return false
+		}
+		if w.Before != "" && clock >= w.Before {
+			return false
+		}
+	}
+	return len(w.Days) == 0 || containsString(w.Days, policyDays[day])
+}
+
+// holds asks the node for the tokens owned by did
+func (h *PolicyHoldingRule) holds(ctx context.Context, did string, nodeAddress string) (bool, error) {
+	if did == "" {
+		return false, nil
+	}
+	switch h.Token {
+	case "ft":
+		var reply struct {
+			BasicResponse
+			FtInfo []struct {
+				FtName  string  `json:"ft_name"`
+				FtCount float64 `json:"ft_count"`
+			} `json:"ft_info"`
+		}
+		if err := getNodeJSON(ctx, nodeAddress+"/api/get-ft-info-by-did?did="+url.QueryEscape(did), &reply); err != nil {
+			return false, err
+		}
+		total := 0.0
+		for _, ft := range reply.FtInfo {
+			if h.FtName == "" || ft.FtName == h.FtName {
+				total += ft.FtCount
+			}
+		}
+		return total >= h.Min, nil
+	case "nft":
+		var reply struct {
+			BasicResponse
+			Nfts []struct {
+				OwnerDid string `json:"owner_did"`
+			} `json:"nfts"`
+		}
+		if err := getNodeJSON(ctx, nodeAddress+"/api/list-nfts", &reply); err != nil {
+			return false, err
+		}
+		owned := 0.0
+		for _, nft := range reply.Nfts {
+			if nft.OwnerDid == did {
+				owned++
+			}
+		}
+		return owned >= h.Min, nil
+	}
+	return false, fmt.Errorf("unknown token %s", h.Token)
+}
+
+// getNodeJSON decodes the reply of the node to a GET of url, within the
+// trace of ctx
+func getNodeJSON(ctx context.Context, url string, reply interface{}) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return err
+	}
+	resp, err := nodeHTTPClient().Do(req)
+	if err != nil {
+		return fmt.Errorf("failed to reach node: %w", err)
+	}
+	defer resp.Body.Close()
+	if err := json.NewDecoder(resp.Body).Decode(reply); err != nil {
+		return fmt.Errorf("unexpected node response %s: %w", resp.Status, err)
+	}
+	return nil
+}
+
+// lookupField returns the value at the dotted path in input
+func lookupField(input interface{}, path string) (interface{}, bool) {
+	value := input
+	for _, key := range strings.Split(path, ".") {
+		object, ok := value.(map[string]interface{})
+		if !ok {
+			return nil, false
+		}
+		value, ok = object[key]
+		if !ok {
+			return nil, false
+		}
+	}
+	return value, true
+}
+
+// valuesEqual compares two decoded JSON values, including their type
+func valuesEqual(a interface{}, b interface{}) bool {
+	return isScalar(a) && isScalar(b) && a == b
+}
+
+// isScalar reports whether a decoded JSON value is a string, number, boolean
+// or null
+func isScalar(value interface{}) bool {
+	switch value.(type) {
+	case nil, string, float64, bool:
+		return true
+	}
+	return false
+}
+
+func containsString(values []string, value string) bool {
+	for _, candidate := range values {
+		if candidate == value {
+			return true
+		}
+	}
+	return false
+}
+
+// evaluatePolicy evaluates the policy file of the config for req, allowing
+// every execution when no policy is configured
+func evaluatePolicy(ctx context.Context, config Config, req PolicyRequest) (PolicyDecision, error) {
+	if config.PolicyPath == "" {
+		return PolicyDecision{Allowed: true, Reason: "no policy configured"}, nil
+	}
+	policy, err := loadPolicy(config.PolicyPath)
+	if err != nil {
+		return PolicyDecision{}, err
+	}
+	nodeAddress := config.NodeAddress
+	if contractInfo, ok := config.ContractsInfo[req.Contract]; ok && contractInfo != nil {
+		nodeAddress = contractInfo.nodeAddress(config)
+	}
+	return policy.evaluate(ctx, req, nodeAddress, time.Now())
+}
+
+// Handler function for POST /policy/check
+//
+// The body is a PolicyRequest, the decision is returned without executing
+// anything.
+func checkPolicyHandler(c *gin.Context) {
+	var req PolicyRequest
+	if err := c.ShouldBindJSON(&req); err != nil || req.Contract == "" || req.Function == "" {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "contract and function are required"})
+		return
+	}
+	decision, err := evaluatePolicy(c.Request.Context(), GetConfig(), req)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, decision)
+}
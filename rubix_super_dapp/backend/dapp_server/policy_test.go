@@ -0,0 +1,168 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"strings"
+	"testing"
+	"time"
+)
+
+// decodePolicy decodes a policy the way loadPolicy does
+func decodePolicy(t *testing.T, content string) *Policy {
+	t.Helper()
+	var policy Policy
+	if err := json.Unmarshal([]byte(content), &policy); err != nil {
+		t.Fatalf("failed to decode policy %s: %v", content, err)
+	}
+	return &policy
+}
+
+func TestPolicyValidate(t *testing.T) {
+	tests := []struct {
+		name    string
+		policy  string
+		wantErr string
+	}{
+		{"empty", `{"rules": []}`, ""},
+		{"unknown default", `{"default": "maybe", "rules": []}`, "default must be"},
+		{"unknown effect", `{"rules": [{"effect": "audit"}]}`, "effect must be"},
+		{"unknown op", `{"rules": [{"effect": "deny", "input": [{"field": "a", "op": "like", "value": "x"}]}]}`, "unknown input op like"},
+		{"missing field", `{"rules": [{"effect": "deny", "input": [{"op": "exists"}]}]}`, "without a field"},
+		{"exists with a value", `{"rules": [{"effect": "deny", "input": [{"field": "a", "op": "exists", "value": 1}]}]}`, "exists takes no value"},
+		{"eq with an object", `{"rules": [{"effect": "deny", "input": [{"field": "a", "op": "eq", "value": {"b": 1}}]}]}`, "eq value must be"},
+		{"gt with a string", `{"rules": [{"effect": "deny", "input": [{"field": "a", "op": "gt", "value": "10"}]}]}`, "gt value must be a number"},
+		{"in with a string", `{"rules": [{"effect": "deny", "input": [{"field": "a", "op": "in", "value": "red"}]}]}`, "in value must be a list"},
+		{"in with a nested list", `{"rules": [{"effect": "deny", "input": [{"field": "a", "op": "in", "value": [[1]]}]}]}`, "in values must be"},
+		{"valid input checks", `{"rules": [{"effect": "deny", "input": [
+			{"field": "a", "op": "eq", "value": "x"}, {"field": "a", "op": "ne", "value": null},
+			{"field": "a", "op": "lte", "value": 3}, {"field": "a", "op": "in", "value": ["x", 1, true]},
+			{"field": "a", "op": "exists"}]}]}`, ""},
+		{"malformed time", `{"rules": [{"effect": "deny", "time": {"after": "9am"}}]}`, "must be formatted as 15:04"},
+		{"empty window", `{"rules": [{"effect": "deny", "time": {"after": "09:00", "before": "09:00"}}]}`, "must differ"},
+		{"overnight window", `{"rules": [{"effect": "deny", "time": {"after": "22:00", "before": "06:00"}}]}`, ""},
+		{"unknown day", `{"rules": [{"effect": "deny", "time": {"days": ["Mon"]}}]}`, "unknown day Mon"},
+		{"unknown timezone", `{"rules": [{"effect": "deny", "time": {"timezone": "Mars/Olympus"}}]}`, "unknown time zone"},
+		{"unknown holding", `{"rules": [{"effect": "deny", "holdings": [{"token": "sft", "min": 1}]}]}`, "must be ft or nft"},
+	}
+	for _, test := range tests {
+		err := decodePolicy(t, test.policy).validate()
+		if test.wantErr == "" && err != nil {
+			t.Errorf("%s: validate = %v, want no error", test.name, err)
+		}
+		if test.wantErr != "" && (err == nil || !strings.Contains(err.Error(), test.wantErr)) {
+			t.Errorf("%s: validate = %v, want an error containing %q", test.name, err, test.wantErr)
+		}
+	}
+}
+
+func TestPolicyInputCheck(t *testing.T) {
+	input := map[string]interface{}{}
+	if err := json.Unmarshal([]byte(`{"name": "rubix1", "count": 5, "flag": true, "id": "1", "nested": {"color": "red"}}`), &input); err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		check string
+		want  bool
+	}{
+		{`{"field": "name", "op": "eq", "value": "rubix1"}`, true},
+		{`{"field": "name", "op": "eq", "value": "rubix2"}`, false},
+		{`{"field": "id", "op": "eq", "value": 1}`, false},
+		{`{"field": "id", "op": "eq", "value": "1"}`, true},
+		{`{"field": "count", "op": "eq", "value": "5"}`, false},
+		{`{"field": "flag", "op": "eq", "value": "true"}`, false},
+		{`{"field": "flag", "op": "eq", "value": true}`, true},
+		{`{"field": "nested", "op": "eq", "value": "map[color:red]"}`, false},
+		{`{"field": "nested.color", "op": "ne", "value": "blue"}`, true},
+		{`{"field": "missing", "op": "ne", "value": "blue"}`, true},
+		{`{"field": "count", "op": "gt", "value": 4}`, true},
+		{`{"field": "count", "op": "gte", "value": 5}`, true},
+		{`{"field": "count", "op": "lt", "value": 5}`, false},
+		{`{"field": "count", "op": "lte", "value": 5}`, true},
+		{`{"field": "name", "op": "gt", "value": 1}`, false},
+		{`{"field": "nested.color", "op": "in", "value": ["red", "green"]}`, true},
+		{`{"field": "count", "op": "in", "value": ["5"]}`, false},
+		{`{"field": "nested.color", "op": "exists"}`, true},
+		{`{"field": "nested.size", "op": "exists"}`, false},
+	}
+	for _, test := range tests {
+		var check PolicyInputCheck
+		if err := json.Unmarshal([]byte(test.check), &check); err != nil {
+			t.Fatal(err)
+		}
+		if got := check.holds(input); got != test.want {
+			t.Errorf("%s holds = %v, want %v", test.check, got, test.want)
+		}
+	}
+}
+
+func TestPolicyTimeWindow(t *testing.T) {
+	// 2024-01-05 is a Friday
+	at := func(clock string) time.Time {
+		now, err := time.Parse("2006-01-02 15:04", clock)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return now
+	}
+	tests := []struct {
+		name   string
+		window PolicyTimeWindow
+		now    time.Time
+		want   bool
+	}{
+		{"within day window", PolicyTimeWindow{After: "09:00", Before: "17:00"}, at("2024-01-05 12:00"), true},
+		{"at day window start", PolicyTimeWindow{After: "09:00", Before: "17:00"}, at("2024-01-05 09:00"), true},
+		{"at day window end", PolicyTimeWindow{After: "09:00", Before: "17:00"}, at("2024-01-05 17:00"), false},
+		{"after only", PolicyTimeWindow{After: "09:00"}, at("2024-01-05 23:00"), true},
+		{"before only", PolicyTimeWindow{Before: "09:00"}, at("2024-01-05 10:00"), false},
+		{"overnight evening", PolicyTimeWindow{After: "22:00", Before: "06:00"}, at("2024-01-05 23:30"), true},
+		{"overnight morning", PolicyTimeWindow{After: "22:00", Before: "06:00"}, at("2024-01-05 05:59"), true},
+		{"overnight daytime", PolicyTimeWindow{After: "22:00", Before: "06:00"}, at("2024-01-05 12:00"), false},
+		{"overnight starting friday", PolicyTimeWindow{After: "22:00", Before: "06:00", Days: []string{"fri"}}, at("2024-01-06 02:00"), true},
+		{"overnight starting saturday", PolicyTimeWindow{After: "22:00", Before: "06:00", Days: []string{"sat"}}, at("2024-01-06 02:00"), false},
+		{"weekday", PolicyTimeWindow{Days: []string{"mon", "fri"}}, at("2024-01-05 12:00"), true},
+		{"weekend", PolicyTimeWindow{Days: []string{"sat", "sun"}}, at("2024-01-05 12:00"), false},
+		{"timezone", PolicyTimeWindow{After: "09:00", Before: "17:00", Timezone: "Asia/Kolkata"}, at("2024-01-05 04:00"), true},
+	}
+	for _, test := range tests {
+		if got := test.window.contains(test.now); got != test.want {
+			t.Errorf("%s: contains(%v) = %v, want %v", test.name, test.now, got, test.want)
+		}
+	}
+}
+
+func TestPolicyEvaluate(t *testing.T) {
+	policy := decodePolicy(t, `{
+		"default": "deny",
+		"rules": [
+			{"name": "big-mints", "effect": "deny", "functions": ["mint_sample_ft"], "input": [{"field": "ft_info.ft_count", "op": "gt", "value": 1000}], "reason": "too many"},
+			{"effect": "allow", "contracts": ["ft"], "callers": ["did:minter"]}
+		]
+	}`)
+	if err := policy.validate(); err != nil {
+		t.Fatal(err)
+	}
+	mint := func(caller string, count float64) PolicyRequest {
+		return PolicyRequest{Contract: "ft", Function: "mint_sample_ft", CallerDid: caller, Input: map[string]interface{}{"ft_info": map[string]interface{}{"ft_count": count}}}
+	}
+	tests := []struct {
+		name    string
+		req     PolicyRequest
+		allowed bool
+		rule    string
+	}{
+		{"first matching rule denies", mint("did:minter", 5000), false, "big-mints"},
+		{"unnamed rule allows", mint("did:minter", 10), true, "#1"},
+		{"default denies", mint("did:other", 10), false, ""},
+	}
+	for _, test := range tests {
+		decision, err := policy.evaluate(context.Background(), test.req, "", time.Now())
+		if err != nil {
+			t.Fatalf("%s: evaluate failed: %v", test.name, err)
+		}
+		if decision.Allowed != test.allowed || decision.Rule != test.rule {
+			t.Errorf("%s: decision = %+v, want allowed %v by rule %q", test.name, decision, test.allowed, test.rule)
+		}
+	}
+}
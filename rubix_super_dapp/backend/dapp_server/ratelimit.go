@@ -0,0 +1,193 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// maxIdleBuckets is the number of buckets kept before idle ones are dropped
+const maxIdleBuckets = 10000
+
+// RateLimit is a token bucket refilled at RatePerMinute, holding at most
+// Burst tokens
+type RateLimit struct {
+	RatePerMinute float64 `json:"rate_per_minute"`
+	Burst         int     `json:"burst"`
+}
+
+// RateLimits are the limits of each kind of client, a kind without a limit
+// is not limited
+type RateLimits struct {
+	PerIP     *RateLimit `json:"per_ip,omitempty"`
+	PerApiKey *RateLimit `json:"per_api_key,omitempty"`
+	PerDid    *RateLimit `json:"per_did,omitempty"`
+	// PerCallback limits the callbacks of each contract, which all come
+	// from its node
+	PerCallback *RateLimit `json:"per_callback,omitempty"`
+}
+
+// Quota caps how often a single DID may execute a function of a contract
+// within a period
+type Quota struct {
+	Limit  int    `json:"limit"`
+	Period string `json:"period"` // minute, hour or day
+}
+
+var quotaPeriods = map[string]time.Duration{
+	"minute": time.Minute,
+	"hour":   time.Hour,
+	"day":    24 * time.Hour,
+}
+
+func (l *RateLimit) validate() error {
+	if l.RatePerMinute <= 0 || l.Burst <= 0 {
+		return fmt.Errorf("rate_per_minute and burst must be positive")
+	}
+	return nil
+}
+
+func (q *Quota) validate() error {
+	if q.Limit <= 0 {
+		return fmt.Errorf("limit must be positive")
+	}
+	if _, ok := quotaPeriods[q.Period]; !ok {
+		return fmt.Errorf("period must be minute, hour or day")
+	}
+	return nil
+}
+
+// window returns the start of the period now falls in and the time left
+// until the next one
+func (q *Quota) window(now time.Time) (time.Time, time.Duration) {
+	period := quotaPeriods[q.Period]
+	start := now.UTC().Truncate(period)
+	return start, start.Add(period).Sub(now)
+}
+
+type tokenBucket struct {
+	tokens float64
+	last   time.Time
+}
+
+// rateLimiter holds the token buckets of every client. Buckets only matter
+// for a short time, so they are kept in memory.
+type rateLimiter struct {
+	mu      sync.Mutex
+	buckets map[string]*tokenBucket
+}
+
+var limiter = &rateLimiter{buckets: make(map[string]*tokenBucket)}
+
+// allow takes a token from the bucket of key, returning how long to wait
+// for the next token when the bucket is empty
+func (r *rateLimiter) allow(key string, limit *RateLimit, now time.Time) (bool, time.Duration) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	ratePerSecond := limit.RatePerMinute / 60
+	bucket, ok := r.buckets[key]
+	if !ok {
+		if len(r.buckets) >= maxIdleBuckets {
+			r.dropFullBuckets(now, limit)
+		}
+		bucket = &tokenBucket{tokens: float64(limit.Burst), last: now}
+		r.buckets[key] = bucket
+	}
+
+	bucket.tokens = math.Min(float64(limit.Burst), bucket.tokens+now.Sub(bucket.last).Seconds()*ratePerSecond)
+	bucket.last = now
+	if bucket.tokens >= 1 {
+		bucket.tokens--
+		return true, 0
+	}
+	wait := time.Duration((1 - bucket.tokens) / ratePerSecond * float64(time.Second))
+	return false, wait
+}
+
+// dropFullBuckets removes the buckets which have been idle long enough to be
+// full again, as they behave the same as a new bucket
+func (r *rateLimiter) dropFullBuckets(now time.Time, limit *RateLimit) {
+	refill := time.Duration(float64(limit.Burst) / (limit.RatePerMinute / 60) * float64(time.Second))
+	for key, bucket := range r.buckets {
+		if now.Sub(bucket.last) > refill {
+			delete(r.buckets, key)
+		}
+	}
+}
+
+// respondRateLimited answers with 429 and the seconds to wait before retrying
+func respondRateLimited(c *gin.Context, message string, wait time.Duration) {
+	retryAfter := int(math.Ceil(wait.Seconds()))
+	if retryAfter < 1 {
+		retryAfter = 1
+	}
+	c.Header("Retry-After", strconv.Itoa(retryAfter))
+	c.AbortWithStatusJSON(http.StatusTooManyRequests, gin.H{"error": message, "retry_after": retryAfter})
+}
+
+// rateLimitByIP limits the requests of every client address
+func rateLimitByIP(c *gin.Context) {
+	limits := GetConfig().RateLimits
+	if limits == nil || limits.PerIP == nil {
+		c.Next()
+		return
+	}
+	if ok, wait := limiter.allow("ip:"+c.RemoteIP(), limits.PerIP, time.Now()); !ok {
+		respondRateLimited(c, "too many requests from this address", wait)
+		return
+	}
+	c.Next()
+}
+
+// rateLimitByClient limits the requests of the API key or DID the request was
+// authenticated with, and the callbacks of a contract. It runs after
+// requireScope, requireSession or the callback authentication.
+func rateLimitByClient(c *gin.Context) {
+	limits := GetConfig().RateLimits
+	if limits == nil {
+		c.Next()
+		return
+	}
+	if id := c.GetString(apiKeyIdKey); id != "" && limits.PerApiKey != nil {
+		if ok, wait := limiter.allow("key:"+id, limits.PerApiKey, time.Now()); !ok {
+			respondRateLimited(c, "too many requests for this API key", wait)
+			return
+		}
+	}
+	if did := c.GetString(sessionDidKey); did != "" && limits.PerDid != nil {
+		if ok, wait := limiter.allow("did:"+did, limits.PerDid, time.Now()); !ok {
+			respondRateLimited(c, "too many requests for this DID", wait)
+			return
+		}
+	}
+	if feature := c.GetString(callbackContractKey); feature != "" && limits.PerCallback != nil {
+		if ok, wait := limiter.allow("callback:"+feature, limits.PerCallback, time.Now()); !ok {
+			respondRateLimited(c, "too many callbacks for this contract", wait)
+			return
+		}
+	}
+	c.Next()
+}
+
+// checkQuota counts the execution of block blockNo of contractHash, calling
+// funcName for did, against the quota of the contract, returning the time
+// until the quota resets when it is used up
+func (c *ContractInfo) checkQuota(ctx context.Context, feature string, contractHash string, blockNo uint64, funcName string, did string) (bool, time.Duration, error) {
+	quota, ok := c.Quotas[funcName]
+	if !ok || quota == nil {
+		return true, 0, nil
+	}
+	start, remaining := quota.window(time.Now())
+	allowed, err := consumeQuota(ctx, feature, contractHash, blockNo, funcName, did, start, quota.Limit)
+	if err != nil {
+		return false, 0, err
+	}
+	return allowed, remaining, nil
+}
@@ -0,0 +1,107 @@
+package main
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+func TestQuotaValidate(t *testing.T) {
+	tests := []struct {
+		name  string
+		quota Quota
+		valid bool
+	}{
+		{"hourly", Quota{Limit: 5, Period: "hour"}, true},
+		{"zero limit", Quota{Limit: 0, Period: "hour"}, false},
+		{"unknown period", Quota{Limit: 5, Period: "week"}, false},
+	}
+	for _, test := range tests {
+		if err := test.quota.validate(); (err == nil) != test.valid {
+			t.Errorf("%s: validate() = %v, want valid %v", test.name, err, test.valid)
+		}
+	}
+}
+
+func TestQuotaWindow(t *testing.T) {
+	now := time.Date(2024, 11, 18, 13, 45, 30, 0, time.UTC)
+	tests := []struct {
+		period    string
+		start     time.Time
+		remaining time.Duration
+	}{
+		{"minute", time.Date(2024, 11, 18, 13, 45, 0, 0, time.UTC), 30 * time.Second},
+		{"hour", time.Date(2024, 11, 18, 13, 0, 0, 0, time.UTC), 14*time.Minute + 30*time.Second},
+		{"day", time.Date(2024, 11, 18, 0, 0, 0, 0, time.UTC), 10*time.Hour + 14*time.Minute + 30*time.Second},
+	}
+	for _, test := range tests {
+		quota := &Quota{Limit: 1, Period: test.period}
+		start, remaining := quota.window(now)
+		if !start.Equal(test.start) || remaining != test.remaining {
+			t.Errorf("%s: window = %s, %s, want %s, %s", test.period, start, remaining, test.start, test.remaining)
+		}
+	}
+}
+
+func TestConsumeQuota(t *testing.T) {
+	setupTestServer(t)
+	ctx := context.Background()
+	first := time.Date(2024, 11, 18, 13, 0, 0, 0, time.UTC)
+	second := first.Add(time.Hour)
+
+	tests := []struct {
+		name    string
+		did     string
+		blockNo uint64
+		window  time.Time
+		allowed bool
+	}{
+		{"first block", "did-a", 1, first, true},
+		{"second block", "did-a", 2, first, true},
+		{"over the limit", "did-a", 3, first, false},
+		{"counted block again", "did-a", 1, first, true},
+		{"another DID", "did-b", 4, first, true},
+		{"new window", "did-a", 5, second, true},
+		{"block of an earlier window", "did-a", 2, second, true},
+		{"rejected block in a new window", "did-a", 3, second, true},
+		{"over the limit of the new window", "did-a", 6, second, false},
+	}
+	for _, test := range tests {
+		allowed, err := consumeQuota(ctx, "nft", "QmContract", test.blockNo, "mint", test.did, test.window, 2)
+		if err != nil {
+			t.Fatalf("%s: %v", test.name, err)
+		}
+		if allowed != test.allowed {
+			t.Errorf("%s: consumeQuota() = %v, want %v", test.name, allowed, test.allowed)
+		}
+	}
+}
+
+func TestRateLimiterAllow(t *testing.T) {
+	limiter := &rateLimiter{buckets: make(map[string]*tokenBucket)}
+	limit := &RateLimit{RatePerMinute: 60, Burst: 2}
+	now := time.Now()
+
+	tests := []struct {
+		name    string
+		key     string
+		at      time.Duration
+		allowed bool
+	}{
+		{"burst", "a", 0, true},
+		{"burst", "a", 0, true},
+		{"empty bucket", "a", 0, false},
+		{"other key", "b", 0, true},
+		{"refilled", "a", time.Second, true},
+		{"empty again", "a", time.Second, false},
+	}
+	for _, test := range tests {
+		allowed, wait := limiter.allow(test.key, limit, now.Add(test.at))
+		if allowed != test.allowed {
+			t.Errorf("%s: allow(%s) = %v, want %v", test.name, test.key, allowed, test.allowed)
+		}
+		if !allowed && wait <= 0 {
+			t.Errorf("%s: rejected without a wait", test.name)
+		}
+	}
+}
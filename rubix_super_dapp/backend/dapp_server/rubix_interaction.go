@@ -2,58 +2,162 @@ package main
 
 import (
 	"bytes"
+	"context"
 	"encoding/json"
 	"fmt"
 	"io"
 	"net/http"
+	"time"
 
 	wasmbridge "github.com/rubixchain/rubix-wasm/go-wasm-bridge"
+	"go.opentelemetry.io/otel/attribute"
 )
 
-func GetSmartContractData(token string, address string) []byte {
+// GetSmartContractData fetches the latest smart contract data of token from
+// the node at address, returning nil when it could not be fetched
+func GetSmartContractData(ctx context.Context, token string, address string) []byte {
+	return fetchSmartContractData(ctx, token, address, true)
+}
+
+// fetchSmartContractData fetches the smart contract data of token from the
+// node at address, only its latest block when latest is set and every block
+// otherwise. It returns nil when the data could not be fetched.
+func fetchSmartContractData(ctx context.Context, token string, address string, latest bool) []byte {
+	ctx, span := startSpan(ctx, "GetSmartContractData", attribute.String("dapp.contract_hash", token), attribute.Bool("dapp.latest", latest))
+	defer span.End()
+	logger := loggerFrom(ctx)
 	data := map[string]interface{}{
 		"token":  token,
-		"latest": true,
+		"latest": latest,
 	}
 	bodyJSON, err := json.Marshal(data)
 	if err != nil {
-		fmt.Println("Error marshaling JSON:", err)
+		failSpan(span, err)
+		logger.Error("Error marshaling JSON", "error", err)
 		return nil
 	}
 	url := address + "/api/get-smart-contract-token-chain-data"
-	req, err := http.NewRequest("POST", url, bytes.NewBuffer(bodyJSON))
+	req, err := http.NewRequestWithContext(ctx, "POST", url, bytes.NewBuffer(bodyJSON))
 	if err != nil {
-		fmt.Println("Error creating HTTP request:", err)
+		failSpan(span, err)
+		logger.Error("Error creating HTTP request", "error", err)
 		return nil
 	}
 	req.Header.Set("Content-Type", "application/json; charset=UTF-8")
-	
-	client := &http.Client{}
-	resp, err := client.Do(req)
+
+	start := time.Now()
+	resp, err := nodeHTTPClient().Do(req)
 	if err != nil {
-		fmt.Println("Error sending HTTP request:", err)
+		failSpan(span, err)
+		logger.Error("Error sending HTTP request", "url", url, "error", err)
 		return nil
 	}
+	defer resp.Body.Close()
 
-	fmt.Println("Response Status:", resp.Status)
 	data2, err := io.ReadAll(resp.Body)
 	if err != nil {
-		fmt.Printf("Error reading response body: %s\n", err)
+		failSpan(span, err)
+		logger.Error("Error reading response body", "url", url, "error", err)
 		return nil
 	}
-	// Process the data as needed
-	fmt.Println("Response Body in get smart contract data :", string(data2))
+	logger.Info("Fetched smart contract data", "url", url, "status", resp.StatusCode, "duration_ms", float64(time.Since(start).Microseconds())/1000)
+	logger.Debug("Smart contract data response", payloadAttr("body", string(data2)))
 
 	return data2
 
 }
 
-func executeAndGetContractResult(wasmModule *wasmbridge.WasmModule, contractInput string) (string, error) {
-	// Call the function
-	contractResult, err := wasmModule.CallFunction(contractInput)
-	if err != nil {
-		return "", fmt.Errorf("function call failed: %v", err)
+// fetchContractBlocks fetches and decodes the blocks of the smart contract
+// token, only its latest block when latest is set
+func fetchContractBlocks(ctx context.Context, token string, address string, latest bool) ([]SCTDataReply, error) {
+	tokenData := fetchSmartContractData(ctx, token, address, latest)
+	if tokenData == nil {
+		return nil, fmt.Errorf("unable to fetch smart contract data of %s", token)
+	}
+	var dataReply SmartContractDataReply
+	if err := json.Unmarshal(tokenData, &dataReply); err != nil {
+		return nil, fmt.Errorf("failed to decode smart contract data: %w", err)
+	}
+	return dataReply.SCTDataReply, nil
+}
+
+// newContractModule instantiates a wasm artifact of a contract with its
+// execution options and limits. The node calls of its host functions go
+// through the node proxy until the module is closed, which
+// executeAndGetContractResult does once the contract has returned.
+func newContractModule(ctx context.Context, version *ContractVersion, contractInfo *ContractInfo, config Config, hostFnRegistry *wasmbridge.HostFunctionRegistry) (*contractModule, error) {
+	nodeAddress, releaseNode := proxyNodeCalls(ctx, contractInfo.nodeAddress(config))
+	ctx, span := startSpan(ctx, "NewWasmModule", attribute.String("dapp.contract_path", version.ContractPath), attribute.String("dapp.contract_version", version.Version))
+	start := time.Now()
+	wasmModule, err := loadContractModule(
+		version.ContractPath,
+		hostFnRegistry,
+		nodeAddress,
+		contractInfo.quorumType(),
+		contractInfo.Limits,
+	)
+	if err == nil {
+		wasmModule.release = releaseNode
+		loggerFrom(ctx).Debug("Loaded wasm module", "path", version.ContractPath, "duration_ms", float64(time.Since(start).Microseconds())/1000)
+	} else {
+		releaseNode()
 	}
+	endSpan(span, err)
+	return wasmModule, err
+}
+
+func executeAndGetContractResult(ctx context.Context, wasmModule *contractModule, contractInput string, limits *ResourceLimits) (string, error) {
+	ctx, span := startSpan(ctx, "CallFunction")
+	start := time.Now()
+	output, err := callContractFunction(wasmModule, contractInput, limits)
+	endSpan(span, err)
+	loggerFrom(ctx).Info("Executed contract", "duration_ms", float64(time.Since(start).Microseconds())/1000, "success", err == nil)
+	return output, err
+}
+
+// callContractFunction calls the contract with its input, interrupting it
+// when it runs past the timeout of limits, and closes it once it returns
+func callContractFunction(wasmModule *contractModule, contractInput string, limits *ResourceLimits) (string, error) {
+	timeout := limits.timeout()
+	if timeout == 0 {
+		defer wasmModule.close()
+		return wasmModule.CallFunction(contractInput)
+	}
+
+	type callResult struct {
+		output string
+		err    error
+	}
+	// Buffered so the execution goroutine can still finish and exit if we
+	// stop waiting for it. The interrupt only takes effect once a host
+	// function being called returns, so running tells the caller when a
+	// timed out contract has actually stopped.
+	done := make(chan callResult, 1)
+	running := make(chan struct{})
+	go func() {
+		defer close(running)
+		defer wasmModule.close()
+		output, err := wasmModule.CallFunction(contractInput)
+		done <- callResult{output, err}
+	}()
 
-	return contractResult, nil
+	select {
+	case result := <-done:
+		return result.output, result.err
+	case <-time.After(timeout):
+		limitErr := &LimitExceededError{
+			Limit:  "timeout",
+			Detail: fmt.Sprintf("execution did not finish within %v", timeout),
+		}
+		wasmModule.interrupt(limitErr)
+		select {
+		case result := <-done:
+			// Returned before the interrupt took effect
+			if result.err == nil {
+				return result.output, nil
+			}
+		default:
+		}
+		return "", &LimitExceededError{Limit: limitErr.Limit, Detail: limitErr.Detail, running: running}
+	}
 }
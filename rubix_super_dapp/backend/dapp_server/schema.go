@@ -0,0 +1,277 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"os"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+	"unicode/utf8"
+)
+
+// FieldError is a validation failure of a single field of a contract input
+type FieldError struct {
+	Field   string `json:"field"`
+	Message string `json:"message"`
+}
+
+// JSONSchema is the subset of JSON Schema used to describe contract inputs
+type JSONSchema struct {
+	Type                 schemaTypes            `json:"type,omitempty"`
+	Properties           map[string]*JSONSchema `json:"properties,omitempty"`
+	Required             []string               `json:"required,omitempty"`
+	AdditionalProperties *bool                  `json:"additionalProperties,omitempty"`
+	Items                *JSONSchema            `json:"items,omitempty"`
+	Enum                 []interface{}          `json:"enum,omitempty"`
+	Minimum              *float64               `json:"minimum,omitempty"`
+	Maximum              *float64               `json:"maximum,omitempty"`
+	MinLength            *int                   `json:"minLength,omitempty"`
+	MaxLength            *int                   `json:"maxLength,omitempty"`
+	Pattern              string                 `json:"pattern,omitempty"`
+	MinItems             *int                   `json:"minItems,omitempty"`
+	MaxItems             *int                   `json:"maxItems,omitempty"`
+}
+
+// schemaTypes is the type keyword of a schema, given either as a single type
+// or as an array of types any of which the value may have
+type schemaTypes []string
+
+func (t *schemaTypes) UnmarshalJSON(data []byte) error {
+	var single string
+	if err := json.Unmarshal(data, &single); err == nil {
+		*t = schemaTypes{single}
+		return nil
+	}
+	var types []string
+	if err := json.Unmarshal(data, &types); err != nil {
+		return fmt.Errorf("type must be a string or an array of strings")
+	}
+	*t = types
+	return nil
+}
+
+func (t schemaTypes) MarshalJSON() ([]byte, error) {
+	if len(t) == 1 {
+		return json.Marshal(t[0])
+	}
+	return json.Marshal([]string(t))
+}
+
+func (t schemaTypes) matches(value interface{}) bool {
+	for _, schemaType := range t {
+		if matchesType(schemaType, value) {
+			return true
+		}
+	}
+	return false
+}
+
+// knownTypes are the types a schema may name
+var knownTypes = map[string]bool{
+	"string": true, "number": true, "integer": true, "boolean": true,
+	"object": true, "array": true, "null": true,
+}
+
+// schemaPatterns caches the compiled pattern of the schemas
+var schemaPatterns sync.Map // map[string]*regexp.Regexp
+
+func schemaPattern(pattern string) (*regexp.Regexp, error) {
+	if re, ok := schemaPatterns.Load(pattern); ok {
+		return re.(*regexp.Regexp), nil
+	}
+	re, err := regexp.Compile(pattern)
+	if err != nil {
+		return nil, err
+	}
+	schemaPatterns.Store(pattern, re)
+	return re, nil
+}
+
+// check reports the problems of a schema which make it unusable, such as an
+// unknown type or an invalid pattern, so that it is rejected when loaded
+// rather than on every request
+func (s *JSONSchema) check(path string) error {
+	if s == nil {
+		return nil
+	}
+	for _, schemaType := range s.Type {
+		if !knownTypes[schemaType] {
+			return fmt.Errorf("%s: unknown type %q", path, schemaType)
+		}
+	}
+	if s.Pattern != "" {
+		if _, err := schemaPattern(s.Pattern); err != nil {
+			return fmt.Errorf("%s: invalid pattern %q: %v", path, s.Pattern, err)
+		}
+	}
+	names := make([]string, 0, len(s.Properties))
+	for name := range s.Properties {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		if err := s.Properties[name].check(path + "." + name); err != nil {
+			return err
+		}
+	}
+	return s.Items.check(path + "[]")
+}
+
+// functionSchemas returns the input schemas of a contract keyed by function
+// name. Schemas given inline in the config take precedence over the ones in
+// schema_path, which is the schema file passed to generatesct.
+func functionSchemas(contractInfo *ContractInfo) (map[string]*JSONSchema, error) {
+	schemas := make(map[string]*JSONSchema)
+
+	if contractInfo.SchemaPath != "" {
+		content, err := os.ReadFile(contractInfo.SchemaPath)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read schema file: %w", err)
+		}
+		// An empty schema file, like the default state.json, declares no schemas
+		if len(strings.TrimSpace(string(content))) > 0 {
+			if err := json.Unmarshal(content, &schemas); err != nil {
+				return nil, fmt.Errorf("failed to parse schema file: %w", err)
+			}
+		}
+	}
+	for funcName, schema := range contractInfo.Schemas {
+		schemas[funcName] = schema
+	}
+	for funcName, schema := range schemas {
+		if err := schema.check(funcName); err != nil {
+			return nil, fmt.Errorf("invalid schema: %w", err)
+		}
+	}
+	return schemas, nil
+}
+
+// validateContractInput checks the input of funcName against its schema.
+// Functions without a schema are not validated.
+func validateContractInput(contractInfo *ContractInfo, funcName string, input interface{}) ([]FieldError, error) {
+	schemas, err := functionSchemas(contractInfo)
+	if err != nil {
+		return nil, err
+	}
+	schema, ok := schemas[funcName]
+	if !ok || schema == nil {
+		return nil, nil
+	}
+
+	var fieldErrors []FieldError
+	schema.validate(funcName, input, &fieldErrors)
+	return fieldErrors, nil
+}
+
+func (s *JSONSchema) validate(path string, value interface{}, fieldErrors *[]FieldError) {
+	addError := func(format string, args ...interface{}) {
+		*fieldErrors = append(*fieldErrors, FieldError{Field: path, Message: fmt.Sprintf(format, args...)})
+	}
+
+	if len(s.Type) > 0 && !s.Type.matches(value) {
+		addError("expected %s, got %s", strings.Join(s.Type, " or "), jsonTypeName(value))
+		return
+	}
+
+	if len(s.Enum) > 0 {
+		allowed := false
+		for _, option := range s.Enum {
+			if fmt.Sprint(option) == fmt.Sprint(value) && jsonTypeName(option) == jsonTypeName(value) {
+				allowed = true
+				break
+			}
+		}
+		if !allowed {
+			addError("must be one of %v", s.Enum)
+		}
+	}
+
+	switch v := value.(type) {
+	case map[string]interface{}:
+		for _, name := range s.Required {
+			if _, ok := v[name]; !ok {
+				*fieldErrors = append(*fieldErrors, FieldError{Field: path + "." + name, Message: "is required"})
+			}
+		}
+		names := make([]string, 0, len(v))
+		for name := range v {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		for _, name := range names {
+			if propSchema, ok := s.Properties[name]; ok {
+				propSchema.validate(path+"."+name, v[name], fieldErrors)
+			} else if s.AdditionalProperties != nil && !*s.AdditionalProperties {
+				*fieldErrors = append(*fieldErrors, FieldError{Field: path + "." + name, Message: "is not allowed"})
+			}
+		}
+	case []interface{}:
+		if s.MinItems != nil && len(v) < *s.MinItems {
+			addError("must have at least %d items", *s.MinItems)
+		}
+		if s.MaxItems != nil && len(v) > *s.MaxItems {
+			addError("must have at most %d items", *s.MaxItems)
+		}
+		if s.Items != nil {
+			for i, item := range v {
+				s.Items.validate(fmt.Sprintf("%s[%d]", path, i), item, fieldErrors)
+			}
+		}
+	case string:
+		length := utf8.RuneCountInString(v)
+		if s.MinLength != nil && length < *s.MinLength {
+			addError("must be at least %d characters", *s.MinLength)
+		}
+		if s.MaxLength != nil && length > *s.MaxLength {
+			addError("must be at most %d characters", *s.MaxLength)
+		}
+		// Patterns are checked when the schema is loaded
+		if s.Pattern != "" {
+			if re, err := schemaPattern(s.Pattern); err == nil && !re.MatchString(v) {
+				addError("must match %s", s.Pattern)
+			}
+		}
+	case float64:
+		if s.Minimum != nil && v < *s.Minimum {
+			addError("must be at least %v", *s.Minimum)
+		}
+		if s.Maximum != nil && v > *s.Maximum {
+			addError("must be at most %v", *s.Maximum)
+		}
+	}
+}
+
+func matchesType(schemaType string, value interface{}) bool {
+	switch schemaType {
+	case "integer":
+		n, ok := value.(float64)
+		return ok && n == math.Trunc(n)
+	case "number":
+		_, ok := value.(float64)
+		return ok
+	default:
+		return jsonTypeName(value) == schemaType
+	}
+}
+
+func jsonTypeName(value interface{}) string {
+	switch value.(type) {
+	case nil:
+		return "null"
+	case bool:
+		return "boolean"
+	case float64:
+		return "number"
+	case string:
+		return "string"
+	case []interface{}:
+		return "array"
+	case map[string]interface{}:
+		return "object"
+	default:
+		return fmt.Sprintf("%T", value)
+	}
+}
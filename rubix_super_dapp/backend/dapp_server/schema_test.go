@@ -0,0 +1,124 @@
+package main
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+// testSchemas returns a contract whose functions have the given schemas
+func testSchemas(t *testing.T, schemas string) *ContractInfo {
+	t.Helper()
+	contractInfo := &ContractInfo{}
+	if err := json.Unmarshal([]byte(`{"schemas": `+schemas+`}`), contractInfo); err != nil {
+		t.Fatal(err)
+	}
+	return contractInfo
+}
+
+func TestFunctionSchemas(t *testing.T) {
+	schemaPath := filepath.Join(t.TempDir(), "schema.json")
+	if err := os.WriteFile(schemaPath, []byte(`{"vote": {"type": "integer"}, "mint": {"type": "object"}}`), 0644); err != nil {
+		t.Fatal(err)
+	}
+	emptyPath := filepath.Join(t.TempDir(), "state.json")
+	if err := os.WriteFile(emptyPath, []byte("\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name       string
+		schemaPath string
+		schemas    string
+		types      map[string]string
+		valid      bool
+	}{
+		{"schema file", schemaPath, `{}`, map[string]string{"vote": "integer", "mint": "object"}, true},
+		{"inline schema takes precedence", schemaPath, `{"vote": {"type": "string"}}`, map[string]string{"vote": "string", "mint": "object"}, true},
+		{"empty schema file", emptyPath, `{}`, map[string]string{}, true},
+		{"missing schema file", filepath.Join(t.TempDir(), "missing.json"), `{}`, nil, false},
+		{"type array", "", `{"vote": {"type": ["integer", "null"]}}`, map[string]string{"vote": "integer"}, true},
+		{"unknown type", "", `{"vote": {"type": "int"}}`, nil, false},
+		{"unknown nested type", "", `{"mint": {"type": "object", "properties": {"tags": {"type": "array", "items": {"type": "text"}}}}}`, nil, false},
+		{"invalid pattern", "", `{"mint": {"type": "object", "properties": {"name": {"type": "string", "pattern": "[a-z"}}}}`, nil, false},
+		{"type neither string nor array", "", `{"vote": {"type": 1}}`, nil, false},
+	}
+	for _, test := range tests {
+		contractInfo := &ContractInfo{}
+		if err := json.Unmarshal([]byte(`{"schemas": `+test.schemas+`}`), contractInfo); err != nil {
+			// Schemas which do not parse are rejected with the config
+			if test.valid {
+				t.Fatalf("%s: %v", test.name, err)
+			}
+			continue
+		}
+		contractInfo.SchemaPath = test.schemaPath
+		schemas, err := functionSchemas(contractInfo)
+		if (err == nil) != test.valid {
+			t.Errorf("%s: functionSchemas() = %v, want valid %v", test.name, err, test.valid)
+			continue
+		}
+		if err != nil {
+			continue
+		}
+		types := make(map[string]string)
+		for funcName, schema := range schemas {
+			types[funcName] = schema.Type[0]
+		}
+		if !reflect.DeepEqual(types, test.types) {
+			t.Errorf("%s: schema types = %v, want %v", test.name, types, test.types)
+		}
+	}
+}
+
+func TestValidateContractInput(t *testing.T) {
+	contractInfo := testSchemas(t, `{
+		"mint": {
+			"type": "object",
+			"required": ["name", "copies"],
+			"additionalProperties": false,
+			"properties": {
+				"name": {"type": "string", "minLength": 3, "maxLength": 8, "pattern": "^[a-z]+$"},
+				"copies": {"type": "integer", "minimum": 1, "maximum": 10},
+				"color": {"enum": ["red", "blue"]},
+				"note": {"type": ["string", "null"]},
+				"tags": {"type": "array", "maxItems": 2, "items": {"type": "string"}}
+			}
+		}
+	}`)
+
+	tests := []struct {
+		name     string
+		funcName string
+		input    string
+		errors   []FieldError
+	}{
+		{"valid input", "mint", `{"name": "rubix", "copies": 2, "color": "red", "note": null, "tags": ["a"]}`, nil},
+		{"function without schema", "burn", `"anything"`, nil},
+		{"missing field", "mint", `{"name": "rubix"}`, []FieldError{{"mint.copies", "is required"}}},
+		{"additional field", "mint", `{"name": "rubix", "copies": 1, "owner": "did"}`, []FieldError{{"mint.owner", "is not allowed"}}},
+		{"wrong type", "mint", `{"name": 5, "copies": 1}`, []FieldError{{"mint.name", "expected string, got number"}}},
+		{"type array", "mint", `{"name": "rubix", "copies": 1, "note": 3}`, []FieldError{{"mint.note", "expected string or null, got number"}}},
+		{"not an integer", "mint", `{"name": "rubix", "copies": 1.5}`, []FieldError{{"mint.copies", "expected integer, got number"}}},
+		{"out of range", "mint", `{"name": "rubix", "copies": 11}`, []FieldError{{"mint.copies", "must be at most 10"}}},
+		{"too short", "mint", `{"name": "ab", "copies": 1}`, []FieldError{{"mint.name", "must be at least 3 characters"}}},
+		{"pattern", "mint", `{"name": "Rubix", "copies": 1}`, []FieldError{{"mint.name", "must match ^[a-z]+$"}}},
+		{"enum", "mint", `{"name": "rubix", "copies": 1, "color": "green"}`, []FieldError{{"mint.color", "must be one of [red blue]"}}},
+		{"array items", "mint", `{"name": "rubix", "copies": 1, "tags": ["a", 1, "c"]}`, []FieldError{{"mint.tags", "must have at most 2 items"}, {"mint.tags[1]", "expected string, got number"}}},
+	}
+	for _, test := range tests {
+		var input interface{}
+		if err := json.Unmarshal([]byte(test.input), &input); err != nil {
+			t.Fatal(err)
+		}
+		fieldErrors, err := validateContractInput(contractInfo, test.funcName, input)
+		if err != nil {
+			t.Fatalf("%s: %v", test.name, err)
+		}
+		if !reflect.DeepEqual(fieldErrors, test.errors) {
+			t.Errorf("%s: validateContractInput() = %v, want %v", test.name, fieldErrors, test.errors)
+		}
+	}
+}
@@ -1,326 +1,432 @@
 package main
 
 import (
+	"context"
 	"database/sql"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"log"
+	"log/slog"
 	"net/http"
 	"strconv"
+	"time"
+
+	"dapp_server/contractresult"
 
-	"github.com/gin-gonic/gin"
 	"github.com/gin-contrib/cors"
-	wasmbridge "github.com/rubixchain/rubix-wasm/go-wasm-bridge"
+	"github.com/gin-gonic/gin"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	oteltrace "go.opentelemetry.io/otel/trace"
 )
 
-// Handler function for /callback/nft
-func nftDappHandler(c *gin.Context) {
+// dappFunctions lists the functions of the sample contracts, along with the
+// suffix used for their request ids. They are allowed for contracts which do
+// not list their own functions.
+var dappFunctions = map[string]map[string]string{
+	"nft": {
+		"mint_sample_nft":     "mint",
+		"transfer_sample_nft": "transfer",
+	},
+	"ft": {
+		"mint_sample_ft":     "mint",
+		"transfer_sample_ft": "transfer",
+	},
+	"host_demo": {
+		"record_greeting": "greeting",
+	},
+	"voting": {
+		"cast_and_tally": "vote",
+	},
+}
+
+// executionOptions select what executeContract executes. The zero value
+// executes the latest block of the contract, as callbacks do.
+type executionOptions struct {
+	// Block is the block number to execute, the latest block when nil
+	Block *uint64
+	// SkipSucceeded leaves requests which already succeeded alone
+	SkipSucceeded bool
+}
+
+// executionResult is the response to an execution. Status is 0 when the
+// execution stopped before anything could be answered, e.g. when the node
+// could not be reached, and Err then says why.
+type executionResult struct {
+	Status     int
+	Body       gin.H
+	RetryAfter time.Duration // set when the caller exceeded its quota
+	RequestId  string
+	Err        error
+}
+
+// contractCallbackHandler fetches the latest state of the smart contract
+// named in the callback and executes it against the wasm artifact of feature
+func contractCallbackHandler(c *gin.Context, feature string) {
+	ctx, span := startSpan(c.Request.Context(), "callback "+feature, attribute.String("dapp.contract", feature))
+	defer span.End()
 	var req ContractInputRequest
 
 	err := json.NewDecoder(c.Request.Body).Decode(&req)
 
 	if err != nil {
 		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid request body"})
-		fmt.Printf("Error reading response body: %s\n", err)
+		loggerFrom(ctx).Warn("Invalid callback body", "contract", feature, "error", err)
 		return
 	}
-	config := GetConfig()
-	smartContractHash := req.SmartContractHash
-	fmt.Println("Received Smart Contract hash: ", req.SmartContractHash)
 
-	smartContractTokenData := GetSmartContractData(smartContractHash, config.NodeAddress)
-	if smartContractTokenData == nil {
-		fmt.Println("Unable to fetch latest smart contract data")
-		return
+	loggerFrom(ctx).Info("Received callback", "contract", feature, "contract_hash", req.SmartContractHash)
+	result := executeContract(ctx, feature, req.SmartContractHash, executionOptions{})
+	switch {
+	case result.RetryAfter > 0:
+		respondRateLimited(c, result.Body["error"].(string), result.RetryAfter)
+	case result.Status != 0:
+		c.JSON(result.Status, result.Body)
 	}
+}
 
-	fmt.Println("Smart Contract Token Data :", string(smartContractTokenData))
-
-	var dataReply SmartContractDataReply
+// executeContract fetches the state of the smart contract smartContractHash
+// and executes it against the wasm artifact of feature. It records the
+// request, and its outcome, as a callback would, so that operators can also
+// requeue and replay requests through it.
+func executeContract(ctx context.Context, feature string, smartContractHash string, opts executionOptions) executionResult {
+	span := oteltrace.SpanFromContext(ctx)
+	ctx = withLogAttrs(ctx, "contract", feature)
+	logger := loggerFrom(ctx)
+	executionsInFlight.inc(feature)
+	defer executionsInFlight.add(-1, feature)
 
-	if err := json.Unmarshal(smartContractTokenData, &dataReply); err != nil {
-		fmt.Println("Error:", err)
-		return
-	}
-	fmt.Println("Data reply in runDappHandler", dataReply)
-	smartContractData := dataReply.SCTDataReply
-	var relevantData string
-	for _, reply := range smartContractData {
-		fmt.Println("SmartContractData:", reply.SmartContractData)
-		relevantData = reply.SmartContractData
-	}
-	var inputMap map[string]interface{}
-	err1 := json.Unmarshal([]byte(relevantData), &inputMap)
-	if err1 != nil {
-		return
-	}
-	if len(inputMap) != 1 {
-		return
+	config := GetConfig()
+	contractInfo, ok := config.ContractsInfo[feature]
+	if !ok || contractInfo == nil || contractInfo.Disabled {
+		logger.Warn("No contracts_info entry found")
+		return executionResult{Status: http.StatusNotFound, Body: gin.H{"error": "contract is not configured"}}
 	}
+	ctx = withLogAttrs(ctx, "contract_hash", smartContractHash)
+	logger = loggerFrom(ctx)
 
-	var funcName string
-	var inputStruct interface{}
-	for key, value := range inputMap {
-		funcName = key
-		inputStruct = value
-	}
-	fmt.Println("The function name extracted =", funcName)
-	fmt.Println("The inputStruct Value :", inputStruct)
-	var requestId string
-	switch funcName {
-	case "mint_sample_nft":
-		requestId = "nft-" + smartContractHash + "-mint"
-	case "transfer_sample_nft":
-		requestId = "nft-" + smartContractHash + "-transfer"
-	default:
-		fmt.Println("This function name is not allowed")
-		return
-	}
-	checkResult, err := checkStringInRequests(requestId)
+	blocks, err := fetchContractBlocks(ctx, smartContractHash, contractInfo.nodeAddress(config), opts.Block == nil)
 	if err != nil {
-		fmt.Println("Error checking result:", err)
-		return
+		logger.Error("Unable to fetch smart contract data", "error", err)
+		return executionResult{Err: err}
 	}
-	if !checkResult {
-		err = insertRequest(requestId, Pending) //Add constants for the status
-		if err != nil {
-			fmt.Println("Error inserting request:", err)
-			return
+	var relevantData string
+	var blockNo uint64
+	var callerDid string
+	found := false
+	for _, reply := range blocks {
+		if opts.Block == nil || reply.BlockNo == *opts.Block {
+			relevantData = reply.SmartContractData
+			blockNo = reply.BlockNo
+			callerDid = reply.ExecutorDID
+			found = true
 		}
 	}
+	if !found && opts.Block != nil {
+		logger.Warn("Block not found", "block", *opts.Block)
+		return executionResult{Status: http.StatusNotFound, Body: gin.H{"error": fmt.Sprintf("block %d not found", *opts.Block)}}
+	}
+	span.SetAttributes(attribute.Int64("dapp.block", int64(blockNo)))
+	ctx = withLogAttrs(ctx, "block", blockNo)
+	logger = loggerFrom(ctx)
+	logger.Debug("Latest smart contract data", payloadAttr("data", relevantData))
 
-	hostFnRegistry := wasmbridge.NewHostFunctionRegistry()
-
-	// Initialize the WASM module
-	wasmModule, err := wasmbridge.NewWasmModule(
-		config.ContractsInfo["nft"].ContractPath,
-		hostFnRegistry,
-		wasmbridge.WithRubixNodeAddress(config.NodeAddress),
-		wasmbridge.WithQuorumType(2),
-	)
+	funcName, inputStruct, err := blockFunction(relevantData)
 	if err != nil {
-		log.Printf("Failed to initialize WASM module: %v", err)
-		return
+		logger.Warn("Smart contract data does not name a function", "error", err)
+		return executionResult{Err: err}
+	}
+	ctx = withLogAttrs(ctx, "function", funcName)
+	logger = loggerFrom(ctx)
+	suffix, ok := contractInfo.functionSuffix(feature, funcName)
+	if !ok {
+		logger.Warn("This function name is not allowed")
+		return executionResult{Err: fmt.Errorf("function %s is not allowed", funcName)}
+	}
+	requestId := contractInfo.requestId(feature, smartContractHash, suffix)
+	span.SetAttributes(attribute.String("dapp.function", funcName), attribute.String("dapp.request_id", requestId))
+	ctx = withLogAttrs(ctx, "request_id", requestId)
+	logger = loggerFrom(ctx)
+	defer trackExecution(requestId)()
+	// Once the contract is executed the request only moves on from
+	// Pending, as a shutdown may have marked it interrupted in the meantime
+	executionStarted := false
+	// fail counts the outcome of the execution and marks the request failed
+	fail := func(result contractresult.Result) {
+		executionsTotal.inc(feature, funcName, string(result.Outcome))
+		span.SetStatus(codes.Error, result.Message)
+		if executionStarted {
+			failExecution(ctx, requestId, result)
+		} else {
+			failRequest(ctx, requestId, result)
+		}
 	}
-
-	executionResult, err := executeAndGetContractResult(wasmModule, relevantData)
+	checkResult, err := checkStringInRequests(ctx, requestId)
 	if err != nil {
-		log.Printf("Failed to execute contract: %v", err)
-		return
+		logger.Error("Error checking request", "error", err)
+		return executionResult{RequestId: requestId, Err: err}
 	}
-	fmt.Println("The result returned is :", executionResult)
-	var response BasicResponse
-
-	// Convert JSON string to struct
-	if executionResult == "success" {
-		response = BasicResponse{Status: true, Message: "NFT Transferred Succesfully"}
-	} else {
-		err = json.Unmarshal([]byte(executionResult), &response)
+	if !checkResult {
+		err = insertRequest(ctx, requestId, Pending) //Add constants for the status
 		if err != nil {
-			log.Printf("Error parsing JSON: %v", err)
-			return
+			logger.Error("Error inserting request", "error", err)
+			return executionResult{RequestId: requestId, Err: err}
 		}
-	}
-
-	if response.Status {
-		err = updateRequestStatus(requestId, Success)
-		if err != nil {
-			fmt.Println("Error updating request status:", err)
-			return
-		} //handle error here
-	} else {
-		err = updateRequestStatus(requestId, Failed)
+	} else if opts.SkipSucceeded {
+		status, _, err := getRequestStatus(requestId)
 		if err != nil {
-			fmt.Println("Error updating request status:", err)
-			return
+			logger.Error("Error checking request", "error", err)
+			return executionResult{RequestId: requestId, Err: err}
+		}
+		if status == Success {
+			logger.Info("Request already succeeded")
+			return executionResult{Status: http.StatusConflict, Body: gin.H{"error": "request already succeeded"}, RequestId: requestId}
 		}
 	}
-	resultFinal := gin.H{
-		"message": "DApp executed successfully",
-		"data":    response,
+	// The caller is the DID which signed the block, the input is chosen by
+	// whoever submitted it
+	if err := recordRequestBlock(ctx, requestId, blockNo, callerDid); err != nil {
+		logger.Error("Error recording block", "error", err)
 	}
 
-	// Return a response
-	c.JSON(http.StatusOK, resultFinal)
-}
-
-// Handler function for /callback/nft
-func ftDappHandler(c *gin.Context) {
-	var req ContractInputRequest
-
-	err := json.NewDecoder(c.Request.Body).Decode(&req)
-
+	fieldErrors, err := validateContractInput(contractInfo, funcName, inputStruct)
 	if err != nil {
-		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid request body"})
-		fmt.Printf("Error reading response body: %s\n", err)
-		return
+		fail(contractresult.FromError(err, ReasonSchemaError))
+		logger.Error("Failed to load input schema", "error", err)
+		return executionResult{RequestId: requestId, Err: err}
+	}
+	if len(fieldErrors) > 0 {
+		requestsRejected.inc(feature, funcName, ReasonInvalidInput)
+		if err := markRequestInvalid(ctx, requestId, fieldErrors); err != nil {
+			logger.Error("Error updating request status", "error", err)
+		}
+		return executionResult{Status: http.StatusBadRequest, Body: gin.H{"error": "invalid contract input", "field_errors": fieldErrors}, RequestId: requestId}
 	}
-	config := GetConfig()
-	smartContractHash := req.SmartContractHash
-	fmt.Println("Received Smart Contract hash: ", req.SmartContractHash)
 
-	smartContractTokenData := GetSmartContractData(smartContractHash, config.NodeAddress)
-	if smartContractTokenData == nil {
-		fmt.Println("Unable to fetch latest smart contract data")
-		return
+	decision, err := evaluatePolicy(ctx, config, PolicyRequest{Contract: feature, Function: funcName, CallerDid: callerDid, Input: inputStruct})
+	if err != nil {
+		fail(contractresult.FromError(err, ReasonPolicyError))
+		logger.Error("Error evaluating policy", "error", err)
+		return executionResult{Status: http.StatusInternalServerError, Body: gin.H{"error": "failed to evaluate policy"}, RequestId: requestId}
+	}
+	if !decision.Allowed {
+		requestsRejected.inc(feature, funcName, ReasonPolicyDenied)
+		if err := markRequestRejected(ctx, requestId, ReasonPolicyDenied, decision.Reason); err != nil {
+			logger.Error("Error updating request status", "error", err)
+		}
+		return executionResult{Status: http.StatusForbidden, Body: gin.H{"error": "denied by policy", "policy": decision}, RequestId: requestId}
 	}
 
-	fmt.Println("Smart Contract Token Data :", string(smartContractTokenData))
-
-	var dataReply SmartContractDataReply
-
-	if err := json.Unmarshal(smartContractTokenData, &dataReply); err != nil {
-		fmt.Println("Error:", err)
-		return
-	}
-	fmt.Println("Data reply in runDappHandler", dataReply)
-	smartContractData := dataReply.SCTDataReply
-	var relevantData string
-	for _, reply := range smartContractData {
-		fmt.Println("SmartContractData:", reply.SmartContractData)
-		relevantData = reply.SmartContractData
-	}
-	var inputMap map[string]interface{}
-	err1 := json.Unmarshal([]byte(relevantData), &inputMap)
-	if err1 != nil {
-		return
-	}
-	if len(inputMap) != 1 {
-		return
+	// Every block counts once against the quota of the caller, after its
+	// input has been accepted
+	allowed, retryAfter, err := contractInfo.checkQuota(ctx, feature, smartContractHash, blockNo, funcName, callerDid)
+	if err != nil {
+		fail(contractresult.FromError(err, ReasonQuotaError))
+		logger.Error("Error checking quota", "error", err)
+		return executionResult{Status: http.StatusInternalServerError, Body: gin.H{"error": "failed to check quota"}, RequestId: requestId}
+	}
+	if !allowed {
+		detail := fmt.Sprintf("quota of %d %s per %s exceeded", contractInfo.Quotas[funcName].Limit, funcName, contractInfo.Quotas[funcName].Period)
+		requestsRejected.inc(feature, funcName, ReasonQuotaExceeded)
+		if err := markRequestRejected(ctx, requestId, ReasonQuotaExceeded, detail); err != nil {
+			logger.Error("Error updating request status", "error", err)
+		}
+		return executionResult{Status: http.StatusTooManyRequests, Body: gin.H{"error": detail}, RetryAfter: retryAfter, RequestId: requestId}
 	}
 
-	var funcName string
-	var inputStruct interface{}
-	for key, value := range inputMap {
-		funcName = key
-		inputStruct = value
-	}
-	fmt.Println("The function name extracted =", funcName)
-	fmt.Println("The inputStruct Value :", inputStruct)
-	var requestId string
-	switch funcName {
-	case "mint_sample_ft":
-		requestId = "ft-" + smartContractHash + "-mint"
-	case "transfer_sample_ft":
-		requestId = "ft-" + smartContractHash + "-transfer"
-	default:
-		fmt.Println("This function name is not allowed")
-		return
+	// Execute the data with the contract code that was active at its block
+	version, err := contractInfo.versionForBlock(blockNo)
+	if err == nil {
+		err = version.verifyArtifact()
 	}
-	checkResult, err := checkStringInRequests(requestId)
 	if err != nil {
-		fmt.Println("Error checking result:", err)
-		return
-	}
-	if !checkResult {
-		err = insertRequest(requestId, Pending) //Add constants for the status
-		if err != nil {
-			fmt.Println("Error inserting request:", err)
-			return
-		}
+		fail(contractresult.FromError(err, ReasonModuleLoadFailed))
+		logger.Error("Failed to select contract version", "error", err)
+		return executionResult{RequestId: requestId, Err: err}
 	}
+	ctx = withLogAttrs(ctx, "contract_version", version.Version)
+	logger = loggerFrom(ctx)
 
-	hostFnRegistry := wasmbridge.NewHostFunctionRegistry()
+	if err := checkModuleLimits(version.ContractPath, contractInfo.Limits); err != nil {
+		reason := ReasonModuleLoadFailed
+		if _, ok := err.(*LimitExceededError); ok {
+			reason = ReasonLimitExceeded
+		}
+		fail(contractresult.FromError(err, reason))
+		logger.Warn("Contract rejected before execution", "error", err)
+		return executionResult{RequestId: requestId, Err: err}
+	}
+
+	trace := newExecutionTrace(requestId, relevantData)
+	trace.BlockNo = blockNo
+	trace.ContractVersion = version.Version
+	defer saveTrace(ctx, trace)
+
+	// Executions of the same contract run one at a time, from their first
+	// state read to the commit of their writes
+	defer lockContractState(smartContractHash)()
+	state := newContractState(smartContractHash)
+	hostFnRegistry := newHostFunctionRegistry(&HostCallContext{
+		Context:      ctx,
+		Feature:      feature,
+		Contract:     contractInfo,
+		ContractHash: smartContractHash,
+		RequestId:    requestId,
+		Config:       config,
+		State:        state,
+		Trace:        trace,
+	})
+	traceHostFunctions(ctx, hostFnRegistry, trace)
 
 	// Initialize the WASM module
-	wasmModule, err := wasmbridge.NewWasmModule(
-		config.ContractsInfo["ft"].ContractPath,
-		hostFnRegistry,
-		wasmbridge.WithRubixNodeAddress(config.NodeAddress),
-		wasmbridge.WithQuorumType(2),
-	)
+	compileStart := time.Now()
+	wasmModule, err := newContractModule(ctx, version, contractInfo, config, hostFnRegistry)
+	wasmCompileDuration.observeSince(compileStart, feature)
 	if err != nil {
-		func() {
-			err = updateRequestStatus(requestId, Failed)
-			if err != nil {
-				fmt.Println("Error updating request status:", err)
-				return
-			}
-		}()
-		log.Printf("Failed to initialize WASM module: %v", err)
-		return
-	}
-
-	executionResult, errExecuteContract := executeAndGetContractResult(wasmModule, relevantData)
-	fmt.Println("----------- FT Execution Result: ", executionResult)
-	if errExecuteContract != nil {
-		func() {
-			err = updateRequestStatus(requestId, Failed)
-			if err != nil {
-				fmt.Println("Error updating request status:", err)
-				return
-			}
-		}()
-		log.Printf("Failed to execute contract: %v", errExecuteContract)
-		return
-	}
-
-	var response BasicResponse
-
-	// Convert JSON string to struct
-	if executionResult == "success" {
-		response = BasicResponse{Status: true, Message: "NFT Transferred Succesfully"}
-	} else {
-		err = json.Unmarshal([]byte(executionResult), &response)
-		if err != nil {
-			log.Printf("Error parsing JSON: %v", err)
-			return
+		trace.finish("", err)
+		fail(contractresult.FromError(err, ReasonModuleLoadFailed))
+		logger.Error("Failed to initialize WASM module", "error", err)
+		return executionResult{RequestId: requestId, Err: err}
+	}
+
+	if err := markExecutionStarted(ctx, requestId); err != nil {
+		wasmModule.close()
+		trace.finish("", err)
+		logger.Error("Error updating request status", "error", err)
+		return executionResult{Status: http.StatusInternalServerError, Body: gin.H{"error": "failed to update request status"}, RequestId: requestId}
+	}
+	executionStarted = true
+	executeStart := time.Now()
+	executionOutput, err := executeAndGetContractResult(ctx, wasmModule, relevantData, contractInfo.Limits)
+	wasmExecuteDuration.observeSince(executeStart, feature, funcName)
+	trace.finish(executionOutput, err)
+	var result contractresult.Result
+	var running <-chan struct{}
+	if err != nil {
+		code := contractresult.CodeTrap
+		if limitErr, ok := err.(*LimitExceededError); ok {
+			code = ReasonLimitExceeded
+			running = limitErr.running
+		} else if errors.Is(err, errExecutionInterrupted) {
+			code = ReasonInterrupted
 		}
-		func() {
-			err = updateRequestStatus(requestId, Failed)
-			if err != nil {
-				fmt.Println("Error updating request status:", err)
-				return
-			}
+		result = contractresult.FromError(err, code)
+		logger.Error("Failed to execute contract", "error", err)
+	} else {
+		logger.Debug("Contract returned", payloadAttr("output", executionOutput))
+		result = contractresult.Parse(executionOutput)
+	}
+
+	if running != nil {
+		// The contract has been interrupted but is still inside a host
+		// function, and may still submit a transaction. The request fails
+		// now, and stays tracked for shutdown until the call returns.
+		fail(result)
+		logger.Warn("Contract still running after its timeout")
+		release := trackExecution(requestId)
+		backgroundJobs.Add(1)
+		go func() {
+			defer backgroundJobs.Done()
+			defer release()
+			<-running
+			logger.Warn("Timed out contract returned")
+			saveTrace(ctx, trace)
 		}()
+		resultFinal := gin.H{
+			"message": "DApp execution timed out",
+			"data":    result,
+		}
+		return executionResult{Status: http.StatusGatewayTimeout, Body: resultFinal, RequestId: requestId}
 	}
 
-	if response.Status {
-		err = updateRequestStatus(requestId, Success)
+	if result.Succeeded() {
+		executionsTotal.inc(feature, funcName, string(result.Outcome))
+		err = completeRequest(ctx, requestId, state, result)
+		if err == errNotPending {
+			logger.Warn("Request finished while its contract was executing, the result and state writes are not recorded")
+			return executionResult{Status: http.StatusConflict, Body: gin.H{"error": "request was finished while its contract was executing", "data": result}, RequestId: requestId}
+		}
 		if err != nil {
-			fmt.Println("Error updating request status:", err)
-			return
+			logger.Error("Error updating request status", "error", err)
+			return executionResult{RequestId: requestId, Err: err}
 		} //handle error here
 	} else {
-		err = updateRequestStatus(requestId, Failed)
-		if err != nil {
-			fmt.Println("Error updating request status:", err)
-			return
-		}
+		fail(result)
 	}
+
 	resultFinal := gin.H{
 		"message": "DApp executed successfully",
-		"data":    response,
+		"data":    result,
+	}
+	if !result.Succeeded() {
+		resultFinal["message"] = "DApp execution failed"
 	}
+	return executionResult{Status: http.StatusOK, Body: resultFinal, RequestId: requestId}
+}
 
-	// Return a response
-	c.JSON(http.StatusOK, resultFinal)
+// blockFunction returns the function named in the data of a block, along
+// with its input
+func blockFunction(data string) (string, interface{}, error) {
+	var inputMap map[string]interface{}
+	if err := json.Unmarshal([]byte(data), &inputMap); err != nil {
+		return "", nil, fmt.Errorf("smart contract data is not a JSON object: %w", err)
+	}
+	if len(inputMap) != 1 {
+		return "", nil, fmt.Errorf("smart contract data must name exactly one function, found %d", len(inputMap))
+	}
+	for funcName, input := range inputMap {
+		return funcName, input, nil
+	}
+	return "", nil, nil
+}
+
+// failRequest marks a request as Failed with the outcome and error code of
+// result, logging rather than returning any error since the caller is already
+// on its failure path
+func failRequest(ctx context.Context, requestId string, result contractresult.Result) {
+	err := markRequestFailed(ctx, requestId, string(result.Outcome), result.Code, result.Message)
+	if err != nil {
+		loggerFrom(ctx).Error("Error updating request status", "error", err)
+	}
+}
+
+// failExecution marks a request whose contract was executed as Failed,
+// unless it was already finished while the contract was running
+func failExecution(ctx context.Context, requestId string, result contractresult.Result) {
+	err := markExecutionFailed(ctx, requestId, string(result.Outcome), result.Code, result.Message)
+	if err == errNotPending {
+		loggerFrom(ctx).Warn("Request finished while its contract was executing, the failure is not recorded", "reason", result.Code)
+	} else if err != nil {
+		loggerFrom(ctx).Error("Error updating request status", "error", err)
+	}
 }
 
 // Handler function for /request-status
 func getRequestStatusHandler(c *gin.Context) {
 	reqId := c.Query("req_id")
 	// Open a SQLite database connection
-	db, err := sql.Open("sqlite3", "./requests.db")
+	db, err := sql.Open("sqlite3", settings.DBPath)
 	if err != nil {
-		log.Printf("Failed to open the database: %v", err)
+		slog.Error("Failed to open the database", "error", err)
 		return
 	}
 	defer db.Close()
 	var status int
+	var outcome, failureReason, failureDetail, validationErrors sql.NullString
 
 	// Prepare the SQL query
-	query := `SELECT status FROM requests WHERE request_id = ?`
+	query := `SELECT status, outcome, failure_reason, failure_detail, validation_errors FROM requests WHERE request_id = ?`
 
 	// Execute the query
-	err = db.QueryRow(query, reqId).Scan(&status)
+	err = db.QueryRow(query, reqId).Scan(&status, &outcome, &failureReason, &failureDetail, &validationErrors)
 	if err != nil {
 		if err == sql.ErrNoRows {
 			// No rows found
-			fmt.Printf("no record found with request_id: %s", reqId)
+			slog.Debug("No record found", "request_id", reqId)
 			return
 		}
-		fmt.Printf("Query Failed")
+		slog.Error("Query failed", "request_id", reqId, "error", err)
 	}
 
 	// Return the status
@@ -328,35 +434,130 @@ func getRequestStatusHandler(c *gin.Context) {
 		"message": "Request Status: " + strconv.Itoa(status),
 		"status":  status,
 	}
+	if outcome.Valid {
+		resultFinal["outcome"] = outcome.String
+	}
+	if failureReason.Valid {
+		resultFinal["failure_reason"] = failureReason.String
+		resultFinal["failure_detail"] = failureDetail.String
+	}
+	if validationErrors.Valid {
+		resultFinal["field_errors"] = json.RawMessage(validationErrors.String)
+	}
 
 	// Return a response
 	c.JSON(http.StatusOK, resultFinal)
 }
 
-func bootupServer() {
-	// Initialize a Gin router
-	router := gin.Default()
-	config := GetConfig()
+// Handler function for /requests/:id/trace
+func getRequestTraceHandler(c *gin.Context) {
+	reqId := c.Param("id")
+	trace, found, err := getRequestTrace(reqId)
+	if err != nil {
+		loggerFrom(c.Request.Context()).Error("Failed to fetch trace", "request_id", reqId, "error", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to fetch trace"})
+		return
+	}
+	if !found {
+		c.JSON(http.StatusNotFound, gin.H{"error": fmt.Sprintf("no trace found for request_id: %s", reqId)})
+		return
+	}
+
+	c.Data(http.StatusOK, "application/json; charset=utf-8", []byte(trace))
+}
+
+// callbackDispatcher authenticates the request and executes the contract
+// whose callback_url is its path
+func callbackDispatcher(c *gin.Context) {
+	if draining.Load() {
+		c.Header("Retry-After", "30")
+		c.JSON(http.StatusServiceUnavailable, gin.H{"error": "server is shutting down"})
+		return
+	}
+	if c.Request.Method == http.MethodPost {
+		config := GetConfig()
+		for feature, contractInfo := range config.ContractsInfo {
+			if contractInfo == nil || contractInfo.Disabled || contractInfo.CallBackUrl != c.Request.URL.Path {
+				continue
+			}
+			callbacksReceived.inc(feature)
+			if contractInfo.CallbackAuth != nil {
+				if reason, ok := contractInfo.CallbackAuth.authenticate(c); !ok {
+					rejectCallback(c, feature, reason)
+					return
+				}
+			}
+			c.Set(callbackContractKey, feature)
+			rateLimitByClient(c)
+			if c.IsAborted() {
+				return
+			}
+			contractCallbackHandler(c, feature)
+			return
+		}
+	}
+	c.JSON(http.StatusNotFound, gin.H{"error": "not found"})
+}
 
-	log.SetFlags(log.LstdFlags)
+// bootupServer serves the API until ctx is cancelled, then shuts down
+// gracefully
+func bootupServer(ctx context.Context) {
+	// Initialize a Gin router
+	router := gin.New()
+	router.Use(gin.Recovery(), traceRequests, logRequests)
 
 	// Configure CORS middleware
+	router.Use(rateLimitByIP)
 	router.Use(cors.New(cors.Config{
-		AllowOrigins:     []string{"*"},
-		AllowMethods:     []string{"GET", "POST", "OPTIONS"},
-		AllowHeaders:     []string{"Origin", "Content-Type", "Accept"},
-		ExposeHeaders:    []string{"Content-Length"},
+		AllowOriginFunc: allowOrigin,
+		AllowMethods:    []string{"GET", "POST", "PUT", "DELETE", "OPTIONS"},
+		AllowHeaders:    []string{"Origin", "Content-Type", "Accept", "Authorization", "X-API-Key"},
+		ExposeHeaders:   []string{"Content-Length"},
 	}))
 
-	nftDappCallbackHandler := config.ContractsInfo["nft"].CallBackUrl
-	ftDappCallbackHandler := config.ContractsInfo["ft"].CallBackUrl
-	
-	// Define endpoints
-	router.POST(nftDappCallbackHandler, nftDappHandler) // NFT
-	router.POST(ftDappCallbackHandler, ftDappHandler) // FT
-	
-	router.GET("/request-status", getRequestStatusHandler)
-
-	// Start the server on port 8080
-	router.Run(":8080")
+	// Callback urls are looked up in the current config, so that contracts
+	// added or removed at runtime are served without a restart
+	router.NoRoute(callbackDispatcher)
+
+	router.GET("/healthz", healthzHandler)
+	router.GET("/readyz", readyzHandler)
+	router.GET("/metrics", requireScope(ScopeReadStatus), metricsHandler)
+	router.GET("/request-status", requireScope(ScopeReadStatus), rateLimitByClient, getRequestStatusHandler)
+	router.POST("/simulate/:contract", requireScope(ScopeExecute), rateLimitByClient, simulateHandler)
+	router.GET("/requests/:id/trace", requireScope(ScopeReadStatus), rateLimitByClient, getRequestTraceHandler)
+	router.POST("/policy/check", requireScope(ScopeExecute), rateLimitByClient, checkPolicyHandler)
+	registerAdminRoutes(router)
+	registerDidAuthRoutes(router)
+
+	// Start the server on the configured port
+	server := &http.Server{
+		Addr:    fmt.Sprintf(":%d", settings.Port),
+		Handler: router,
+	}
+	config := GetConfig()
+	if config.TLS != nil {
+		tlsConfig, err := serverTLSConfig(config.TLS)
+		if err != nil {
+			log.Fatalf("Failed to load TLS certificate: %v", err)
+		}
+		server.TLSConfig = tlsConfig
+	}
+
+	serveErr := make(chan error, 1)
+	go func() {
+		if server.TLSConfig != nil {
+			slog.Info("Listening and serving HTTPS", "address", server.Addr)
+			serveErr <- server.ListenAndServeTLS("", "")
+		} else {
+			slog.Info("Listening and serving HTTP", "address", server.Addr)
+			serveErr <- server.ListenAndServe()
+		}
+	}()
+
+	select {
+	case err := <-serveErr:
+		log.Fatalf("Server stopped: %v", err)
+	case <-ctx.Done():
+		shutdownServer(server)
+	}
 }
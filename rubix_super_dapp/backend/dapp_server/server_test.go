@@ -0,0 +1,59 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"testing"
+)
+
+// blocksNode is a Rubix node which returns blocks as the smart contract data
+// of every contract
+func blocksNode(t *testing.T, blocks ...SCTDataReply) *httptest.Server {
+	t.Helper()
+	node := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(SmartContractDataReply{BasicResponse: BasicResponse{Status: true}, SCTDataReply: blocks})
+	}))
+	t.Cleanup(node.Close)
+	return node
+}
+
+// requestFailure returns the status and failure reason stored for a request
+func requestFailure(t *testing.T, requestId string) (int, string) {
+	t.Helper()
+	db, err := sql.Open("sqlite3", settings.DBPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	var status int
+	var reason sql.NullString
+	if err := db.QueryRow(`SELECT status, failure_reason FROM requests WHERE request_id = ?;`, requestId).Scan(&status, &reason); err != nil {
+		t.Fatalf("failed to read request %s: %v", requestId, err)
+	}
+	return status, reason.String
+}
+
+func TestPolicyErrorFailsRequest(t *testing.T) {
+	setupTestServer(t)
+	node := blocksNode(t, SCTDataReply{BlockNo: 1, SmartContractData: `{"mint_sample_nft": {"name": "rubix1"}}`, ExecutorDID: "did:caller"})
+	contractInfo := &ContractInfo{ContractHash: "QmPolicy", ContractPath: nftArtifact, CallBackUrl: "/api/nft"}
+	currentConfig.Store(&Config{
+		NodeAddress:   node.URL,
+		PolicyPath:    filepath.Join(t.TempDir(), "missing-policy.json"),
+		ContractsInfo: map[string]*ContractInfo{"nft": contractInfo},
+	})
+
+	result := executeContract(context.Background(), "nft", "QmPolicy", executionOptions{})
+	if result.Status != http.StatusInternalServerError {
+		t.Errorf("status = %d, want %d", result.Status, http.StatusInternalServerError)
+	}
+	status, reason := requestFailure(t, result.RequestId)
+	if status != Failed || reason != ReasonPolicyError {
+		t.Errorf("request %s is %d with reason %q, want failed with %s", result.RequestId, status, reason, ReasonPolicyError)
+	}
+}
@@ -0,0 +1,227 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"os"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// defaultShutdownTimeout bounds the draining of in-flight executions when
+// shutdown_timeout_seconds is not set
+const defaultShutdownTimeout = 30 * time.Second
+
+// draining is set once the server stops accepting callbacks
+var draining atomic.Bool
+
+// backgroundJobs are the jobs, such as audit anchoring, which are waited for
+// along with the in-flight executions on shutdown
+var backgroundJobs sync.WaitGroup
+
+// inFlight counts the executions of every request being processed
+var inFlight = struct {
+	sync.Mutex
+	requests map[string]int
+}{requests: make(map[string]int)}
+
+// runningModules are the contract modules being called, which are
+// interrupted when the shutdown timeout is reached
+var runningModules = struct {
+	sync.Mutex
+	modules map[*contractModule]int
+}{modules: make(map[*contractModule]int)}
+
+// A running server records a heartbeat every serverHeartbeatInterval.
+// Commands executing contracts refuse to run while the heartbeat is more
+// recent than serverHeartbeatTTL, as the executions of a contract are only
+// serialized within a process.
+const (
+	serverHeartbeatInterval = 10 * time.Second
+	serverHeartbeatTTL      = 30 * time.Second
+)
+
+// errNotPending is returned when a request has already finished
+var errNotPending = errors.New("request is not pending")
+
+// trackExecution records that requestId is being executed until the returned
+// function is called
+func trackExecution(requestId string) func() {
+	inFlight.Lock()
+	inFlight.requests[requestId]++
+	inFlight.Unlock()
+	return func() {
+		inFlight.Lock()
+		defer inFlight.Unlock()
+		if inFlight.requests[requestId]--; inFlight.requests[requestId] <= 0 {
+			delete(inFlight.requests, requestId)
+		}
+	}
+}
+
+// trackRunningModule records that a function of module is being called until
+// the returned function is called
+func trackRunningModule(module *contractModule) func() {
+	runningModules.Lock()
+	runningModules.modules[module]++
+	runningModules.Unlock()
+	return func() {
+		runningModules.Lock()
+		defer runningModules.Unlock()
+		if runningModules.modules[module]--; runningModules.modules[module] <= 0 {
+			delete(runningModules.modules, module)
+		}
+	}
+}
+
+// startServerHeartbeat records the heartbeat of the server until the
+// returned function is called, which removes it
+func startServerHeartbeat() (func(), error) {
+	hostname, _ := os.Hostname()
+	holder := fmt.Sprintf("pid %d on %s", os.Getpid(), hostname)
+	if err := recordServerHeartbeat(holder, time.Now()); err != nil {
+		return nil, err
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		ticker := time.NewTicker(serverHeartbeatInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case now := <-ticker.C:
+				if err := recordServerHeartbeat(holder, now); err != nil {
+					slog.Error("Failed to record server heartbeat", "error", err)
+				}
+			}
+		}
+	}()
+	return func() {
+		cancel()
+		<-done
+		if err := clearServerHeartbeat(holder); err != nil {
+			slog.Error("Failed to clear server heartbeat", "error", err)
+		}
+	}, nil
+}
+
+// interruptRunningModules interrupts every contract being called, returning
+// how many there were
+func interruptRunningModules() int {
+	runningModules.Lock()
+	defer runningModules.Unlock()
+	for module := range runningModules.modules {
+		module.interrupt(errExecutionInterrupted)
+	}
+	return len(runningModules.modules)
+}
+
+// inFlightRequests lists the requests being executed
+func inFlightRequests() []string {
+	inFlight.Lock()
+	defer inFlight.Unlock()
+	requests := make([]string, 0, len(inFlight.requests))
+	for requestId := range inFlight.requests {
+		requests = append(requests, requestId)
+	}
+	sort.Strings(requests)
+	return requests
+}
+
+func (c Config) shutdownTimeout() time.Duration {
+	if c.ShutdownTimeoutSeconds == 0 {
+		return defaultShutdownTimeout
+	}
+	return time.Duration(c.ShutdownTimeoutSeconds) * time.Second
+}
+
+// shutdownServer stops accepting callbacks and waits, up to the shutdown
+// timeout, for the in-flight executions and background jobs to finish. The
+// contracts still running after that are interrupted and their requests are
+// marked interrupted.
+func shutdownServer(server *http.Server) {
+	draining.Store(true)
+	timeout := GetConfig().shutdownTimeout()
+	slog.Info("Shutting down, draining in-flight executions", "timeout", timeout.String(), "in_flight", len(inFlightRequests()))
+
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	if err := server.Shutdown(ctx); err != nil {
+		slog.Warn("Shutdown timeout reached with executions in flight", "error", err)
+	}
+
+	jobsDone := make(chan struct{})
+	go func() {
+		backgroundJobs.Wait()
+		close(jobsDone)
+	}()
+	select {
+	case <-jobsDone:
+	case <-ctx.Done():
+		slog.Warn("Shutdown timeout reached with background jobs running")
+	}
+
+	// The contracts still running are stopped, they fail once the host
+	// function they may be in returns
+	if interrupted := interruptRunningModules(); interrupted > 0 {
+		slog.Warn("Interrupted contracts still running", "count", interrupted)
+	}
+
+	for _, requestId := range inFlightRequests() {
+		err := markRequestInterrupted(context.Background(), requestId, "the server shut down while the request was executing")
+		if err != nil && err != errNotPending {
+			slog.Error("Failed to mark request interrupted", "request_id", requestId, "error", err)
+		}
+	}
+
+	if err := checkpointDB(); err != nil {
+		slog.Error("Failed to checkpoint the database", "error", err)
+	}
+	slog.Info("Shutdown complete")
+}
+
+// checkpointDB writes the database journal back to the database file
+func checkpointDB() error {
+	db, err := sql.Open("sqlite3", settings.DBPath)
+	if err != nil {
+		return fmt.Errorf("failed to open the database: %w", err)
+	}
+	defer db.Close()
+	if _, err := db.Exec(`PRAGMA wal_checkpoint(TRUNCATE);`); err != nil {
+		return fmt.Errorf("failed to checkpoint: %w", err)
+	}
+	return nil
+}
+
+// reconcileInterruptedRequests fails the requests left pending by a previous
+// run of the server, which was stopped before they finished. Requests whose
+// contract had started executing may have submitted transactions, so they
+// are only requeued by an operator after checking the chain.
+func reconcileInterruptedRequests() error {
+	requests, err := getPendingRequests()
+	if err != nil {
+		return err
+	}
+	for _, request := range requests {
+		detail := "the server stopped before the contract was executed"
+		if request.executionStarted {
+			detail = "the server stopped while the contract was executing, it may have submitted transactions"
+		}
+		err := markRequestInterrupted(context.Background(), request.requestId, detail)
+		if err != nil && err != errNotPending {
+			return err
+		}
+		slog.Warn("Marked interrupted request", "request_id", request.requestId, "execution_started", request.executionStarted)
+	}
+	return nil
+}
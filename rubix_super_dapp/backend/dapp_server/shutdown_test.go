@@ -0,0 +1,141 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"testing"
+	"time"
+
+	"dapp_server/contractresult"
+
+	wasmbridge "github.com/rubixchain/rubix-wasm/go-wasm-bridge"
+)
+
+func TestFinishedRequestIsNotOverwritten(t *testing.T) {
+	setupTestServer(t)
+	ctx := context.Background()
+
+	tests := []struct {
+		name   string
+		finish func(requestId string) error
+	}{
+		{"complete", func(requestId string) error {
+			state := newContractState("QmInterrupted")
+			state.set("votes/alice", json.RawMessage(`"red"`))
+			return completeRequest(ctx, requestId, state, contractresult.Parse("success"))
+		}},
+		{"fail", func(requestId string) error {
+			return markExecutionFailed(ctx, requestId, string(contractresult.Trap), contractresult.CodeTrap, "trapped")
+		}},
+		{"interrupt", func(requestId string) error {
+			return markRequestInterrupted(ctx, requestId, "shut down again")
+		}},
+	}
+	for _, test := range tests {
+		requestId := "interrupted-" + test.name
+		if err := insertRequest(ctx, requestId, Pending); err != nil {
+			t.Fatal(err)
+		}
+		if err := markRequestInterrupted(ctx, requestId, "the server shut down while the request was executing"); err != nil {
+			t.Fatal(err)
+		}
+		if err := test.finish(requestId); err != errNotPending {
+			t.Errorf("%s: finishing an interrupted request = %v, want errNotPending", test.name, err)
+		}
+		status, _, err := getRequestStatus(requestId)
+		if err != nil || status != Failed {
+			t.Errorf("%s: status = %d, %v, want failed", test.name, status, err)
+		}
+	}
+
+	if _, found, err := newContractState("QmInterrupted").get("votes/alice"); err != nil || found {
+		t.Errorf("state of an interrupted request was committed: found %v, %v", found, err)
+	}
+	if verification, err := verifyAuditLog(); err != nil || !verification.Valid {
+		t.Errorf("audit log after refused transitions = %+v, %v", verification, err)
+	}
+}
+
+func TestInterruptRunningModules(t *testing.T) {
+	module, err := loadContractModule(writeLimitsTestContract(t), wasmbridge.NewHostFunctionRegistry(), "", 2, nil)
+	if err != nil {
+		t.Fatalf("failed to load module: %v", err)
+	}
+	done := make(chan error, 1)
+	go func() {
+		_, err := module.CallFunction(`{"spin": {}}`)
+		done <- err
+	}()
+
+	deadline := time.Now().Add(5 * time.Second)
+	for interruptRunningModules() == 0 {
+		if time.Now().After(deadline) {
+			t.Fatal("spinning contract never started")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	select {
+	case err := <-done:
+		if !errors.Is(err, errExecutionInterrupted) {
+			t.Errorf("interrupted call = %v, want errExecutionInterrupted", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("contract still running after it was interrupted")
+	}
+	if interrupted := interruptRunningModules(); interrupted != 0 {
+		t.Errorf("%d contracts still tracked after returning", interrupted)
+	}
+}
+
+func TestActiveServer(t *testing.T) {
+	setupTestServer(t)
+	now := time.Now()
+
+	tests := []struct {
+		name   string
+		update func() error
+		active bool
+	}{
+		{"no heartbeat", func() error { return nil }, false},
+		{"recent heartbeat", func() error { return recordServerHeartbeat("server-a", now.Add(-serverHeartbeatInterval)) }, true},
+		{"stale heartbeat", func() error { return recordServerHeartbeat("server-a", now.Add(-2*serverHeartbeatTTL)) }, false},
+		{"heartbeat of another server", func() error { return recordServerHeartbeat("server-b", now) }, true},
+		{"cleared by another server", func() error { return clearServerHeartbeat("server-a") }, true},
+		{"cleared", func() error { return clearServerHeartbeat("server-b") }, false},
+	}
+	for _, test := range tests {
+		if err := test.update(); err != nil {
+			t.Fatalf("%s: %v", test.name, err)
+		}
+		_, active, err := activeServer(now)
+		if err != nil {
+			t.Fatalf("%s: %v", test.name, err)
+		}
+		if active != test.active {
+			t.Errorf("%s: activeServer() = %v, want %v", test.name, active, test.active)
+		}
+	}
+}
+
+func TestGetRequestBlock(t *testing.T) {
+	setupTestServer(t)
+	ctx := context.Background()
+	if err := insertRequest(ctx, "requeued", Pending); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, known, err := getRequestBlock("requeued"); err != nil || known {
+		t.Errorf("getRequestBlock() before the block is recorded = %v, %v, want unknown", known, err)
+	}
+	if err := recordRequestBlock(ctx, "requeued", 7, "did-caller"); err != nil {
+		t.Fatal(err)
+	}
+	blockNo, known, err := getRequestBlock("requeued")
+	if err != nil || !known || blockNo != 7 {
+		t.Errorf("getRequestBlock() = %d, %v, %v, want block 7", blockNo, known, err)
+	}
+	if _, known, err := getRequestBlock("missing"); err != nil || known {
+		t.Errorf("getRequestBlock() of a missing request = %v, %v, want unknown", known, err)
+	}
+}
@@ -0,0 +1,271 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"strconv"
+	"sync"
+
+	"dapp_server/contractresult"
+
+	"github.com/bytecodealliance/wasmtime-go"
+	"github.com/gin-gonic/gin"
+	wasmbridge "github.com/rubixchain/rubix-wasm/go-wasm-bridge"
+)
+
+// bridgeCallType is the signature the contracts import the bridge functions
+// with, (input_ptr, input_len, resp_ptr_ptr, resp_len_ptr) -> i32
+var bridgeCallType = wasmFuncType{
+	params:  []byte{wasmI32, wasmI32, wasmI32, wasmI32},
+	results: []byte{wasmI32},
+}
+
+// chainHostFunctions are the bridge host functions which submit transactions
+// to the Rubix node, with the signature they are imported with from env.
+// During a simulation they are replaced by functions which only record the
+// call.
+var chainHostFunctions = map[string]wasmFuncType{
+	"do_mint_nft":     bridgeCallType,
+	"do_transfer_nft": bridgeCallType,
+	"do_mint_ft":      bridgeCallType,
+	"do_transfer_ft":  bridgeCallType,
+}
+
+// SimulatedCall is a host call which was intercepted during a simulation
+type SimulatedCall struct {
+	HostFunction string          `json:"host_function"`
+	Args         json.RawMessage `json:"args"`
+}
+
+// simulationRecorder collects the calls intercepted during a simulation
+type simulationRecorder struct {
+	mu    sync.Mutex
+	calls []SimulatedCall
+}
+
+func (r *simulationRecorder) record(name string, args json.RawMessage) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.calls = append(r.calls, SimulatedCall{HostFunction: name, Args: args})
+}
+
+func (r *simulationRecorder) recorded() []SimulatedCall {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return append([]SimulatedCall{}, r.calls...)
+}
+
+// simulatedHostFunction replaces a chain mutating bridge function, with the
+// signature of the function it replaces
+type simulatedHostFunction struct {
+	dappHostFunction
+	funcType wasmFuncType
+}
+
+func (h *simulatedHostFunction) FuncType() *wasmtime.FuncType {
+	kinds := map[byte]wasmtime.ValKind{wasmI32: wasmtime.KindI32, wasmI64: wasmtime.KindI64, wasmF32: wasmtime.KindF32, wasmF64: wasmtime.KindF64}
+	valTypes := func(types []byte) []*wasmtime.ValType {
+		var valTypes []*wasmtime.ValType
+		for _, valType := range types {
+			valTypes = append(valTypes, wasmtime.NewValType(kinds[valType]))
+		}
+		return valTypes
+	}
+	return wasmtime.NewFuncType(valTypes(h.funcType.params), valTypes(h.funcType.results))
+}
+
+// newSimulationRegistry returns the host functions of a simulation, the dapp
+// host functions the contract may use with the chain mutating bridge
+// functions replaced
+func newSimulationRegistry(ctx *HostCallContext) *wasmbridge.HostFunctionRegistry {
+	registry := newHostFunctionRegistry(ctx)
+	for name, funcType := range chainHostFunctions {
+		registry.Register(&simulatedHostFunction{
+			dappHostFunction: dappHostFunction{name: name, handler: simulatedChainCall(name), ctx: ctx},
+			funcType:         funcType,
+		})
+	}
+	return registry
+}
+
+// checkSimulationImports makes sure a simulation of the wasm artifact at
+// path cannot reach the chain. Every function it imports must be one the
+// simulation replaces, with the signature it replaces it with, or a dapp host
+// function available to the contract. Other bridge functions may have side
+// effects, so such artifacts are not simulated.
+func checkSimulationImports(path string, feature string, contractInfo *ContractInfo) error {
+	code, err := os.ReadFile(path)
+	if err != nil {
+		return fmt.Errorf("failed to read wasm artifact: %w", err)
+	}
+	imports, err := declaredImports(code)
+	if err != nil {
+		return fmt.Errorf("failed to parse wasm artifact: %w", err)
+	}
+	dappFunctions := make(map[string]bool)
+	for _, name := range hostFunctionNames(feature) {
+		dappFunctions[name] = contractInfo.allowsHostFunction(name)
+	}
+	for _, imp := range imports {
+		if !imp.isFunc {
+			continue
+		}
+		if imp.module != "env" {
+			return fmt.Errorf("contract imports %s.%s, which cannot be simulated", imp.module, imp.name)
+		}
+		if funcType, ok := chainHostFunctions[imp.name]; ok {
+			if !imp.funcType.equal(funcType) {
+				return fmt.Errorf("contract imports %s as %s, the simulation only replaces %s", imp.name, imp.funcType, funcType)
+			}
+			continue
+		}
+		if !dappFunctions[imp.name] {
+			return fmt.Errorf("contract imports %s, which cannot be simulated without side effects", imp.name)
+		}
+	}
+	return nil
+}
+
+// simulatedChainCall stands in for a chain mutating host function, reporting
+// success to the contract without contacting the node
+func simulatedChainCall(name string) HostFunctionHandler {
+	return func(ctx *HostCallContext, args json.RawMessage) (interface{}, error) {
+		ctx.Simulation.record(name, args)
+		return BasicResponse{Status: true, Message: "simulated " + name}, nil
+	}
+}
+
+// Handler function for /simulate/:contract
+//
+// The body is the contract input, e.g. {"mint_sample_nft": {...}}, which is
+// run against the local wasm artifact of the contract, with the policy
+// checked for the DID of the caller_did query parameter. Nothing is written
+// to the chain or the database.
+func simulateHandler(c *gin.Context) {
+	feature := c.Param("contract")
+	config := GetConfig()
+	contractInfo, ok := config.ContractsInfo[feature]
+	if !ok || contractInfo == nil || contractInfo.Disabled {
+		c.JSON(http.StatusNotFound, gin.H{"error": fmt.Sprintf("unknown contract %s", feature)})
+		return
+	}
+
+	body, err := io.ReadAll(c.Request.Body)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid request body"})
+		return
+	}
+	var inputMap map[string]json.RawMessage
+	if err := json.Unmarshal(body, &inputMap); err != nil || len(inputMap) != 1 {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "input must be a JSON object with a single function name as key"})
+		return
+	}
+	var funcName string
+	for key := range inputMap {
+		funcName = key
+	}
+	if _, ok := contractInfo.functionSuffix(feature, funcName); !ok {
+		c.JSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("function %s is not allowed", funcName)})
+		return
+	}
+
+	var input interface{}
+	if err := json.Unmarshal(inputMap[funcName], &input); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid request body"})
+		return
+	}
+	fieldErrors, err := validateContractInput(contractInfo, funcName, input)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": fmt.Sprintf("failed to load input schema: %v", err)})
+		return
+	}
+	if len(fieldErrors) > 0 {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "invalid contract input", "field_errors": fieldErrors})
+		return
+	}
+
+	decision, err := evaluatePolicy(c.Request.Context(), config, PolicyRequest{Contract: feature, Function: funcName, CallerDid: c.Query("caller_did"), Input: input})
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": fmt.Sprintf("failed to evaluate policy: %v", err)})
+		return
+	}
+	if !decision.Allowed {
+		c.JSON(http.StatusForbidden, gin.H{"error": "denied by policy", "policy": decision})
+		return
+	}
+
+	// Simulate against the latest version unless a block is given
+	blockNo := uint64(latestBlock)
+	if block := c.Query("block"); block != "" {
+		blockNo, err = strconv.ParseUint(block, 10, 64)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "block must be a block number"})
+			return
+		}
+	}
+	version, err := contractInfo.versionForBlock(blockNo)
+	if err == nil {
+		err = version.verifyArtifact()
+	}
+	if err != nil {
+		c.JSON(http.StatusUnprocessableEntity, gin.H{"error": err.Error()})
+		return
+	}
+
+	if err := checkModuleLimits(version.ContractPath, contractInfo.Limits); err != nil {
+		c.JSON(http.StatusUnprocessableEntity, gin.H{"error": err.Error()})
+		return
+	}
+
+	if err := checkSimulationImports(version.ContractPath, feature, contractInfo); err != nil {
+		c.JSON(http.StatusUnprocessableEntity, gin.H{"error": err.Error()})
+		return
+	}
+
+	recorder := &simulationRecorder{}
+	trace := newExecutionTrace("simulation", string(body))
+	trace.ContractVersion = version.Version
+	state := newContractState(contractInfo.ContractHash)
+	ctx := &HostCallContext{
+		Context:      withLogAttrs(c.Request.Context(), "contract", feature, "simulation", true),
+		Feature:      feature,
+		Contract:     contractInfo,
+		ContractHash: contractInfo.ContractHash,
+		RequestId:    "simulation",
+		Config:       config,
+		State:        state,
+		Simulation:   recorder,
+		Trace:        trace,
+	}
+	hostFnRegistry := newSimulationRegistry(ctx)
+	traceHostFunctions(ctx.Context, hostFnRegistry, trace)
+
+	wasmModule, err := newContractModule(ctx.Context, version, contractInfo, config, hostFnRegistry)
+	if err != nil {
+		ctx.logger().Error("Failed to initialize WASM module", "error", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": fmt.Sprintf("failed to load contract: %v", err)})
+		return
+	}
+
+	executionResult, err := executeAndGetContractResult(ctx.Context, wasmModule, string(body), contractInfo.Limits)
+	trace.finish(executionResult, err)
+	if err != nil {
+		c.JSON(http.StatusOK, gin.H{
+			"error": err.Error(),
+			"calls": recorder.recorded(),
+			"trace": trace,
+		})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"output":       executionResult,
+		"result":       contractresult.Parse(executionResult),
+		"calls":        recorder.recorded(),
+		"state_writes": state.pendingWrites(),
+		"trace":        trace,
+	})
+}
@@ -0,0 +1,202 @@
+package main
+
+import (
+	"context"
+	"encoding/binary"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"testing"
+
+	"github.com/bytecodealliance/wasmtime-go"
+	"github.com/gin-gonic/gin"
+	wasmbridge "github.com/rubixchain/rubix-wasm/go-wasm-bridge"
+)
+
+// Artifacts shipped with the sample dapps
+const (
+	nftArtifact       = "../nft_contract/artifacts/nft_contract.wasm"
+	ftArtifact        = "../ft_contract/artifacts/ft_contract.wasm"
+	legacyNftArtifact = "../../../nft_dapp/backend/nft_contract/artifacts/nft_contract.wasm"
+)
+
+const mintSampleNftInput = `{"name": "rubix1", "nft_info": {"did": "bafybmitestdid", "metadata": "metadata.json", "artifact": "artifact.png"}}`
+
+// countingNode is a Rubix node which only counts the calls made to it
+func countingNode(t *testing.T) (*httptest.Server, *atomic.Int32) {
+	t.Helper()
+	var calls atomic.Int32
+	node := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		calls.Add(1)
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte(`{"status": true, "message": "done"}`))
+	}))
+	t.Cleanup(node.Close)
+	return node, &calls
+}
+
+// setupSimulation configures the nft contract against node
+func setupSimulation(t *testing.T, node *httptest.Server) (*HostCallContext, *simulationRecorder) {
+	t.Helper()
+	setupTestServer(t)
+	registerDefaultHostFunctions()
+	contractInfo := &ContractInfo{ContractHash: "QmSimulated", ContractPath: nftArtifact, CallBackUrl: "/api/nft"}
+	config := &Config{NodeAddress: node.URL, ContractsInfo: map[string]*ContractInfo{"nft": contractInfo}}
+	currentConfig.Store(config)
+
+	recorder := &simulationRecorder{}
+	return &HostCallContext{
+		Context:      context.Background(),
+		Feature:      "nft",
+		Contract:     contractInfo,
+		ContractHash: contractInfo.ContractHash,
+		RequestId:    "simulation",
+		Config:       *config,
+		State:        newContractState(contractInfo.ContractHash),
+		Simulation:   recorder,
+		Trace:        newExecutionTrace("simulation", mintSampleNftInput),
+	}, recorder
+}
+
+// callArtifact calls function of the wasm artifact at path with input, the
+// way the bridge does, resolving its imports from registry. Functions
+// registered later replace earlier ones of the same name.
+func callArtifact(t *testing.T, path string, registry *wasmbridge.HostFunctionRegistry, nodeAddress string, function string, input string) (int32, string) {
+	t.Helper()
+	engine := wasmtime.NewEngine()
+	store := wasmtime.NewStore(engine)
+	module, err := wasmtime.NewModuleFromFile(engine, path)
+	if err != nil {
+		t.Fatalf("failed to load %s: %v", path, err)
+	}
+	linker := wasmtime.NewLinker(engine)
+	linker.AllowShadowing(true)
+	hostFns := registry.GetHostFunctions()
+	for _, hostFn := range hostFns {
+		if err := linker.FuncNew("env", hostFn.Name(), hostFn.FuncType(), hostFn.Callback()); err != nil {
+			t.Fatalf("failed to define %s: %v", hostFn.Name(), err)
+		}
+	}
+	instance, err := linker.Instantiate(store, module)
+	if err != nil {
+		t.Fatalf("failed to instantiate %s: %v", path, err)
+	}
+	memory := instance.GetExport(store, "memory").Memory()
+	alloc, dealloc := instance.GetFunc(store, "alloc"), instance.GetFunc(store, "dealloc")
+	for _, hostFn := range hostFns {
+		hostFn.Initialize(alloc, dealloc, memory, nodeAddress, 2)
+	}
+
+	allocate := func(size int) int32 {
+		ptr, err := alloc.Call(store, int32(size))
+		if err != nil {
+			t.Fatalf("alloc failed: %v", err)
+		}
+		return ptr.(int32)
+	}
+	inputPtr := allocate(len(input))
+	copy(memory.UnsafeData(store)[inputPtr:], input)
+	respPtrPtr, respLenPtr := allocate(4), allocate(4)
+
+	result, err := instance.GetFunc(store, function+"_").Call(store, inputPtr, int32(len(input)), respPtrPtr, respLenPtr)
+	if err != nil {
+		t.Fatalf("%s trapped: %v", function, err)
+	}
+	data := memory.UnsafeData(store)
+	respPtr := binary.LittleEndian.Uint32(data[respPtrPtr:])
+	respLen := binary.LittleEndian.Uint32(data[respLenPtr:])
+	return result.(int32), string(data[respPtr : respPtr+respLen])
+}
+
+func TestSimulateMintSampleNftDoesNotCallNode(t *testing.T) {
+	node, nodeCalls := countingNode(t)
+	ctx, recorder := setupSimulation(t, node)
+
+	code, output := callArtifact(t, nftArtifact, newSimulationRegistry(ctx), node.URL, "mint_sample_nft", mintSampleNftInput)
+	if code != 0 {
+		t.Fatalf("mint_sample_nft returned %d: %s", code, output)
+	}
+	if calls := nodeCalls.Load(); calls != 0 {
+		t.Errorf("the node was called %d times during the simulation", calls)
+	}
+	calls := recorder.recorded()
+	if len(calls) != 1 || calls[0].HostFunction != "do_mint_nft" {
+		t.Fatalf("recorded calls = %+v, want a single do_mint_nft", calls)
+	}
+	if !strings.Contains(string(calls[0].Args), "bafybmitestdid") {
+		t.Errorf("do_mint_nft args = %s, want the nft_info of the input", calls[0].Args)
+	}
+}
+
+func TestSimulateHandlerDoesNotCallNode(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	node, nodeCalls := countingNode(t)
+	setupSimulation(t, node)
+
+	w := httptest.NewRecorder()
+	c, _ := gin.CreateTestContext(w)
+	c.Request = httptest.NewRequest(http.MethodPost, "/simulate/nft", strings.NewReader(`{"mint_sample_nft": `+mintSampleNftInput+`}`))
+	c.Params = gin.Params{{Key: "contract", Value: "nft"}}
+	simulateHandler(c)
+
+	if w.Code != http.StatusOK {
+		t.Fatalf("status = %d, want 200: %s", w.Code, w.Body)
+	}
+	var resp map[string]json.RawMessage
+	if err := json.Unmarshal(w.Body.Bytes(), &resp); err != nil {
+		t.Fatalf("response is not JSON: %v", err)
+	}
+	if calls := nodeCalls.Load(); calls != 0 {
+		t.Errorf("the node was called %d times during the simulation", calls)
+	}
+}
+
+func TestCheckSimulationImports(t *testing.T) {
+	setupTestServer(t)
+	registerDefaultHostFunctions()
+	for _, path := range []string{nftArtifact, ftArtifact, legacyNftArtifact} {
+		if err := checkSimulationImports(path, "nft", &ContractInfo{}); err != nil {
+			t.Errorf("%s: %v", path, err)
+		}
+	}
+
+	tests := []struct {
+		name   string
+		wat    string
+		reject string
+	}{
+		{
+			"unknown bridge function",
+			`(module (import "env" "do_api_call" (func (param i32 i32 i32 i32) (result i32))))`,
+			"do_api_call",
+		},
+		{
+			"chain function with another signature",
+			`(module (import "env" "do_mint_nft" (func (param i32 i32) (result i32))))`,
+			"do_mint_nft",
+		},
+		{
+			"dapp host function left out of host_functions",
+			`(module (import "env" "dapp_state_set" (func (param i32 i32 i32 i32) (result i32))))`,
+			"dapp_state_set",
+		},
+	}
+	for _, test := range tests {
+		code, err := wasmtime.Wat2Wasm(test.wat)
+		if err != nil {
+			t.Fatalf("%s: %v", test.name, err)
+		}
+		path := filepath.Join(t.TempDir(), "contract.wasm")
+		if err := os.WriteFile(path, code, 0644); err != nil {
+			t.Fatal(err)
+		}
+		err = checkSimulationImports(path, "nft", &ContractInfo{HostFunctions: []string{"dapp_log"}})
+		if err == nil || !strings.Contains(err.Error(), test.reject) {
+			t.Errorf("%s: error = %v, want %s to be refused", test.name, err, test.reject)
+		}
+	}
+}
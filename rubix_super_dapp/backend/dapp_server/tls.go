@@ -0,0 +1,200 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+)
+
+// certCheckInterval is how often the certificate files are checked for
+// rotation
+const certCheckInterval = 30 * time.Second
+
+// nodeRequestTimeout bounds the calls made to the Rubix node
+const nodeRequestTimeout = 60 * time.Second
+
+// ServerTLS configures TLS for the listener of the dapp server
+type ServerTLS struct {
+	CertFile string `json:"cert_file"`
+	KeyFile  string `json:"key_file"`
+	// ClientCAFile enables client certificates, which are verified against
+	// it when presented. Callbacks can then require one, see CallbackAuth.
+	ClientCAFile string `json:"client_ca_file,omitempty"`
+}
+
+// NodeTLS configures TLS for the calls made to the Rubix node
+type NodeTLS struct {
+	// CAFile is used instead of the system roots to verify the node
+	CAFile string `json:"ca_file,omitempty"`
+	// CertFile and KeyFile are the client certificate presented to the node
+	CertFile string `json:"cert_file,omitempty"`
+	KeyFile  string `json:"key_file,omitempty"`
+}
+
+func (t *ServerTLS) validate() error {
+	if t.CertFile == "" || t.KeyFile == "" {
+		return fmt.Errorf("cert_file and key_file are required")
+	}
+	if _, err := tls.LoadX509KeyPair(t.CertFile, t.KeyFile); err != nil {
+		return err
+	}
+	if t.ClientCAFile != "" {
+		if _, err := loadCertPool(t.ClientCAFile); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (t *NodeTLS) validate() error {
+	_, err := t.clientConfig()
+	return err
+}
+
+// clientConfig builds the TLS config of the node client
+func (t *NodeTLS) clientConfig() (*tls.Config, error) {
+	tlsConfig := &tls.Config{MinVersion: tls.VersionTLS12}
+	if t.CAFile != "" {
+		pool, err := loadCertPool(t.CAFile)
+		if err != nil {
+			return nil, err
+		}
+		tlsConfig.RootCAs = pool
+	}
+	if t.CertFile != "" || t.KeyFile != "" {
+		cert, err := tls.LoadX509KeyPair(t.CertFile, t.KeyFile)
+		if err != nil {
+			return nil, fmt.Errorf("client certificate: %w", err)
+		}
+		tlsConfig.Certificates = []tls.Certificate{cert}
+	}
+	return tlsConfig, nil
+}
+
+func loadCertPool(path string) (*x509.CertPool, error) {
+	content, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read CA file: %w", err)
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(content) {
+		return nil, fmt.Errorf("no certificates found in %s", path)
+	}
+	return pool, nil
+}
+
+// certReloader serves the certificate of the listener, loading it again when
+// the files change so that rotated certificates are used without a restart
+type certReloader struct {
+	certFile string
+	keyFile  string
+
+	mu        sync.Mutex
+	cert      *tls.Certificate
+	modTime   time.Time
+	checkedAt time.Time
+}
+
+func newCertReloader(certFile string, keyFile string) (*certReloader, error) {
+	r := &certReloader{certFile: certFile, keyFile: keyFile}
+	if err := r.reload(); err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+func (r *certReloader) reload() error {
+	info, err := os.Stat(r.certFile)
+	if err != nil {
+		return err
+	}
+	cert, err := tls.LoadX509KeyPair(r.certFile, r.keyFile)
+	if err != nil {
+		return err
+	}
+	r.cert = &cert
+	r.modTime = info.ModTime()
+	return nil
+}
+
+// getCertificate is the tls.Config GetCertificate callback
+func (r *certReloader) getCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if time.Since(r.checkedAt) >= certCheckInterval {
+		r.checkedAt = time.Now()
+		if info, err := os.Stat(r.certFile); err == nil && !info.ModTime().Equal(r.modTime) {
+			if err := r.reload(); err != nil {
+				slog.Error("Failed to reload TLS certificate, keeping the current one", "error", err)
+			} else {
+				slog.Info("Reloaded TLS certificate", "path", r.certFile)
+			}
+		}
+	}
+	return r.cert, nil
+}
+
+// serverTLSConfig builds the TLS config of the listener
+func serverTLSConfig(t *ServerTLS) (*tls.Config, error) {
+	reloader, err := newCertReloader(t.CertFile, t.KeyFile)
+	if err != nil {
+		return nil, err
+	}
+	tlsConfig := &tls.Config{
+		MinVersion:     tls.VersionTLS12,
+		GetCertificate: reloader.getCertificate,
+	}
+	if t.ClientCAFile != "" {
+		pool, err := loadCertPool(t.ClientCAFile)
+		if err != nil {
+			return nil, err
+		}
+		// Only callbacks may require a certificate, other clients connect
+		// without one
+		tlsConfig.ClientCAs = pool
+		tlsConfig.ClientAuth = tls.VerifyClientCertIfGiven
+	}
+	return tlsConfig, nil
+}
+
+// nodeClients caches the HTTP client for the node TLS settings it was built
+// with, so that connections are reused across requests
+var nodeClients = struct {
+	sync.Mutex
+	settings NodeTLS
+	client   *http.Client
+}{}
+
+// nodeHTTPClient returns the client for calls to the Rubix node, using the
+// node_tls settings of the current config
+func nodeHTTPClient() *http.Client {
+	var nodeTLS NodeTLS
+	if config := GetConfig(); config.NodeTLS != nil {
+		nodeTLS = *config.NodeTLS
+	}
+
+	nodeClients.Lock()
+	defer nodeClients.Unlock()
+	if nodeClients.client != nil && nodeClients.settings == nodeTLS {
+		return nodeClients.client
+	}
+
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	tlsConfig, err := nodeTLS.clientConfig()
+	if err != nil {
+		// The settings were validated when the config was loaded, so the
+		// files changed since. Retry on the next call.
+		slog.Error("Failed to load node TLS settings, using the defaults", "error", err)
+		return &http.Client{Transport: &metricsTransport{base: &tracingTransport{base: transport}}, Timeout: nodeRequestTimeout}
+	}
+	transport.TLSClientConfig = tlsConfig
+	nodeClients.settings = nodeTLS
+	nodeClients.client = &http.Client{Transport: &metricsTransport{base: &tracingTransport{base: transport}}, Timeout: nodeRequestTimeout}
+	return nodeClients.client
+}
@@ -0,0 +1,186 @@
+package main
+
+import (
+	"context"
+	"encoding/binary"
+	"encoding/json"
+	"sync"
+	"time"
+
+	"github.com/bytecodealliance/wasmtime-go"
+	wasmbridge "github.com/rubixchain/rubix-wasm/go-wasm-bridge"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+)
+
+// TraceLog is a line written by the contract through dapp_log
+type TraceLog struct {
+	Time    time.Time `json:"time"`
+	Stream  string    `json:"stream"`
+	Message string    `json:"message"`
+}
+
+// TraceHostCall is a single host function invocation made by the contract
+type TraceHostCall struct {
+	Name       string    `json:"name"`
+	Args       string    `json:"args,omitempty"`
+	Response   string    `json:"response,omitempty"`
+	ReturnCode *int32    `json:"return_code,omitempty"`
+	Trap       string    `json:"trap,omitempty"`
+	StartedAt  time.Time `json:"started_at"`
+	DurationMs float64   `json:"duration_ms"`
+}
+
+// ExecutionTrace records what happened during one contract execution
+type ExecutionTrace struct {
+	RequestId       string          `json:"request_id"`
+	BlockNo         uint64          `json:"block_no,omitempty"`
+	ContractVersion string          `json:"contract_version,omitempty"`
+	Input           string          `json:"input"`
+	Logs            []TraceLog      `json:"logs"`
+	HostCalls       []TraceHostCall `json:"host_calls"`
+	Output          string          `json:"output,omitempty"`
+	Error           string          `json:"error,omitempty"`
+	StartedAt       time.Time       `json:"started_at"`
+	FinishedAt      *time.Time      `json:"finished_at,omitempty"`
+
+	// A contract may still be running after a timeout, so the trace can be
+	// written to while it is being saved
+	mu sync.Mutex
+}
+
+func newExecutionTrace(requestId string, input string) *ExecutionTrace {
+	return &ExecutionTrace{
+		RequestId: requestId,
+		Input:     input,
+		Logs:      []TraceLog{},
+		HostCalls: []TraceHostCall{},
+		StartedAt: time.Now(),
+	}
+}
+
+func (t *ExecutionTrace) log(stream string, message string) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.Logs = append(t.Logs, TraceLog{Time: time.Now(), Stream: stream, Message: message})
+}
+
+func (t *ExecutionTrace) addHostCall(call TraceHostCall) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.HostCalls = append(t.HostCalls, call)
+}
+
+// finish records the outcome of the execution
+func (t *ExecutionTrace) finish(output string, err error) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	now := time.Now()
+	t.Output = output
+	if err != nil {
+		t.Error = err.Error()
+	}
+	t.FinishedAt = &now
+}
+
+func (t *ExecutionTrace) MarshalJSON() ([]byte, error) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	type trace ExecutionTrace
+	return json.Marshal((*trace)(t))
+}
+
+// traceHostFunctions wraps every host function of registry, built-in or
+// provided by the dapp server, so that its invocations are recorded in trace
+func traceHostFunctions(ctx context.Context, registry *wasmbridge.HostFunctionRegistry, trace *ExecutionTrace) {
+	var traced []wasmbridge.HostFunction
+	for _, hostFn := range registry.GetHostFunctions() {
+		traced = append(traced, &tracedHostFunction{HostFunction: hostFn, ctx: ctx, trace: trace})
+	}
+	for _, hostFn := range traced {
+		registry.Register(hostFn)
+	}
+}
+
+// tracedHostFunction records the invocations of the host function it wraps.
+// Arguments and responses are decoded when the function follows the
+// (args_ptr, args_len, resp_ptr_ptr, resp_len_ptr) convention used by the
+// Rubix host functions, otherwise only the call and its duration are kept.
+type tracedHostFunction struct {
+	wasmbridge.HostFunction
+	ctx    context.Context
+	trace  *ExecutionTrace
+	memory *wasmtime.Memory
+}
+
+func (h *tracedHostFunction) Initialize(allocFunc, deallocFunc *wasmtime.Func, memory *wasmtime.Memory, nodeAddress string, quorumType int) {
+	h.memory = memory
+	h.HostFunction.Initialize(allocFunc, deallocFunc, memory, nodeAddress, quorumType)
+}
+
+func (h *tracedHostFunction) Callback() wasmbridge.HostFunctionCallBack {
+	callback := h.HostFunction.Callback()
+	return func(caller *wasmtime.Caller, args []wasmtime.Val) ([]wasmtime.Val, *wasmtime.Trap) {
+		_, span := startSpan(h.ctx, "host "+h.Name(), attribute.String("dapp.host_function", h.Name()))
+		defer span.End()
+		call := TraceHostCall{Name: h.Name(), StartedAt: time.Now()}
+		if len(args) == 4 {
+			call.Args = h.readMemory(caller, args[0].I32(), args[1].I32())
+		}
+
+		results, trap := callback(caller, args)
+
+		call.DurationMs = float64(time.Since(call.StartedAt).Microseconds()) / 1000
+		if trap != nil {
+			call.Trap = trap.Message()
+			span.SetStatus(codes.Error, call.Trap)
+		}
+		if len(results) == 1 && results[0].Kind() == wasmtime.KindI32 {
+			code := results[0].I32()
+			call.ReturnCode = &code
+			span.SetAttributes(attribute.Int("dapp.return_code", int(code)))
+		}
+		if trap == nil && len(args) == 4 {
+			call.Response = h.readResponse(caller, args[2].I32(), args[3].I32())
+		}
+		h.trace.addHostCall(call)
+		return results, trap
+	}
+}
+
+func (h *tracedHostFunction) readMemory(caller *wasmtime.Caller, ptr int32, length int32) string {
+	if h.memory == nil {
+		return ""
+	}
+	data := h.memory.UnsafeData(caller)
+	if ptr < 0 || length < 0 || int(ptr)+int(length) > len(data) {
+		return ""
+	}
+	return string(data[ptr : ptr+length])
+}
+
+func (h *tracedHostFunction) readResponse(caller *wasmtime.Caller, respPtrPtr int32, respLenPtr int32) string {
+	if h.memory == nil {
+		return ""
+	}
+	data := h.memory.UnsafeData(caller)
+	if respPtrPtr < 0 || int(respPtrPtr)+4 > len(data) || respLenPtr < 0 || int(respLenPtr)+4 > len(data) {
+		return ""
+	}
+	respPtr := binary.LittleEndian.Uint32(data[respPtrPtr:])
+	respLen := binary.LittleEndian.Uint32(data[respLenPtr:])
+	return h.readMemory(caller, int32(respPtr), int32(respLen))
+}
+
+// saveTrace stores the trace of a request, logging rather than returning any
+// error as a missing trace must not fail the request itself
+func saveTrace(ctx context.Context, trace *ExecutionTrace) {
+	traceJSON, err := json.Marshal(trace)
+	if err != nil {
+		loggerFrom(ctx).Error("Error encoding execution trace", "error", err)
+		return
+	}
+	if err := upsertRequestTrace(ctx, trace.RequestId, string(traceJSON)); err != nil {
+		loggerFrom(ctx).Error("Error saving execution trace", "error", err)
+	}
+}
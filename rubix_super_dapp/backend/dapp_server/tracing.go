@@ -0,0 +1,193 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"os"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp"
+	"go.opentelemetry.io/otel/exporters/stdout/stdouttrace"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	oteltrace "go.opentelemetry.io/otel/trace"
+)
+
+// tracerName is the instrumentation scope of the spans of the dapp server
+const tracerName = "dapp_server"
+
+// Exporters of the spans
+const (
+	TracingExporterOTLP   = "otlp"
+	TracingExporterStdout = "stdout"
+)
+
+// TracingConfig configures the OpenTelemetry tracing of the dapp server.
+// Changes take effect after a restart.
+type TracingConfig struct {
+	// Exporter is otlp or stdout, tracing is disabled when it is empty
+	Exporter string `json:"exporter,omitempty"`
+	// Endpoint is the host:port of the OTLP/HTTP collector. The standard
+	// OTEL_EXPORTER_OTLP_* variables apply when it is empty.
+	Endpoint string `json:"endpoint,omitempty"`
+	// Insecure sends the spans over plain HTTP
+	Insecure    bool   `json:"insecure,omitempty"`
+	ServiceName string `json:"service_name,omitempty"` // dapp_server when empty
+	// SampleRatio is the fraction of new traces which are recorded, 1 when
+	// unset. Traces started by the caller follow its sampling decision.
+	SampleRatio *float64 `json:"sample_ratio,omitempty"`
+}
+
+func (t *TracingConfig) validate() error {
+	if t.Exporter != "" && t.Exporter != TracingExporterOTLP && t.Exporter != TracingExporterStdout {
+		return fmt.Errorf("exporter must be %s or %s", TracingExporterOTLP, TracingExporterStdout)
+	}
+	if t.SampleRatio != nil && (*t.SampleRatio < 0 || *t.SampleRatio > 1) {
+		return fmt.Errorf("sample_ratio must be between 0 and 1")
+	}
+	return nil
+}
+
+// initTracing installs the tracer provider for the tracing settings of the
+// config. The returned function flushes the spans which were not exported
+// yet. Trace context is propagated in the W3C traceparent header either way.
+func initTracing(config *TracingConfig) (func(context.Context) error, error) {
+	otel.SetTextMapPropagator(propagation.NewCompositeTextMapPropagator(propagation.TraceContext{}, propagation.Baggage{}))
+	if config == nil || config.Exporter == "" {
+		return func(context.Context) error { return nil }, nil
+	}
+
+	var exporter sdktrace.SpanExporter
+	var err error
+	switch config.Exporter {
+	case TracingExporterOTLP:
+		var options []otlptracehttp.Option
+		if config.Endpoint != "" {
+			options = append(options, otlptracehttp.WithEndpoint(config.Endpoint))
+		}
+		if config.Insecure {
+			options = append(options, otlptracehttp.WithInsecure())
+		}
+		exporter, err = otlptracehttp.New(context.Background(), options...)
+	case TracingExporterStdout:
+		exporter, err = stdouttrace.New(stdouttrace.WithWriter(os.Stdout))
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to create %s exporter: %w", config.Exporter, err)
+	}
+
+	serviceName := firstNonEmpty(config.ServiceName, tracerName)
+	ratio := 1.0
+	if config.SampleRatio != nil {
+		ratio = *config.SampleRatio
+	}
+	provider := sdktrace.NewTracerProvider(
+		sdktrace.WithBatcher(exporter),
+		sdktrace.WithResource(resource.NewSchemaless(attribute.String("service.name", serviceName))),
+		sdktrace.WithSampler(sdktrace.ParentBased(sdktrace.TraceIDRatioBased(ratio))),
+	)
+	otel.SetTracerProvider(provider)
+	slog.Info("Tracing enabled", "exporter", config.Exporter, "service_name", serviceName)
+	return provider.Shutdown, nil
+}
+
+func tracer() oteltrace.Tracer {
+	return otel.Tracer(tracerName)
+}
+
+// startSpan starts a span as a child of the span carried by ctx
+func startSpan(ctx context.Context, name string, attrs ...attribute.KeyValue) (context.Context, oteltrace.Span) {
+	return tracer().Start(ctx, name, oteltrace.WithAttributes(attrs...))
+}
+
+// failSpan marks span as failed with err
+func failSpan(span oteltrace.Span, err error) {
+	span.RecordError(err)
+	span.SetStatus(codes.Error, err.Error())
+}
+
+// endSpan ends span, marking it failed when err is set
+func endSpan(span oteltrace.Span, err error) {
+	if err != nil {
+		failSpan(span, err)
+	}
+	span.End()
+}
+
+// startDBOperation starts the span of a database operation. The returned
+// function ends it and records the latency of the operation.
+func startDBOperation(ctx context.Context, operation string) func() {
+	start := time.Now()
+	_, span := tracer().Start(ctx, "db "+operation,
+		oteltrace.WithSpanKind(oteltrace.SpanKindClient),
+		oteltrace.WithAttributes(attribute.String("db.system", "sqlite"), attribute.String("db.operation", operation)),
+	)
+	return func() {
+		span.End()
+		dbOperationDuration.observeSince(start, operation)
+	}
+}
+
+// traceRequests starts a server span for every HTTP request, continuing the
+// trace of the caller when it sent a traceparent header
+func traceRequests(c *gin.Context) {
+	ctx := otel.GetTextMapPropagator().Extract(c.Request.Context(), propagation.HeaderCarrier(c.Request.Header))
+	ctx, span := tracer().Start(ctx, c.Request.Method+" "+c.Request.URL.Path,
+		oteltrace.WithSpanKind(oteltrace.SpanKindServer),
+		oteltrace.WithAttributes(
+			attribute.String("http.request.method", c.Request.Method),
+			attribute.String("url.path", c.Request.URL.Path),
+			attribute.String("client.address", c.RemoteIP()),
+		),
+	)
+	defer span.End()
+	if span.SpanContext().IsValid() {
+		ctx = withLogAttrs(ctx, "trace_id", span.SpanContext().TraceID().String())
+	}
+	c.Request = c.Request.WithContext(ctx)
+
+	c.Next()
+
+	status := c.Writer.Status()
+	span.SetAttributes(attribute.Int("http.response.status_code", status))
+	if status >= http.StatusInternalServerError {
+		span.SetStatus(codes.Error, http.StatusText(status))
+	}
+}
+
+// tracingTransport starts a client span for every call to the Rubix node and
+// propagates the trace context to it
+type tracingTransport struct {
+	base http.RoundTripper
+}
+
+func (t *tracingTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	ctx, span := tracer().Start(req.Context(), req.Method+" "+req.URL.Path,
+		oteltrace.WithSpanKind(oteltrace.SpanKindClient),
+		oteltrace.WithAttributes(
+			attribute.String("http.request.method", req.Method),
+			attribute.String("url.full", req.URL.String()),
+		),
+	)
+	defer span.End()
+
+	req = req.Clone(ctx)
+	otel.GetTextMapPropagator().Inject(ctx, propagation.HeaderCarrier(req.Header))
+	resp, err := t.base.RoundTrip(req)
+	if err != nil {
+		failSpan(span, err)
+		return resp, err
+	}
+	span.SetAttributes(attribute.Int("http.response.status_code", resp.StatusCode))
+	if resp.StatusCode >= http.StatusInternalServerError {
+		span.SetStatus(codes.Error, resp.Status)
+	}
+	return resp, nil
+}
@@ -0,0 +1,69 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"math"
+	"os"
+	"strings"
+)
+
+// latestBlock selects the newest version of a contract
+const latestBlock = math.MaxUint64
+
+// ContractVersion is a wasm artifact of a contract which is used from its
+// activation block onwards, until the next version is activated
+type ContractVersion struct {
+	Version         string `json:"version"`
+	ContractPath    string `json:"contract_path"`
+	ArtifactHash    string `json:"artifact_hash,omitempty"` // hex encoded sha256 of the wasm artifact
+	ActivationBlock uint64 `json:"activation_block"`
+}
+
+// versionForBlock returns the version of the contract that was active at
+// blockNo. A contract without versions always runs contract_path.
+func (c *ContractInfo) versionForBlock(blockNo uint64) (*ContractVersion, error) {
+	if len(c.Versions) == 0 {
+		return &ContractVersion{ContractPath: c.ContractPath, ArtifactHash: c.ArtifactHash}, nil
+	}
+
+	var selected *ContractVersion
+	for _, version := range c.Versions {
+		if version.ActivationBlock > blockNo {
+			continue
+		}
+		if selected == nil || version.ActivationBlock > selected.ActivationBlock {
+			selected = version
+		}
+	}
+	if selected == nil {
+		return nil, fmt.Errorf("no contract version is active at block %d", blockNo)
+	}
+	return selected, nil
+}
+
+// verifyArtifact checks that the wasm artifact of the version has not changed
+// since it was registered
+func (v *ContractVersion) verifyArtifact() error {
+	if v.ArtifactHash == "" {
+		return nil
+	}
+
+	file, err := os.Open(v.ContractPath)
+	if err != nil {
+		return fmt.Errorf("failed to open wasm artifact: %w", err)
+	}
+	defer file.Close()
+
+	hasher := sha256.New()
+	if _, err := io.Copy(hasher, file); err != nil {
+		return fmt.Errorf("failed to read wasm artifact: %w", err)
+	}
+	actual := hex.EncodeToString(hasher.Sum(nil))
+	if !strings.EqualFold(actual, v.ArtifactHash) {
+		return fmt.Errorf("wasm artifact %s has hash %s, expected %s", v.ContractPath, actual, v.ArtifactHash)
+	}
+	return nil
+}
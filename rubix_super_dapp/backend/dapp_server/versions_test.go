@@ -0,0 +1,79 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestVersionForBlock(t *testing.T) {
+	versioned := &ContractInfo{ContractPath: "latest.wasm", Versions: []*ContractVersion{
+		{Version: "v2", ContractPath: "v2.wasm", ActivationBlock: 100},
+		{Version: "v1", ContractPath: "v1.wasm", ActivationBlock: 10},
+		{Version: "v3", ContractPath: "v3.wasm", ActivationBlock: 200},
+	}}
+	unversioned := &ContractInfo{ContractPath: "latest.wasm", ArtifactHash: "9f86d0"}
+
+	tests := []struct {
+		name         string
+		contractInfo *ContractInfo
+		blockNo      uint64
+		contractPath string
+	}{
+		{"before the first version", versioned, 9, ""},
+		{"activation block", versioned, 10, "v1.wasm"},
+		{"between versions", versioned, 99, "v1.wasm"},
+		{"later version", versioned, 150, "v2.wasm"},
+		{"latest block", versioned, latestBlock, "v3.wasm"},
+		{"without versions", unversioned, 0, "latest.wasm"},
+	}
+	for _, test := range tests {
+		version, err := test.contractInfo.versionForBlock(test.blockNo)
+		if test.contractPath == "" {
+			if err == nil {
+				t.Errorf("%s: versionForBlock(%d) = %s, want an error", test.name, test.blockNo, version.ContractPath)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: versionForBlock(%d) = %v", test.name, test.blockNo, err)
+			continue
+		}
+		if version.ContractPath != test.contractPath {
+			t.Errorf("%s: versionForBlock(%d) = %s, want %s", test.name, test.blockNo, version.ContractPath, test.contractPath)
+		}
+	}
+	if version, _ := unversioned.versionForBlock(0); version.ArtifactHash != unversioned.ArtifactHash {
+		t.Errorf("version without versions has artifact_hash %q, want %q", version.ArtifactHash, unversioned.ArtifactHash)
+	}
+}
+
+func TestVerifyArtifact(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "contract.wasm")
+	artifact := []byte("\x00asm\x01\x00\x00\x00")
+	if err := os.WriteFile(path, artifact, 0644); err != nil {
+		t.Fatal(err)
+	}
+	sum := sha256.Sum256(artifact)
+	hash := hex.EncodeToString(sum[:])
+
+	tests := []struct {
+		name    string
+		version ContractVersion
+		valid   bool
+	}{
+		{"matching hash", ContractVersion{ContractPath: path, ArtifactHash: hash}, true},
+		{"upper case hash", ContractVersion{ContractPath: path, ArtifactHash: strings.ToUpper(hash)}, true},
+		{"without hash", ContractVersion{ContractPath: path}, true},
+		{"other hash", ContractVersion{ContractPath: path, ArtifactHash: strings.Repeat("0", 64)}, false},
+		{"missing artifact", ContractVersion{ContractPath: path + ".missing", ArtifactHash: hash}, false},
+	}
+	for _, test := range tests {
+		if err := test.version.verifyArtifact(); (err == nil) != test.valid {
+			t.Errorf("%s: verifyArtifact() = %v, want valid %v", test.name, err, test.valid)
+		}
+	}
+}
@@ -0,0 +1,202 @@
+package main
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+	"sync/atomic"
+
+	"github.com/bytecodealliance/wasmtime-go"
+	wasmbridge "github.com/rubixchain/rubix-wasm/go-wasm-bridge"
+)
+
+// contractModule is a wasm artifact of a contract instantiated in a store of
+// its own. It links the host functions of a go-wasm-bridge registry and
+// follows the calling convention of the bridge, but owns the wasmtime store
+// so that an execution can be metered with fuel and interrupted.
+type contractModule struct {
+	engine   *wasmtime.Engine
+	store    *wasmtime.Store
+	instance *wasmtime.Instance
+	memory   *wasmtime.Memory
+	alloc    *wasmtime.Func
+	limits   *ResourceLimits
+	// release is called by close, once the module is no longer used
+	release func()
+
+	// interruption is why the execution was interrupted, once interrupt
+	// has been called
+	interruption atomic.Pointer[error]
+}
+
+// errExecutionInterrupted is returned by a contract interrupted by a shutdown
+var errExecutionInterrupted = errors.New("execution was interrupted by the server shutdown")
+
+// loadContractModule compiles and instantiates the wasm artifact at path,
+// resolving its env imports from registry. Functions registered later
+// replace earlier ones of the same name.
+func loadContractModule(path string, registry *wasmbridge.HostFunctionRegistry, nodeAddress string, quorumType int, limits *ResourceLimits) (*contractModule, error) {
+	code, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read wasm artifact: %w", err)
+	}
+	if limits != nil && limits.MaxMemoryPages > 0 {
+		if code, err = capMemory(code, limits.MaxMemoryPages); err != nil {
+			return nil, err
+		}
+	}
+
+	config := wasmtime.NewConfig()
+	config.SetEpochInterruption(true)
+	config.SetConsumeFuel(limits != nil && limits.MaxFuel > 0)
+	engine := wasmtime.NewEngineWithConfig(config)
+	store := wasmtime.NewStore(engine)
+	// The epoch is only incremented by interrupt
+	store.SetEpochDeadline(1)
+	if limits != nil && limits.MaxFuel > 0 {
+		if err := store.AddFuel(limits.MaxFuel); err != nil {
+			return nil, fmt.Errorf("failed to add fuel: %w", err)
+		}
+	}
+
+	module, err := wasmtime.NewModule(engine, code)
+	if err != nil {
+		return nil, fmt.Errorf("failed to compile wasm artifact: %w", err)
+	}
+	linker := wasmtime.NewLinker(engine)
+	linker.AllowShadowing(true)
+	hostFns := registry.GetHostFunctions()
+	for _, hostFn := range hostFns {
+		if err := linker.FuncNew("env", hostFn.Name(), hostFn.FuncType(), hostFn.Callback()); err != nil {
+			return nil, fmt.Errorf("failed to define host function %s: %w", hostFn.Name(), err)
+		}
+	}
+	instance, err := linker.Instantiate(store, module)
+	if err != nil {
+		return nil, fmt.Errorf("failed to instantiate wasm artifact: %w", err)
+	}
+
+	memoryExport := instance.GetExport(store, "memory")
+	alloc, dealloc := instance.GetFunc(store, "alloc"), instance.GetFunc(store, "dealloc")
+	if memoryExport == nil || memoryExport.Memory() == nil || alloc == nil || dealloc == nil {
+		return nil, errors.New("wasm artifact must export memory, alloc and dealloc")
+	}
+	memory := memoryExport.Memory()
+	for _, hostFn := range hostFns {
+		hostFn.Initialize(alloc, dealloc, memory, nodeAddress, quorumType)
+	}
+
+	return &contractModule{
+		engine:   engine,
+		store:    store,
+		instance: instance,
+		memory:   memory,
+		alloc:    alloc,
+		limits:   limits,
+	}, nil
+}
+
+// CallFunction calls the function named by the only key of the JSON input
+// with its value, returning the response the contract wrote. A contract
+// reports its own errors in the response, so it is returned whatever the
+// return code of the function.
+func (m *contractModule) CallFunction(input string) (string, error) {
+	defer trackRunningModule(m)()
+
+	var call map[string]interface{}
+	decoder := json.NewDecoder(strings.NewReader(input))
+	decoder.UseNumber()
+	if err := decoder.Decode(&call); err != nil {
+		return "", fmt.Errorf("invalid contract input: %w", err)
+	}
+	if len(call) != 1 {
+		return "", fmt.Errorf("contract input must name exactly one function, got %d", len(call))
+	}
+	var function string
+	var args []byte
+	for name, value := range call {
+		encoded, err := json.Marshal(value)
+		if err != nil {
+			return "", fmt.Errorf("invalid contract input: %w", err)
+		}
+		function, args = name, encoded
+	}
+
+	fn := m.instance.GetFunc(m.store, function+"_")
+	if fn == nil {
+		return "", fmt.Errorf("contract does not export %s", function)
+	}
+
+	argsPtr, err := m.allocate(len(args))
+	if err != nil {
+		return "", err
+	}
+	copy(m.memory.UnsafeData(m.store)[argsPtr:], args)
+	respPtrPtr, err := m.allocate(4)
+	if err != nil {
+		return "", err
+	}
+	respLenPtr, err := m.allocate(4)
+	if err != nil {
+		return "", err
+	}
+
+	if _, err := fn.Call(m.store, argsPtr, int32(len(args)), respPtrPtr, respLenPtr); err != nil {
+		return "", m.callError(err)
+	}
+
+	data := m.memory.UnsafeData(m.store)
+	respPtr := binary.LittleEndian.Uint32(data[respPtrPtr:])
+	respLen := binary.LittleEndian.Uint32(data[respLenPtr:])
+	if uint64(respPtr)+uint64(respLen) > uint64(len(data)) {
+		return "", errors.New("contract response is out of bounds of its memory")
+	}
+	return string(data[respPtr : respPtr+respLen]), nil
+}
+
+// interrupt stops the execution of the module at the next function entry or
+// loop iteration, failing it with reason. A host function being called is
+// not interrupted, the contract stops once it returns.
+func (m *contractModule) interrupt(reason error) {
+	m.interruption.CompareAndSwap(nil, &reason)
+	m.engine.IncrementEpoch()
+}
+
+// close releases what the module holds outside of its store, once it is no
+// longer called
+func (m *contractModule) close() {
+	if m.release != nil {
+		m.release()
+	}
+}
+
+// allocate reserves size bytes in the memory of the contract
+func (m *contractModule) allocate(size int) (int32, error) {
+	ptr, err := m.alloc.Call(m.store, int32(size))
+	if err != nil {
+		return 0, m.callError(err)
+	}
+	return ptr.(int32), nil
+}
+
+// callError explains why a call of the contract failed, as a
+// LimitExceededError when it was stopped by one of its limits
+func (m *contractModule) callError(err error) error {
+	if reason := m.interruption.Load(); reason != nil {
+		return *reason
+	}
+	if m.limits != nil && m.limits.MaxFuel > 0 {
+		if consumed, ok := m.store.FuelConsumed(); ok && consumed >= m.limits.MaxFuel {
+			return &LimitExceededError{Limit: "fuel", Detail: fmt.Sprintf("execution used all of its %d fuel", m.limits.MaxFuel)}
+		}
+	}
+	// A contract which cannot grow its memory usually aborts, which shows as
+	// a trap with its memory at the limit
+	if m.limits != nil && m.limits.MaxMemoryPages > 0 && m.memory.Size(m.store) >= uint64(m.limits.MaxMemoryPages) {
+		return &LimitExceededError{Limit: "memory", Detail: fmt.Sprintf("execution trapped with its memory at the limit of %d pages: %v", m.limits.MaxMemoryPages, err)}
+	}
+	return fmt.Errorf("function call failed: %v", err)
+}
@@ -0,0 +1,110 @@
+package main
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/bytecodealliance/wasmtime-go"
+	wasmbridge "github.com/rubixchain/rubix-wasm/go-wasm-bridge"
+)
+
+// limitsTestContract follows the calling convention of the contracts, with
+// functions which loop forever, grow their memory until it fails and echo
+// their input
+const limitsTestContract = `(module
+	(memory (export "memory") 1)
+	(global $next (mut i32) (i32.const 1024))
+	(func (export "alloc") (param $size i32) (result i32)
+		(local $ptr i32)
+		(local.set $ptr (global.get $next))
+		(global.set $next (i32.add (global.get $next) (local.get $size)))
+		(local.get $ptr))
+	(func (export "dealloc") (param i32 i32))
+	(func (export "spin_") (param i32 i32 i32 i32) (result i32)
+		(loop $forever (br $forever))
+		(i32.const 0))
+	(func (export "grow_") (param i32 i32 i32 i32) (result i32)
+		(loop $grow (br_if $grow (i32.ne (memory.grow (i32.const 1)) (i32.const -1))))
+		unreachable)
+	(func (export "echo_") (param $ptr i32) (param $len i32) (param $respPtrPtr i32) (param $respLenPtr i32) (result i32)
+		(i32.store (local.get $respPtrPtr) (local.get $ptr))
+		(i32.store (local.get $respLenPtr) (local.get $len))
+		(i32.const 0)))`
+
+func writeLimitsTestContract(t *testing.T) string {
+	t.Helper()
+	code, err := wasmtime.Wat2Wasm(limitsTestContract)
+	if err != nil {
+		t.Fatal(err)
+	}
+	path := filepath.Join(t.TempDir(), "limits.wasm")
+	if err := os.WriteFile(path, code, 0o644); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestContractModuleLimits(t *testing.T) {
+	path := writeLimitsTestContract(t)
+	tests := []struct {
+		name      string
+		input     string
+		limits    *ResourceLimits
+		wantLimit string
+	}{
+		{"no limits", `{"echo": {"a": 1}}`, nil, ""},
+		{"all limits", `{"echo": {"a": 1}}`, &ResourceLimits{TimeoutMs: 1000, MaxFuel: 1000000, MaxMemoryPages: 4}, ""},
+		{"fuel", `{"spin": {}}`, &ResourceLimits{MaxFuel: 1000000}, "fuel"},
+		{"timeout", `{"spin": {}}`, &ResourceLimits{TimeoutMs: 50}, "timeout"},
+		{"memory", `{"grow": {}}`, &ResourceLimits{MaxMemoryPages: 4}, "memory"},
+	}
+	for _, test := range tests {
+		module, err := loadContractModule(path, wasmbridge.NewHostFunctionRegistry(), "", 2, test.limits)
+		if err != nil {
+			t.Fatalf("%s: failed to load module: %v", test.name, err)
+		}
+		output, err := callContractFunction(module, test.input, test.limits)
+		if test.wantLimit == "" {
+			if err != nil || output != `{"a":1}` {
+				t.Errorf("%s: call = %q, %v, want the input echoed", test.name, output, err)
+			}
+			continue
+		}
+		var limitErr *LimitExceededError
+		if !errors.As(err, &limitErr) || limitErr.Limit != test.wantLimit {
+			t.Errorf("%s: call error = %v, want a %s limit error", test.name, err, test.wantLimit)
+			continue
+		}
+		if limitErr.running != nil {
+			select {
+			case <-limitErr.running:
+			case <-time.After(5 * time.Second):
+				t.Errorf("%s: contract still running after its timeout", test.name)
+			}
+		}
+	}
+}
+
+func TestContractModuleInput(t *testing.T) {
+	module, err := loadContractModule(writeLimitsTestContract(t), wasmbridge.NewHostFunctionRegistry(), "", 2, nil)
+	if err != nil {
+		t.Fatalf("failed to load module: %v", err)
+	}
+	tests := []struct {
+		name  string
+		input string
+	}{
+		{"malformed JSON", `{`},
+		{"no function", `{}`},
+		{"two functions", `{"echo": {}, "spin": {}}`},
+		{"unknown function", `{"missing": {}}`},
+	}
+	for _, test := range tests {
+		if output, err := module.CallFunction(test.input); err == nil {
+			t.Errorf("%s: CallFunction(%s) = %q, want an error", test.name, test.input, output)
+		}
+	}
+}
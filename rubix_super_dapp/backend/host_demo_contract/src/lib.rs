@@ -0,0 +1,57 @@
+use rubixwasm_std::errors::WasmError;
+use serde::{Deserialize, Serialize};
+use serde_json::{json, Value};
+use rubixwasm_std::contract_fn;
+
+// Host functions provided by the dapp server, see
+// backend/dapp_server/dapp_host_functions.go
+extern "C" {
+    fn dapp_get_config(args_ptr: *const u8, args_len: usize, resp_ptr_ptr: *mut *const u8, resp_len_ptr: *mut usize) -> i32;
+    fn dapp_emit_event(args_ptr: *const u8, args_len: usize, resp_ptr_ptr: *mut *const u8, resp_len_ptr: *mut usize) -> i32;
+}
+
+// Calls a dapp server host function with JSON arguments and decodes its JSON response
+fn call_dapp_host_function(
+    host_fn: unsafe extern "C" fn(*const u8, usize, *mut *const u8, *mut usize) -> i32,
+    args: Value,
+) -> Result<Value, WasmError> {
+    let args_bytes = serde_json::to_vec(&args)
+        .map_err(|e| WasmError::from(format!("failed to encode host function args: {}", e)))?;
+
+    let mut resp_ptr: *const u8 = std::ptr::null();
+    let mut resp_len: usize = 0;
+    let code = unsafe { host_fn(args_bytes.as_ptr(), args_bytes.len(), &mut resp_ptr, &mut resp_len) };
+
+    let resp_bytes = unsafe { std::slice::from_raw_parts(resp_ptr, resp_len) }.to_vec();
+    let resp: Value = serde_json::from_slice(&resp_bytes)
+        .map_err(|e| WasmError::from(format!("failed to decode host function response: {}", e)))?;
+
+    if code != 0 {
+        return Err(WasmError::from(format!("host function failed: {}", resp["error"])));
+    }
+    Ok(resp)
+}
+
+#[derive(Serialize, Deserialize)]
+pub struct RecordGreetingReq {
+    pub name: String,
+}
+
+#[contract_fn]
+pub fn record_greeting(record_greeting_req: RecordGreetingReq) -> Result<String, WasmError> {
+    let user_did = call_dapp_host_function(dapp_get_config, json!({ "key": "user_did" }))?;
+
+    call_dapp_host_function(
+        dapp_emit_event,
+        json!({
+            "name": "greeting",
+            "data": { "name": record_greeting_req.name, "user_did": user_did },
+        }),
+    )?;
+
+    let response = json!({
+        "status": true,
+        "message": format!("Greeting from {} recorded", record_greeting_req.name),
+    });
+    Ok(response.to_string())
+}